@@ -0,0 +1,83 @@
+package audit
+
+import (
+	"time"
+)
+
+// Actions that are audited. Each corresponds to one of the ptmerge routes, except
+// ActionExpire, which is taken by the server when it expires an inactive merge.
+const (
+	ActionCreate               = "create"
+	ActionResolve              = "resolve"
+	ActionAbort                = "abort"
+	ActionCommit               = "commit"
+	ActionApprove              = "approve"
+	ActionReject               = "reject"
+	ActionExpire               = "expire"
+	ActionClaim                = "claim"
+	ActionAssign               = "assign"
+	ActionRelease              = "release"
+	ActionViewQueue            = "view-queue"
+	ActionAddComment           = "add-comment"
+	ActionListComments         = "list-comments"
+	ActionDeleteComment        = "delete-comment"
+	ActionViewTarget           = "view-target"
+	ActionUpdateTargetResource = "update-target-resource"
+	ActionDeleteTargetResource = "delete-target-resource"
+	ActionViewConflicts        = "view-conflicts"
+	ActionViewResolved         = "view-resolved"
+	ActionDeleteConflict       = "delete-conflict"
+	ActionPairConflict         = "pair-conflict"
+	ActionListMerges           = "list-merges"
+	ActionViewMerge            = "view-merge"
+	ActionSearchMerges         = "search-merges"
+	ActionWatchMerge           = "watch-merge"
+	ActionCreateWebhook        = "create-webhook"
+	ActionListWebhooks         = "list-webhooks"
+	ActionViewWebhook          = "view-webhook"
+	ActionDeleteWebhook        = "delete-webhook"
+	ActionViewDeliveries       = "view-webhook-deliveries"
+	ActionListExpiring         = "list-expiring"
+)
+
+// Outcomes of an audited action.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Record is a single audited action taken against a merge.
+type Record struct {
+	Action      string    `bson:"action" json:"action"`
+	Actor       string    `bson:"actor" json:"actor"`
+	Timestamp   time.Time `bson:"timestamp" json:"timestamp"`
+	MergeID     string    `bson:"mergeId,omitempty" json:"mergeId,omitempty"`
+	ResourceIDs []string  `bson:"resourceIds,omitempty" json:"resourceIds,omitempty"`
+	Outcome     string    `bson:"outcome" json:"outcome"`
+	Status      int       `bson:"status" json:"status"`
+	Method      string    `bson:"method" json:"method"`
+	Path        string    `bson:"path" json:"path"`
+	// Comments are the reviewers' comments on a merge, recorded when the merge completes.
+	Comments []Comment `bson:"comments,omitempty" json:"comments,omitempty"`
+}
+
+// Comment is a reviewer's comment on a merge, or on one of its conflicts.
+type Comment struct {
+	ConflictID string    `bson:"conflictId,omitempty" json:"conflictId,omitempty"`
+	Author     string    `bson:"author" json:"author"`
+	Timestamp  time.Time `bson:"timestamp" json:"timestamp"`
+	Text       string    `bson:"text" json:"text"`
+}
+
+// Sink stores audit records.
+type Sink interface {
+	Write(record *Record) error
+}
+
+// Discard is a Sink that drops every record. It is used when auditing is disabled.
+type Discard struct{}
+
+// Write does nothing.
+func (d Discard) Write(record *Record) error {
+	return nil
+}
@@ -0,0 +1,158 @@
+package audit
+
+import (
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/mitre/ptmerge/fhirutil"
+)
+
+// auditActionCodes maps each audited action to the FHIR AuditEvent action code
+// (C, R, U, D, or E) that best describes it.
+var auditActionCodes = map[string]string{
+	ActionCreate:               "C",
+	ActionResolve:              "U",
+	ActionAbort:                "D",
+	ActionCommit:               "U",
+	ActionApprove:              "U",
+	ActionReject:               "U",
+	ActionExpire:               "D",
+	ActionClaim:                "U",
+	ActionAssign:               "U",
+	ActionRelease:              "U",
+	ActionViewQueue:            "R",
+	ActionAddComment:           "C",
+	ActionListComments:         "R",
+	ActionDeleteComment:        "D",
+	ActionViewTarget:           "R",
+	ActionUpdateTargetResource: "U",
+	ActionDeleteTargetResource: "D",
+	ActionViewConflicts:        "R",
+	ActionViewResolved:         "R",
+	ActionDeleteConflict:       "D",
+	ActionPairConflict:         "U",
+	ActionListMerges:           "R",
+	ActionViewMerge:            "R",
+	ActionSearchMerges:         "E",
+	ActionWatchMerge:           "R",
+	ActionCreateWebhook:        "C",
+	ActionListWebhooks:         "R",
+	ActionViewWebhook:          "R",
+	ActionDeleteWebhook:        "D",
+	ActionViewDeliveries:       "R",
+	ActionListExpiring:         "R",
+}
+
+// FHIRSink POSTs audit records to the host FHIR server as AuditEvent resources.
+type FHIRSink struct {
+	fhirHost string
+}
+
+// NewFHIRSink returns a pointer to a newly initialized FHIRSink with a known FHIR host.
+func NewFHIRSink(fhirHost string) *FHIRSink {
+	return &FHIRSink{
+		fhirHost: fhirHost,
+	}
+}
+
+// Write POSTs the record to the host FHIR server as an AuditEvent.
+func (f *FHIRSink) Write(record *Record) error {
+	_, err := fhirutil.PostResource(f.fhirHost, "AuditEvent", AuditEvent(record))
+	return err
+}
+
+// AuditEvent converts an audit record to a FHIR AuditEvent.
+func AuditEvent(record *Record) *models.AuditEvent {
+	requestor := true
+	event := &models.AuditEvent{
+		DomainResource: models.DomainResource{
+			Resource: models.Resource{
+				Id:           bson.NewObjectId().Hex(),
+				ResourceType: "AuditEvent",
+			},
+		},
+		Type: &models.Coding{
+			System:  "http://dicom.nema.org/resources/ontology/DCM",
+			Code:    "110110",
+			Display: "Patient Record",
+		},
+		Subtype: []models.Coding{
+			models.Coding{
+				System: "urn:ptmerge:audit",
+				Code:   record.Action,
+			},
+		},
+		Action: auditActionCodes[record.Action],
+		Recorded: &models.FHIRDateTime{
+			Time:      record.Timestamp,
+			Precision: models.Timestamp,
+		},
+		Agent: []models.AuditEventAgentComponent{
+			models.AuditEventAgentComponent{
+				UserId: &models.Identifier{
+					Value: record.Actor,
+				},
+				Requestor: &requestor,
+			},
+		},
+		Source: &models.AuditEventSourceComponent{
+			Site: "ptmerge",
+			Identifier: &models.Identifier{
+				Value: "ptmerge",
+			},
+		},
+	}
+
+	// AuditEvent outcomes are 0 (success), 4 (minor failure), or 8 (serious failure).
+	switch {
+	case record.Outcome == OutcomeSuccess:
+		event.Outcome = "0"
+	case record.Status >= 500:
+		event.Outcome = "8"
+	default:
+		event.Outcome = "4"
+	}
+	event.OutcomeDesc = record.Method + " " + record.Path
+
+	if record.MergeID != "" {
+		event.Entity = append(event.Entity, models.AuditEventEntityComponent{
+			Identifier: &models.Identifier{
+				System: "urn:ptmerge:merge",
+				Value:  record.MergeID,
+			},
+			Name: "merge",
+		})
+	}
+
+	for _, id := range record.ResourceIDs {
+		entity := models.AuditEventEntityComponent{}
+		if strings.Contains(id, "/") {
+			// Resources recorded by URL can be referenced directly.
+			entity.Reference = &models.Reference{Reference: id}
+		} else {
+			entity.Identifier = &models.Identifier{Value: id}
+		}
+		event.Entity = append(event.Entity, entity)
+	}
+
+	for _, comment := range record.Comments {
+		entity := models.AuditEventEntityComponent{
+			Type: &models.Coding{
+				System: "urn:ptmerge:audit",
+				Code:   "comment",
+			},
+			Name:        comment.Author,
+			Description: comment.Text,
+		}
+		if comment.ConflictID != "" {
+			entity.Identifier = &models.Identifier{
+				System: "urn:ptmerge:conflict",
+				Value:  comment.ConflictID,
+			}
+		}
+		event.Entity = append(event.Entity, entity)
+	}
+	return event
+}
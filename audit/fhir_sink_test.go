@@ -0,0 +1,76 @@
+package audit
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type FHIRSinkTestSuite struct {
+	suite.Suite
+}
+
+func TestFHIRSinkTestSuite(t *testing.T) {
+	suite.Run(t, new(FHIRSinkTestSuite))
+}
+
+func (f *FHIRSinkTestSuite) TestAuditEvent() {
+	now := time.Now()
+	event := AuditEvent(&Record{
+		Action:      ActionResolve,
+		Actor:       "jdoe",
+		Timestamp:   now,
+		MergeID:     "abc123",
+		ResourceIDs: []string{"def456", "http://fhir/Bundle/1"},
+		Outcome:     OutcomeSuccess,
+		Status:      http.StatusOK,
+		Method:      "POST",
+		Path:        "/merge/abc123/resolve/def456",
+	})
+
+	f.Equal("AuditEvent", event.ResourceType)
+	f.NotEmpty(event.Id)
+	f.Equal("U", event.Action)
+	f.Equal("0", event.Outcome)
+	f.Equal(now, event.Recorded.Time)
+	f.Equal(ActionResolve, event.Subtype[0].Code)
+
+	f.Len(event.Agent, 1)
+	f.Equal("jdoe", event.Agent[0].UserId.Value)
+	f.True(*event.Agent[0].Requestor)
+
+	f.Len(event.Entity, 3)
+	f.Equal("abc123", event.Entity[0].Identifier.Value)
+	f.Equal("def456", event.Entity[1].Identifier.Value)
+	f.Equal("http://fhir/Bundle/1", event.Entity[2].Reference.Reference)
+}
+
+func (f *FHIRSinkTestSuite) TestAuditEventFailures() {
+	event := AuditEvent(&Record{Action: ActionAbort, Outcome: OutcomeFailure, Status: http.StatusNotFound})
+	f.Equal("D", event.Action)
+	f.Equal("4", event.Outcome)
+
+	event = AuditEvent(&Record{Action: ActionAbort, Outcome: OutcomeFailure, Status: http.StatusInternalServerError})
+	f.Equal("8", event.Outcome)
+}
+
+func (f *FHIRSinkTestSuite) TestAuditEventComments() {
+	event := AuditEvent(&Record{
+		Action:  ActionApprove,
+		MergeID: "abc123",
+		Comments: []Comment{
+			Comment{Author: "jdoe", Text: "Looks good"},
+			Comment{ConflictID: "def456", Author: "asmith", Text: "Called the clinic, confirmed new address"},
+		},
+	})
+
+	f.Len(event.Entity, 3)
+	f.Equal("comment", event.Entity[1].Type.Code)
+	f.Equal("jdoe", event.Entity[1].Name)
+	f.Equal("Looks good", event.Entity[1].Description)
+	f.Nil(event.Entity[1].Identifier)
+	f.Equal("asmith", event.Entity[2].Name)
+	f.Equal("def456", event.Entity[2].Identifier.Value)
+}
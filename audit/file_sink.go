@@ -0,0 +1,43 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// FileSink appends audit records to a file as JSON lines.
+type FileSink struct {
+	file  *os.File
+	mutex sync.Mutex
+}
+
+// NewFileSink returns a pointer to a newly initialized FileSink that appends to the
+// file at filepath, creating it if necessary.
+func NewFileSink(filepath string) (*FileSink, error) {
+	file, err := os.OpenFile(filepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{
+		file: file,
+	}, nil
+}
+
+// Write appends the record to the file as a single line of JSON.
+func (f *FileSink) Write(record *Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_, err = f.file.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes the underlying file.
+func (f *FileSink) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,50 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type FileSinkTestSuite struct {
+	suite.Suite
+}
+
+func TestFileSinkTestSuite(t *testing.T) {
+	suite.Run(t, new(FileSinkTestSuite))
+}
+
+func (f *FileSinkTestSuite) TestWriteAppendsJSONLines() {
+	file, err := ioutil.TempFile("", "audit")
+	f.NoError(err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	sink, err := NewFileSink(file.Name())
+	f.NoError(err)
+	f.NoError(sink.Write(&Record{Action: ActionCreate, Actor: "jdoe", Timestamp: time.Now(), MergeID: "abc123", Outcome: OutcomeSuccess}))
+	f.NoError(sink.Write(&Record{Action: ActionAbort, Actor: "admin", Timestamp: time.Now(), MergeID: "abc123", Outcome: OutcomeSuccess}))
+	f.NoError(sink.Close())
+
+	file, err = os.Open(file.Name())
+	f.NoError(err)
+	defer file.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record Record
+		f.NoError(json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	f.Len(records, 2)
+	f.Equal(ActionCreate, records[0].Action)
+	f.Equal("jdoe", records[0].Actor)
+	f.Equal(ActionAbort, records[1].Action)
+	f.Equal("admin", records[1].Actor)
+}
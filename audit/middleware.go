@@ -0,0 +1,88 @@
+package audit
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mitre/ptmerge/auth"
+)
+
+// resourcesKey is the key additional audited resources are stored under in the gin context.
+const resourcesKey = "ptmerge.audit.resources"
+
+// commentsKey is the key audited comments are stored under in the gin context.
+const commentsKey = "ptmerge.audit.comments"
+
+// Middleware returns middleware that writes an audit record to the sink once the
+// handler for an action has finished. The merge, conflict, and resource IDs in the
+// route are recorded automatically. Handlers may record other resources they touch
+// with AddResources.
+func Middleware(sink Sink, action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		record := &Record{
+			Action:    action,
+			Actor:     auth.CurrentUserID(c),
+			Timestamp: time.Now(),
+			MergeID:   c.Param("merge_id"),
+			Status:    c.Writer.Status(),
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.Path,
+		}
+
+		if record.MergeID == "" {
+			// New merges return their ID in the Location header.
+			record.MergeID = c.Writer.Header().Get("Location")
+		}
+
+		if conflictID := c.Param("conflict_id"); conflictID != "" {
+			record.ResourceIDs = append(record.ResourceIDs, conflictID)
+		}
+		if resourceID := c.Param("resource_id"); resourceID != "" {
+			record.ResourceIDs = append(record.ResourceIDs, resourceID)
+		}
+		if val, exists := c.Get(resourcesKey); exists {
+			record.ResourceIDs = append(record.ResourceIDs, val.([]string)...)
+		}
+		if val, exists := c.Get(commentsKey); exists {
+			record.Comments = val.([]Comment)
+		}
+
+		if record.Status < http.StatusBadRequest {
+			record.Outcome = OutcomeSuccess
+		} else {
+			record.Outcome = OutcomeFailure
+		}
+
+		// The response has already been sent, so the best we can do is log the failure.
+		if err := sink.Write(record); err != nil {
+			log.Printf("Failed to write audit record for %s %s: %s\n", record.Method, record.Path, err.Error())
+		}
+	}
+}
+
+// AddResources adds the IDs or URLs of resources touched by an action to its audit record.
+func AddResources(c *gin.Context, resources ...string) {
+	var existing []string
+	if val, exists := c.Get(resourcesKey); exists {
+		existing = val.([]string)
+	}
+	for _, r := range resources {
+		if r != "" {
+			existing = append(existing, r)
+		}
+	}
+	c.Set(resourcesKey, existing)
+}
+
+// AddComments adds reviewers' comments to an action's audit record.
+func AddComments(c *gin.Context, comments ...Comment) {
+	var existing []Comment
+	if val, exists := c.Get(commentsKey); exists {
+		existing = val.([]Comment)
+	}
+	c.Set(commentsKey, append(existing, comments...))
+}
@@ -0,0 +1,88 @@
+package audit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mitre/ptmerge/auth"
+	"github.com/stretchr/testify/suite"
+)
+
+type MiddlewareTestSuite struct {
+	suite.Suite
+	Sink   *memorySink
+	Engine *gin.Engine
+}
+
+func TestMiddlewareTestSuite(t *testing.T) {
+	suite.Run(t, new(MiddlewareTestSuite))
+}
+
+// memorySink collects audit records in memory.
+type memorySink struct {
+	records []*Record
+}
+
+func (m *memorySink) Write(record *Record) error {
+	m.records = append(m.records, record)
+	return nil
+}
+
+func (m *MiddlewareTestSuite) SetupTest() {
+	gin.SetMode(gin.ReleaseMode)
+	m.Sink = &memorySink{}
+	m.Engine = gin.New()
+	m.Engine.Use(auth.Authenticate(auth.Anonymous{}))
+
+	m.Engine.POST("/merge", Middleware(m.Sink, ActionCreate), func(c *gin.Context) {
+		AddResources(c, "http://fhir/Bundle/1", "", "http://fhir/Bundle/2")
+		AddComments(c, Comment{Author: "jdoe", Text: "Looks good"})
+		AddComments(c, Comment{ConflictID: "def456", Author: "jdoe", Text: "Called the clinic"})
+		c.Header("Location", "abc123")
+		c.String(http.StatusCreated, "")
+	})
+	m.Engine.POST("/merge/:merge_id/resolve/:conflict_id", Middleware(m.Sink, ActionResolve), func(c *gin.Context) {
+		c.String(http.StatusNotFound, "Merge not found")
+	})
+}
+
+func (m *MiddlewareTestSuite) TestAuditsSuccess() {
+	m.do("POST", "/merge")
+
+	m.Len(m.Sink.records, 1)
+	record := m.Sink.records[0]
+	m.Equal(ActionCreate, record.Action)
+	m.Equal("anonymous", record.Actor)
+	m.Equal("abc123", record.MergeID)
+	m.Equal([]string{"http://fhir/Bundle/1", "http://fhir/Bundle/2"}, record.ResourceIDs)
+	m.Equal(OutcomeSuccess, record.Outcome)
+	m.Equal(http.StatusCreated, record.Status)
+	m.Equal("POST", record.Method)
+	m.Equal("/merge", record.Path)
+	m.False(record.Timestamp.IsZero())
+
+	m.Len(record.Comments, 2)
+	m.Equal("Looks good", record.Comments[0].Text)
+	m.Equal("def456", record.Comments[1].ConflictID)
+}
+
+func (m *MiddlewareTestSuite) TestAuditsFailure() {
+	m.do("POST", "/merge/abc123/resolve/def456")
+
+	m.Len(m.Sink.records, 1)
+	record := m.Sink.records[0]
+	m.Equal(ActionResolve, record.Action)
+	m.Equal("abc123", record.MergeID)
+	m.Equal([]string{"def456"}, record.ResourceIDs)
+	m.Equal(OutcomeFailure, record.Outcome)
+	m.Equal(http.StatusNotFound, record.Status)
+	m.Empty(record.Comments)
+}
+
+func (m *MiddlewareTestSuite) do(method, path string) {
+	req, err := http.NewRequest(method, path, nil)
+	m.Require().NoError(err)
+	m.Engine.ServeHTTP(httptest.NewRecorder(), req)
+}
@@ -0,0 +1,26 @@
+package audit
+
+import (
+	mgo "gopkg.in/mgo.v2"
+)
+
+// MongoSink stores audit records in the "audit" collection.
+type MongoSink struct {
+	session *mgo.Session
+	dbname  string
+}
+
+// NewMongoSink returns a pointer to a newly initialized MongoSink.
+func NewMongoSink(session *mgo.Session, dbname string) *MongoSink {
+	return &MongoSink{
+		session: session,
+		dbname:  dbname,
+	}
+}
+
+// Write inserts the record into the "audit" collection.
+func (m *MongoSink) Write(record *Record) error {
+	worker := m.session.Copy()
+	defer worker.Close()
+	return worker.DB(m.dbname).C("audit").Insert(record)
+}
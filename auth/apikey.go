@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+)
+
+// APIKeyHeader is the request header that carries an API key.
+const APIKeyHeader = "X-API-Key"
+
+// APIKeyAuthenticator authenticates requests by a pre-shared API key. Each key
+// maps to the user it was issued to.
+type APIKeyAuthenticator struct {
+	keys map[string]*User
+}
+
+// NewAPIKeyAuthenticator returns a pointer to a newly initialized APIKeyAuthenticator
+// with a known set of keys.
+func NewAPIKeyAuthenticator(keys map[string]*User) *APIKeyAuthenticator {
+	return &APIKeyAuthenticator{
+		keys: keys,
+	}
+}
+
+// LoadAPIKeys loads a JSON file of API keys, where each key maps to a user, e.g.
+// {"s3cr3t": {"id": "jdoe", "name": "Jane Doe", "roles": ["reviewer"]}}.
+func LoadAPIKeys(filepath string) (*APIKeyAuthenticator, error) {
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*User)
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return nil, err
+	}
+	return NewAPIKeyAuthenticator(keys), nil
+}
+
+// Authenticate looks up the user for the API key in the request's X-API-Key header.
+func (a *APIKeyAuthenticator) Authenticate(req *http.Request) (*User, error) {
+	key := req.Header.Get(APIKeyHeader)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	user, found := a.keys[key]
+	if !found {
+		return nil, ErrInvalidCredentials
+	}
+	return user, nil
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type APIKeyTestSuite struct {
+	suite.Suite
+}
+
+func TestAPIKeyTestSuite(t *testing.T) {
+	suite.Run(t, new(APIKeyTestSuite))
+}
+
+func (a *APIKeyTestSuite) TestLoadAPIKeys() {
+	file, err := ioutil.TempFile("", "apikeys")
+	a.NoError(err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(`{"s3cr3t": {"id": "jdoe", "name": "Jane Doe", "roles": ["reviewer"]}}`)
+	a.NoError(err)
+	file.Close()
+
+	authenticator, err := LoadAPIKeys(file.Name())
+	a.NoError(err)
+
+	req, err := http.NewRequest("GET", "/merge", nil)
+	a.NoError(err)
+	req.Header.Set(APIKeyHeader, "s3cr3t")
+	user, err := authenticator.Authenticate(req)
+	a.NoError(err)
+	a.Equal("jdoe", user.ID)
+	a.Equal("Jane Doe", user.Name)
+	a.Equal([]Role{Reviewer}, user.Roles)
+}
+
+func (a *APIKeyTestSuite) TestAuthenticateNoKey() {
+	authenticator := NewAPIKeyAuthenticator(map[string]*User{"s3cr3t": {ID: "jdoe"}})
+	req, err := http.NewRequest("GET", "/merge", nil)
+	a.NoError(err)
+	_, err = authenticator.Authenticate(req)
+	a.Equal(ErrNoCredentials, err)
+}
+
+func (a *APIKeyTestSuite) TestAuthenticateBadKey() {
+	authenticator := NewAPIKeyAuthenticator(map[string]*User{"s3cr3t": {ID: "jdoe"}})
+	req, err := http.NewRequest("GET", "/merge", nil)
+	a.NoError(err)
+	req.Header.Set(APIKeyHeader, "guess")
+	_, err = authenticator.Authenticate(req)
+	a.Equal(ErrInvalidCredentials, err)
+}
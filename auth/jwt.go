@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// JWTAuthenticator authenticates requests bearing an RSA-signed JSON Web Token.
+// Tokens are verified against the public keys in a local JSON Web Key Set (JWKS).
+type JWTAuthenticator struct {
+	// Issuer, if set, must match the token's "iss" claim.
+	Issuer string
+	// Audience, if set, must be one of the token's "aud" claims.
+	Audience string
+	// RolesClaim names the claim holding the user's roles. Defaults to "roles".
+	RolesClaim string
+	keys       map[string]*rsa.PublicKey
+}
+
+// jwks is a JSON Web Key Set. Only the fields needed for RSA keys are used.
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// NewJWTAuthenticator returns a pointer to a newly initialized JWTAuthenticator with a
+// known set of public keys, indexed by key ID.
+func NewJWTAuthenticator(keys map[string]*rsa.PublicKey) *JWTAuthenticator {
+	return &JWTAuthenticator{
+		RolesClaim: "roles",
+		keys:       keys,
+	}
+}
+
+// LoadJWKS loads the RSA public keys in a local JWKS file and returns a JWTAuthenticator
+// that verifies tokens with them.
+func LoadJWKS(filepath string) (*JWTAuthenticator, error) {
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	var set jwks
+	err = json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			// Only RSA keys are supported, skip anything else.
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("Key %s has a malformed modulus", k.Kid)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("Key %s has a malformed exponent", k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No RSA keys found in %s", filepath)
+	}
+	return NewJWTAuthenticator(keys), nil
+}
+
+// Authenticate verifies the bearer token in the request's Authorization header and
+// returns the user it identifies.
+func (a *JWTAuthenticator) Authenticate(req *http.Request) (*User, error) {
+	header := req.Header.Get("Authorization")
+	if header == "" {
+		return nil, ErrNoCredentials
+	}
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, ErrInvalidCredentials
+	}
+	claims, err := a.verify(strings.TrimPrefix(header, "Bearer "))
+	if err != nil {
+		return nil, err
+	}
+	return a.userFromClaims(claims)
+}
+
+// verify checks the token's signature and returns its claims.
+func (a *JWTAuthenticator) verify(token string) (claims map[string]interface{}, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidCredentials
+	}
+
+	// Decode the header to find the signing key and algorithm.
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	var header jwtHeader
+	err = json.Unmarshal(headerJSON, &header)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	key, found := a.keys[header.Kid]
+	if !found {
+		return nil, ErrInvalidCredentials
+	}
+
+	var hash crypto.Hash
+	var digest []byte
+	signed := []byte(parts[0] + "." + parts[1])
+	switch header.Alg {
+	case "RS256":
+		sum := sha256.Sum256(signed)
+		hash, digest = crypto.SHA256, sum[:]
+	case "RS384":
+		sum := sha512.Sum384(signed)
+		hash, digest = crypto.SHA384, sum[:]
+	case "RS512":
+		sum := sha512.Sum512(signed)
+		hash, digest = crypto.SHA512, sum[:]
+	default:
+		// Notably this rejects "none" and the HMAC algorithms.
+		return nil, ErrInvalidCredentials
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	err = rsa.VerifyPKCS1v15(key, hash, digest, signature)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	// The signature is good, so we can trust the claims.
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	err = json.Unmarshal(claimsJSON, &claims)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return claims, nil
+}
+
+// userFromClaims validates the registered claims (exp, nbf, iss, aud) and builds a User
+// from the subject, name, and roles claims.
+func (a *JWTAuthenticator) userFromClaims(claims map[string]interface{}) (*User, error) {
+	now := float64(time.Now().Unix())
+	if exp, ok := claims["exp"].(float64); ok && now >= exp {
+		return nil, ErrInvalidCredentials
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return nil, ErrInvalidCredentials
+	}
+	if a.Issuer != "" && claims["iss"] != a.Issuer {
+		return nil, ErrInvalidCredentials
+	}
+	if a.Audience != "" && !claimContains(claims["aud"], a.Audience) {
+		return nil, ErrInvalidCredentials
+	}
+
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, ErrInvalidCredentials
+	}
+	user := &User{ID: sub}
+	user.Name, _ = claims["name"].(string)
+
+	rolesClaim := a.RolesClaim
+	if rolesClaim == "" {
+		rolesClaim = "roles"
+	}
+	if roles, ok := claims[rolesClaim].([]interface{}); ok {
+		for _, r := range roles {
+			if role, ok := r.(string); ok {
+				user.Roles = append(user.Roles, Role(role))
+			}
+		}
+	}
+	return user, nil
+}
+
+// claimContains tests if a claim that may be a string or a list of strings contains value.
+func claimContains(claim interface{}, value string) bool {
+	switch c := claim.(type) {
+	case string:
+		return c == value
+	case []interface{}:
+		for _, item := range c {
+			if item == value {
+				return true
+			}
+		}
+	}
+	return false
+}
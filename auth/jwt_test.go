@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type JWTTestSuite struct {
+	suite.Suite
+	Key           *rsa.PrivateKey
+	Authenticator *JWTAuthenticator
+}
+
+func TestJWTTestSuite(t *testing.T) {
+	suite.Run(t, new(JWTTestSuite))
+}
+
+func (j *JWTTestSuite) SetupSuite() {
+	var err error
+	j.Key, err = rsa.GenerateKey(rand.Reader, 2048)
+	j.Require().NoError(err)
+
+	// Write the public key to a JWKS file, then load it.
+	file, err := ioutil.TempFile("", "jwks")
+	j.Require().NoError(err)
+	defer os.Remove(file.Name())
+
+	set := fmt.Sprintf(`{"keys": [{"kty": "RSA", "kid": "test", "n": "%s", "e": "%s"}]}`,
+		base64.RawURLEncoding.EncodeToString(j.Key.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(j.Key.E)).Bytes()))
+	_, err = file.WriteString(set)
+	j.Require().NoError(err)
+	file.Close()
+
+	j.Authenticator, err = LoadJWKS(file.Name())
+	j.Require().NoError(err)
+}
+
+func (j *JWTTestSuite) TestAuthenticate() {
+	token := j.sign("test", map[string]interface{}{
+		"sub":   "jdoe",
+		"name":  "Jane Doe",
+		"roles": []string{"reviewer"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+
+	user, err := j.Authenticator.Authenticate(j.request(token))
+	j.NoError(err)
+	j.Equal("jdoe", user.ID)
+	j.Equal("Jane Doe", user.Name)
+	j.Equal([]Role{Reviewer}, user.Roles)
+}
+
+func (j *JWTTestSuite) TestAuthenticateNoToken() {
+	req, err := http.NewRequest("GET", "/merge", nil)
+	j.NoError(err)
+	_, err = j.Authenticator.Authenticate(req)
+	j.Equal(ErrNoCredentials, err)
+}
+
+func (j *JWTTestSuite) TestAuthenticateExpiredToken() {
+	token := j.sign("test", map[string]interface{}{
+		"sub": "jdoe",
+		"exp": time.Now().Add(-time.Hour).Unix(),
+	})
+	_, err := j.Authenticator.Authenticate(j.request(token))
+	j.Equal(ErrInvalidCredentials, err)
+}
+
+func (j *JWTTestSuite) TestAuthenticateUnknownKey() {
+	token := j.sign("other", map[string]interface{}{"sub": "jdoe"})
+	_, err := j.Authenticator.Authenticate(j.request(token))
+	j.Equal(ErrInvalidCredentials, err)
+}
+
+func (j *JWTTestSuite) TestAuthenticateTamperedToken() {
+	token := j.sign("test", map[string]interface{}{"sub": "jdoe", "roles": []string{"viewer"}})
+	// Swap in a payload granting admin, keeping the original signature.
+	payload, err := json.Marshal(map[string]interface{}{"sub": "jdoe", "roles": []string{"admin"}})
+	j.NoError(err)
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+
+	_, err = j.Authenticator.Authenticate(j.request(tampered))
+	j.Equal(ErrInvalidCredentials, err)
+}
+
+func (j *JWTTestSuite) TestAuthenticateWrongIssuerAndAudience() {
+	token := j.sign("test", map[string]interface{}{
+		"sub": "jdoe",
+		"iss": "https://evil.example.com",
+		"aud": []string{"ptmerge"},
+	})
+
+	a := *j.Authenticator
+	a.Issuer = "https://auth.example.com"
+	_, err := a.Authenticate(j.request(token))
+	j.Equal(ErrInvalidCredentials, err)
+
+	a.Issuer = "https://evil.example.com"
+	a.Audience = "ptmerge"
+	user, err := a.Authenticate(j.request(token))
+	j.NoError(err)
+	j.Equal("jdoe", user.ID)
+
+	a.Audience = "something-else"
+	_, err = a.Authenticate(j.request(token))
+	j.Equal(ErrInvalidCredentials, err)
+}
+
+// sign builds an RS256-signed JWT with the given key ID and claims.
+func (j *JWTTestSuite) sign(kid string, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	j.Require().NoError(err)
+	payload, err := json.Marshal(claims)
+	j.Require().NoError(err)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, j.Key, crypto.SHA256, digest[:])
+	j.Require().NoError(err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (j *JWTTestSuite) request(token string) *http.Request {
+	req, err := http.NewRequest("GET", "/merge", nil)
+	j.Require().NoError(err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// userKey is the key the authenticated user is stored under in the gin context.
+const userKey = "ptmerge.user"
+
+// Authenticate returns middleware that identifies the user making each request with
+// the given Authenticator. Requests that can't be authenticated are rejected with
+// 401 Unauthorized. The error is added to the context, for the server to render.
+func Authenticate(authenticator Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := authenticator.Authenticate(c.Request)
+		if err != nil {
+			c.Status(http.StatusUnauthorized)
+			c.Error(err)
+			c.Abort()
+			return
+		}
+		c.Set(userKey, user)
+		c.Next()
+	}
+}
+
+// RequireRole returns middleware that rejects requests from users who don't hold
+// the given role with 403 Forbidden. It must be used after Authenticate.
+func RequireRole(role Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := CurrentUser(c)
+		if !user.HasRole(role) {
+			c.Status(http.StatusForbidden)
+			c.Error(fmt.Errorf("This operation requires the %s role", role))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// CurrentUser returns the authenticated user for this request, or nil if the request
+// was not authenticated.
+func CurrentUser(c *gin.Context) *User {
+	val, exists := c.Get(userKey)
+	if !exists {
+		return nil
+	}
+	user, _ := val.(*User)
+	return user
+}
+
+// CurrentUserID returns the ID of the authenticated user for this request, or an
+// empty string if the request was not authenticated.
+func CurrentUserID(c *gin.Context) string {
+	user := CurrentUser(c)
+	if user == nil {
+		return ""
+	}
+	return user.ID
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+type MiddlewareTestSuite struct {
+	suite.Suite
+	Engine *gin.Engine
+}
+
+func TestMiddlewareTestSuite(t *testing.T) {
+	suite.Run(t, new(MiddlewareTestSuite))
+}
+
+func (m *MiddlewareTestSuite) SetupSuite() {
+	gin.SetMode(gin.ReleaseMode)
+	authenticator := NewAPIKeyAuthenticator(map[string]*User{
+		"viewer-key": {ID: "viewer", Roles: []Role{Viewer}},
+		"admin-key":  {ID: "admin", Roles: []Role{Admin}},
+	})
+
+	m.Engine = gin.New()
+	// Render errors as plain text. The server renders them as OperationOutcomes.
+	m.Engine.Use(func(c *gin.Context) {
+		c.Next()
+		if len(c.Errors) > 0 && !c.Writer.Written() {
+			c.String(c.Writer.Status(), c.Errors.Last().Error())
+		}
+	})
+	m.Engine.Use(Authenticate(authenticator))
+	m.Engine.GET("/whoami", RequireRole(Viewer), func(c *gin.Context) {
+		c.String(http.StatusOK, CurrentUserID(c))
+	})
+	m.Engine.POST("/abort", RequireRole(Admin), func(c *gin.Context) {
+		c.String(http.StatusOK, "aborted")
+	})
+}
+
+func (m *MiddlewareTestSuite) TestUnauthenticated() {
+	res := m.do("GET", "/whoami", "")
+	m.Equal(http.StatusUnauthorized, res.Code)
+	m.Equal(ErrNoCredentials.Error(), res.Body.String())
+}
+
+func (m *MiddlewareTestSuite) TestAuthenticatedWithRole() {
+	res := m.do("GET", "/whoami", "viewer-key")
+	m.Equal(http.StatusOK, res.Code)
+	m.Equal("viewer", res.Body.String())
+
+	res = m.do("POST", "/abort", "admin-key")
+	m.Equal(http.StatusOK, res.Code)
+}
+
+func (m *MiddlewareTestSuite) TestAuthenticatedWithoutRole() {
+	res := m.do("POST", "/abort", "viewer-key")
+	m.Equal(http.StatusForbidden, res.Code)
+	m.Equal("This operation requires the admin role", res.Body.String())
+}
+
+func (m *MiddlewareTestSuite) do(method, path, key string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, nil)
+	m.Require().NoError(err)
+	if key != "" {
+		req.Header.Set(APIKeyHeader, key)
+	}
+	res := httptest.NewRecorder()
+	m.Engine.ServeHTTP(res, req)
+	return res
+}
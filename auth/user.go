@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Role is a level of access to the ptmerge service. Roles are ordered, so a user
+// with a higher role may do anything a user with a lower role may do.
+type Role string
+
+const (
+	// Viewer may read merge state, conflicts, and targets.
+	Viewer Role = "viewer"
+	// Reviewer may additionally start merges and resolve conflicts.
+	Reviewer Role = "reviewer"
+	// Admin may additionally abort and delete merges.
+	Admin Role = "admin"
+)
+
+// roleRanks orders the known roles from least to most privileged.
+var roleRanks = map[Role]int{
+	Viewer:   1,
+	Reviewer: 2,
+	Admin:    3,
+}
+
+var (
+	// ErrNoCredentials occurs if a request did not include any credentials.
+	ErrNoCredentials = errors.New("No credentials were provided")
+
+	// ErrInvalidCredentials occurs if the credentials provided could not be verified.
+	ErrInvalidCredentials = errors.New("The credentials provided are invalid")
+)
+
+// User is an authenticated user of the ptmerge service.
+type User struct {
+	ID    string `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Roles []Role `json:"roles,omitempty"`
+}
+
+// HasRole tests if the user holds the given role, or any role above it.
+func (u *User) HasRole(role Role) bool {
+	if u == nil {
+		return false
+	}
+	for _, r := range u.Roles {
+		if roleRanks[r] >= roleRanks[role] && roleRanks[r] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator identifies the user making a request.
+type Authenticator interface {
+	Authenticate(req *http.Request) (*User, error)
+}
+
+// Anonymous is an Authenticator that accepts every request as an anonymous
+// administrator. It is used when authentication is disabled.
+type Anonymous struct{}
+
+// Authenticate always returns the anonymous administrator.
+func (a Anonymous) Authenticate(req *http.Request) (*User, error) {
+	return &User{
+		ID:    "anonymous",
+		Roles: []Role{Admin},
+	}, nil
+}
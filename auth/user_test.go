@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type UserTestSuite struct {
+	suite.Suite
+}
+
+func TestUserTestSuite(t *testing.T) {
+	suite.Run(t, new(UserTestSuite))
+}
+
+func (u *UserTestSuite) TestHasRole() {
+	viewer := &User{ID: "v", Roles: []Role{Viewer}}
+	u.True(viewer.HasRole(Viewer))
+	u.False(viewer.HasRole(Reviewer))
+	u.False(viewer.HasRole(Admin))
+
+	reviewer := &User{ID: "r", Roles: []Role{Reviewer}}
+	u.True(reviewer.HasRole(Viewer))
+	u.True(reviewer.HasRole(Reviewer))
+	u.False(reviewer.HasRole(Admin))
+
+	admin := &User{ID: "a", Roles: []Role{Admin}}
+	u.True(admin.HasRole(Viewer))
+	u.True(admin.HasRole(Reviewer))
+	u.True(admin.HasRole(Admin))
+}
+
+func (u *UserTestSuite) TestHasRoleUnknownRoles() {
+	user := &User{ID: "x", Roles: []Role{"superuser"}}
+	u.False(user.HasRole(Viewer))
+	u.False(user.HasRole("superuser"))
+}
+
+func (u *UserTestSuite) TestHasRoleNilUser() {
+	var user *User
+	u.False(user.HasRole(Viewer))
+}
+
+func (u *UserTestSuite) TestAnonymous() {
+	req, err := http.NewRequest("GET", "/merge", nil)
+	u.NoError(err)
+	user, err := Anonymous{}.Authenticate(req)
+	u.NoError(err)
+	u.Equal("anonymous", user.ID)
+	u.True(user.HasRole(Admin))
+}
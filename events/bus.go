@@ -0,0 +1,178 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// The types of merge events.
+const (
+	MergeCreated          = "merge-created"
+	ApprovalRequested     = "approval-requested"
+	MergeRejected         = "merge-rejected"
+	MergeCompleted        = "merge-completed"
+	MergeCommitted        = "merge-committed"
+	MergeAborted          = "merge-aborted"
+	MergeExpired          = "merge-expired"
+	MergeAssigned         = "merge-assigned"
+	MergeReleased         = "merge-released"
+	ConflictResolved      = "conflict-resolved"
+	ConflictReopened      = "conflict-reopened"
+	ConflictDeleted       = "conflict-deleted"
+	TargetResourceUpdated = "target-resource-updated"
+	TargetResourceDeleted = "target-resource-deleted"
+	CommentAdded          = "comment-added"
+	CommentDeleted        = "comment-deleted"
+	// EventsDropped tells a subscriber that events were dropped because it wasn't keeping
+	// up, so it should fetch the merge again rather than rely on the events it received.
+	EventsDropped = "events-dropped"
+)
+
+// SubscriberBufferSize is the number of events buffered for each subscriber. Events
+// published to a subscriber with a full buffer are dropped, so one slow subscriber can't
+// hold up the merge service, and the subscriber is sent an EventsDropped event instead.
+var SubscriberBufferSize = 64
+
+// Event is a change to a merge session.
+type Event struct {
+	Type       string    `json:"type"`
+	MergeID    string    `json:"mergeId"`
+	ConflictID string    `json:"conflictId,omitempty"`
+	ResourceID string    `json:"resourceId,omitempty"`
+	CommentID  string    `json:"commentId,omitempty"`
+	Assignee   string    `json:"assignee,omitempty"`
+	Actor      string    `json:"actor,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// IsFinal returns true if no more events will follow this one for its merge.
+func (e *Event) IsFinal() bool {
+	return e.Type == MergeCommitted || e.Type == MergeAborted || e.Type == MergeExpired
+}
+
+// Subscription receives the events published for one merge, or for all merges.
+type Subscription struct {
+	// Events is closed when the subscription is cancelled.
+	Events  <-chan *Event
+	mergeID string
+	events  chan *Event
+	bus     *Bus
+	// mutex serializes sends, so events never take the slot kept for EventsDropped.
+	mutex sync.Mutex
+	// sent counts the events sent to the subscriber, and dropped is the position of the
+	// last EventsDropped event among them, or -1 if none was sent.
+	sent    int
+	dropped int
+}
+
+// Cancel stops the subscription and closes its Events channel. It is safe to cancel a
+// subscription more than once.
+func (s *Subscription) Cancel() {
+	s.bus.unsubscribe(s)
+}
+
+// Bus delivers the events published by the merge service to its subscribers and handlers.
+type Bus struct {
+	mutex       sync.RWMutex
+	subscribers map[*Subscription]bool
+	handlers    map[int]func(*Event)
+	nextHandler int
+}
+
+// NewBus returns a pointer to a newly initialized Bus.
+func NewBus() *Bus {
+	return &Bus{
+		subscribers: make(map[*Subscription]bool),
+		handlers:    make(map[int]func(*Event)),
+	}
+}
+
+// Handle registers a handler that is called with every event published to the bus, for
+// all merges. Unlike subscribers, handlers never miss events: each is called before Publish
+// returns, so it should be quick and must not publish events itself. The returned function
+// removes the handler.
+func (b *Bus) Handle(handler func(*Event)) (remove func()) {
+	b.mutex.Lock()
+	id := b.nextHandler
+	b.nextHandler++
+	b.handlers[id] = handler
+	b.mutex.Unlock()
+	return func() {
+		b.mutex.Lock()
+		delete(b.handlers, id)
+		b.mutex.Unlock()
+	}
+}
+
+// Subscribe returns a new subscription to the events for a merge. If mergeID is empty,
+// the subscription receives the events for all merges.
+func (b *Bus) Subscribe(mergeID string) *Subscription {
+	// One more slot than the buffer size is kept for an EventsDropped event.
+	events := make(chan *Event, SubscriberBufferSize+1)
+	sub := &Subscription{
+		Events:  events,
+		mergeID: mergeID,
+		events:  events,
+		bus:     b,
+		dropped: -1,
+	}
+	b.mutex.Lock()
+	b.subscribers[sub] = true
+	b.mutex.Unlock()
+	return sub
+}
+
+// Publish calls every handler with an event, then sends it to all subscribers of its
+// merge. The event's Timestamp is set if it wasn't already. Publish only blocks on the
+// handlers, never on subscribers: subscribers with a full buffer get an EventsDropped
+// event instead, unless one is already waiting in their buffer.
+func (b *Bus) Publish(event *Event) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for _, handler := range b.handlers {
+		handler(event)
+	}
+	for sub := range b.subscribers {
+		if sub.mergeID != "" && sub.mergeID != event.MergeID {
+			continue
+		}
+		sub.send(event)
+	}
+}
+
+// send sends an event to the subscriber, or an EventsDropped event if its buffer is full
+// and it hasn't yet received the last one it was sent.
+func (s *Subscription) send(event *Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.events) < SubscriberBufferSize {
+		s.events <- event
+		s.sent++
+		return
+	}
+
+	// The subscriber has received every event but those still in its buffer.
+	received := s.sent - len(s.events)
+	if s.dropped >= received {
+		return
+	}
+	select {
+	case s.events <- &Event{Type: EventsDropped, MergeID: event.MergeID, Timestamp: time.Now()}:
+		s.dropped = s.sent
+		s.sent++
+	default:
+	}
+}
+
+func (b *Bus) unsubscribe(sub *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.subscribers[sub] {
+		delete(b.subscribers, sub)
+		close(sub.events)
+	}
+}
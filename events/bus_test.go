@@ -0,0 +1,113 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type BusTestSuite struct {
+	suite.Suite
+}
+
+func TestBusTestSuite(t *testing.T) {
+	suite.Run(t, new(BusTestSuite))
+}
+
+func (b *BusTestSuite) TestPublishToMergeSubscribers() {
+	bus := NewBus()
+	sub1 := bus.Subscribe("merge1")
+	defer sub1.Cancel()
+	sub2 := bus.Subscribe("merge2")
+	defer sub2.Cancel()
+	all := bus.Subscribe("")
+	defer all.Cancel()
+
+	bus.Publish(&Event{Type: ConflictResolved, MergeID: "merge1", ConflictID: "conflict1"})
+
+	event := <-sub1.Events
+	b.Equal(ConflictResolved, event.Type)
+	b.Equal("conflict1", event.ConflictID)
+	b.False(event.Timestamp.IsZero())
+	b.Equal(event, <-all.Events)
+
+	// Subscribers to other merges don't get the event.
+	b.Len(sub2.Events, 0)
+}
+
+func (b *BusTestSuite) TestCancel() {
+	bus := NewBus()
+	sub := bus.Subscribe("merge1")
+	sub.Cancel()
+	sub.Cancel()
+
+	bus.Publish(&Event{Type: MergeAborted, MergeID: "merge1"})
+	_, ok := <-sub.Events
+	b.False(ok)
+}
+
+func (b *BusTestSuite) TestSlowSubscriber() {
+	bus := NewBus()
+	sub := bus.Subscribe("merge1")
+	defer sub.Cancel()
+
+	// Publishing to a full subscriber drops events rather than blocking, and tells the
+	// subscriber once that it missed some.
+	for i := 0; i < SubscriberBufferSize+10; i++ {
+		bus.Publish(&Event{Type: TargetResourceUpdated, MergeID: "merge1"})
+	}
+	b.Len(sub.Events, SubscriberBufferSize+1)
+	for i := 0; i < SubscriberBufferSize; i++ {
+		b.Equal(TargetResourceUpdated, (<-sub.Events).Type)
+	}
+	dropped := <-sub.Events
+	b.Equal(EventsDropped, dropped.Type)
+	b.Equal("merge1", dropped.MergeID)
+	b.Len(sub.Events, 0)
+
+	// Once it has caught up, it gets events again, and is told if it falls behind again,
+	// but only once until it has received the EventsDropped event.
+	for i := 0; i < SubscriberBufferSize+1; i++ {
+		bus.Publish(&Event{Type: CommentAdded, MergeID: "merge1"})
+	}
+	b.Equal(CommentAdded, (<-sub.Events).Type)
+	bus.Publish(&Event{Type: CommentDeleted, MergeID: "merge1"})
+	b.Len(sub.Events, SubscriberBufferSize)
+	for i := 0; i < SubscriberBufferSize-1; i++ {
+		b.Equal(CommentAdded, (<-sub.Events).Type)
+	}
+	b.Equal(EventsDropped, (<-sub.Events).Type)
+
+	bus.Publish(&Event{Type: CommentDeleted, MergeID: "merge1"})
+	b.Equal(CommentDeleted, (<-sub.Events).Type)
+	b.Len(sub.Events, 0)
+}
+
+func (b *BusTestSuite) TestHandler() {
+	bus := NewBus()
+	handled := []*Event{}
+	remove := bus.Handle(func(event *Event) {
+		handled = append(handled, event)
+	})
+
+	// Handlers get every event, for every merge, even more than a subscriber could buffer.
+	for i := 0; i < SubscriberBufferSize+10; i++ {
+		bus.Publish(&Event{Type: TargetResourceUpdated, MergeID: "merge1"})
+	}
+	bus.Publish(&Event{Type: MergeAborted, MergeID: "merge2"})
+	b.Len(handled, SubscriberBufferSize+11)
+	b.Equal("merge2", handled[len(handled)-1].MergeID)
+
+	// Removed handlers get no more events.
+	remove()
+	bus.Publish(&Event{Type: MergeAborted, MergeID: "merge3"})
+	b.Len(handled, SubscriberBufferSize+11)
+}
+
+func (b *BusTestSuite) TestIsFinal() {
+	b.True((&Event{Type: MergeCommitted}).IsFinal())
+	b.True((&Event{Type: MergeAborted}).IsFinal())
+	b.True((&Event{Type: MergeExpired}).IsFinal())
+	b.False((&Event{Type: MergeCompleted}).IsFinal())
+	b.False((&Event{Type: ConflictResolved}).IsFinal())
+}
@@ -0,0 +1,92 @@
+package fhirutil
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// NotFoundError occurs when a resource doesn't exist on a FHIR server, or in a bundle.
+type NotFoundError struct {
+	// Resource identifies the missing resource, by URL or as type:id.
+	Resource string
+	// In optionally describes where the resource was expected, e.g. "target bundle ...".
+	In string
+}
+
+func (e *NotFoundError) Error() string {
+	if e.In != "" {
+		return fmt.Sprintf("Resource %s not found in %s", e.Resource, e.In)
+	}
+	return fmt.Sprintf("Resource %s not found", e.Resource)
+}
+
+// UpstreamError occurs when a request to a FHIR server fails, or the server responds
+// with an unexpected status or body.
+type UpstreamError struct {
+	Message string
+	// StatusCode is the status the FHIR server responded with, or 0 if it didn't respond.
+	StatusCode int
+	// Err is the underlying error, if any. It isn't included in the error's message,
+	// since it may reveal details of the FHIR server.
+	Err error
+}
+
+func (e *UpstreamError) Error() string {
+	return e.Message
+}
+
+// ConflictError occurs when a FHIR server refuses a change that conflicts with the
+// current state of a resource.
+type ConflictError struct {
+	Resource string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("Resource %s was changed by someone else", e.Resource)
+}
+
+// responseError returns the error for an unexpected response from a FHIR server. Missing
+// resources are NotFoundErrors, rejected changes are ConflictErrors, and anything else
+// is an UpstreamError with the given message.
+func responseError(res *http.Response, resource, message string) error {
+	switch res.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return &NotFoundError{Resource: resource}
+	case http.StatusConflict, http.StatusPreconditionFailed:
+		return &ConflictError{Resource: resource}
+	default:
+		return &UpstreamError{Message: message, StatusCode: res.StatusCode}
+	}
+}
+
+// ErrorOutcome creates a new OperationOutcome describing an error, with one of the FHIR
+// issue type codes (e.g. "not-found").
+func ErrorOutcome(code, diagnostics string) *models.OperationOutcome {
+	return &models.OperationOutcome{
+		DomainResource: models.DomainResource{
+			Resource: models.Resource{
+				Id:           bson.NewObjectId().Hex(),
+				ResourceType: "OperationOutcome",
+			},
+		},
+		Issue: []models.OperationOutcomeIssueComponent{
+			models.OperationOutcomeIssueComponent{
+				Severity:    "error",
+				Code:        code,
+				Diagnostics: diagnostics,
+			},
+		},
+	}
+}
+
+// PatchError occurs when a FHIRPath Patch is invalid, or can't be applied to a resource.
+type PatchError struct {
+	Message string
+}
+
+func (e *PatchError) Error() string {
+	return e.Message
+}
@@ -0,0 +1,76 @@
+package fhirutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ErrorsTestSuite struct {
+	suite.Suite
+	Server *httptest.Server
+}
+
+func TestErrorsTestSuite(t *testing.T) {
+	suite.Run(t, new(ErrorsTestSuite))
+}
+
+func (e *ErrorsTestSuite) SetupSuite() {
+	// The mock FHIR server responds to /Patient/<status> with that status.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Patient/404", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNotFound) })
+	mux.HandleFunc("/Patient/409", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusConflict) })
+	mux.HandleFunc("/Patient/500", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) })
+	mux.HandleFunc("/Patient/garbage", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("<Patient/>")) })
+	e.Server = httptest.NewServer(mux)
+}
+
+func (e *ErrorsTestSuite) TearDownSuite() {
+	e.Server.Close()
+}
+
+func (e *ErrorsTestSuite) TestNotFound() {
+	_, err := GetResource(e.Server.URL, "Patient", "404")
+	e.Equal(&NotFoundError{Resource: "Patient:404"}, err)
+	e.Equal("Resource Patient:404 not found", err.Error())
+
+	err = DeleteResourceByURL(e.Server.URL + "/Patient/404")
+	e.IsType(&NotFoundError{}, err)
+
+	err = &NotFoundError{Resource: "123", In: "target bundle http://fhir/Bundle/1"}
+	e.Equal("Resource 123 not found in target bundle http://fhir/Bundle/1", err.Error())
+}
+
+func (e *ErrorsTestSuite) TestConflict() {
+	err := DeleteResource(e.Server.URL, "Patient", "409")
+	e.Equal(&ConflictError{Resource: "Patient:409"}, err)
+}
+
+func (e *ErrorsTestSuite) TestUpstreamFailures() {
+	_, err := GetResourceByURL("Patient", e.Server.URL+"/Patient/500")
+	e.IsType(&UpstreamError{}, err)
+	e.Equal(http.StatusInternalServerError, err.(*UpstreamError).StatusCode)
+
+	_, err = GetResource(e.Server.URL, "Patient", "garbage")
+	e.IsType(&UpstreamError{}, err)
+	e.Equal("Resource Patient:garbage is not valid Patient JSON", err.Error())
+	e.NotNil(err.(*UpstreamError).Err)
+
+	// The FHIR server can't be reached at all.
+	_, err = GetResource("http://localhost:0", "Patient", "123")
+	e.IsType(&UpstreamError{}, err)
+	e.Equal(0, err.(*UpstreamError).StatusCode)
+	e.Equal("Failed to request resource Patient:123", err.Error())
+}
+
+func (e *ErrorsTestSuite) TestErrorOutcome() {
+	oo := ErrorOutcome("not-found", "Resource Patient:404 not found")
+	e.Equal("OperationOutcome", oo.ResourceType)
+	e.NotEmpty(oo.Id)
+	e.Len(oo.Issue, 1)
+	e.Equal("error", oo.Issue[0].Severity)
+	e.Equal("not-found", oo.Issue[0].Code)
+	e.Equal("Resource Patient:404 not found", oo.Issue[0].Diagnostics)
+}
@@ -0,0 +1,487 @@
+package fhirutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// EvaluateFHIRPath evaluates a FHIRPath expression against a resource, returning the
+// collection of values it selects. Only the subset of FHIRPath needed to address elements
+// of a resource is supported:
+//
+//	Patient.name[0].given[1]                      navigation and indexers
+//	Patient.extension.where(url = 'http://...')   where() with = or != and a literal
+//	Observation.value                             choice elements (e.g. valueQuantity)
+//	Patient.birthDate.extension                   extensions on primitives (_birthDate)
+//	Patient.name.first(), last(), exists(), count()
+//
+// The expression may start with the resource's type, in which case it selects nothing from
+// resources of other types. Resources may be models or decoded from JSON. Primitives are
+// returned as they are in JSON (string, float64, or bool), and complex elements as objects.
+func EvaluateFHIRPath(resource interface{}, expression string) ([]interface{}, error) {
+	steps, err := parseFHIRPath(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := jsonObject(resource)
+	if err != nil {
+		return nil, err
+	}
+	nodes := []fhirPathNode{{value: root}}
+
+	// A leading type name selects the resource itself, if it's of that type.
+	if first := steps[0]; !first.function && unicode.IsUpper(rune(first.name[0])) {
+		if first.name != root["resourceType"] {
+			return []interface{}{}, nil
+		}
+		nodes = indexNodes(nodes, first.indexes)
+		steps = steps[1:]
+	}
+
+	nodes, err = evaluateSteps(nodes, steps)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(nodes))
+	for i, node := range nodes {
+		values[i] = node.result()
+	}
+	return values, nil
+}
+
+// ReplaceFHIRPath replaces the element a FHIRPath expression selects in a resource, which
+// must be a generic JSON object, with a value. The expression must select exactly one
+// element of the resource (see EvaluateFHIRPath).
+func ReplaceFHIRPath(resource map[string]interface{}, expression string, value interface{}) error {
+	steps, err := parseFHIRPath(expression)
+	if err != nil {
+		return err
+	}
+	if first := steps[0]; !first.function && unicode.IsUpper(rune(first.name[0])) {
+		if first.name != resource["resourceType"] || len(first.indexes) > 0 {
+			return fmt.Errorf("FHIRPath expression %s does not select an element of a %s", expression, resource["resourceType"])
+		}
+		steps = steps[1:]
+	}
+	if len(steps) == 0 {
+		return fmt.Errorf("FHIRPath expression %s selects the resource itself, not one of its elements", expression)
+	}
+
+	nodes, err := evaluateSteps([]fhirPathNode{{value: resource}}, steps)
+	if err != nil {
+		return err
+	}
+	if len(nodes) != 1 {
+		return fmt.Errorf("FHIRPath expression %s selects %d elements, rather than one element", expression, len(nodes))
+	}
+	if nodes[0].set == nil {
+		return fmt.Errorf("FHIRPath expression %s does not select an element that can be replaced", expression)
+	}
+	nodes[0].set(value)
+	return nil
+}
+
+// fhirPathStep is one step of a parsed FHIRPath expression: an element name or a function
+// call, followed by any indexers.
+type fhirPathStep struct {
+	name     string
+	function bool
+	criteria *fhirPathCriteria
+	indexes  []int
+}
+
+// fhirPathCriteria is the argument to where(): a path relative to each item, optionally
+// compared to a literal.
+type fhirPathCriteria struct {
+	steps    []fhirPathStep
+	operator string
+	literal  interface{}
+}
+
+// fhirPathNode is an item in a collection being evaluated. Primitives in FHIR JSON keep their
+// id and extensions in a separate element (e.g. _birthDate), which is kept with the value.
+// Nodes that are elements of the resource can be replaced with set; function results can't.
+type fhirPathNode struct {
+	value   interface{}
+	element map[string]interface{}
+	set     func(interface{})
+}
+
+// result returns the value of a node, or its element if the primitive only has extensions.
+func (n fhirPathNode) result() interface{} {
+	if n.value == nil {
+		return n.element
+	}
+	return n.value
+}
+
+// children returns the nodes for the child elements with the given name.
+func (n fhirPathNode) children(name string) []fhirPathNode {
+	object, ok := n.value.(map[string]interface{})
+	if !ok {
+		object = n.element
+	}
+	if object == nil {
+		return nil
+	}
+	if _, found := object[name]; found || object["_"+name] != nil {
+		return fhirPathNodes(object, name)
+	}
+
+	// Choice elements are named by their type in JSON, e.g. valueQuantity for value.
+	var nodes []fhirPathNode
+	for key := range object {
+		if len(key) > len(name) && strings.HasPrefix(key, name) && unicode.IsUpper(rune(key[len(name)])) {
+			nodes = append(nodes, fhirPathNodes(object, key)...)
+		}
+	}
+	return nodes
+}
+
+// FHIRPathString returns a string as a FHIRPath literal, quoted and escaped, e.g. 'it\'s'.
+func FHIRPathString(s string) string {
+	return "'" + fhirPathEscaper.Replace(s) + "'"
+}
+
+// fhirPathEscaper escapes the quotes and backslashes in FHIRPath string literals, and
+// fhirPathUnescaper removes the escapes.
+var (
+	fhirPathEscaper   = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	fhirPathUnescaper = strings.NewReplacer(`\\`, `\`, `\'`, `'`)
+)
+
+// fhirPathNodes returns the nodes for an element of a JSON object, by its key, along with
+// the element that holds its extensions if it's a primitive. Repeating elements have a node
+// for each item.
+func fhirPathNodes(object map[string]interface{}, key string) (nodes []fhirPathNode) {
+	value, element := object[key], object["_"+key]
+	values, valuesOK := value.([]interface{})
+	elements, elementsOK := element.([]interface{})
+	if !valuesOK && !elementsOK {
+		e, _ := element.(map[string]interface{})
+		if value == nil && e == nil {
+			return nil
+		}
+		return []fhirPathNode{{value: value, element: e, set: func(v interface{}) { object[key] = v }}}
+	}
+
+	for i := 0; i < len(values) || i < len(elements); i++ {
+		node := fhirPathNode{}
+		if i < len(values) {
+			i := i
+			node.value = values[i]
+			node.set = func(v interface{}) { values[i] = v }
+		}
+		if i < len(elements) {
+			node.element, _ = elements[i].(map[string]interface{})
+		}
+		if node.value != nil || node.element != nil {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// evaluateSteps evaluates each step of an expression against the collection from the last.
+func evaluateSteps(nodes []fhirPathNode, steps []fhirPathStep) ([]fhirPathNode, error) {
+	for _, step := range steps {
+		var next []fhirPathNode
+		if !step.function {
+			for _, node := range nodes {
+				next = append(next, node.children(step.name)...)
+			}
+		} else {
+			switch step.name {
+			case "where":
+				for _, node := range nodes {
+					matches, err := step.criteria.matches(node)
+					if err != nil {
+						return nil, err
+					}
+					if matches {
+						next = append(next, node)
+					}
+				}
+			case "first":
+				next = indexNodes(nodes, []int{0})
+			case "last":
+				next = indexNodes(nodes, []int{len(nodes) - 1})
+			case "exists":
+				next = []fhirPathNode{{value: len(nodes) > 0}}
+			case "count":
+				next = []fhirPathNode{{value: float64(len(nodes))}}
+			default:
+				return nil, fmt.Errorf("Unsupported FHIRPath function %s()", step.name)
+			}
+		}
+		nodes = indexNodes(next, step.indexes)
+	}
+	return nodes, nil
+}
+
+// indexNodes applies indexers to a collection. Indexes out of range select nothing.
+func indexNodes(nodes []fhirPathNode, indexes []int) []fhirPathNode {
+	for _, i := range indexes {
+		if i < 0 || i >= len(nodes) {
+			return nil
+		}
+		nodes = nodes[i : i+1]
+	}
+	return nodes
+}
+
+// matches tests if a node meets the criteria of a where(). Without a comparison, the path
+// must select something other than false. With one, it must select a single value.
+func (c *fhirPathCriteria) matches(node fhirPathNode) (bool, error) {
+	results, err := evaluateSteps([]fhirPathNode{node}, c.steps)
+	if err != nil {
+		return false, err
+	}
+	if c.operator == "" {
+		return len(results) > 0 && results[0].value != false, nil
+	}
+	if len(results) != 1 {
+		return false, nil
+	}
+	equal := results[0].value == c.literal
+	return equal == (c.operator == "="), nil
+}
+
+// jsonObject returns a resource as a JSON object, marshaling and decoding models.
+func jsonObject(resource interface{}) (map[string]interface{}, error) {
+	if object, ok := resource.(map[string]interface{}); ok {
+		return object, nil
+	}
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return nil, err
+	}
+	object := make(map[string]interface{})
+	err = json.Unmarshal(data, &object)
+	return object, err
+}
+
+// fhirPathParser parses FHIRPath expressions into steps.
+type fhirPathParser struct {
+	expression string
+	tokens     []string
+	pos        int
+}
+
+// parseFHIRPath parses a FHIRPath expression, returning an error if it's invalid or uses
+// parts of FHIRPath that aren't supported.
+func parseFHIRPath(expression string) ([]fhirPathStep, error) {
+	p := &fhirPathParser{expression: expression}
+	err := p.tokenize()
+	if err != nil {
+		return nil, err
+	}
+	steps, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected %s", p.tokens[p.pos])
+	}
+	return steps, nil
+}
+
+// tokenize splits the expression into identifiers, string and number literals, and symbols.
+func (p *fhirPathParser) tokenize() error {
+	s := p.expression
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ':
+			i++
+		case strings.IndexByte(".[]()=", c) >= 0:
+			p.tokens = append(p.tokens, s[i:i+1])
+			i++
+		case c == '!' && strings.HasPrefix(s[i:], "!="):
+			p.tokens = append(p.tokens, "!=")
+			i += 2
+		case c == '\'':
+			// Quotes and backslashes in strings are escaped with a backslash.
+			end := i + 1
+			for end < len(s) && s[end] != '\'' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return p.errorf("unterminated string")
+			}
+			p.tokens = append(p.tokens, s[i:end+1])
+			i = end + 1
+		case c == '-' || unicode.IsDigit(rune(c)):
+			start := i
+			i++
+			for i < len(s) && (unicode.IsDigit(rune(s[i])) || s[i] == '.' && i+1 < len(s) && unicode.IsDigit(rune(s[i+1]))) {
+				i++
+			}
+			p.tokens = append(p.tokens, s[start:i])
+		case c == '_' || unicode.IsLetter(rune(c)):
+			start := i
+			for i < len(s) && (s[i] == '_' || unicode.IsLetter(rune(s[i])) || unicode.IsDigit(rune(s[i]))) {
+				i++
+			}
+			p.tokens = append(p.tokens, s[start:i])
+		default:
+			return p.errorf("unexpected %c", c)
+		}
+	}
+	return nil
+}
+
+// parsePath parses steps separated by dots.
+func (p *fhirPathParser) parsePath() ([]fhirPathStep, error) {
+	var steps []fhirPathStep
+	for {
+		step, err := p.parseStep()
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+		if !p.accept(".") {
+			return steps, nil
+		}
+	}
+}
+
+// parseStep parses an element name or function call, and any indexers after it.
+func (p *fhirPathParser) parseStep() (step fhirPathStep, err error) {
+	step.name = p.next()
+	if step.name == "" || !(step.name[0] == '_' || unicode.IsLetter(rune(step.name[0]))) {
+		return step, p.errorf("expected an element name")
+	}
+
+	if p.accept("(") {
+		step.function = true
+		if step.name == "where" {
+			step.criteria, err = p.parseCriteria()
+			if err != nil {
+				return step, err
+			}
+		}
+		if !p.accept(")") {
+			return step, p.errorf("expected ) after %s(", step.name)
+		}
+	}
+
+	for p.accept("[") {
+		index, err := strconv.Atoi(p.next())
+		if err != nil || !p.accept("]") {
+			return step, p.errorf("expected an integer index")
+		}
+		step.indexes = append(step.indexes, index)
+	}
+	return step, nil
+}
+
+// parseCriteria parses the argument to where().
+func (p *fhirPathParser) parseCriteria() (*fhirPathCriteria, error) {
+	steps, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	criteria := &fhirPathCriteria{steps: steps}
+	if !p.accept("=") {
+		if !p.accept("!=") {
+			return criteria, nil
+		}
+		criteria.operator = "!="
+	} else {
+		criteria.operator = "="
+	}
+
+	token := p.next()
+	switch {
+	case len(token) >= 2 && token[0] == '\'':
+		criteria.literal = fhirPathUnescaper.Replace(token[1 : len(token)-1])
+	case token == "true" || token == "false":
+		criteria.literal = token == "true"
+	default:
+		number, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, p.errorf("expected a literal after %s", criteria.operator)
+		}
+		criteria.literal = number
+	}
+	return criteria, nil
+}
+
+// next returns the next token, or "" at the end of the expression.
+func (p *fhirPathParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	p.pos++
+	return p.tokens[p.pos-1]
+}
+
+// accept consumes the next token if it's the one given.
+func (p *fhirPathParser) accept(token string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos] == token {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *fhirPathParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Invalid FHIRPath expression %s: %s", p.expression, fmt.Sprintf(format, args...))
+}
+
+// ApplyFHIRPathPatch applies a FHIRPath Patch, a Parameters resource of "operation"
+// parameters, to a resource decoded from JSON. Only replace operations are supported, and
+// each path must select exactly one element of the resource. Invalid patches are
+// PatchErrors, and the resource may be partly patched when one is returned.
+func ApplyFHIRPathPatch(resource map[string]interface{}, patch map[string]interface{}) error {
+	parameters, _ := patch["parameter"].([]interface{})
+	if len(parameters) == 0 {
+		return &PatchError{Message: "FHIRPath Patch has no operations"}
+	}
+
+	for _, p := range parameters {
+		parameter, _ := p.(map[string]interface{})
+		if parameter["name"] != "operation" {
+			return &PatchError{Message: fmt.Sprintf("FHIRPath Patch parameter %v is not an operation", parameter["name"])}
+		}
+
+		var opType, path string
+		var value interface{}
+		parts, _ := parameter["part"].([]interface{})
+		for _, pt := range parts {
+			part, _ := pt.(map[string]interface{})
+			switch part["name"] {
+			case "type":
+				opType, _ = part["valueCode"].(string)
+			case "path":
+				path, _ = part["valueString"].(string)
+			case "value":
+				for key, v := range part {
+					if strings.HasPrefix(key, "value") {
+						value = v
+					}
+				}
+			}
+		}
+
+		if opType != "replace" {
+			return &PatchError{Message: fmt.Sprintf("FHIRPath Patch operation type %q is not supported, only replace is", opType)}
+		}
+		if path == "" || value == nil {
+			return &PatchError{Message: "FHIRPath Patch replace operations need a path and a value"}
+		}
+		err := ReplaceFHIRPath(resource, path, value)
+		if err != nil {
+			return &PatchError{Message: err.Error()}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package fhirutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type FHIRPathTestSuite struct {
+	suite.Suite
+	Patient map[string]interface{}
+}
+
+func TestFHIRPathTestSuite(t *testing.T) {
+	suite.Run(t, new(FHIRPathTestSuite))
+}
+
+func (f *FHIRPathTestSuite) SetupTest() {
+	patient, err := UnmarshalJSONResource([]byte(`{
+		"resourceType": "Patient",
+		"id": "123",
+		"active": true,
+		"name": [
+			{"use": "official", "family": "Abbott", "given": ["Lowell", "Quincy"]},
+			{"use": "nickname", "given": ["Low"]}
+		],
+		"birthDate": "1950-09-02",
+		"_birthDate": {"extension": [{"url": "http://example.com/birthTime", "valueDateTime": "1950-09-02T16:09:32Z"}]},
+		"address": [{"line": ["123 Main St"], "_line": [{"id": "line1"}]}],
+		"deceasedBoolean": false,
+		"extension": [
+			{"url": "http://hl7.org/fhir/us/core/StructureDefinition/us-core-birthsex", "valueCode": "M"},
+			{"url": "http://example.com/score", "valueDecimal": 4.5}
+		]
+	}`))
+	f.NoError(err)
+	f.Patient = patient
+}
+
+func (f *FHIRPathTestSuite) evaluate(expression string) []interface{} {
+	values, err := EvaluateFHIRPath(f.Patient, expression)
+	f.NoError(err)
+	return values
+}
+
+func (f *FHIRPathTestSuite) TestNavigation() {
+	f.Equal([]interface{}{"Abbott"}, f.evaluate("Patient.name.family"))
+	f.Equal([]interface{}{"Lowell", "Quincy", "Low"}, f.evaluate("Patient.name.given"))
+	f.Equal([]interface{}{"Quincy"}, f.evaluate("Patient.name[0].given[1]"))
+	f.Equal([]interface{}{"1950-09-02"}, f.evaluate("birthDate"))
+	f.Equal([]interface{}{true}, f.evaluate("Patient.active"))
+	f.Empty(f.evaluate("Patient.name[2]"))
+	f.Empty(f.evaluate("Patient.maritalStatus"))
+
+	// Other resource types select nothing.
+	f.Empty(f.evaluate("Observation.status"))
+}
+
+func (f *FHIRPathTestSuite) TestChoiceElements() {
+	f.Equal([]interface{}{false}, f.evaluate("Patient.deceased"))
+	f.Equal([]interface{}{"M", 4.5}, f.evaluate("Patient.extension.value"))
+}
+
+func (f *FHIRPathTestSuite) TestPrimitiveExtensions() {
+	f.Equal([]interface{}{"1950-09-02T16:09:32Z"}, f.evaluate("Patient.birthDate.extension.valueDateTime"))
+	f.Equal([]interface{}{"line1"}, f.evaluate("Patient.address[0].line[0].id"))
+}
+
+func (f *FHIRPathTestSuite) TestWhere() {
+	f.Equal([]interface{}{"M"}, f.evaluate("Patient.extension.where(url = 'http://hl7.org/fhir/us/core/StructureDefinition/us-core-birthsex').valueCode"))
+	f.Equal([]interface{}{"Low"}, f.evaluate("Patient.name.where(use != 'official').given"))
+	f.Equal([]interface{}{"http://example.com/score"}, f.evaluate("Patient.extension.where(valueDecimal = 4.5).url"))
+	f.Equal([]interface{}{"Abbott"}, f.evaluate("Patient.name.where(family).family"))
+	f.Empty(f.evaluate("Patient.name.where(use = 'maiden')"))
+}
+
+func (f *FHIRPathTestSuite) TestEscapedStrings() {
+	f.Patient["extension"] = append(f.Patient["extension"].([]interface{}), map[string]interface{}{
+		"url":         `http://example.com/it's\here`,
+		"valueString": "escaped",
+	})
+	expression := "Patient.extension.where(url = " + FHIRPathString(`http://example.com/it's\here`) + ").valueString"
+	f.Equal(`Patient.extension.where(url = 'http://example.com/it\'s\\here').valueString`, expression)
+	f.Equal([]interface{}{"escaped"}, f.evaluate(expression))
+}
+
+func (f *FHIRPathTestSuite) TestFunctions() {
+	f.Equal([]interface{}{"Lowell"}, f.evaluate("Patient.name.given.first()"))
+	f.Equal([]interface{}{"Low"}, f.evaluate("Patient.name.given.last()"))
+	f.Equal([]interface{}{true}, f.evaluate("Patient.name.exists()"))
+	f.Equal([]interface{}{false}, f.evaluate("Patient.photo.exists()"))
+	f.Equal([]interface{}{float64(3)}, f.evaluate("Patient.name.given.count()"))
+}
+
+func (f *FHIRPathTestSuite) TestInvalidExpressions() {
+	_, err := EvaluateFHIRPath(f.Patient, "Patient.name.given.distinct()")
+	f.Equal("Unsupported FHIRPath function distinct()", err.Error())
+
+	_, err = EvaluateFHIRPath(f.Patient, "Patient.name[first]")
+	f.Equal("Invalid FHIRPath expression Patient.name[first]: expected an integer index", err.Error())
+
+	_, err = EvaluateFHIRPath(f.Patient, "Patient.name.where(use = 'official'")
+	f.Equal("Invalid FHIRPath expression Patient.name.where(use = 'official': expected ) after where(", err.Error())
+
+	_, err = EvaluateFHIRPath(f.Patient, "Patient.name | Patient.address")
+	f.Equal("Invalid FHIRPath expression Patient.name | Patient.address: unexpected |", err.Error())
+}
+
+func (f *FHIRPathTestSuite) TestReplace() {
+	f.NoError(ReplaceFHIRPath(f.Patient, "Patient.name.where(use = 'official').given[1]", "Q."))
+	f.Equal([]interface{}{"Lowell", "Q.", "Low"}, f.evaluate("Patient.name.given"))
+
+	f.NoError(ReplaceFHIRPath(f.Patient, "birthDate", "1950-09-03"))
+	f.Equal([]interface{}{"1950-09-03"}, f.evaluate("Patient.birthDate"))
+	// The primitive's extensions are kept.
+	f.Equal([]interface{}{"1950-09-02T16:09:32Z"}, f.evaluate("Patient.birthDate.extension.valueDateTime"))
+
+	f.NoError(ReplaceFHIRPath(f.Patient, "Patient.name.last()", map[string]interface{}{"use": "nickname", "given": []interface{}{"Q"}}))
+	f.Equal([]interface{}{"Lowell", "Q.", "Q"}, f.evaluate("Patient.name.given"))
+
+	err := ReplaceFHIRPath(f.Patient, "Patient.name.given", "Lowell")
+	f.Equal("FHIRPath expression Patient.name.given selects 3 elements, rather than one element", err.Error())
+	err = ReplaceFHIRPath(f.Patient, "Patient.maritalStatus", "M")
+	f.Equal("FHIRPath expression Patient.maritalStatus selects 0 elements, rather than one element", err.Error())
+	err = ReplaceFHIRPath(f.Patient, "Patient.name.exists()", false)
+	f.Equal("FHIRPath expression Patient.name.exists() does not select an element that can be replaced", err.Error())
+	err = ReplaceFHIRPath(f.Patient, "Observation.status", "final")
+	f.Equal("FHIRPath expression Observation.status does not select an element of a Patient", err.Error())
+	err = ReplaceFHIRPath(f.Patient, "Patient", "")
+	f.Equal("FHIRPath expression Patient selects the resource itself, not one of its elements", err.Error())
+}
+
+func (f *FHIRPathTestSuite) TestApplyFHIRPathPatch() {
+	patch, err := UnmarshalJSONResource([]byte(`{
+		"resourceType": "Parameters",
+		"parameter": [
+			{"name": "operation", "part": [
+				{"name": "type", "valueCode": "replace"},
+				{"name": "path", "valueString": "Patient.birthDate"},
+				{"name": "value", "valueDate": "1950-09-03"}
+			]},
+			{"name": "operation", "part": [
+				{"name": "type", "valueCode": "replace"},
+				{"name": "path", "valueString": "Patient.name[0].family"},
+				{"name": "value", "valueString": "Abbot"}
+			]}
+		]
+	}`))
+	f.NoError(err)
+	f.NoError(ApplyFHIRPathPatch(f.Patient, patch))
+	f.Equal([]interface{}{"1950-09-03"}, f.evaluate("Patient.birthDate"))
+	f.Equal([]interface{}{"Abbot"}, f.evaluate("Patient.name.family"))
+
+	patch, err = UnmarshalJSONResource([]byte(`{
+		"resourceType": "Parameters",
+		"parameter": [
+			{"name": "operation", "part": [
+				{"name": "type", "valueCode": "delete"},
+				{"name": "path", "valueString": "Patient.birthDate"}
+			]}
+		]
+	}`))
+	f.NoError(err)
+	err = ApplyFHIRPathPatch(f.Patient, patch)
+	f.IsType(&PatchError{}, err)
+	f.Equal(`FHIRPath Patch operation type "delete" is not supported, only replace is`, err.Error())
+
+	err = ApplyFHIRPathPatch(f.Patient, map[string]interface{}{"resourceType": "Parameters"})
+	f.Equal("FHIRPath Patch has no operations", err.Error())
+}
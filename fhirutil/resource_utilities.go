@@ -14,16 +14,28 @@ import (
 
 // GetResourceID returns the string equivalent of a FHIR resource ID.
 func GetResourceID(resource interface{}) string {
+	if object, ok := resource.(map[string]interface{}); ok {
+		id, _ := object["id"].(string)
+		return id
+	}
 	return reflect.ValueOf(resource).Elem().FieldByName("Id").String()
 }
 
 // SetResourceID sets or updates the Id for a FHIR resource.
 func SetResourceID(resource interface{}, newID string) {
+	if object, ok := resource.(map[string]interface{}); ok {
+		object["id"] = newID
+		return
+	}
 	reflect.ValueOf(resource).Elem().FieldByName("Id").SetString(newID)
 }
 
 // GetResourceType returns the string equivalent of a FHIR resource type.
 func GetResourceType(resource interface{}) string {
+	if object, ok := resource.(map[string]interface{}); ok {
+		resourceType, _ := object["resourceType"].(string)
+		return resourceType
+	}
 	val := reflect.ValueOf(resource)
 	if val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
 		return val.Elem().FieldByName("ResourceType").String()
@@ -47,64 +59,66 @@ func JSONGetResourceType(obj []byte) string {
 	return s
 }
 
-// GetResourceByURL GETs a FHIR resource from it's specified URL.
+// GetResourceByURL GETs a FHIR resource from it's specified URL. The resource is
+// unmarshaled for the version of the FHIR server it's on (see URLVersion).
 func GetResourceByURL(resourceType, resourceURL string) (resource interface{}, err error) {
 	// Make the request.
 	res, err := http.Get(resourceURL)
 	if err != nil {
-		return nil, err
+		return nil, &UpstreamError{Message: fmt.Sprintf("Failed to request resource %s", resourceURL), Err: err}
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode == 404 {
-		return nil, fmt.Errorf("Resource %s not found", resourceURL)
-	}
-
-	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("An unexpected error occured while requesting resource %s", resourceURL)
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res, resourceURL, fmt.Sprintf("An unexpected error occured while requesting resource %s", resourceURL))
 	}
 
 	// Unmarshal the resource returned.
-	resource = models.NewStructForResourceName(resourceType)
-	body, err := ioutil.ReadAll(res.Body)
+	return readResource(res, URLVersion(resourceURL).Unmarshal, resourceType, resourceURL)
+}
+
+// GetJSONBundle GETs a FHIR bundle from it's specified URL. Unlike GetResourceByURL, the
+// resources in the bundle's entries are generic JSON objects, whatever the version of FHIR,
+// so none of their elements (e.g. extensions the models don't have) are lost.
+func GetJSONBundle(bundleURL string) (bundle *models.Bundle, err error) {
+	// Make the request.
+	res, err := http.Get(bundleURL)
 	if err != nil {
-		return nil, err
+		return nil, &UpstreamError{Message: fmt.Sprintf("Failed to request resource %s", bundleURL), Err: err}
 	}
-	err = json.Unmarshal(body, &resource)
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res, bundleURL, fmt.Sprintf("An unexpected error occured while requesting resource %s", bundleURL))
+	}
+
+	// Unmarshal the bundle returned.
+	resource, err := readResource(res, func(data []byte, _ string) (interface{}, error) {
+		return unmarshalJSONBundle(data)
+	}, "Bundle", bundleURL)
 	if err != nil {
 		return nil, err
 	}
-	return resource, nil
+	return resource.(*models.Bundle), nil
 }
 
 // GetResource GETs a FHIR resource of a specified resourceType from the host provided.
 func GetResource(host, resourceType, resourceID string) (resource interface{}, err error) {
+	name := resourceType + ":" + resourceID
+
 	// Make the request.
 	res, err := http.Get(host + "/" + resourceType + "/" + resourceID)
 	if err != nil {
-		return nil, err
+		return nil, &UpstreamError{Message: fmt.Sprintf("Failed to request resource %s", name), Err: err}
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode == http.StatusNotFound {
-		return nil, fmt.Errorf("Resource %s:%s not found", resourceType, resourceID)
-	}
-
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("An unexpected error occured while requesting resource %s:%s", resourceType, resourceID)
+		return nil, responseError(res, name, fmt.Sprintf("An unexpected error occured while requesting resource %s", name))
 	}
 
 	// Unmarshal the resource returned.
-	resource = models.NewStructForResourceName(resourceType)
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
-	}
-	err = json.Unmarshal(body, &resource)
-	if err != nil {
-		return nil, err
-	}
-	return resource, nil
+	return readResource(res, HostVersion(host).Unmarshal, resourceType, name)
 }
 
 // PostResource POSTs a FHIR resource of a specified resourceType to the host provided.
@@ -116,24 +130,14 @@ func PostResource(host, resourceType string, resource interface{}) (created inte
 
 	res, err := http.Post(host+"/"+resourceType, "application/fhir+json", bytes.NewBuffer(data))
 	if err != nil {
-		return nil, err
+		return nil, &UpstreamError{Message: fmt.Sprintf("Failed to create resource %s", resourceType), Err: err}
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("Failed to create resource %s", resourceType)
-	}
-
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
-	}
-	created = models.NewStructForResourceName(resourceType)
-	err = json.Unmarshal(body, &created)
-	if err != nil {
-		return nil, err
+		return nil, &UpstreamError{Message: fmt.Sprintf("Failed to create resource %s", resourceType), StatusCode: res.StatusCode}
 	}
-	return created, nil
+	return readResource(res, HostVersion(host).Unmarshal, resourceType, resourceType)
 }
 
 // UpdateResource PUTs a FHIR resource of a specified resourceType on the host provided, updating the resource.
@@ -145,34 +149,26 @@ func UpdateResource(host, resourceType string, resource interface{}) (updatedRes
 	}
 
 	resourceID := GetResourceID(resource)
+	name := resourceType + ":" + resourceID
 
 	req, err := http.NewRequest("PUT", host+"/"+resourceType+"/"+resourceID, bytes.NewReader(data))
-	req.Header.Set("Content-Type", "application/fhir+json")
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/fhir+json")
 
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, &UpstreamError{Message: fmt.Sprintf("Failed to update resource %s", name), Err: err}
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Failed to update resource %s:%s", resourceType, resourceID)
+		return nil, responseError(res, name, fmt.Sprintf("Failed to update resource %s", name))
 	}
 
 	// Unmarshal the resource returned.
-	updatedResource = models.NewStructForResourceName(resourceType)
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
-	}
-	err = json.Unmarshal(body, &updatedResource)
-	if err != nil {
-		return nil, err
-	}
-	return updatedResource, nil
+	return readResource(res, HostVersion(host).Unmarshal, resourceType, name)
 }
 
 // DeleteResourceByURL DELETEs a FHIR resource at the specified URL.
@@ -184,12 +180,12 @@ func DeleteResourceByURL(resourceURL string) error {
 
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return err
+		return &UpstreamError{Message: fmt.Sprintf("Resource %s was not deleted", resourceURL), Err: err}
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("Resource %s was not deleted", resourceURL)
+		return responseError(res, resourceURL, fmt.Sprintf("Resource %s was not deleted", resourceURL))
 	}
 	return nil
 }
@@ -201,21 +197,38 @@ func DeleteResource(host, resourceType, resourceID string) error {
 		return err
 	}
 
+	name := resourceType + ":" + resourceID
+
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return err
+		return &UpstreamError{Message: fmt.Sprintf("Resource %s was not deleted", name), Err: err}
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("Resource %s:%s was not deleted", resourceType, resourceID)
+		return responseError(res, name, fmt.Sprintf("Resource %s was not deleted", name))
 	}
 	return nil
 }
 
+// readResource unmarshals the resource in a FHIR server's response, usually with the
+// server's version of FHIR. If the response can't be read, an UpstreamError is returned.
+func readResource(res *http.Response, unmarshal func([]byte, string) (interface{}, error), resourceType, name string) (resource interface{}, err error) {
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, &UpstreamError{Message: fmt.Sprintf("Failed to read resource %s", name), StatusCode: res.StatusCode, Err: err}
+	}
+	resource, err = unmarshal(body, resourceType)
+	if err != nil {
+		return nil, &UpstreamError{Message: fmt.Sprintf("Resource %s is not valid %s JSON", name, resourceType), StatusCode: res.StatusCode, Err: err}
+	}
+	return resource, nil
+}
+
 // OperationOutcome creates a new OperatioOutcome detailing all conflicts
-// in the target resource, identified by its targetResourceID.
-func OperationOutcome(targetResourceType, targetResourceID string, conflictPaths []string) (oo *models.OperationOutcome) {
+// in the target resource, identified by its targetResourceID. The conflicts
+// are given as FHIRPath expressions (see EvaluateFHIRPath).
+func OperationOutcome(targetResourceType, targetResourceID string, expressions []string) (oo *models.OperationOutcome) {
 	oo = &models.OperationOutcome{
 		DomainResource: models.DomainResource{
 			Resource: models.Resource{
@@ -229,14 +242,27 @@ func OperationOutcome(targetResourceType, targetResourceID string, conflictPaths
 				Code:     "conflict",
 				// The target resource type and ID are stored as additional diagnostic information.
 				Diagnostics: targetResourceType + ":" + targetResourceID,
-				// Paths in the resource with conflicts, as a JSON path rather than XPath.
-				Location: conflictPaths,
+				// Elements in the resource with conflicts, e.g. Patient.address[0].line[0].
+				// Location is deprecated in favor of Expression, but is kept for clients that
+				// still read it.
+				Expression: expressions,
+				Location:   expressions,
 			},
 		},
 	}
 	return oo
 }
 
+// ResourcesOfType returns all resources of the given resourceType in a bundle.
+func ResourcesOfType(bundle *models.Bundle, resourceType string) (resources []interface{}) {
+	for _, entry := range bundle.Entry {
+		if GetResourceType(entry.Resource) == resourceType {
+			resources = append(resources, entry.Resource)
+		}
+	}
+	return resources
+}
+
 // TransactionBundle creates a new Bundle of resources for
 // transaction with the host FHIR server.
 func TransactionBundle(resources []interface{}) (bundle *models.Bundle) {
@@ -306,6 +332,15 @@ func LoadResource(resourceType, filepath string) (resource interface{}, err erro
 	return resource, nil
 }
 
+// LoadVersionResource unmarshals a resource from a file for the given version of FHIR.
+func LoadVersionResource(version Version, resourceType, filepath string) (resource interface{}, err error) {
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	return version.Unmarshal(data, resourceType)
+}
+
 // LoadAndPostResource loads a resource from a fixture and immediately POSTs it,
 // returning the resource that was created.
 func LoadAndPostResource(host, resourceType, filepath string) (created interface{}, err error) {
@@ -120,6 +120,31 @@ func (f *FHIRUtilTestSuite) TestGetResourceByURL() {
 	}
 }
 
+func (f *FHIRUtilTestSuite) TestGetJSONBundle() {
+	fixture, err := LoadResource("Bundle", "../fixtures/bundles/clint_abbott_bundle.json")
+	f.NoError(err)
+	put, err := PostResource(f.FHIRServer.URL, "Bundle", fixture)
+	f.NoError(err)
+	putBundle, ok := put.(*models.Bundle)
+	f.True(ok)
+
+	gotBundle, err := GetJSONBundle(f.FHIRServer.URL + "/Bundle/" + putBundle.Id)
+	f.NoError(err)
+	f.Equal(putBundle.Id, gotBundle.Id)
+	f.Equal(len(putBundle.Entry), len(gotBundle.Entry))
+
+	// The resources are generic JSON objects.
+	for _, entry := range gotBundle.Entry {
+		resource, ok := entry.Resource.(map[string]interface{})
+		f.True(ok)
+		if GetResourceType(resource) == "Patient" {
+			name := resource["name"].([]interface{})[0].(map[string]interface{})
+			f.Equal("Clint", name["given"].([]interface{})[0])
+			f.Equal("Abbott", name["family"])
+		}
+	}
+}
+
 func (f *FHIRUtilTestSuite) TestGetResource() {
 	fixture, err := LoadResource("OperationOutcome", "../fixtures/operation_outcomes/oo_0.json")
 	f.NoError(err)
@@ -217,3 +242,26 @@ func (f *FHIRUtilTestSuite) TestLoadAndPostResource() {
 	f.True(ok)
 	f.Len(bundle.Entry, 7)
 }
+
+func (f *FHIRUtilTestSuite) TestOperationOutcome() {
+	oo := OperationOutcome("Patient", "123", []string{"Patient.gender", "Patient.birthDate"})
+	f.Len(oo.Issue, 1)
+	f.Equal("Patient:123", oo.Issue[0].Diagnostics)
+	f.Equal([]string{"Patient.gender", "Patient.birthDate"}, oo.Issue[0].Expression)
+	f.Equal([]string{"Patient.gender", "Patient.birthDate"}, oo.Issue[0].Location)
+}
+
+func (f *FHIRUtilTestSuite) TestResourcesOfType() {
+	resource, err := LoadResource("Bundle", "../fixtures/bundles/lowell_abbott_bundle.json")
+	f.NoError(err)
+	bundle, ok := resource.(*models.Bundle)
+	f.True(ok)
+
+	patients := ResourcesOfType(bundle, "Patient")
+	f.Len(patients, 1)
+	_, ok = patients[0].(*models.Patient)
+	f.True(ok)
+
+	f.Len(ResourcesOfType(bundle, "Encounter"), 2)
+	f.Len(ResourcesOfType(bundle, "Observation"), 0)
+}
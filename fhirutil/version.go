@@ -0,0 +1,313 @@
+package fhirutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// Version is a release of FHIR that ptmerge can merge resources from. STU3 resources are
+// unmarshaled into the intervention-engine/fhir models. There are no models for R4, so R4
+// resources are unmarshaled into generic JSON objects (map[string]interface{}) instead.
+// Resources being merged are always generic JSON objects (see GetJSONBundle).
+type Version interface {
+	// Name returns the name of the release, e.g. "STU3".
+	Name() string
+	// IsResourceType reports whether resourceType is a resource in the release.
+	IsResourceType(resourceType string) bool
+	// Unmarshal unmarshals a resource of the given type from JSON.
+	Unmarshal(data []byte, resourceType string) (resource interface{}, err error)
+}
+
+var (
+	// STU3 is FHIR STU3 (3.0).
+	STU3 Version = stu3{}
+
+	// R4 is FHIR R4 (4.0).
+	R4 Version = r4{}
+
+	// DefaultVersion is the version of FHIR servers whose version isn't set with
+	// SetHostVersion and can't be detected.
+	DefaultVersion = STU3
+)
+
+// ParseVersion returns the FHIR version with the given name (e.g. "R4"), or for the given
+// fhirVersion from a CapabilityStatement (e.g. "4.0.1").
+func ParseVersion(name string) (Version, error) {
+	switch {
+	case strings.EqualFold(name, "STU3"), strings.HasPrefix(name, "3.0"):
+		return STU3, nil
+	case strings.EqualFold(name, "R4"), strings.HasPrefix(name, "4.0"):
+		return R4, nil
+	default:
+		return nil, fmt.Errorf("Unsupported FHIR version %s, must be STU3 or R4", name)
+	}
+}
+
+// hostVersions caches the FHIR version of each FHIR server, by base URL.
+var hostVersions = struct {
+	sync.RWMutex
+	versions map[string]Version
+}{versions: make(map[string]Version)}
+
+// SetHostVersion sets the FHIR version of the FHIR server at host, rather than detecting it.
+func SetHostVersion(host string, version Version) {
+	hostVersions.Lock()
+	defer hostVersions.Unlock()
+	hostVersions.versions[strings.TrimRight(host, "/")] = version
+}
+
+// HostVersion returns the FHIR version of the FHIR server at host. Unless it was set with
+// SetHostVersion, the version is detected from the fhirVersion in the server's
+// CapabilityStatement (GET [host]/metadata). Servers that respond without a supported
+// fhirVersion are DefaultVersion. Servers that can't be reached are also DefaultVersion,
+// but are asked again next time.
+func HostVersion(host string) Version {
+	host = strings.TrimRight(host, "/")
+
+	hostVersions.RLock()
+	version, ok := hostVersions.versions[host]
+	hostVersions.RUnlock()
+	if ok {
+		return version
+	}
+
+	version, err := detectVersion(host)
+	if err != nil {
+		return DefaultVersion
+	}
+	SetHostVersion(host, version)
+	return version
+}
+
+// URLVersion returns the FHIR version of the FHIR server a resource URL is on.
+func URLVersion(resourceURL string) Version {
+	return HostVersion(BaseURL(resourceURL))
+}
+
+// BaseURL returns the base URL of the FHIR server a resource URL is on, e.g.
+// http://example.com/fhir for http://example.com/fhir/Bundle/123/_history/2.
+func BaseURL(resourceURL string) string {
+	u, err := url.Parse(resourceURL)
+	if err != nil {
+		return resourceURL
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i, segment := range segments {
+		if segment == "_history" {
+			segments = segments[:i]
+			break
+		}
+	}
+	// Drop the resource type and ID.
+	if len(segments) >= 2 {
+		segments = segments[:len(segments)-2]
+	}
+	u.Path = ""
+	if len(segments) > 0 && segments[0] != "" {
+		u.Path = "/" + strings.Join(segments, "/")
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// detectVersion requests the CapabilityStatement of the FHIR server at host to find its
+// version. An error is only returned if the server couldn't be reached.
+func detectVersion(host string) (Version, error) {
+	req, err := http.NewRequest("GET", host+"/metadata", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/fhir+json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return DefaultVersion, nil
+	}
+	metadata := struct {
+		FHIRVersion string `json:"fhirVersion"`
+	}{}
+	if json.NewDecoder(res.Body).Decode(&metadata) != nil {
+		return DefaultVersion, nil
+	}
+	version, err := ParseVersion(metadata.FHIRVersion)
+	if err != nil {
+		return DefaultVersion, nil
+	}
+	return version, nil
+}
+
+type stu3 struct{}
+
+func (stu3) Name() string {
+	return "STU3"
+}
+
+func (stu3) IsResourceType(resourceType string) bool {
+	return models.StructForResourceName(resourceType) != nil
+}
+
+func (stu3) Unmarshal(data []byte, resourceType string) (interface{}, error) {
+	resource := models.NewStructForResourceName(resourceType)
+	if resource == nil {
+		return nil, fmt.Errorf("Unknown STU3 resource type %s", resourceType)
+	}
+	err := json.Unmarshal(data, &resource)
+	if err != nil {
+		return nil, err
+	}
+	return resource, nil
+}
+
+type r4 struct{}
+
+func (r4) Name() string {
+	return "R4"
+}
+
+func (r4) IsResourceType(resourceType string) bool {
+	return r4ResourceTypes[resourceType]
+}
+
+// Unmarshal unmarshals R4 resources into generic JSON objects. Bundles and
+// OperationOutcomes, which ptmerge itself creates and reads, are the same in STU3 and R4,
+// so they are unmarshaled into the STU3 models. The resources in a bundle's entries are
+// still generic JSON objects.
+func (r4) Unmarshal(data []byte, resourceType string) (interface{}, error) {
+	switch {
+	case resourceType == "Bundle":
+		return unmarshalJSONBundle(data)
+	case resourceType == "OperationOutcome":
+		return STU3.Unmarshal(data, resourceType)
+	case !r4ResourceTypes[resourceType]:
+		return nil, fmt.Errorf("Unknown R4 resource type %s", resourceType)
+	}
+	return UnmarshalJSONResource(data)
+}
+
+// UnmarshalJSONResource unmarshals a resource of any type or version of FHIR into a generic
+// JSON object, so none of its elements are lost.
+func UnmarshalJSONResource(data []byte) (map[string]interface{}, error) {
+	var resource map[string]interface{}
+	err := json.Unmarshal(data, &resource)
+	if err != nil {
+		return nil, err
+	}
+	if resource == nil {
+		return nil, fmt.Errorf("Resource is not a JSON object")
+	}
+	return resource, nil
+}
+
+// unmarshalJSONBundle unmarshals a bundle into the STU3 model, leaving the resources in its
+// entries as generic JSON objects. Bundles are the same in STU3 and R4.
+func unmarshalJSONBundle(data []byte) (*models.Bundle, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, err
+	}
+	var resourceType string
+	json.Unmarshal(fields["resourceType"], &resourceType)
+	if resourceType != "Bundle" {
+		return nil, fmt.Errorf("Expected resourceType to be Bundle, instead received %s", resourceType)
+	}
+
+	// The STU3 model would unmarshal the entries' resources into STU3 models, so the
+	// entries are unmarshaled separately.
+	var entries []map[string]json.RawMessage
+	if raw, ok := fields["entry"]; ok {
+		err = json.Unmarshal(raw, &entries)
+		if err != nil {
+			return nil, err
+		}
+		delete(fields, "entry")
+	}
+
+	bundle := &models.Bundle{}
+	if err = remarshal(fields, bundle); err != nil {
+		return nil, err
+	}
+
+	for _, entryFields := range entries {
+		var resource map[string]interface{}
+		if raw, ok := entryFields["resource"]; ok {
+			err = json.Unmarshal(raw, &resource)
+			if err != nil {
+				return nil, err
+			}
+			delete(entryFields, "resource")
+		}
+
+		entry := models.BundleEntryComponent{}
+		if err = remarshal(entryFields, &entry); err != nil {
+			return nil, err
+		}
+		if resource != nil {
+			entry.Resource = resource
+		}
+		bundle.Entry = append(bundle.Entry, entry)
+	}
+	return bundle, nil
+}
+
+// remarshal unmarshals the JSON fields in from into to.
+func remarshal(from map[string]json.RawMessage, to interface{}) error {
+	data, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, to)
+}
+
+// r4ResourceTypes are all of the resource types in FHIR R4.
+var r4ResourceTypes = map[string]bool{
+	"Account": true, "ActivityDefinition": true, "AdverseEvent": true, "AllergyIntolerance": true,
+	"Appointment": true, "AppointmentResponse": true, "AuditEvent": true, "Basic": true,
+	"Binary": true, "BiologicallyDerivedProduct": true, "BodyStructure": true, "Bundle": true,
+	"CapabilityStatement": true, "CarePlan": true, "CareTeam": true, "CatalogEntry": true,
+	"ChargeItem": true, "ChargeItemDefinition": true, "Claim": true, "ClaimResponse": true,
+	"ClinicalImpression": true, "CodeSystem": true, "Communication": true, "CommunicationRequest": true,
+	"CompartmentDefinition": true, "Composition": true, "ConceptMap": true, "Condition": true,
+	"Consent": true, "Contract": true, "Coverage": true, "CoverageEligibilityRequest": true,
+	"CoverageEligibilityResponse": true, "DetectedIssue": true, "Device": true, "DeviceDefinition": true,
+	"DeviceMetric": true, "DeviceRequest": true, "DeviceUseStatement": true, "DiagnosticReport": true,
+	"DocumentManifest": true, "DocumentReference": true, "EffectEvidenceSynthesis": true, "Encounter": true,
+	"Endpoint": true, "EnrollmentRequest": true, "EnrollmentResponse": true, "EpisodeOfCare": true,
+	"EventDefinition": true, "Evidence": true, "EvidenceVariable": true, "ExampleScenario": true,
+	"ExplanationOfBenefit": true, "FamilyMemberHistory": true, "Flag": true, "Goal": true,
+	"GraphDefinition": true, "Group": true, "GuidanceResponse": true, "HealthcareService": true,
+	"ImagingStudy": true, "Immunization": true, "ImmunizationEvaluation": true, "ImmunizationRecommendation": true,
+	"ImplementationGuide": true, "InsurancePlan": true, "Invoice": true, "Library": true,
+	"Linkage": true, "List": true, "Location": true, "Measure": true,
+	"MeasureReport": true, "Media": true, "Medication": true, "MedicationAdministration": true,
+	"MedicationDispense": true, "MedicationKnowledge": true, "MedicationRequest": true, "MedicationStatement": true,
+	"MedicinalProduct": true, "MedicinalProductAuthorization": true, "MedicinalProductContraindication": true, "MedicinalProductIndication": true,
+	"MedicinalProductIngredient": true, "MedicinalProductInteraction": true, "MedicinalProductManufactured": true, "MedicinalProductPackaged": true,
+	"MedicinalProductPharmaceutical": true, "MedicinalProductUndesirableEffect": true, "MessageDefinition": true, "MessageHeader": true,
+	"MolecularSequence": true, "NamingSystem": true, "NutritionOrder": true, "Observation": true,
+	"ObservationDefinition": true, "OperationDefinition": true, "OperationOutcome": true, "Organization": true,
+	"OrganizationAffiliation": true, "Parameters": true, "Patient": true, "PaymentNotice": true,
+	"PaymentReconciliation": true, "Person": true, "PlanDefinition": true, "Practitioner": true,
+	"PractitionerRole": true, "Procedure": true, "Provenance": true, "Questionnaire": true,
+	"QuestionnaireResponse": true, "RelatedPerson": true, "RequestGroup": true, "ResearchDefinition": true,
+	"ResearchElementDefinition": true, "ResearchStudy": true, "ResearchSubject": true, "RiskAssessment": true,
+	"RiskEvidenceSynthesis": true, "Schedule": true, "SearchParameter": true, "ServiceRequest": true,
+	"Slot": true, "Specimen": true, "SpecimenDefinition": true, "StructureDefinition": true,
+	"StructureMap": true, "Subscription": true, "Substance": true, "SubstanceNucleicAcid": true,
+	"SubstancePolymer": true, "SubstanceProtein": true, "SubstanceReferenceInformation": true, "SubstanceSourceMaterial": true,
+	"SubstanceSpecification": true, "SupplyDelivery": true, "SupplyRequest": true, "Task": true,
+	"TerminologyCapabilities": true, "TestReport": true, "TestScript": true, "ValueSet": true,
+	"VerificationResult": true, "VisionPrescription": true,
+}
@@ -0,0 +1,135 @@
+package fhirutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/stretchr/testify/suite"
+)
+
+type VersionTestSuite struct {
+	suite.Suite
+	R4Server        *httptest.Server
+	UnknownServer   *httptest.Server
+	MetadataQueries int
+}
+
+func TestVersionTestSuite(t *testing.T) {
+	suite.Run(t, new(VersionTestSuite))
+}
+
+func (v *VersionTestSuite) SetupSuite() {
+	// The mock R4 server has a CapabilityStatement, and a bundle with one patient.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fhir/metadata", func(w http.ResponseWriter, r *http.Request) {
+		v.MetadataQueries++
+		w.Write([]byte(`{"resourceType": "CapabilityStatement", "fhirVersion": "4.0.1"}`))
+	})
+	mux.HandleFunc("/fhir/Bundle/123", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"resourceType": "Bundle",
+			"type": "collection",
+			"entry": [{
+				"fullUrl": "http://example.com/fhir/Patient/456",
+				"resource": {"resourceType": "Patient", "id": "456", "birthDate": "1950-09-02"}
+			}]
+		}`))
+	})
+	v.R4Server = httptest.NewServer(mux)
+
+	// The other server doesn't have a CapabilityStatement.
+	v.UnknownServer = httptest.NewServer(http.NotFoundHandler())
+}
+
+func (v *VersionTestSuite) TearDownSuite() {
+	v.R4Server.Close()
+	v.UnknownServer.Close()
+}
+
+func (v *VersionTestSuite) TestParseVersion() {
+	for name, expected := range map[string]Version{"STU3": STU3, "stu3": STU3, "3.0.1": STU3, "R4": R4, "4.0.1": R4} {
+		version, err := ParseVersion(name)
+		v.NoError(err)
+		v.Equal(expected, version)
+	}
+
+	_, err := ParseVersion("5.0.0")
+	v.Equal("Unsupported FHIR version 5.0.0, must be STU3 or R4", err.Error())
+}
+
+func (v *VersionTestSuite) TestBaseURL() {
+	v.Equal("http://example.com/fhir", BaseURL("http://example.com/fhir/Bundle/123"))
+	v.Equal("http://example.com/fhir", BaseURL("http://example.com/fhir/Bundle/123/_history/2"))
+	v.Equal("http://example.com", BaseURL("http://example.com/Bundle/123?_format=json"))
+}
+
+func (v *VersionTestSuite) TestHostVersion() {
+	// The version is detected once, then cached.
+	v.Equal(R4, HostVersion(v.R4Server.URL+"/fhir"))
+	queries := v.MetadataQueries
+	v.Equal(R4, HostVersion(v.R4Server.URL+"/fhir/"))
+	v.Equal(R4, URLVersion(v.R4Server.URL+"/fhir/Patient/456"))
+	v.Equal(queries, v.MetadataQueries)
+
+	v.Equal(DefaultVersion, HostVersion(v.UnknownServer.URL))
+
+	SetHostVersion(v.UnknownServer.URL+"/r4", R4)
+	v.Equal(R4, HostVersion(v.UnknownServer.URL+"/r4"))
+}
+
+func (v *VersionTestSuite) TestGetR4Bundle() {
+	resource, err := GetResourceByURL("Bundle", v.R4Server.URL+"/fhir/Bundle/123")
+	v.NoError(err)
+	bundle, ok := resource.(*models.Bundle)
+	v.True(ok)
+	v.Equal("collection", bundle.Type)
+
+	v.Len(bundle.Entry, 1)
+	v.Equal("http://example.com/fhir/Patient/456", bundle.Entry[0].FullUrl)
+	patient, ok := bundle.Entry[0].Resource.(map[string]interface{})
+	v.True(ok)
+	v.Equal("Patient", GetResourceType(patient))
+	v.Equal("456", GetResourceID(patient))
+	v.Equal("1950-09-02", patient["birthDate"])
+
+	SetResourceID(patient, "789")
+	v.Equal("789", GetResourceID(patient))
+}
+
+func (v *VersionTestSuite) TestR4Unmarshal() {
+	resource, err := R4.Unmarshal([]byte(`{"resourceType": "Observation", "status": "final"}`), "Observation")
+	v.NoError(err)
+	v.Equal(map[string]interface{}{"resourceType": "Observation", "status": "final"}, resource)
+
+	_, err = R4.Unmarshal([]byte(`{}`), "Foo")
+	v.Equal("Unknown R4 resource type Foo", err.Error())
+
+	v.True(R4.IsResourceType("ServiceRequest"))
+	v.False(R4.IsResourceType("ProcedureRequest"))
+}
+
+func (v *VersionTestSuite) TestUnmarshalJSONBundle() {
+	// Elements that aren't in the models, such as extensions on primitives, are kept.
+	bundle, err := unmarshalJSONBundle([]byte(`{
+		"resourceType": "Bundle",
+		"id": "123",
+		"type": "collection",
+		"entry": [{
+			"resource": {
+				"resourceType": "Patient",
+				"birthDate": "1950-09-02",
+				"_birthDate": {"extension": [{"url": "http://example.com/birthTime", "valueDateTime": "1950-09-02T16:09:32Z"}]}
+			}
+		}]
+	}`))
+	v.NoError(err)
+	v.Equal("123", bundle.Id)
+	v.Len(bundle.Entry, 1)
+	patient := bundle.Entry[0].Resource.(map[string]interface{})
+	v.Contains(patient, "_birthDate")
+
+	_, err = unmarshalJSONBundle([]byte(`{"resourceType": "Patient"}`))
+	v.Equal("Expected resourceType to be Bundle, instead received Patient", err.Error())
+}
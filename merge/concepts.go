@@ -0,0 +1,239 @@
+package merge
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// DisplaySimilarityThreshold is how similar the display text of two CodeableConcepts must be,
+// from 0 to 1, for them to match when none of their codes are equivalent. Similarity is the
+// share of words the texts have in common.
+var DisplaySimilarityThreshold = 0.75
+
+// coding is a code in a code system.
+type coding struct {
+	system string
+	code   string
+}
+
+// conceptMappings are the codings mapped to each other by the loaded ConceptMaps, in both
+// directions.
+var conceptMappings = map[coding]map[coding]bool{}
+
+// mappedEquivalences are the ConceptMap equivalences that count as the same concept when
+// matching. Codes that are disjoint or unmatched don't.
+var mappedEquivalences = map[string]bool{
+	"relatedto": true, "equivalent": true, "equal": true, "wider": true,
+	"subsumes": true, "narrower": true, "specializes": true, "inexact": true,
+}
+
+// LoadConceptMaps loads the FHIR ConceptMaps (or Bundles of them) in the JSON files in a
+// directory, replacing any loaded before. CodeableConcepts with codes the ConceptMaps map to
+// each other match, e.g. a SNOMED CT code and the ICD-10-CM code it maps to.
+func LoadConceptMaps(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	mappings := map[coding]map[coding]bool{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var resource map[string]interface{}
+		err = json.Unmarshal(data, &resource)
+		if err != nil {
+			return fmt.Errorf("Failed to load ConceptMaps from %s: %s", file, err.Error())
+		}
+		err = addConceptMappings(resource, mappings)
+		if err != nil {
+			return fmt.Errorf("Failed to load ConceptMaps from %s: %s", file, err.Error())
+		}
+	}
+	conceptMappings = mappings
+	return nil
+}
+
+// addConceptMappings adds the mappings in a ConceptMap, or in each ConceptMap in a Bundle.
+func addConceptMappings(resource map[string]interface{}, mappings map[coding]map[coding]bool) error {
+	switch resourceType, _ := resource["resourceType"].(string); resourceType {
+	case "Bundle":
+		entries, _ := resource["entry"].([]interface{})
+		for _, entry := range entries {
+			e, _ := entry.(map[string]interface{})
+			if r, ok := e["resource"].(map[string]interface{}); ok {
+				if err := addConceptMappings(r, mappings); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case "ConceptMap":
+	default:
+		return fmt.Errorf("Expected a ConceptMap or Bundle, instead received %s", resourceType)
+	}
+
+	groups, _ := resource["group"].([]interface{})
+	for _, g := range groups {
+		group, _ := g.(map[string]interface{})
+		sourceSystem, _ := group["source"].(string)
+		targetSystem, _ := group["target"].(string)
+		elements, _ := group["element"].([]interface{})
+		for _, el := range elements {
+			element, _ := el.(map[string]interface{})
+			sourceCode, _ := element["code"].(string)
+			targets, _ := element["target"].([]interface{})
+			for _, t := range targets {
+				target, _ := t.(map[string]interface{})
+				targetCode, _ := target["code"].(string)
+				equivalence, _ := target["equivalence"].(string)
+				if sourceCode == "" || targetCode == "" || !mappedEquivalences[equivalence] {
+					continue
+				}
+				addMapping(mappings, coding{sourceSystem, sourceCode}, coding{targetSystem, targetCode})
+				addMapping(mappings, coding{targetSystem, targetCode}, coding{sourceSystem, sourceCode})
+			}
+		}
+	}
+	return nil
+}
+
+func addMapping(mappings map[coding]map[coding]bool, from, to coding) {
+	if mappings[from] == nil {
+		mappings[from] = map[coding]bool{}
+	}
+	mappings[from][to] = true
+}
+
+// concept is a CodeableConcept found in a resource.
+type concept struct {
+	codings []coding
+	// texts are the concept's text and the display of each of its codings.
+	texts []string
+}
+
+// codeableConceptRegex matches the paths to the elements of the codings in a CodeableConcept,
+// capturing the path to the CodeableConcept and the index of the coding.
+var codeableConceptRegex = regexp.MustCompile(`^(.+)\.coding\[(\d+)\]\.(system|code|display)$`)
+
+// compareConcepts compares the CodeableConcepts two resources have at the same paths, returning
+// a score (1 or 0) for each. The paths to those CodeableConcepts in both resources are also
+// returned, since they're compared as a whole rather than path by path.
+func compareConcepts(leftPathMap, rightPathMap PathMap) (scores []float64, paths []string) {
+	leftConcepts, rightConcepts := findConcepts(leftPathMap), findConcepts(rightPathMap)
+
+	prefixes := []string{}
+	for prefix := range leftConcepts {
+		if _, ok := rightConcepts[prefix]; ok {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+
+	for _, prefix := range prefixes {
+		if matchConcepts(leftConcepts[prefix], rightConcepts[prefix]) {
+			scores = append(scores, 1)
+		} else {
+			scores = append(scores, 0)
+		}
+		paths = append(paths, subPaths(leftPathMap, prefix)...)
+		paths = append(paths, subPaths(rightPathMap, prefix)...)
+	}
+	return scores, paths
+}
+
+// findConcepts finds the CodeableConcepts in a resource, by their paths.
+func findConcepts(paths PathMap) map[string]*concept {
+	codings := map[string]map[string]*coding{}
+	concepts := map[string]*concept{}
+	for _, path := range paths.Keys() {
+		match := codeableConceptRegex.FindStringSubmatch(path)
+		if match == nil || paths[path].Kind() != reflect.String {
+			continue
+		}
+		prefix, index, field := match[1], match[2], match[3]
+		if concepts[prefix] == nil {
+			concepts[prefix] = &concept{}
+			codings[prefix] = map[string]*coding{}
+			if text, ok := paths[prefix+".text"]; ok && text.Kind() == reflect.String {
+				concepts[prefix].texts = append(concepts[prefix].texts, text.String())
+			}
+		}
+		if codings[prefix][index] == nil {
+			codings[prefix][index] = &coding{}
+		}
+		switch value := paths[path].String(); field {
+		case "system":
+			codings[prefix][index].system = value
+		case "code":
+			codings[prefix][index].code = value
+		case "display":
+			concepts[prefix].texts = append(concepts[prefix].texts, value)
+		}
+	}
+
+	for prefix, c := range concepts {
+		for _, cd := range codings[prefix] {
+			if cd.code != "" {
+				c.codings = append(c.codings, *cd)
+			}
+		}
+	}
+	return concepts
+}
+
+// matchConcepts tests if two CodeableConcepts are the same concept: if any of their codings
+// have the same system and code, or are mapped to each other by a loaded ConceptMap. If none
+// are, their display text must be similar.
+func matchConcepts(left, right *concept) bool {
+	for _, l := range left.codings {
+		for _, r := range right.codings {
+			if l == r || conceptMappings[l][r] {
+				return true
+			}
+		}
+	}
+	for _, l := range left.texts {
+		for _, r := range right.texts {
+			if textSimilarity(l, r) >= DisplaySimilarityThreshold {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// textSimilarity returns the share of words two texts have in common, ignoring case and
+// punctuation, from 0 to 1.
+func textSimilarity(left, right string) float64 {
+	leftWords, rightWords := words(left), words(right)
+	if len(leftWords) == 0 || len(rightWords) == 0 {
+		return 0
+	}
+	common := 0
+	for word := range leftWords {
+		if rightWords[word] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(leftWords)+len(rightWords)-common)
+}
+
+// words returns the set of lower-case words in a text.
+func words(text string) map[string]bool {
+	set := map[string]bool{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		set[word] = true
+	}
+	return set
+}
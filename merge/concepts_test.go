@@ -0,0 +1,82 @@
+package merge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ConceptsTestSuite struct {
+	suite.Suite
+}
+
+func TestConceptsTestSuite(t *testing.T) {
+	suite.Run(t, new(ConceptsTestSuite))
+}
+
+func (c *ConceptsTestSuite) SetupSuite() {
+	c.NoError(LoadConceptMaps("../fixtures/concept_maps"))
+}
+
+func (c *ConceptsTestSuite) TearDownSuite() {
+	conceptMappings = map[coding]map[coding]bool{}
+}
+
+func (c *ConceptsTestSuite) condition(system, code, display string) PathMap {
+	// Only the code and status are compared, so the code decides the match.
+	return pathMap(fixture(conditionFixture, map[string]interface{}{
+		"code":          codeableConcept(system, code, display),
+		"onsetDateTime": nil,
+	}))
+}
+
+func (c *ConceptsTestSuite) TestLoadConceptMaps() {
+	snomed := coding{"http://snomed.info/sct", "44054006"}
+	icd10 := coding{"http://hl7.org/fhir/sid/icd-10-cm", "E11.9"}
+	c.True(conceptMappings[snomed][icd10])
+	c.True(conceptMappings[icd10][snomed])
+
+	// Disjoint codes aren't mapped.
+	c.False(conceptMappings[coding{"http://snomed.info/sct", "195967001"}][coding{"http://hl7.org/fhir/sid/icd-10-cm", "J45.998"}])
+
+	err := LoadConceptMaps("../fixtures/patients")
+	c.Contains(err.Error(), "Expected a ConceptMap or Bundle, instead received Patient")
+	c.NoError(LoadConceptMaps("../fixtures/concept_maps"))
+}
+
+func (c *ConceptsTestSuite) TestMatchConcepts() {
+	diabetes := &concept{codings: []coding{{"http://snomed.info/sct", "44054006"}}, texts: []string{"Diabetes mellitus type 2"}}
+
+	// The same code.
+	c.True(matchConcepts(diabetes, &concept{codings: []coding{{"http://snomed.info/sct", "44054006"}}}))
+	// A code in another system the ConceptMaps map it to.
+	c.True(matchConcepts(diabetes, &concept{codings: []coding{{"http://hl7.org/fhir/sid/icd-10-cm", "E11.9"}}}))
+	// The same code in another system isn't the same.
+	c.False(matchConcepts(diabetes, &concept{codings: []coding{{"http://hl7.org/fhir/sid/icd-10-cm", "44054006"}}}))
+	// Similar display text.
+	c.True(matchConcepts(diabetes, &concept{codings: []coding{{"http://example.com/codes", "dm2"}}, texts: []string{"Type 2 Diabetes Mellitus"}}))
+	c.False(matchConcepts(diabetes, &concept{texts: []string{"Diabetes mellitus type 1"}}))
+}
+
+func (c *ConceptsTestSuite) TestTextSimilarity() {
+	c.Equal(1.0, textSimilarity("Type 2 diabetes mellitus", "diabetes mellitus, type 2"))
+	c.Equal(0.5, textSimilarity("Hypertension", "Essential hypertension"))
+	c.Equal(0.0, textSimilarity("Asthma", ""))
+}
+
+func (c *ConceptsTestSuite) TestCompareConcepts() {
+	snomed := c.condition("http://snomed.info/sct", "38341003", "Hypertensive disorder")
+	scores, paths := compareConcepts(snomed, c.condition("http://hl7.org/fhir/sid/icd-10-cm", "I10", "Essential (primary) hypertension"))
+	c.Equal([]float64{1}, scores)
+	c.Len(paths, 6)
+
+	scores, _ = compareConcepts(snomed, c.condition("http://hl7.org/fhir/sid/icd-10-cm", "J45.909", "Unspecified asthma, uncomplicated"))
+	c.Equal([]float64{0}, scores)
+}
+
+func (c *ConceptsTestSuite) TestComparePathsAcrossCodeSystems() {
+	matcher := new(Matcher)
+	snomed := c.condition("http://snomed.info/sct", "195967001", "Asthma")
+	c.True(matcher.comparePaths(snomed, c.condition("http://hl7.org/fhir/sid/icd-10-cm", "J45.909", "Unspecified asthma, uncomplicated")))
+	c.False(matcher.comparePaths(snomed, c.condition("http://hl7.org/fhir/sid/icd-10-cm", "J45.998", "Other asthma")))
+}
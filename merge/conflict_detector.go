@@ -1,6 +1,7 @@
 package merge
 
 import (
+	"fmt"
 	"reflect"
 
 	"gopkg.in/mgo.v2/bson"
@@ -9,12 +10,24 @@ import (
 	"github.com/mitre/ptmerge/fhirutil"
 )
 
+// The issue codes of the conflicts a Detector creates, besides ordinary "conflict" ones.
+const (
+	DuplicateIssueCode = "duplicate"
+	InclusionIssueCode = "informational"
+)
+
 // Detector provides tools for detecting all conflicts between 2 resources in a Match.
 type Detector struct{}
 
 // Conflicts identifies all conflicts in a Match, returning a target resource
 // and any conflicts between Left and Right.
 func (d *Detector) Conflicts(match *Match) (targetResource interface{}, conflict *models.OperationOutcome) {
+	return d.conflicts(match, bson.NewObjectId().Hex())
+}
+
+// conflicts identifies all conflicts in a Match, returning a target resource with the
+// given ID and any conflicts between Left and Right.
+func (d *Detector) conflicts(match *Match, targetID string) (targetResource interface{}, conflict *models.OperationOutcome) {
 
 	// Identify any conflicts between Left and Right.
 	conflictPaths := d.findConflictPaths(match)
@@ -22,28 +35,78 @@ func (d *Detector) Conflicts(match *Match) (targetResource interface{}, conflict
 	// Create a new target. For simplicity, use the Left resource.
 	target := match.Left
 
-	// Give it a new ID.
+	// Dates that don't conflict, but are more precise in the Right resource, are kept from
+	// the Right (e.g. a birthDate of 1950-09-02 rather than 1950).
+	if paths := d.findMorePreciseDatePaths(match); len(paths) > 0 {
+		tree, right := jsonTree(match.Left), jsonTree(match.Right)
+		for _, path := range paths {
+			value, _, foundRight := findPath(right, path)
+			_, set, foundLeft := findPath(tree, path)
+			if foundRight && foundLeft {
+				set(value)
+			}
+		}
+		target = tree
+	}
+
+	// Give it the target's ID.
+	fhirutil.SetResourceID(target, targetID)
+
+	if len(conflictPaths) > 0 || match.ConflictingIdentifier != "" {
+		// Build an OperationOutcome detailing the conflicts, as FHIRPath expressions.
+		resourceType := fhirutil.GetResourceType(target)
+		expressions := fhirPathExpressions(resourceType, conflictPaths)
+		conflict = fhirutil.OperationOutcome(resourceType, targetID, expressions)
+	}
+
+	if match.ConflictingIdentifier != "" {
+		// The resources share an identifier but are clearly different, so the whole match
+		// needs review, not just the conflicting elements.
+		conflict.Issue[0].Severity = "warning"
+		conflict.Issue[0].Details = &models.CodeableConcept{
+			Text: "Identifier " + match.ConflictingIdentifier + " is shared by resources with different content",
+		}
+	}
+	return target, conflict
+}
+
+// DuplicateConflict creates a target resource for an ambiguous Duplicate (see Deduplicate), and
+// a conflict asking whether it's really a duplicate of the resource it matched.
+func (d *Detector) DuplicateConflict(duplicate *Duplicate) (targetResource interface{}, conflict *models.OperationOutcome) {
+	target := duplicate.removed
 	targetID := bson.NewObjectId().Hex()
 	fhirutil.SetResourceID(target, targetID)
 
-	if len(conflictPaths) > 0 {
-		// Build an OperationOutcome detailing the conflicts.
-		conflict = fhirutil.OperationOutcome(fhirutil.GetResourceType(target), targetID, conflictPaths)
+	// The expressions are the elements that conflict with the resource it duplicates.
+	resourceType := fhirutil.GetResourceType(target)
+	expressions := fhirPathExpressions(resourceType, duplicate.conflictPaths)
+	conflict = fhirutil.OperationOutcome(resourceType, targetID, expressions)
+	conflict.Issue[0].Code = DuplicateIssueCode
+	conflict.Issue[0].Details = &models.CodeableConcept{
+		Text: fmt.Sprintf("Possible duplicate of %s/%s in source %d", duplicate.ResourceType, duplicate.KeptID, duplicate.Source),
 	}
 	return target, conflict
 }
 
+// InclusionConflict creates a conflict for an unmatchable resource that was included in the
+// target, asking a reviewer to accept, reject, or pair it with another target resource. The
+// resource should already have its target ID. source is the source bundle it's from, 1 or 2.
+func (d *Detector) InclusionConflict(resource interface{}, source int) *models.OperationOutcome {
+	resourceType := fhirutil.GetResourceType(resource)
+	conflict := fhirutil.OperationOutcome(resourceType, fhirutil.GetResourceID(resource), []string{resourceType})
+	conflict.Issue[0].Code = InclusionIssueCode
+	conflict.Issue[0].Details = &models.CodeableConcept{
+		Text: fmt.Sprintf("Only in source %d, and included in the target", source),
+	}
+	return conflict
+}
+
 // findConflictPaths finds all non-nil paths in both resources comprising a Match. It then identifies
 // which paths have a conflict, and which paths do not.
 func (d *Detector) findConflictPaths(match *Match) (conflictPaths []string) {
 
-	// First, find all non-nil paths in the left resource, and the values at those paths.
-	leftPaths := make(PathMap)
-	traverse(reflect.ValueOf(match.Left), leftPaths, "")
-
-	// Then traverse the right.
-	rightPaths := make(PathMap)
-	traverse(reflect.ValueOf(match.Right), rightPaths, "")
+	// First, find all non-nil paths in both resources, and the values at those paths.
+	leftPaths, rightPaths := d.traverseMatch(match)
 
 	// Finally, compare paths and values. If a path exists in both resources we can compare
 	// it to identify conflicts. If it only exists in one resource, there is automatically a conflict.
@@ -65,10 +128,33 @@ func (d *Detector) findConflictPaths(match *Match) (conflictPaths []string) {
 	return conflictPaths
 }
 
+// findMorePreciseDatePaths finds the paths to dates and dateTimes that don't conflict, but are
+// more precise in the Right resource than in the Left.
+func (d *Detector) findMorePreciseDatePaths(match *Match) (paths []string) {
+	leftPaths, rightPaths := d.traverseMatch(match)
+	for _, path := range intersection(leftPaths.Keys(), rightPaths.Keys()) {
+		leftTime, leftOK := leftPaths[path].Interface().(models.FHIRDateTime)
+		rightTime, rightOK := rightPaths[path].Interface().(models.FHIRDateTime)
+		if leftOK && rightOK && compatibleDateTimes(leftTime, rightTime) && morePrecise(rightTime, leftTime) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// traverseMatch finds all non-nil paths in both resources comprising a Match.
+func (d *Detector) traverseMatch(match *Match) (leftPaths, rightPaths PathMap) {
+	leftPaths = make(PathMap)
+	traverse(jsonTree(match.Left), leftPaths, "")
+	rightPaths = make(PathMap)
+	traverse(jsonTree(match.Right), rightPaths, "")
+	return leftPaths, rightPaths
+}
+
 // compareValues compares 2 reflected values obtained by traversing FHIR resources. The values
 // must be of the same kind to do a comparison. compareValues should only be used to compare values
-// collected by traverse(). Traverse ensures that only primitive go types (strings, bools, ints, etc.)
-// are collected as valid paths for comparison.
+// collected by traverse(). Traverse ensures that only JSON primitives (strings, floats and bools) and
+// dates are collected as valid paths for comparison.
 func (d *Detector) compareValues(left, right reflect.Value) bool {
 	if left.Kind() != right.Kind() {
 		return false
@@ -91,6 +177,7 @@ func (d *Detector) compareValues(left, right reflect.Value) bool {
 		return left.Bool() == right.Bool()
 
 	// This is only for models.FHIRDateTime objects, all other structs should have been traversed.
+	// Dates of different precisions don't conflict if they're compatible (e.g. 1950 and 1950-09-02).
 	case reflect.Struct:
 		leftTime, ok := left.Interface().(models.FHIRDateTime)
 		if !ok {
@@ -100,7 +187,7 @@ func (d *Detector) compareValues(left, right reflect.Value) bool {
 		if !ok {
 			return false
 		}
-		return leftTime.Time.Equal(rightTime.Time)
+		return compatibleDateTimes(leftTime, rightTime)
 
 	default:
 		return false
@@ -8,6 +8,7 @@ import (
 	"gopkg.in/mgo.v2/bson"
 
 	"github.com/intervention-engine/fhir/models"
+	"github.com/mitre/ptmerge/fhirutil"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -78,12 +79,13 @@ func (d *DetectorTestSuite) TestConflicts() {
 
 	// Validate the OperationOutcome first.
 	d.Len(oo.Issue, 1)
-	d.Len(oo.Issue[0].Location, 4)
+	d.Len(oo.Issue[0].Expression, 4)
+	d.Equal(oo.Issue[0].Expression, oo.Issue[0].Location)
 	d.Len(oo.Issue[0].Diagnostics, len("Patient:"+bson.NewObjectId().Hex())) // Contains the resourceType and targetResourceID
 
-	expected := []string{"id", "gender", "birthDate", "name[0].given[0]"}
+	expected := []string{"Patient.id", "Patient.gender", "Patient.birthDate", "Patient.name[0].given[0]"}
 	for _, x := range expected {
-		d.True(contains(oo.Issue[0].Location, x))
+		d.True(contains(oo.Issue[0].Expression, x))
 	}
 
 	// Validate the target resource. Should be the same as the left.
@@ -99,6 +101,49 @@ func (d *DetectorTestSuite) TestConflicts() {
 	d.True(left.BirthDate.Time.Equal(targetPatient.BirthDate.Time))
 }
 
+func (d *DetectorTestSuite) TestConflictsR4Patient() {
+	match := &Match{
+		ResourceType: "Patient",
+		Left: map[string]interface{}{
+			"resourceType": "Patient",
+			"id":           bson.NewObjectId().Hex(),
+			"gender":       "male",
+			"name": []interface{}{
+				map[string]interface{}{"family": "Smith", "given": []interface{}{"John"}},
+			},
+			"birthDate": "1976-12-02",
+		},
+		Right: map[string]interface{}{
+			"resourceType": "Patient",
+			"id":           bson.NewObjectId().Hex(),
+			"gender":       "female",
+			"name": []interface{}{
+				map[string]interface{}{"family": "Smith", "given": []interface{}{"Jane"}},
+			},
+			"birthDate": "1976-11-01",
+		},
+	}
+	leftID := fhirutil.GetResourceID(match.Left)
+
+	detector := new(Detector)
+	targetResource, oo := detector.Conflicts(match)
+	d.NotNil(oo)
+
+	d.Len(oo.Issue, 1)
+	d.Len(oo.Issue[0].Expression, 4)
+	d.Equal(oo.Issue[0].Expression, oo.Issue[0].Location)
+	for _, x := range []string{"Patient.id", "Patient.gender", "Patient.birthDate", "Patient.name[0].given[0]"} {
+		d.True(contains(oo.Issue[0].Expression, x))
+	}
+
+	// The target is the left resource, with a new ID.
+	target, ok := targetResource.(map[string]interface{})
+	d.True(ok)
+	d.NotEqual(leftID, target["id"])
+	d.Equal("Patient:"+target["id"].(string), oo.Issue[0].Diagnostics)
+	d.Equal("male", target["gender"])
+}
+
 // ========================================================================= //
 // TEST FIND CONFLICT PATHS                                                  //
 // ========================================================================= //
@@ -302,6 +347,138 @@ func (d *DetectorTestSuite) TestFindConflictsUncommonPathsSomeConflicts() {
 	}
 }
 
+func (d *DetectorTestSuite) TestFindConflictsExtensionsInAnyOrder() {
+	race := map[string]interface{}{
+		"url":         "http://hl7.org/fhir/us/core/StructureDefinition/us-core-race",
+		"valueString": "White",
+	}
+	birthsex := map[string]interface{}{
+		"url":       "http://hl7.org/fhir/us/core/StructureDefinition/us-core-birthsex",
+		"valueCode": "M",
+	}
+	match := &Match{
+		ResourceType: "Patient",
+		Left: map[string]interface{}{
+			"resourceType": "Patient",
+			"extension":    []interface{}{race, birthsex},
+		},
+		Right: map[string]interface{}{
+			"resourceType": "Patient",
+			"extension": []interface{}{
+				birthsex,
+				map[string]interface{}{
+					"url":         "http://hl7.org/fhir/us/core/StructureDefinition/us-core-race",
+					"valueString": "Asian",
+				},
+			},
+		},
+	}
+
+	// The extensions are compared by URL, not position, so only the race conflicts.
+	detector := new(Detector)
+	d.Equal([]string{"extension(http://hl7.org/fhir/us/core/StructureDefinition/us-core-race).valueString"}, detector.findConflictPaths(match))
+}
+
+func (d *DetectorTestSuite) TestConflictsKeepMorePreciseDates() {
+	match := &Match{
+		ResourceType: "Patient",
+		Left: map[string]interface{}{
+			"resourceType":     "Patient",
+			"birthDate":        "1950",
+			"deceasedDateTime": "2017-01-02T10:00:00Z",
+			"extension": []interface{}{
+				map[string]interface{}{"url": "http://example.com/visit", "valueDateTime": "2016-05"},
+			},
+		},
+		Right: map[string]interface{}{
+			"resourceType":     "Patient",
+			"birthDate":        "1950-09-02",
+			"deceasedDateTime": "2017-01-02T10:00:00",
+			"extension": []interface{}{
+				map[string]interface{}{"url": "http://example.com/visit", "valueDateTime": "2016-05-20"},
+			},
+		},
+	}
+
+	// The dates are compatible, so they aren't conflicts.
+	detector := new(Detector)
+	target, oo := detector.Conflicts(match)
+	d.Nil(oo)
+
+	// The target keeps the more precise date from either resource.
+	patient := target.(map[string]interface{})
+	d.Equal("1950-09-02", patient["birthDate"])
+	d.Equal("2017-01-02T10:00:00Z", patient["deceasedDateTime"])
+	extension := patient["extension"].([]interface{})[0].(map[string]interface{})
+	d.Equal("2016-05-20", extension["valueDateTime"])
+}
+
+func (d *DetectorTestSuite) TestConflictsConflictingIdentifier() {
+	patient := map[string]interface{}{
+		"resourceType": "Patient",
+		"gender":       "male",
+		"identifier": []interface{}{
+			map[string]interface{}{"system": "http://example.com/mrn", "value": "12345"},
+		},
+	}
+	match := &Match{ResourceType: "Patient", Left: patient, Right: patient}
+
+	// Identical resources have no conflicts.
+	detector := new(Detector)
+	_, oo := detector.Conflicts(match)
+	d.Nil(oo)
+
+	// Resources matched by an identifier they shouldn't share always conflict.
+	match.ConflictingIdentifier = "http://example.com/mrn|12345"
+	_, oo = detector.Conflicts(match)
+	d.NotNil(oo)
+	d.Len(oo.Issue, 1)
+	d.Equal("warning", oo.Issue[0].Severity)
+	d.Equal("conflict", oo.Issue[0].Code)
+	d.Contains(oo.Issue[0].Details.Text, "http://example.com/mrn|12345")
+	d.Empty(oo.Issue[0].Expression)
+}
+
+func (d *DetectorTestSuite) TestDuplicateConflict() {
+	duplicate := &Duplicate{
+		ResourceType:  "Condition",
+		Source:        1,
+		KeptID:        "c1",
+		RemovedID:     "c2",
+		Ambiguous:     true,
+		kept:          map[string]interface{}{"resourceType": "Condition", "id": "c1", "clinicalStatus": "active"},
+		removed:       map[string]interface{}{"resourceType": "Condition", "id": "c2", "clinicalStatus": "resolved"},
+		conflictPaths: []string{"clinicalStatus"},
+	}
+
+	// The duplicate is the target, with a new ID.
+	detector := new(Detector)
+	target, oo := detector.DuplicateConflict(duplicate)
+	targetID := fhirutil.GetResourceID(target)
+	d.NotEqual("c2", targetID)
+	d.Equal("resolved", target.(map[string]interface{})["clinicalStatus"])
+
+	d.NotNil(oo)
+	d.Len(oo.Issue, 1)
+	d.Equal("duplicate", oo.Issue[0].Code)
+	d.Equal("Condition:"+targetID, oo.Issue[0].Diagnostics)
+	d.Equal([]string{"Condition.clinicalStatus"}, oo.Issue[0].Expression)
+	d.Equal("Possible duplicate of Condition/c1 in source 1", oo.Issue[0].Details.Text)
+}
+
+func (d *DetectorTestSuite) TestInclusionConflict() {
+	resource := map[string]interface{}{"resourceType": "MedicationStatement", "id": "m1", "status": "active"}
+
+	detector := new(Detector)
+	oo := detector.InclusionConflict(resource, 2)
+	d.NotNil(oo)
+	d.Len(oo.Issue, 1)
+	d.Equal("informational", oo.Issue[0].Code)
+	d.Equal("MedicationStatement:m1", oo.Issue[0].Diagnostics)
+	d.Equal([]string{"MedicationStatement"}, oo.Issue[0].Expression)
+	d.Equal("Only in source 2, and included in the target", oo.Issue[0].Details.Text)
+}
+
 // ========================================================================= //
 // TEST REFLECTION VALUE COMPARISON                                          //
 // ========================================================================= //
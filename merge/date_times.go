@@ -0,0 +1,143 @@
+package merge
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// localTimestamp is the precision of dateTimes with a time but no timezone. FHIR requires a
+// timezone with a time, but some systems leave it out. Since the instant such a dateTime refers
+// to isn't known, it's less precise than a timestamp.
+const localTimestamp models.Precision = "local-timestamp"
+
+// precisions ranks the precisions of dates and dateTimes, least precise first.
+var precisions = map[models.Precision]int{
+	models.Year:      1,
+	models.YearMonth: 2,
+	models.Date:      3,
+	localTimestamp:   4,
+	models.Timestamp: 5,
+}
+
+// dateTimeRegex matches FHIR dates (e.g. 2017, 2017-01 or 2017-01-02) and dateTimes with a time,
+// with or without a timezone.
+var dateTimeRegex = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2}(T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})?)?)?)?$`)
+
+// dateTimeElements are the elements whose values are dates, dateTimes or instants, other than
+// those named for their type (see isDateTimeElement).
+var dateTimeElements = map[string]bool{
+	"asserted":       true,
+	"authored":       true,
+	"authoredOn":     true,
+	"created":        true,
+	"date":           true,
+	"end":            true,
+	"event":          true,
+	"issued":         true,
+	"lastUpdated":    true,
+	"received":       true,
+	"recorded":       true,
+	"sent":           true,
+	"start":          true,
+	"started":        true,
+	"time":           true,
+	"timestamp":      true,
+	"whenHandedOver": true,
+	"whenPrepared":   true,
+}
+
+// isDateTimeElement tests if the value at a path found by traverse is a date, dateTime or
+// instant, by the name of its element: either one of the dateTimeElements, or one named for
+// its type, e.g. birthDate, onsetDateTime or valueInstant. Other strings, like identifiers,
+// codes and postal codes, may look like dates (e.g. 1234) but aren't.
+func isDateTimeElement(path string) bool {
+	segments := pathSegmentRegex.FindAllStringSubmatch(path, -1)
+	if len(segments) == 0 {
+		return false
+	}
+	name := segments[len(segments)-1][1]
+	return dateTimeElements[name] || strings.HasSuffix(name, "Date") || strings.HasSuffix(name, "DateTime") || strings.HasSuffix(name, "Instant")
+}
+
+// parseDateTime parses a FHIR date or dateTime from JSON, keeping its precision. Dates, and
+// dateTimes without a timezone, are in the local timezone, like those in models.
+func parseDateTime(s string) (models.FHIRDateTime, bool) {
+	if !dateTimeRegex.MatchString(s) {
+		return models.FHIRDateTime{}, false
+	}
+
+	var layout string
+	var precision models.Precision
+	switch {
+	case len(s) == len("2006"):
+		layout, precision = "2006", models.Year
+	case len(s) == len("2006-01"):
+		layout, precision = "2006-01", models.YearMonth
+	case len(s) == len("2006-01-02"):
+		layout, precision = "2006-01-02", models.Date
+	case s[len(s)-1] == 'Z' || s[len(s)-6] == '+' || s[len(s)-6] == '-':
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return models.FHIRDateTime{}, false
+		}
+		return models.FHIRDateTime{Time: t, Precision: models.Timestamp}, true
+	default:
+		layout, precision = "2006-01-02T15:04:05.999999999", localTimestamp
+	}
+
+	t, err := time.ParseInLocation(layout, s, time.Local)
+	if err != nil {
+		return models.FHIRDateTime{}, false
+	}
+	return models.FHIRDateTime{Time: t, Precision: precision}, true
+}
+
+// precisionRank returns the rank of a date or dateTime's precision. Those without a known
+// precision are treated as timestamps.
+func precisionRank(dt models.FHIRDateTime) int {
+	if rank, ok := precisions[dt.Precision]; ok {
+		return rank
+	}
+	return precisions[models.Timestamp]
+}
+
+// morePrecise tests if the left date or dateTime is more precise than the right.
+func morePrecise(left, right models.FHIRDateTime) bool {
+	return precisionRank(left) > precisionRank(right)
+}
+
+// compatibleDateTimes tests if two dates or dateTimes could be the same, comparing them at the
+// precision of the less precise one. 1950 is compatible with 1950-09-02, for example, but not
+// with 1951-01-01. Timestamps are compared as instants, but a dateTime without a timezone is
+// compatible with a timestamp with the same local time, since the timezone is unknown.
+func compatibleDateTimes(left, right models.FHIRDateTime) bool {
+	rank := precisionRank(left)
+	if r := precisionRank(right); r < rank {
+		rank = r
+	}
+	if rank == precisions[models.Timestamp] {
+		return left.Time.Equal(right.Time)
+	}
+	return truncateDateTime(left.Time, rank).Equal(truncateDateTime(right.Time, rank))
+}
+
+// truncateDateTime returns the local date and time of t, in UTC so times from different
+// timezones can be compared, without the parts more precise than the given rank.
+func truncateDateTime(t time.Time, rank int) time.Time {
+	year, month, day := t.Date()
+	hour, min, sec, nsec := t.Hour(), t.Minute(), t.Second(), t.Nanosecond()
+	switch {
+	case rank <= precisions[models.Year]:
+		month = time.January
+		fallthrough
+	case rank <= precisions[models.YearMonth]:
+		day = 1
+		fallthrough
+	case rank <= precisions[models.Date]:
+		hour, min, sec, nsec = 0, 0, 0, 0
+	}
+	return time.Date(year, month, day, hour, min, sec, nsec, time.UTC)
+}
@@ -0,0 +1,103 @@
+package merge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/stretchr/testify/suite"
+)
+
+type DateTimesTestSuite struct {
+	suite.Suite
+}
+
+func TestDateTimesTestSuite(t *testing.T) {
+	suite.Run(t, new(DateTimesTestSuite))
+}
+
+func (d *DateTimesTestSuite) parse(s string) models.FHIRDateTime {
+	dt, ok := parseDateTime(s)
+	d.True(ok, s)
+	return dt
+}
+
+func (d *DateTimesTestSuite) TestParseDateTime() {
+	precisions := map[string]models.Precision{
+		"1950":                          models.Year,
+		"1950-09":                       models.YearMonth,
+		"1950-09-02":                    models.Date,
+		"1950-09-02T16:09:32":           localTimestamp,
+		"1950-09-02T16:09:32.123":       localTimestamp,
+		"1950-09-02T16:09:32Z":          models.Timestamp,
+		"1950-09-02T16:09:32.123-05:00": models.Timestamp,
+	}
+	for s, precision := range precisions {
+		d.Equal(precision, d.parse(s).Precision, s)
+	}
+	d.True(d.parse("1950-09-02T16:09:32-05:00").Time.Equal(time.Date(1950, 9, 2, 21, 9, 32, 0, time.UTC)))
+	d.Equal(time.Date(1950, 9, 1, 0, 0, 0, 0, time.Local), d.parse("1950-09").Time)
+
+	for _, s := range []string{"195", "1950-9-2", "1950-09-02T16:09", "September 2, 1950", "12345"} {
+		_, ok := parseDateTime(s)
+		d.False(ok, s)
+	}
+}
+
+func (d *DateTimesTestSuite) TestIsDateTimeElement() {
+	for _, path := range []string{"birthDate", "period.start", "effectiveDateTime", "extension(http://example.com/birthTime).valueDateTime", "meta.lastUpdated", "issued", "event[1]"} {
+		d.True(isDateTimeElement(path), path)
+	}
+	for _, path := range []string{"identifier[0].value", "address[0].postalCode", "code.coding[0].code", "valueString", "id"} {
+		d.False(isDateTimeElement(path), path)
+	}
+
+	// Only date elements are traversed as dates.
+	paths := make(PathMap)
+	traverse(map[string]interface{}{
+		"resourceType": "Patient",
+		"birthDate":    "1950",
+		"address":      []interface{}{map[string]interface{}{"postalCode": "1234"}},
+	}, paths, "")
+	d.IsType(models.FHIRDateTime{}, paths["birthDate"].Interface())
+	d.Equal("1234", paths["address[0].postalCode"].Interface())
+}
+
+func (d *DateTimesTestSuite) TestCompatibleDateTimes() {
+	compatible := [][2]string{
+		{"1950", "1950-09-02"},
+		{"1950-09", "1950-09-02T16:09:32Z"},
+		{"1950-09-02", "1950-09-02T23:30:00-05:00"},
+		{"1950-09-02T16:09:32", "1950-09-02T16:09:32+02:00"},
+		{"1950-09-02T11:09:32-05:00", "1950-09-02T16:09:32Z"},
+	}
+	for _, pair := range compatible {
+		d.True(compatibleDateTimes(d.parse(pair[0]), d.parse(pair[1])), pair[0]+" "+pair[1])
+		d.True(compatibleDateTimes(d.parse(pair[1]), d.parse(pair[0])), pair[1]+" "+pair[0])
+	}
+
+	incompatible := [][2]string{
+		{"1950", "1951-01-01"},
+		{"1950-09", "1950-10-02"},
+		{"1950-09-02", "1950-09-03T01:00:00Z"},
+		{"1950-09-02T16:09:32", "1950-09-02T16:09:33Z"},
+		{"1950-09-02T16:09:32-05:00", "1950-09-02T16:09:32Z"},
+	}
+	for _, pair := range incompatible {
+		d.False(compatibleDateTimes(d.parse(pair[0]), d.parse(pair[1])), pair[0]+" "+pair[1])
+	}
+}
+
+func (d *DateTimesTestSuite) TestMorePrecise() {
+	d.True(morePrecise(d.parse("1950-09-02"), d.parse("1950")))
+	d.True(morePrecise(d.parse("1950-09-02T16:09:32Z"), d.parse("1950-09-02T16:09:32")))
+	d.False(morePrecise(d.parse("1950-09"), d.parse("1950-09-02")))
+	d.False(morePrecise(d.parse("1950-09-02"), d.parse("1951-01-01")))
+}
+
+func (d *DateTimesTestSuite) TestFuzzyTimeMatchPartialDates() {
+	d.True(fuzzyTimeMatch(d.parse("1950"), d.parse("1950-09-02")))
+	d.True(fuzzyTimeMatch(d.parse("1950-09-02T16:09:32"), d.parse("1950-09-02T08:00:00Z")))
+	d.True(fuzzyTimeMatch(d.parse("1950-09-02"), d.parse("1950-09-02T23:30:00-05:00")))
+	d.False(fuzzyTimeMatch(d.parse("1950-09"), d.parse("1950-10-02")))
+}
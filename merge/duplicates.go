@@ -0,0 +1,90 @@
+package merge
+
+import (
+	"github.com/intervention-engine/fhir/models"
+	"github.com/mitre/ptmerge/fhirutil"
+)
+
+// Duplicate is a resource in a source bundle that matches an earlier resource of the same type
+// in the same bundle. Duplicates are removed from their bundle before it's matched to the other.
+type Duplicate struct {
+	ResourceType string
+	// Source is the source bundle the resources are in, 1 or 2.
+	Source int
+	// KeptID is the ID of the earlier resource, which is kept in the bundle.
+	KeptID string
+	// RemovedID is the ID of the duplicate, which is removed from the bundle.
+	RemovedID string
+	// Ambiguous is true if the resources match but have conflicting elements, so they may
+	// not be duplicates after all. Ambiguous duplicates are added to the target as resources
+	// of their own, each with a conflict of its own.
+	Ambiguous bool
+
+	kept, removed interface{}
+	conflictPaths []string
+}
+
+// Deduplicate finds the resources in a source bundle that match an earlier resource of the same
+// type in the bundle, using the same matching as Match. Duplicates that have no conflicting
+// elements (besides their IDs and metadata) are collapsed into the earlier resource. Either way,
+// all of the duplicates are removed from the returned bundle. source is the number of the source
+// bundle, 1 or 2.
+//
+// Patients aren't deduplicated, since a bundle may have more than one (see LeftPatient).
+func (m *Matcher) Deduplicate(bundle *models.Bundle, source int) (deduplicated *models.Bundle, duplicates []Duplicate) {
+	deduplicated = &models.Bundle{}
+	*deduplicated = *bundle
+	deduplicated.Entry = make([]models.BundleEntryComponent, 0, len(bundle.Entry))
+
+	// kept are the resources kept so far, and their PathMaps, by type.
+	kept := map[string][]interface{}{}
+	keptPathMaps := map[string][]PathMap{}
+	detector := new(Detector)
+
+	for _, entry := range bundle.Entry {
+		resourceType := fhirutil.GetResourceType(entry.Resource)
+		if resourceType == "Patient" {
+			deduplicated.Entry = append(deduplicated.Entry, entry)
+			continue
+		}
+
+		pathMap := m.traverseResources([]interface{}{entry.Resource})[0]
+		duplicate := false
+		for i, original := range kept[resourceType] {
+			if _, shared := sharedIdentifier(keptPathMaps[resourceType][i], pathMap); !shared && !m.comparePaths(keptPathMaps[resourceType][i], pathMap) {
+				continue
+			}
+
+			conflictPaths := []string{}
+			for _, path := range detector.findConflictPaths(&Match{ResourceType: resourceType, Left: original, Right: entry.Resource}) {
+				if element := topLevelElement(path); element != "id" && element != "meta" {
+					conflictPaths = append(conflictPaths, path)
+				}
+			}
+			duplicates = append(duplicates, Duplicate{
+				ResourceType:  resourceType,
+				Source:        source,
+				KeptID:        fhirutil.GetResourceID(original),
+				RemovedID:     fhirutil.GetResourceID(entry.Resource),
+				Ambiguous:     len(conflictPaths) > 0,
+				kept:          original,
+				removed:       entry.Resource,
+				conflictPaths: conflictPaths,
+			})
+			duplicate = true
+			break
+		}
+
+		if !duplicate {
+			kept[resourceType] = append(kept[resourceType], entry.Resource)
+			keptPathMaps[resourceType] = append(keptPathMaps[resourceType], pathMap)
+			deduplicated.Entry = append(deduplicated.Entry, entry)
+		}
+	}
+
+	if deduplicated.Total != nil {
+		total := uint32(len(deduplicated.Entry))
+		deduplicated.Total = &total
+	}
+	return deduplicated, duplicates
+}
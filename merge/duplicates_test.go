@@ -0,0 +1,73 @@
+package merge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type DuplicatesTestSuite struct {
+	suite.Suite
+}
+
+func TestDuplicatesTestSuite(t *testing.T) {
+	suite.Run(t, new(DuplicatesTestSuite))
+}
+
+func (d *DuplicatesTestSuite) condition(id, code, onset, severity string) map[string]interface{} {
+	condition := fixture(conditionFixture, map[string]interface{}{
+		"id":            id,
+		"code":          codeableConcept("http://snomed.info/sct", code, ""),
+		"severity":      codeableConcept("http://snomed.info/sct", severity, ""),
+		"onsetDateTime": onset,
+	})
+	if id == "c3" {
+		condition["meta"] = map[string]interface{}{"lastUpdated": "2017-02-03T10:00:00Z"}
+	}
+	return condition
+}
+
+func (d *DuplicatesTestSuite) TestDeduplicate() {
+	patient := map[string]interface{}{"resourceType": "Patient", "id": "p"}
+	bundle := fixtureBundle(
+		patient,
+		patient,
+		d.condition("c1", "44054006", "2016-05-20", "6736007"),
+		d.condition("c2", "38341003", "2012-03-01", "6736007"),
+		d.condition("c3", "44054006", "2016-05-20", "6736007"),
+		d.condition("c4", "44054006", "2016-05-20", "24484000"),
+	)
+
+	matcher := new(Matcher)
+	deduplicated, duplicates := matcher.Deduplicate(bundle, 1)
+
+	// Identical Conditions (besides their IDs and metadata) are collapsed, and Conditions
+	// that match but conflict are ambiguous. Patients are left alone.
+	d.Len(deduplicated.Entry, 4)
+	d.Equal(uint32(4), *deduplicated.Total)
+	d.Len(bundle.Entry, 6)
+	d.Len(duplicates, 2)
+	d.Equal("Condition", duplicates[0].ResourceType)
+	d.Equal(1, duplicates[0].Source)
+	d.Equal("c1", duplicates[0].KeptID)
+	d.Equal("c3", duplicates[0].RemovedID)
+	d.False(duplicates[0].Ambiguous)
+	d.Equal("c4", duplicates[1].RemovedID)
+	d.True(duplicates[1].Ambiguous)
+	d.Equal([]string{"severity.coding[0].code"}, duplicates[1].conflictPaths)
+}
+
+func (d *DuplicatesTestSuite) TestDeduplicateIdentifiers() {
+	left := d.condition("c1", "44054006", "2016-05-20", "6736007")
+	left["identifier"] = []interface{}{map[string]interface{}{"system": "http://example.com/conditions", "value": "1"}}
+	right := d.condition("c2", "38341003", "2012-01-01", "24484000")
+	right["identifier"] = left["identifier"]
+
+	// Resources with the same identifier are duplicates, however different they are.
+	matcher := new(Matcher)
+	deduplicated, duplicates := matcher.Deduplicate(fixtureBundle(left, right), 2)
+	d.Len(deduplicated.Entry, 1)
+	d.Len(duplicates, 1)
+	d.Equal(2, duplicates[0].Source)
+	d.True(duplicates[0].Ambiguous)
+}
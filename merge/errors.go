@@ -0,0 +1,24 @@
+package merge
+
+import "fmt"
+
+// BadSourceError occurs when a merge's source bundles can't be merged, e.g. if one of
+// them doesn't exist or has no Patient.
+type BadSourceError struct {
+	Message string
+}
+
+func (e *BadSourceError) Error() string {
+	return e.Message
+}
+
+// TypeMismatchError occurs when a resource given to replace a target resource is of a
+// different resource type.
+type TypeMismatchError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *TypeMismatchError) Error() string {
+	return fmt.Sprintf("Updated resource of type %s does not match target resource of type %s", e.Actual, e.Expected)
+}
@@ -0,0 +1,70 @@
+package merge
+
+import (
+	"io/ioutil"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/mitre/ptmerge/fhirutil"
+)
+
+// The fixtures that tests of matching and merging vary. Each is a small, valid resource.
+const (
+	encounterFixture   = "../fixtures/encounters/ambulatory_encounter.json"
+	observationFixture = "../fixtures/observations/body_weight.json"
+	conditionFixture   = "../fixtures/conditions/diabetes.json"
+)
+
+// fixture loads a resource from a fixture as a generic JSON object, replacing any of its
+// top-level elements with the given values. Elements given as nil are removed. Since the
+// fixtures are part of the tests, fixture panics if one can't be loaded, failing the test.
+func fixture(filepath string, elements map[string]interface{}) map[string]interface{} {
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		panic(err)
+	}
+	resource, err := fhirutil.UnmarshalJSONResource(data)
+	if err != nil {
+		panic(err)
+	}
+	for key, value := range elements {
+		if value == nil {
+			delete(resource, key)
+			continue
+		}
+		resource[key] = value
+	}
+	return resource
+}
+
+// codeableConcept returns a CodeableConcept with a single coding. The display is left out
+// if it's empty.
+func codeableConcept(system, code, display string) map[string]interface{} {
+	coding := map[string]interface{}{"system": system, "code": code}
+	if display != "" {
+		coding["display"] = display
+	}
+	return map[string]interface{}{"coding": []interface{}{coding}}
+}
+
+// pathMap traverses a resource, returning its paths.
+func pathMap(resource map[string]interface{}) PathMap {
+	paths := make(PathMap)
+	traverse(resource, paths, "")
+	return paths
+}
+
+// fixtureBundle returns a collection Bundle of resources. Resources with an ID have it as
+// their fullUrl (e.g. urn:uuid:e1), so others in the bundle may reference them by it.
+func fixtureBundle(resources ...map[string]interface{}) *models.Bundle {
+	bundle := &models.Bundle{Type: "collection"}
+	for _, resource := range resources {
+		entry := models.BundleEntryComponent{Resource: resource}
+		if id, ok := resource["id"].(string); ok && id != "" {
+			entry.FullUrl = "urn:uuid:" + id
+		}
+		bundle.Entry = append(bundle.Entry, entry)
+	}
+	total := uint32(len(bundle.Entry))
+	bundle.Total = &total
+	return bundle
+}
@@ -0,0 +1,52 @@
+package merge
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+)
+
+// IdentifierConflictThreshold is the share of paths, from 0 to 1, that two resources with an
+// identifier in common must match on (see MatchThreshold) for them not to be flagged. Resources
+// that share an identifier always match, but if their content is clearly different the
+// identifier may have been reused or assigned in error, so the match is flagged as a conflict.
+var IdentifierConflictThreshold = 0.5
+
+// identifierRegex matches the paths to the system and value of a resource's identifiers.
+var identifierRegex = regexp.MustCompile(`^identifier(\[\d+\])?\.(system|value)$`)
+
+// identifiers returns the business identifiers (e.g. MRNs or accession numbers) of a resource,
+// as system|value. Identifiers without a system aren't returned, since their values may only
+// be unique to the system that assigned them.
+func identifiers(paths PathMap) []string {
+	systems, values := map[string]string{}, map[string]string{}
+	for path, value := range paths {
+		match := identifierRegex.FindStringSubmatch(path)
+		if match == nil || value.Kind() != reflect.String {
+			continue
+		}
+		if match[2] == "system" {
+			systems[match[1]] = value.String()
+		} else {
+			values[match[1]] = value.String()
+		}
+	}
+
+	ids := []string{}
+	for index, system := range systems {
+		if value, ok := values[index]; ok && system != "" && value != "" {
+			ids = append(ids, system+"|"+value)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// sharedIdentifier returns the first identifier two resources have in common, if any.
+func sharedIdentifier(leftPathMap, rightPathMap PathMap) (string, bool) {
+	shared := intersection(identifiers(leftPathMap), identifiers(rightPathMap))
+	if len(shared) == 0 {
+		return "", false
+	}
+	return shared[0], true
+}
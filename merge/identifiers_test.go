@@ -0,0 +1,96 @@
+package merge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type IdentifiersTestSuite struct {
+	suite.Suite
+}
+
+func TestIdentifiersTestSuite(t *testing.T) {
+	suite.Run(t, new(IdentifiersTestSuite))
+}
+
+func (i *IdentifiersTestSuite) encounter(identifier, status, class string) map[string]interface{} {
+	encounter := fixture(encounterFixture, map[string]interface{}{
+		"status": status,
+		"class":  map[string]interface{}{"code": class},
+	})
+	if identifier != "" {
+		encounter["identifier"] = []interface{}{
+			map[string]interface{}{"system": "http://example.com/encounters", "value": identifier},
+		}
+	}
+	return encounter
+}
+
+func (i *IdentifiersTestSuite) TestIdentifiers() {
+	paths := make(PathMap)
+	traverse(map[string]interface{}{
+		"resourceType": "Patient",
+		"identifier": []interface{}{
+			map[string]interface{}{"system": "http://example.com/mrn", "value": "12345"},
+			map[string]interface{}{"value": "no-system"},
+			map[string]interface{}{"system": "http://hl7.org/fhir/sid/us-ssn", "value": "999-99-9999"},
+		},
+	}, paths, "")
+	i.Equal([]string{"http://example.com/mrn|12345", "http://hl7.org/fhir/sid/us-ssn|999-99-9999"}, identifiers(paths))
+
+	// Some resources only have one identifier.
+	paths = make(PathMap)
+	traverse(map[string]interface{}{
+		"resourceType": "Bundle",
+		"identifier":   map[string]interface{}{"system": "http://example.com/bundles", "value": "1"},
+	}, paths, "")
+	i.Equal([]string{"http://example.com/bundles|1"}, identifiers(paths))
+
+	// Numeric identifiers that look like years are still identifiers.
+	paths = make(PathMap)
+	traverse(map[string]interface{}{
+		"resourceType": "Patient",
+		"identifier": []interface{}{
+			map[string]interface{}{"system": "http://example.com/mrn", "value": "1234"},
+		},
+	}, paths, "")
+	i.Equal([]string{"http://example.com/mrn|1234"}, identifiers(paths))
+}
+
+func (i *IdentifiersTestSuite) TestMatchWithoutReplacementIdentifiers() {
+	matcher := new(Matcher)
+
+	// Encounters with the same identifier match before any others, even if another is
+	// identical.
+	lefts := []interface{}{i.encounter("A1", "finished", "AMB")}
+	rights := []interface{}{i.encounter("", "finished", "AMB"), i.encounter("A1", "finished", "EMER")}
+	matches, unmatchables, err := matcher.matchWithoutReplacement(lefts, rights)
+	i.NoError(err)
+	i.Len(matches, 1)
+	i.Equal(rights[1], matches[0].Right)
+	i.Equal("", matches[0].ConflictingIdentifier)
+	i.Equal([]interface{}{rights[0]}, unmatchables)
+
+	// Encounters with different identifiers can still match by their content.
+	lefts = []interface{}{i.encounter("A1", "finished", "AMB")}
+	rights = []interface{}{i.encounter("B2", "finished", "AMB")}
+	matches, _, err = matcher.matchWithoutReplacement(lefts, rights)
+	i.NoError(err)
+	i.Len(matches, 1)
+}
+
+func (i *IdentifiersTestSuite) TestMatchWithoutReplacementConflictingIdentifier() {
+	matcher := new(Matcher)
+
+	// Encounters with the same identifier but clearly different content still match, but
+	// the match is flagged.
+	left := i.encounter("A1", "finished", "AMB")
+	right := i.encounter("A1", "cancelled", "EMER")
+	right["period"] = map[string]interface{}{"start": "2015-06-01T10:00:00Z", "end": "2015-06-01T11:00:00Z"}
+	matches, unmatchables, err := matcher.matchWithoutReplacement([]interface{}{left}, []interface{}{right})
+	i.NoError(err)
+	i.Empty(unmatchables)
+	i.Len(matches, 1)
+	i.Equal("http://example.com/encounters|A1", matches[0].ConflictingIdentifier)
+}
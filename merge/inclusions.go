@@ -0,0 +1,38 @@
+package merge
+
+import (
+	"reflect"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// InclusionResourceTypes are the resource types whose unmatchable resources need a reviewer's
+// decision before they're included in the target, e.g. a MedicationStatement only in one source
+// bundle. "*" includes every type. Unmatchable resources of other types are included without
+// review.
+var InclusionResourceTypes = []string{}
+
+// reviewInclusion tests if unmatchable resources of a type need a reviewer's decision.
+func reviewInclusion(resourceType string) bool {
+	return contains(InclusionResourceTypes, "*") || contains(InclusionResourceTypes, resourceType)
+}
+
+// sourceOf returns which source bundle a resource is from, 1 or 2, by identity rather than by
+// ID, since both bundles may have resources with the same IDs.
+func sourceOf(resource interface{}, bundle1 *models.Bundle) int {
+	for _, entry := range bundle1.Entry {
+		if sameResource(entry.Resource, resource) {
+			return 1
+		}
+	}
+	return 2
+}
+
+// sameResource tests if two resources are the same object.
+func sameResource(a, b interface{}) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Kind() != vb.Kind() || (va.Kind() != reflect.Map && va.Kind() != reflect.Ptr) {
+		return false
+	}
+	return va.Pointer() == vb.Pointer()
+}
@@ -0,0 +1,56 @@
+package merge
+
+import (
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/stretchr/testify/suite"
+)
+
+type InclusionsTestSuite struct {
+	suite.Suite
+}
+
+func TestInclusionsTestSuite(t *testing.T) {
+	suite.Run(t, new(InclusionsTestSuite))
+}
+
+func (i *InclusionsTestSuite) TearDownTest() {
+	InclusionResourceTypes = []string{}
+}
+
+func (i *InclusionsTestSuite) TestReviewInclusion() {
+	// By default, nothing needs review.
+	i.False(reviewInclusion("MedicationStatement"))
+
+	InclusionResourceTypes = []string{"MedicationStatement", "AllergyIntolerance"}
+	i.True(reviewInclusion("MedicationStatement"))
+	i.True(reviewInclusion("AllergyIntolerance"))
+	i.False(reviewInclusion("Observation"))
+
+	InclusionResourceTypes = []string{"*"}
+	i.True(reviewInclusion("Observation"))
+}
+
+func (i *InclusionsTestSuite) TestSourceOf() {
+	// Both bundles have a resource with the same ID and content, so only identity tells them
+	// apart.
+	left := map[string]interface{}{"resourceType": "Condition", "id": "c1"}
+	right := map[string]interface{}{"resourceType": "Condition", "id": "c1"}
+	bundle1 := &models.Bundle{Entry: []models.BundleEntryComponent{{Resource: left}}}
+
+	i.Equal(1, sourceOf(left, bundle1))
+	i.Equal(2, sourceOf(right, bundle1))
+}
+
+func (i *InclusionsTestSuite) TestSameResource() {
+	condition := map[string]interface{}{"resourceType": "Condition", "id": "c1"}
+	i.True(sameResource(condition, condition))
+	i.False(sameResource(condition, map[string]interface{}{"resourceType": "Condition", "id": "c1"}))
+
+	patient := &models.Patient{}
+	i.True(sameResource(patient, patient))
+	i.False(sameResource(patient, &models.Patient{}))
+	i.False(sameResource(patient, condition))
+	i.False(sameResource("Condition", "Condition"))
+}
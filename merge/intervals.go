@@ -0,0 +1,219 @@
+package merge
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+var (
+	// IntervalElements are the elements of each resource type that are matched as intervals,
+	// by how much they overlap, rather than path by path. Each may be a Period, a Range, or a
+	// choice of them (e.g. onset for onsetPeriod, onsetRange or onsetDateTime).
+	IntervalElements = map[string][]string{
+		"Encounter":           {"period"},
+		"Condition":           {"onset", "abatement"},
+		"MedicationStatement": {"effective"},
+		"Procedure":           {"performed"},
+	}
+
+	// PeriodTolerance is how far apart the start or end of two Periods (or two dateTimes) may
+	// be for them to still be considered the same.
+	PeriodTolerance = 24 * time.Hour
+
+	// RangeTolerance is how far apart the low or high values of two Ranges (or two Quantities,
+	// e.g. Ages) may be, in their units, for them to still be considered the same.
+	RangeTolerance = 0.0
+)
+
+// interval is a Period, Range, dateTime or Quantity as the range of values it covers. Times are
+// in seconds. Periods and Ranges without a start or end are open on that side (infinite).
+type interval struct {
+	low, high float64
+	// unit is the unit of a Range or Quantity, or "s" for times.
+	unit string
+}
+
+// intervalScore scores how closely two intervals match, from 0 to 1. Intervals with bounds
+// within tolerance of each other score 1. Otherwise overlapping intervals score by how much
+// of their combined length they share, and intervals that don't overlap by how close they
+// are, down to 0 when they're tolerance apart.
+func intervalScore(a, b interval, tolerance float64) float64 {
+	if near(a.low, b.low, tolerance) && near(a.high, b.high, tolerance) {
+		return 1
+	}
+
+	overlap := math.Min(a.high, b.high) - math.Max(a.low, b.low)
+	if overlap <= 0 {
+		if tolerance <= 0 || -overlap >= tolerance {
+			return 0
+		}
+		return 1 - (-overlap / tolerance)
+	}
+
+	union := math.Max(a.high, b.high) - math.Min(a.low, b.low)
+	if math.IsInf(union, 0) {
+		// Open intervals that overlap can't be compared by length.
+		return 1
+	}
+	return overlap / union
+}
+
+// near tests if two bounds are within tolerance of each other. Open bounds are only near
+// bounds that are open on the same side.
+func near(a, b, tolerance float64) bool {
+	if math.IsInf(a, 0) || math.IsInf(b, 0) {
+		return a == b
+	}
+	return math.Abs(a-b) <= tolerance
+}
+
+// compareIntervals compares the IntervalElements of two resources, returning a score for each
+// element both resources have comparable intervals for (e.g. two Periods, or Ranges with the
+// same units). The paths to those elements in both resources are also returned, since they're
+// compared as a whole rather than path by path.
+func compareIntervals(leftPathMap, rightPathMap PathMap) (scores []float64, paths []string) {
+	resourceType, ok := leftPathMap["resourceType"]
+	if !ok {
+		return nil, nil
+	}
+
+	for _, element := range IntervalElements[resourceType.String()] {
+		left, leftPaths := elementInterval(leftPathMap, element)
+		right, rightPaths := elementInterval(rightPathMap, element)
+		if left == nil || right == nil || left.unit != right.unit {
+			continue
+		}
+
+		tolerance := RangeTolerance
+		if left.unit == "s" {
+			tolerance = PeriodTolerance.Seconds()
+		}
+		scores = append(scores, intervalScore(*left, *right, tolerance))
+		paths = append(paths, leftPaths...)
+		paths = append(paths, rightPaths...)
+	}
+	return scores, paths
+}
+
+// elementInterval returns the interval for an element of a resource, e.g. period or onset, and
+// the paths the interval is made from. Elements that aren't a Period, Range, dateTime, or
+// Quantity (e.g. onsetString) have no interval.
+func elementInterval(paths PathMap, element string) (*interval, []string) {
+	var name string
+	var elementPaths []string
+	for _, path := range paths.Keys() {
+		if n := topLevelElement(path); n == element || strings.HasPrefix(n, element) && unicode.IsUpper(rune(n[len(element)])) {
+			name = n
+			elementPaths = append(elementPaths, path)
+		}
+	}
+	if name == "" {
+		return nil, nil
+	}
+
+	var iv *interval
+	switch name[len(element):] {
+	case "", "Period":
+		start, hasStart := dateTimeAt(paths, name+".start")
+		end, hasEnd := dateTimeAt(paths, name+".end")
+		if !hasStart && !hasEnd {
+			return nil, nil
+		}
+		iv = &interval{low: math.Inf(-1), high: math.Inf(1), unit: "s"}
+		if hasStart {
+			iv.low, _ = dateTimeBounds(start)
+		}
+		if hasEnd {
+			_, iv.high = dateTimeBounds(end)
+		}
+	case "DateTime":
+		dt, ok := dateTimeAt(paths, name)
+		if !ok {
+			return nil, nil
+		}
+		iv = &interval{unit: "s"}
+		iv.low, iv.high = dateTimeBounds(dt)
+	case "Range":
+		low, hasLow := paths[name+".low.value"]
+		high, hasHigh := paths[name+".high.value"]
+		if !hasLow && !hasHigh {
+			return nil, nil
+		}
+		iv = &interval{low: math.Inf(-1), high: math.Inf(1), unit: quantityUnit(paths, name+".low")}
+		if hasLow && low.Kind() == reflect.Float64 {
+			iv.low = low.Float()
+		}
+		if hasHigh && high.Kind() == reflect.Float64 {
+			iv.high = high.Float()
+			if !hasLow {
+				iv.unit = quantityUnit(paths, name+".high")
+			}
+		}
+	case "Age", "Quantity":
+		value, ok := paths[name+".value"]
+		if !ok || value.Kind() != reflect.Float64 {
+			return nil, nil
+		}
+		iv = &interval{low: value.Float(), high: value.Float(), unit: quantityUnit(paths, name)}
+	default:
+		return nil, nil
+	}
+	return iv, elementPaths
+}
+
+// topLevelElement returns the name of the top-level element a path is in, e.g. period for
+// period.start.
+func topLevelElement(path string) string {
+	if i := strings.IndexAny(path, ".[("); i >= 0 {
+		return path[:i]
+	}
+	return path
+}
+
+// dateTimeAt returns the date or dateTime at a path, if there is one.
+func dateTimeAt(paths PathMap, path string) (models.FHIRDateTime, bool) {
+	value, ok := paths[path]
+	if !ok || !value.IsValid() {
+		return models.FHIRDateTime{}, false
+	}
+	dt, ok := value.Interface().(models.FHIRDateTime)
+	return dt, ok
+}
+
+// dateTimeBounds returns the first and last second a date or dateTime covers, depending on its
+// precision. 1950-09 covers all of September 1950, for example.
+func dateTimeBounds(dt models.FHIRDateTime) (low, high float64) {
+	start := dt.Time
+	var end time.Time
+	switch dt.Precision {
+	case models.Year:
+		end = start.AddDate(1, 0, 0)
+	case models.YearMonth:
+		end = start.AddDate(0, 1, 0)
+	case models.Date:
+		end = start.AddDate(0, 0, 1)
+	default:
+		end = start
+	}
+	return seconds(start), seconds(end)
+}
+
+// seconds returns a time as seconds since the Unix epoch.
+func seconds(t time.Time) float64 {
+	return float64(t.Unix()) + float64(t.Nanosecond())/float64(time.Second)
+}
+
+// quantityUnit returns the unit of a Quantity, preferring its code to its human-readable unit.
+func quantityUnit(paths PathMap, path string) string {
+	for _, p := range []string{path + ".code", path + ".unit"} {
+		if unit, ok := paths[p]; ok && unit.Kind() == reflect.String {
+			return unit.String()
+		}
+	}
+	return ""
+}
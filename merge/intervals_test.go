@@ -0,0 +1,131 @@
+package merge
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type IntervalsTestSuite struct {
+	suite.Suite
+}
+
+func TestIntervalsTestSuite(t *testing.T) {
+	suite.Run(t, new(IntervalsTestSuite))
+}
+
+func (i *IntervalsTestSuite) encounter(start, end string) PathMap {
+	period := map[string]interface{}{}
+	if start != "" {
+		period["start"] = start
+	}
+	if end != "" {
+		period["end"] = end
+	}
+	return pathMap(fixture(encounterFixture, map[string]interface{}{"period": period}))
+}
+
+func (i *IntervalsTestSuite) TestIntervalScore() {
+	a := interval{low: 0, high: 10}
+
+	// Bounds within tolerance.
+	i.Equal(1.0, intervalScore(a, interval{low: 1, high: 9}, 1))
+
+	// Overlapping intervals score by their share of the whole.
+	i.Equal(0.5, intervalScore(a, interval{low: 0, high: 5}, 0))
+	i.Equal(0.25, intervalScore(a, interval{low: 5, high: 20}, 0))
+
+	// Intervals that don't overlap score by how close they are.
+	i.Equal(0.5, intervalScore(a, interval{low: 12, high: 20}, 4))
+	i.Equal(0.0, intervalScore(a, interval{low: 14, high: 20}, 4))
+	i.Equal(0.0, intervalScore(a, interval{low: 12, high: 20}, 0))
+
+	// Open intervals.
+	open := interval{low: 5, high: math.Inf(1)}
+	i.Equal(1.0, intervalScore(open, interval{low: 5, high: math.Inf(1)}, 0))
+	i.Equal(1.0, intervalScore(a, open, 0))
+	i.Equal(0.0, intervalScore(interval{low: 0, high: 4}, open, 0))
+}
+
+func (i *IntervalsTestSuite) TestElementInterval() {
+	// A Period covers the whole of its start and end dates.
+	iv, paths := elementInterval(i.encounter("2017-01-02", "2017-01-03"), "period")
+	i.NotNil(iv)
+	i.Equal("s", iv.unit)
+	i.Equal(seconds(time.Date(2017, 1, 2, 0, 0, 0, 0, time.Local)), iv.low)
+	i.Equal(seconds(time.Date(2017, 1, 4, 0, 0, 0, 0, time.Local)), iv.high)
+	i.Len(paths, 2)
+
+	// A Period without an end is open.
+	iv, _ = elementInterval(i.encounter("2017-01-02T10:00:00Z", ""), "period")
+	i.True(math.IsInf(iv.high, 1))
+
+	condition := pathMap(map[string]interface{}{
+		"resourceType":      "Condition",
+		"onsetRange":        map[string]interface{}{"low": map[string]interface{}{"value": 40.0, "unit": "years", "code": "a"}, "high": map[string]interface{}{"value": 45.0, "code": "a"}},
+		"abatementDateTime": "2016",
+		"note":              []interface{}{map[string]interface{}{"text": "Started in 2016"}},
+	})
+	iv, paths = elementInterval(condition, "onset")
+	i.Equal(&interval{low: 40, high: 45, unit: "a"}, iv)
+	i.Len(paths, 5)
+
+	iv, paths = elementInterval(condition, "abatement")
+	i.Equal(seconds(time.Date(2016, 1, 1, 0, 0, 0, 0, time.Local)), iv.low)
+	i.Equal(seconds(time.Date(2017, 1, 1, 0, 0, 0, 0, time.Local)), iv.high)
+	i.Equal([]string{"abatementDateTime"}, paths)
+
+	// Elements that aren't intervals have none.
+	iv, _ = elementInterval(pathMap(map[string]interface{}{"onsetString": "In childhood"}), "onset")
+	i.Nil(iv)
+	iv, _ = elementInterval(condition, "period")
+	i.Nil(iv)
+}
+
+func (i *IntervalsTestSuite) TestCompareIntervals() {
+	left := i.encounter("2017-01-02T10:00:00Z", "2017-01-02T11:00:00Z")
+
+	// Periods within the tolerance match, and their paths aren't compared path by path.
+	scores, paths := compareIntervals(left, i.encounter("2017-01-02T10:30:00Z", "2017-01-02T12:00:00Z"))
+	i.Equal([]float64{1}, scores)
+	i.Len(paths, 4)
+
+	originalTolerance := PeriodTolerance
+	PeriodTolerance = 0
+	scores, _ = compareIntervals(left, i.encounter("2017-01-02T10:30:00Z", "2017-01-02T11:30:00Z"))
+	i.InDelta(1.0/3, scores[0], 0.00001)
+	PeriodTolerance = originalTolerance
+
+	// Resource types without interval elements have no scores.
+	scores, paths = compareIntervals(pathMap(map[string]interface{}{"resourceType": "Patient"}), left)
+	i.Empty(scores)
+	i.Empty(paths)
+
+	// Intervals with different units aren't compared.
+	age := func(unit string) PathMap {
+		return pathMap(map[string]interface{}{
+			"resourceType": "Condition",
+			"onsetAge":     map[string]interface{}{"value": 40.0, "code": unit},
+		})
+	}
+	scores, _ = compareIntervals(age("a"), age("mo"))
+	i.Empty(scores)
+	scores, _ = compareIntervals(age("a"), age("a"))
+	i.Equal([]float64{1}, scores)
+}
+
+func (i *IntervalsTestSuite) TestComparePathsOverlappingEncounters() {
+	matcher := new(Matcher)
+
+	// Encounters whose periods are a few hours apart would only share their status path by
+	// path, but match as intervals.
+	left := i.encounter("2017-01-02T10:00:00Z", "2017-01-02T11:00:00Z")
+	right := i.encounter("2017-01-02T13:00:00Z", "2017-01-02T14:15:00Z")
+	i.True(matcher.comparePaths(left, right))
+
+	// Encounters on different weeks don't.
+	right = i.encounter("2017-01-09T10:00:00Z", "2017-01-09T11:00:00Z")
+	i.False(matcher.comparePaths(left, right))
+}
@@ -1,10 +1,10 @@
 package merge
 
 import (
-	"errors"
 	"fmt"
 	"math"
 	"reflect"
+	"regexp"
 	"strings"
 
 	"github.com/intervention-engine/fhir/models"
@@ -24,17 +24,43 @@ var (
 	// match for the whole resource to be considered a match.
 	MatchThreshold = 0.8
 
+	// IgnoredExtensions are extensions, by URL or name (e.g. "us-core-birthsex"), that
+	// are ignored when matching resources and detecting conflicts.
+	IgnoredExtensions = []string{}
+
+	// KeyExtensions are extensions, by URL or name, that identify a resource. If two
+	// resources have the same key extension, they match if and only if its values are
+	// the same, whatever else they have in common.
+	KeyExtensions = []string{}
+
 	// ErrNoPatientResource occurs if a Patient resource is not found in one or both
 	// source bundles.
-	ErrNoPatientResource = errors.New("Patient resource not found in one or both source bundles")
+	ErrNoPatientResource error = &BadSourceError{Message: "Patient resource not found in one or both source bundles"}
 
 	// ErrDuplicatePatientResource occurs if more than one Patient resource is found
-	// in either source bundle.
-	ErrDuplicatePatientResource = errors.New("Duplicate Patient resources found in one or both source bundles")
+	// in either source bundle, and none of them is the primary Patient.
+	ErrDuplicatePatientResource error = &BadSourceError{Message: "Duplicate Patient resources found in one or both source bundles, and no primary Patient could be chosen"}
 )
 
+// extensionURLRegex matches the URLs extensions are identified by in paths, e.g.
+// (http://example.com/note).
+var extensionURLRegex = regexp.MustCompile(`\([^)]*\)`)
+
 // Matcher provides tools for identifying all resources in 2 source bundles that "match".
-type Matcher struct{}
+type Matcher struct {
+	// Version is the version of FHIR the source bundles are from. If it's nil, resources of
+	// any type in STU3 or R4 may be matched.
+	Version fhirutil.Version
+
+	// LeftPatient and RightPatient are the IDs of the primary Patients in the left and right
+	// bundles. If either is empty and its bundle has more than one Patient, the Patient most
+	// resources reference is the primary Patient.
+	LeftPatient, RightPatient string
+
+	// leftReferences and rightReferences index the resources in the source bundles being
+	// matched, so references to matched resources can be compared.
+	leftReferences, rightReferences *bundleReferences
+}
 
 // Match iterates through all resources in the two source bundles and attempts to find resources that "match". These
 // resources can then be compared to each other to see what conflicts may still exist between them. All matches are
@@ -51,6 +77,8 @@ func (m *Matcher) Match(leftBundle, rightBundle *models.Bundle) (matches []Match
 	if err != nil {
 		return nil, nil, err
 	}
+	m.leftReferences = newBundleReferences(leftBundle)
+	m.rightReferences = newBundleReferences(rightBundle)
 
 	// There are now three sets of resource types to consider:
 	// 1. L intersect R - these are all the resource types we'll attempt to match
@@ -77,26 +105,46 @@ func (m *Matcher) Match(leftBundle, rightBundle *models.Bundle) (matches []Match
 
 	// Handle all of the matchable resource types. Since the resourceType key existed
 	// in both the leftResources and rightResources, there is guaranteed to be at least
-	// one resource of each resourceType in both sets.
+	// one resource of each resourceType in both sets. Referenced resource types are
+	// matched first, so the resources that reference them can be matched by whether
+	// they reference the same matched resources.
+	matchableResourceTypes = dependencyOrder(matchableResourceTypes, m.leftReferences, m.rightReferences)
 	for _, resourceType := range matchableResourceTypes {
 		lefts := leftResources[resourceType]
 		rights := rightResources[resourceType]
 
-		// Always match the patient resource, even if there are many conflicts.
-		// This allows bundles that are seemingly dissimilar to be merged.
+		// Always match the primary patient resources, even if there are many conflicts.
+		// This allows bundles that are seemingly dissimilar to be merged. Any other Patients
+		// (e.g. linked records, or a newborn's mother) are matched like other resources.
 		if resourceType == "Patient" {
-			if len(lefts) > 1 || len(rights) > 1 {
-				// Cannot handle duplicate Patient resources.
-				return nil, nil, ErrDuplicatePatientResource
+			leftPatient, err := m.primaryPatient(lefts, m.LeftPatient, m.leftReferences)
+			if err != nil {
+				return nil, nil, err
+			}
+			rightPatient, err := m.primaryPatient(rights, m.RightPatient, m.rightReferences)
+			if err != nil {
+				return nil, nil, err
 			}
+			m.leftReferences.setPrimary(lefts[leftPatient])
+			m.rightReferences.setPrimary(rights[rightPatient])
 
-			// Create a match for the Patient resources.
+			// Create a match for the Patient resources, flagging it if they share an
+			// identifier but are clearly different patients.
+			pathMaps := m.traverseResources([]interface{}{lefts[leftPatient], rights[rightPatient]})
 			matches = append(matches, Match{
-				ResourceType: "Patient",
-				Left:         lefts[0],
-				Right:        rights[0],
+				ResourceType:          "Patient",
+				Left:                  lefts[leftPatient],
+				Right:                 rights[rightPatient],
+				ConflictingIdentifier: m.conflictingIdentifier(pathMaps[0], pathMaps[1]),
 			})
-			continue
+			m.addMatches(matches[len(matches)-1:], len(matches)-1)
+
+			lefts = append(append([]interface{}{}, lefts[:leftPatient]...), lefts[leftPatient+1:]...)
+			rights = append(append([]interface{}{}, rights[:rightPatient]...), rights[rightPatient+1:]...)
+			if len(lefts) == 0 || len(rights) == 0 {
+				unmatchables = append(append(unmatchables, lefts...), rights...)
+				continue
+			}
 		}
 
 		// For all other resource types, perform matching without replacement.
@@ -106,12 +154,52 @@ func (m *Matcher) Match(leftBundle, rightBundle *models.Bundle) (matches []Match
 			return nil, nil, err
 		}
 
+		m.addMatches(someMatches, len(matches))
 		matches = append(matches, someMatches...)
 		unmatchables = append(unmatchables, someUnmatchables...)
 	}
 	return matches, unmatchables, nil
 }
 
+// primaryPatient returns the index of the primary Patient in a bundle's Patients: the one with
+// the given ID, or if there's no ID, the only Patient or the one most resources reference.
+func (m *Matcher) primaryPatient(patients []interface{}, id string, references *bundleReferences) (int, error) {
+	if id != "" {
+		for i, patient := range patients {
+			if fhirutil.GetResourceID(patient) == id {
+				return i, nil
+			}
+		}
+		return -1, &BadSourceError{Message: fmt.Sprintf("Primary Patient %s not found in source bundle", id)}
+	}
+
+	primary, most, tied := 0, -1, false
+	for i, patient := range patients {
+		count := references.count(patient)
+		if count > most {
+			primary, most, tied = i, count, false
+		} else if count == most {
+			tied = true
+		}
+	}
+	if tied {
+		return -1, ErrDuplicatePatientResource
+	}
+	return primary, nil
+}
+
+// addMatches records the resources in some matches as matched, so references to them can be
+// compared. offset is the index of the first of them in all matches.
+func (m *Matcher) addMatches(matches []Match, offset int) {
+	if m.leftReferences == nil || m.rightReferences == nil {
+		return
+	}
+	for i, match := range matches {
+		m.leftReferences.addMatch(match.Left, offset+i)
+		m.rightReferences.addMatch(match.Right, offset+i)
+	}
+}
+
 // Collects all resources in a bundle into structs that match their resource types.
 func (m *Matcher) collectResources(bundle *models.Bundle) (resources ResourceMap, err error) {
 	resources = make(ResourceMap)
@@ -119,9 +207,8 @@ func (m *Matcher) collectResources(bundle *models.Bundle) (resources ResourceMap
 		// Get the entry.Resource's type.
 		resourceType := fhirutil.GetResourceType(entry.Resource)
 		// Make sure it's a known FHIR type.
-		s := models.StructForResourceName(resourceType)
-		if s == nil {
-			return nil, fmt.Errorf("Unknown resource type %s", resourceType)
+		if !m.isResourceType(resourceType) {
+			return nil, &BadSourceError{Message: fmt.Sprintf("Unknown resource type %s", resourceType)}
 		}
 
 		resources[resourceType] = append(resources[resourceType], entry.Resource)
@@ -129,6 +216,14 @@ func (m *Matcher) collectResources(bundle *models.Bundle) (resources ResourceMap
 	return resources, nil
 }
 
+// isResourceType reports whether resourceType is a resource in the Matcher's version of FHIR.
+func (m *Matcher) isResourceType(resourceType string) bool {
+	if m.Version != nil {
+		return m.Version.IsResourceType(resourceType)
+	}
+	return fhirutil.STU3.IsResourceType(resourceType) || fhirutil.R4.IsResourceType(resourceType)
+}
+
 // Performs matching without replacement. If a match is found between a left resource and a
 // right resource, a new Match is created and the left and right are removed from their respective
 // slices. Matching stops when there are no elements remaining in one of the slices. The original
@@ -142,10 +237,41 @@ func (m *Matcher) matchWithoutReplacement(lefts, rights []interface{}) (matches
 	copy(rightResources, rights)
 
 	// Build a PathMap for each resource that can be used to compare them. We do this only
-	// once at the start of matching to minimize the use of reflection.
+	// once at the start of matching to minimize traversal.
 	leftPathMaps := m.traverseResources(leftResources)
 	rightPathMaps := m.traverseResources(rightResources)
 
+	// Resources that share an identifier are matched first, whatever else they have in
+	// common. Only the rest are matched by comparing their paths.
+	for i := 0; i < len(leftResources); i++ {
+		for j := 0; j < len(rightResources); j++ {
+			if _, shared := sharedIdentifier(leftPathMaps[i], rightPathMaps[j]); !shared {
+				continue
+			}
+
+			leftResourceType := fhirutil.GetResourceType(leftResources[i])
+			rightResourceType := fhirutil.GetResourceType(rightResources[j])
+			if leftResourceType != rightResourceType {
+				return nil, nil, fmt.Errorf("Mismatched resource types %s and %s, cannot compare", leftResourceType, rightResourceType)
+			}
+
+			matches = append(matches, Match{
+				ResourceType:          leftResourceType,
+				Left:                  leftResources[i],
+				Right:                 rightResources[j],
+				ConflictingIdentifier: m.conflictingIdentifier(leftPathMaps[i], rightPathMaps[j]),
+			})
+
+			// Remove both resources and their PathMaps from their slices.
+			leftResources = append(leftResources[:i], leftResources[i+1:]...)
+			leftPathMaps = append(leftPathMaps[:i], leftPathMaps[i+1:]...)
+			rightResources = append(rightResources[:j], rightResources[j+1:]...)
+			rightPathMaps = append(rightPathMaps[:j], rightPathMaps[j+1:]...)
+			i--
+			break
+		}
+	}
+
 	for len(leftPathMaps) > 0 {
 		// For consistency we always start with the first resource in the left slice.
 		// Remove the resource and PathMap from the front of each slice, then compare
@@ -200,13 +326,26 @@ func (m *Matcher) matchWithoutReplacement(lefts, rights []interface{}) (matches
 	return matches, unmatchables, nil
 }
 
+// conflictingIdentifier returns the identifier two resources share if their content is
+// otherwise clearly different (see IdentifierConflictThreshold), or "" if it isn't.
+func (m *Matcher) conflictingIdentifier(leftPathMap, rightPathMap PathMap) string {
+	identifier, shared := sharedIdentifier(leftPathMap, rightPathMap)
+	if !shared {
+		return ""
+	}
+	if score, comparable := m.matchScore(leftPathMap, rightPathMap); comparable && score >= IdentifierConflictThreshold {
+		return ""
+	}
+	return identifier
+}
+
 // traverses a list of resources, generating a PathMap for each.
 func (m *Matcher) traverseResources(resources []interface{}) []PathMap {
 	pathMaps := make([]PathMap, len(resources))
 
 	for i, resource := range resources {
 		pathmap := make(PathMap)
-		traverse(reflect.ValueOf(resource), pathmap, "")
+		traverse(jsonTree(resource), pathmap, "")
 		pathMaps[i] = pathmap
 	}
 	return pathMaps
@@ -215,18 +354,56 @@ func (m *Matcher) traverseResources(resources []interface{}) []PathMap {
 // comparePaths compares all common paths between two resources. If enough values at those
 // paths "match", the resources are considered a match.
 func (m *Matcher) comparePaths(leftPathMap, rightPathMap PathMap) bool {
+	// Test how many of the common paths were a match. If the percentage of matches exceeds
+	// the configurable MatchThreshold, we've got a match.
+	score, comparable := m.matchScore(leftPathMap, rightPathMap)
+	return comparable && score >= MatchThreshold
+}
+
+// matchScore scores how closely two resources match, from 0 to 1, as the share of their common
+// paths that match. If they have nothing in common to match on, comparable is false.
+func (m *Matcher) matchScore(leftPathMap, rightPathMap PathMap) (score float64, comparable bool) {
+	// Key extensions decide whether the resources match, if they have any in common.
+	if match, decided := m.compareKeyExtensions(leftPathMap, rightPathMap); decided {
+		if match {
+			return 1, true
+		}
+		return 0, true
+	}
+
 	// We can only match on paths in both resources.
 	commonPaths := intersection(leftPathMap.Keys(), rightPathMap.Keys())
 
 	// But don't match on every path - some are unsuitable for matching.
 	matchablePaths := m.stripUnsuitablePaths(commonPaths)
 
-	totalCriteria := float64(len(matchablePaths))
+	// Interval elements (e.g. an Encounter's period) are scored as a whole, by how much
+	// they overlap, rather than path by path.
+	intervalScores, intervalPaths := compareIntervals(leftPathMap, rightPathMap)
+	matchablePaths = setDiff(matchablePaths, intervalPaths)
+
+	// So are Quantities, so their values are compared in the same units.
+	quantityScores, quantityPaths := compareQuantities(leftPathMap, rightPathMap, intervalPaths)
+	matchablePaths = setDiff(matchablePaths, quantityPaths)
+
+	// And CodeableConcepts, so codes from different code systems can match.
+	conceptScores, conceptPaths := compareConcepts(leftPathMap, rightPathMap)
+	matchablePaths = setDiff(matchablePaths, conceptPaths)
+
+	// References to matched resources are a strong signal, though the reference paths
+	// themselves aren't matched on.
+	referenceScores := m.compareReferences(leftPathMap, rightPathMap)
+
+	scores := append(append(append(intervalScores, quantityScores...), conceptScores...), referenceScores...)
+	totalCriteria := float64(len(matchablePaths) + len(scores))
 	matchCounter := 0.0
+	for _, score := range scores {
+		matchCounter += score
+	}
 
 	if totalCriteria == 0 {
 		// There is nothing in-common to match on.
-		return false
+		return 0, false
 	}
 
 	for _, mp := range matchablePaths {
@@ -235,13 +412,59 @@ func (m *Matcher) comparePaths(leftPathMap, rightPathMap PathMap) bool {
 		}
 	}
 
-	// Test how many of the common paths were a match. If the percentage of matches exceeds
-	// the configurable MatchThreshold, we've got a match. At this point totalCriteria is
-	// guaranteed to be greater than 0, making division by 0 impossible.
-	if (matchCounter / totalCriteria) >= MatchThreshold {
-		return true
+	// At this point totalCriteria is guaranteed to be greater than 0, making division by 0
+	// impossible.
+	return matchCounter / totalCriteria, true
+}
+
+// compareKeyExtensions compares the KeyExtensions two resources have in common. If they have
+// any in common, decided is true, and match is whether all of their values are the same. Key
+// extensions given by name are compared separately for each URL with that name, so extensions
+// from different IGs are never compared with each other.
+func (m *Matcher) compareKeyExtensions(leftPathMap, rightPathMap PathMap) (match, decided bool) {
+	for _, url := range keyExtensionURLs(leftPathMap.Keys()) {
+		leftPaths := extensionPaths(leftPathMap.Keys(), url)
+		rightPaths := extensionPaths(rightPathMap.Keys(), url)
+		if len(leftPaths) == 0 || len(rightPaths) == 0 {
+			continue
+		}
+
+		decided = true
+		if len(leftPaths) != len(rightPaths) || len(intersection(leftPaths, rightPaths)) != len(leftPaths) {
+			return false, true
+		}
+		for _, path := range leftPaths {
+			if !m.matchValues(leftPathMap[path], rightPathMap[path]) {
+				return false, true
+			}
+		}
 	}
-	return false
+	return decided, decided
+}
+
+// keyExtensionURLs returns the URLs of the KeyExtensions in a set of paths.
+func keyExtensionURLs(paths []string) []string {
+	urls := []string{}
+	for _, path := range paths {
+		for _, match := range extensionURLRegex.FindAllString(path, -1) {
+			url := match[1 : len(match)-1]
+			if containsExtension(KeyExtensions, url) && !contains(urls, url) {
+				urls = append(urls, url)
+			}
+		}
+	}
+	return urls
+}
+
+// extensionPaths returns the paths to the values of an extension, by URL.
+func extensionPaths(paths []string, url string) []string {
+	extensionPaths := []string{}
+	for _, path := range paths {
+		if strings.Contains(path, "extension("+url+")") || strings.Contains(path, "Extension("+url+")") {
+			extensionPaths = append(extensionPaths, path)
+		}
+	}
+	return extensionPaths
 }
 
 // stripUnsuitablePaths elminiates any paths that are unsuitable for matching,
@@ -250,7 +473,9 @@ func (m *Matcher) stripUnsuitablePaths(paths []string) []string {
 	matchablePaths := make([]string, 0, len(paths))
 
 	for _, path := range paths {
-		if !ciPathContainsAny(path, PathsUnsuitableForComparison) {
+		// Extension URLs (e.g. .../us-core-genderIdentity) aren't considered, since they
+		// may contain unsuitable words by chance.
+		if !ciPathContainsAny(extensionURLRegex.ReplaceAllString(path, "()"), PathsUnsuitableForComparison) {
 			matchablePaths = append(matchablePaths, path)
 		}
 	}
@@ -259,8 +484,8 @@ func (m *Matcher) stripUnsuitablePaths(paths []string) []string {
 
 // matchValues compares 2 reflected values obtained by traversing FHIR resources. The values
 // must be of the same kind to do a comparison. matchValues should only be used to match up values
-// collected by traverse(). Traverse ensures that only primitive go types (strings, bools, ints, etc.)
-// are collected as valid paths for comparison. Matching may be imperfect, or "fuzzy".
+// collected by traverse(). Traverse ensures that only JSON primitives (strings, floats and bools) and
+// dates are collected as valid paths for comparison. Matching may be imperfect, or "fuzzy".
 func (m *Matcher) matchValues(left, right reflect.Value) bool {
 	if left.Kind() != right.Kind() {
 		return false
@@ -308,6 +533,18 @@ func fuzzyFloatMatch(leftFloat, rightFloat float64) bool {
 }
 
 func fuzzyTimeMatch(leftTime, rightTime models.FHIRDateTime) bool {
+	// Dates, and dateTimes without a timezone, match if they're compatible to the day, or to
+	// the precision of the less precise one (e.g. 1950 matches 1950-09-02).
+	if morePrecise(leftTime, rightTime) {
+		leftTime, rightTime = rightTime, leftTime
+	}
+	if precisionRank(leftTime) < precisions[models.Timestamp] {
+		if morePrecise(leftTime, models.FHIRDateTime{Precision: models.Date}) {
+			leftTime.Precision = models.Date
+		}
+		return compatibleDateTimes(leftTime, rightTime)
+	}
+
 	// Check that the times both use the same location.
 	if leftTime.Time.Location() != rightTime.Time.Location() {
 		// If they don't, force them to UTC.
@@ -99,6 +99,57 @@ func (m *MatcherTestSuite) TestMatchBundlesGoodMatch() {
 	m.Equal("58a4904e97bba945de21fac0", fhirutil.GetResourceID(um))
 }
 
+func (m *MatcherTestSuite) TestMatchR4BundlesGoodMatch() {
+	var err error
+
+	// The same as TestMatchBundlesGoodMatch, but with R4 resources.
+	fix, err := fhirutil.LoadVersionResource(fhirutil.R4, "Bundle", "../fixtures/r4/bundles/lowell_abbott_bundle.json")
+	m.NoError(err)
+	leftBundle, ok := fix.(*models.Bundle)
+	m.True(ok)
+
+	fix, err = fhirutil.LoadVersionResource(fhirutil.R4, "Bundle", "../fixtures/r4/bundles/lowell_abbott_unmarried_bundle.json")
+	m.NoError(err)
+	rightBundle, ok := fix.(*models.Bundle)
+	m.True(ok)
+
+	matcher := new(Matcher)
+	matches, unmatchables, err := matcher.Match(leftBundle, rightBundle)
+	m.NoError(err)
+
+	// Most things will match, including the Encounter that has a different timestamp.
+	m.Len(matches, 6)
+	for _, match := range matches {
+		_, ok := match.Left.(map[string]interface{})
+		m.True(ok)
+		_, ok = match.Right.(map[string]interface{})
+		m.True(ok)
+	}
+
+	m.Len(unmatchables, 1)
+	um := unmatchables[0]
+	m.Equal("MedicationStatement", fhirutil.GetResourceType(um))
+	m.Equal("58a4904e97bba945de21fac0", fhirutil.GetResourceID(um))
+}
+
+func (m *MatcherTestSuite) TestMatchR4UnknownResourceType() {
+	bundle := &models.Bundle{
+		Entry: []models.BundleEntryComponent{
+			models.BundleEntryComponent{
+				Resource: map[string]interface{}{"resourceType": "Patient"},
+			},
+			models.BundleEntryComponent{
+				Resource: map[string]interface{}{"resourceType": "Foo"},
+			},
+		},
+	}
+
+	matcher := new(Matcher)
+	_, _, err := matcher.Match(bundle, bundle)
+	m.Error(err)
+	m.Equal("Unknown resource type Foo", err.Error())
+}
+
 func (m *MatcherTestSuite) TestMatchBundlesPartialMatch() {
 	var err error
 
@@ -196,8 +247,9 @@ func (m *MatcherTestSuite) TestErrNoPatientResource() {
 	m.Equal(ErrNoPatientResource, err)
 }
 
-func (m *MatcherTestSuite) TestErrDuplicatePatientResource() {
-	// If one or both bundles has more than one Patient resource, we error out.
+func (m *MatcherTestSuite) TestMatchBundlesDuplicatePatientResource() {
+	// If a bundle has more than one Patient resource, the one most resources reference is
+	// matched to the other bundle's Patient.
 	fix, err := fhirutil.LoadResource("Bundle", "../fixtures/bundles/lowell_abbott_bundle.json")
 	m.NoError(err)
 	leftBundle, ok := fix.(*models.Bundle)
@@ -210,11 +262,25 @@ func (m *MatcherTestSuite) TestErrDuplicatePatientResource() {
 
 	matcher := new(Matcher)
 	matches, unmatchables, err := matcher.Match(leftBundle, rightBundle)
-	m.Error(err)
-	m.Len(matches, 0)
-	m.Len(unmatchables, 0)
+	m.NoError(err)
 
-	m.Equal(ErrDuplicatePatientResource, err)
+	var patientMatch *Match
+	for i := range matches {
+		if matches[i].ResourceType == "Patient" {
+			patientMatch = &matches[i]
+		}
+	}
+	m.NotNil(patientMatch)
+	m.Equal("58a4904e97bba945de21eac8", fhirutil.GetResourceID(patientMatch.Right))
+
+	// The other Patient has nothing to match.
+	var unmatchedPatients []string
+	for _, resource := range unmatchables {
+		if fhirutil.GetResourceType(resource) == "Patient" {
+			unmatchedPatients = append(unmatchedPatients, fhirutil.GetResourceID(resource))
+		}
+	}
+	m.Equal([]string{"58a4904e97bba945de21ebc8"}, unmatchedPatients)
 }
 
 // ========================================================================= //
@@ -542,6 +608,77 @@ func (m *MatcherTestSuite) TestComparePathsMatchLowThresholdNoMatchHighThreshold
 	MatchThreshold = originalThreshold
 }
 
+func (m *MatcherTestSuite) TestComparePathsKeyExtensions() {
+	patient := func(gender, id string) map[string]interface{} {
+		return map[string]interface{}{
+			"resourceType": "Patient",
+			"gender":       gender,
+			"birthDate":    "1950-09-02",
+			"name":         []interface{}{map[string]interface{}{"family": "Abbott", "given": []interface{}{"Lowell"}}},
+			"extension": []interface{}{
+				map[string]interface{}{
+					"url":         "http://example.com/patient-key",
+					"valueString": id,
+				},
+			},
+		}
+	}
+	matcher := new(Matcher)
+	pathmaps := matcher.traverseResources([]interface{}{
+		patient("male", "123"),
+		patient("female", "123"),
+		patient("male", "456"),
+	})
+
+	// Without key extensions, patients with the same demographics match.
+	m.True(matcher.comparePaths(pathmaps[0], pathmaps[2]))
+
+	// With the key extension, only patients with the same key match, whatever else differs.
+	originalKeys := KeyExtensions
+	KeyExtensions = []string{"http://example.com/patient-key"}
+	m.True(matcher.comparePaths(pathmaps[0], pathmaps[1]))
+	m.False(matcher.comparePaths(pathmaps[0], pathmaps[2]))
+	KeyExtensions = originalKeys
+}
+
+func (m *MatcherTestSuite) TestComparePathsKeyExtensionsByName() {
+	patient := func(url, id string) map[string]interface{} {
+		return map[string]interface{}{
+			"resourceType": "Patient",
+			"gender":       "male",
+			"birthDate":    "1950-09-02",
+			"name":         []interface{}{map[string]interface{}{"family": "Abbott", "given": []interface{}{"Lowell"}}},
+			"extension": []interface{}{
+				map[string]interface{}{"url": url, "valueString": id},
+			},
+		}
+	}
+	matcher := new(Matcher)
+	pathmaps := matcher.traverseResources([]interface{}{
+		patient("http://example.com/patient-key", "123"),
+		patient("http://example.com/patient-key", "456"),
+		patient("http://example.org/patient-key", "456"),
+	})
+
+	// Key extensions given by name are compared by URL, so the same name in another IG
+	// doesn't decide the match.
+	originalKeys := KeyExtensions
+	KeyExtensions = []string{"patient-key"}
+	m.False(matcher.comparePaths(pathmaps[0], pathmaps[1]))
+	m.True(matcher.comparePaths(pathmaps[0], pathmaps[2]))
+	KeyExtensions = originalKeys
+}
+
+func (m *MatcherTestSuite) TestStripUnsuitablePathsExtensionNames() {
+	paths := []string{
+		"extension(http://hl7.org/fhir/us/core/StructureDefinition/us-core-genderIdentity).valueCode",
+		"extension(http://hl7.org/fhir/us/core/StructureDefinition/us-core-race).extension(text).valueString",
+		"extension(http://hl7.org/fhir/us/core/StructureDefinition/us-core-race).valueCoding.system",
+	}
+	matcher := new(Matcher)
+	m.Equal(paths[:2], matcher.stripUnsuitablePaths(paths))
+}
+
 // ========================================================================= //
 // TEST MATCH VALUES                                                         //
 // ========================================================================= //
@@ -10,6 +10,9 @@ type Match struct {
 	ResourceType string
 	Left         interface{}
 	Right        interface{}
+	// ConflictingIdentifier is the identifier (system|value) Left and Right were matched by,
+	// if their content is otherwise clearly different.
+	ConflictingIdentifier string
 }
 
 // ResourceMap is used to map a list of resources to their specific type.
@@ -12,6 +12,10 @@ import (
 // Merger is the top-level interface used to merge resources and resolve conflicts.
 type Merger struct {
 	fhirHost string
+
+	// Patient1 and Patient2 are the IDs of the primary Patients in the first and second source
+	// bundles, if they have more than one Patient. See Matcher.
+	Patient1, Patient2 string
 }
 
 // NewMerger returns a pointer to a newly initialized Merger with a known FHIR host.
@@ -24,67 +28,146 @@ func NewMerger(fhirHost string) *Merger {
 // Merge attempts to merge two FHIR Bundles containing patient records. If a merge
 // is successful a new FHIR Bundle containing the merged patient record is returned.
 // If a merge fails, a FHIR Bundle containing one or more OperationOutcomes is
-// returned detailing the merge conflicts.
-func (m *Merger) Merge(source1, source2 string) (outcome *models.Bundle, targetURL string, err error) {
-	// Get the bundles from the host FHIR server.
-	resource1, err := fhirutil.GetResourceByURL("Bundle", source1)
+// returned detailing the merge conflicts. Either way, the duplicates found in each
+// source bundle are returned too.
+func (m *Merger) Merge(source1, source2 string) (outcome *models.Bundle, targetURL string, duplicates []Duplicate, err error) {
+	bundle1, bundle2, err := m.FetchSourceBundles(source1, source2)
 	if err != nil {
-		return nil, "", err
+		return nil, "", nil, err
 	}
-	bundle1, ok := resource1.(*models.Bundle)
-	if !ok {
-		return nil, "", fmt.Errorf("Source 1 (%s) was not a valid bundle", source1)
+	return m.MergeBundles(bundle1, bundle2)
+}
+
+// FetchSourceBundles gets the two source bundles for a merge. The sources must be from the
+// same version of FHIR as the host FHIR server, since the target bundle is created there.
+// The resources in the bundles are generic JSON objects, so none of their elements are lost
+// in the target bundle.
+func (m *Merger) FetchSourceBundles(source1, source2 string) (bundle1, bundle2 *models.Bundle, err error) {
+	hostVersion := fhirutil.HostVersion(m.fhirHost)
+	for i, source := range []string{source1, source2} {
+		if version := fhirutil.URLVersion(source); version != hostVersion {
+			return nil, nil, &BadSourceError{Message: fmt.Sprintf("Source %d (%s) is FHIR %s, but the host FHIR server is FHIR %s", i+1, source, version.Name(), hostVersion.Name())}
+		}
 	}
 
-	resource2, err := fhirutil.GetResourceByURL("Bundle", source2)
+	bundle1, err = fetchSourceBundle(1, source1)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, err
 	}
-	bundle2, ok := resource2.(*models.Bundle)
-	if !ok {
-		return nil, "", fmt.Errorf("Source 2 (%s) was not a valid bundle", source2)
+	bundle2, err = fetchSourceBundle(2, source2)
+	if err != nil {
+		return nil, nil, err
 	}
+	return bundle1, bundle2, nil
+}
 
-	// Start by matching all resources in each bundle.
-	matcher := new(Matcher)
+// fetchSourceBundle gets one of the source bundles for a merge. Sources that don't exist
+// are BadSourceErrors.
+func fetchSourceBundle(n int, source string) (*models.Bundle, error) {
+	bundle, err := fhirutil.GetJSONBundle(source)
+	if err != nil {
+		if _, ok := err.(*fhirutil.NotFoundError); ok {
+			return nil, &BadSourceError{Message: fmt.Sprintf("Source %d (%s) was not found", n, source)}
+		}
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// MergeBundles merges two source bundles that have already been fetched from the
+// host FHIR server. See Merge.
+func (m *Merger) MergeBundles(bundle1, bundle2 *models.Bundle) (outcome *models.Bundle, targetURL string, duplicates []Duplicate, err error) {
+	matcher := &Matcher{
+		Version:      fhirutil.HostVersion(m.fhirHost),
+		LeftPatient:  m.Patient1,
+		RightPatient: m.Patient2,
+	}
+
+	// Index both bundles before any IDs change, so the references between their resources
+	// can be rewritten to the resources they become in the target.
+	sources := []*targetReferences{nil, newTargetReferences(bundle1), newTargetReferences(bundle2)}
+
+	// Start by removing any duplicates within each bundle, so they aren't duplicated
+	// in the target.
+	bundle1, duplicates1 := matcher.Deduplicate(bundle1, 1)
+	bundle2, duplicates2 := matcher.Deduplicate(bundle2, 2)
+	duplicates = append(duplicates1, duplicates2...)
+
+	// Then match all resources in each bundle.
 	matches, unmatchables, err := matcher.Match(bundle1, bundle2)
 	if err != nil {
-		return nil, "", err
+		return nil, "", nil, err
 	}
 
 	// Then identify conflicts between the match pairs. This process creates 2 things:
 	// 1. targetResources for a targetBundle
 	// 2. OperationOutcomes (oos) representing conflicts in a targetResource
 	// len(oos) <= len(targetResources) depending on what resources have conflicts
+	// targetSources is the source bundle each target resource's references are from.
 	detector := new(Detector)
 	targetResources := make([]interface{}, 0, len(matches))
+	targetSources := make([]*targetReferences, 0, len(matches))
 	opOutcomes := make([]models.OperationOutcome, 0, len(matches))
 
 	for _, match := range matches {
+		leftKey, rightKey := resourceKey(match.Left), resourceKey(match.Right)
 		targetResource, conflictOpOutcome := detector.Conflicts(&match)
 		if conflictOpOutcome != nil {
 			opOutcomes = append(opOutcomes, *conflictOpOutcome)
 		}
+		sources[1].add(leftKey, targetResource)
+		sources[2].add(rightKey, targetResource)
 		targetResources = append(targetResources, targetResource)
+		targetSources = append(targetSources, sources[1])
 	}
 
-	// Unmatchables get new IDs for the target bundle.
+	// Duplicates that may not really be duplicates are kept in the target, so a reviewer
+	// can decide. Each is a conflict of its own. References to the others are references
+	// to the resource they duplicate.
+	for i := range duplicates {
+		if !duplicates[i].Ambiguous {
+			sources[duplicates[i].Source].addDuplicate(&duplicates[i])
+			continue
+		}
+		removedKey := resourceKey(duplicates[i].removed)
+		targetResource, duplicateOpOutcome := detector.DuplicateConflict(&duplicates[i])
+		opOutcomes = append(opOutcomes, *duplicateOpOutcome)
+		sources[duplicates[i].Source].add(removedKey, targetResource)
+		targetResources = append(targetResources, targetResource)
+		targetSources = append(targetSources, sources[duplicates[i].Source])
+	}
+
+	// Unmatchables get new IDs for the target bundle. Those of the InclusionResourceTypes
+	// are each a conflict of their own, so a reviewer decides whether they're included.
 	for _, umatch := range unmatchables {
+		source := sourceOf(umatch, bundle1)
+		sourceKey := resourceKey(umatch)
 		fhirutil.SetResourceID(umatch, bson.NewObjectId().Hex())
+		sources[source].add(sourceKey, umatch)
+		targetResources = append(targetResources, umatch)
+		targetSources = append(targetSources, sources[source])
+		if reviewInclusion(fhirutil.GetResourceType(umatch)) {
+			opOutcomes = append(opOutcomes, *detector.InclusionConflict(umatch, source))
+		}
+	}
+
+	// Now that every target resource has its ID, point their references at each other.
+	for i := range targetResources {
+		targetResources[i] = targetSources[i].rewrite(targetResources[i])
 	}
 
 	if len(opOutcomes) == 0 {
 		// The merge had no conflicts, so just returned the merged bundle.
-		responseBundle := fhirutil.ResponseBundle("200", append(targetResources, unmatchables...))
-		return responseBundle, "", nil
+		responseBundle := fhirutil.ResponseBundle("200", targetResources)
+		return responseBundle, "", duplicates, nil
 	}
 
 	// This merge had one or more conflicts, so we'll be preparing for a new
 	// merge session by POSTing the target bundle.
-	targetBundle := fhirutil.TransactionBundle(append(targetResources, unmatchables...))
+	targetBundle := fhirutil.TransactionBundle(targetResources)
 	createdTarget, err := fhirutil.PostResource(m.fhirHost, "Bundle", targetBundle)
 	if err != nil {
-		return nil, "", err
+		return nil, "", nil, err
 	}
 	targetURL = m.fhirHost + "/Bundle/" + fhirutil.GetResourceID(createdTarget)
 
@@ -97,28 +180,29 @@ func (m *Merger) Merge(source1, source2 string) (outcome *models.Bundle, targetU
 			// Deleting the target to be safe. The error for DeleteResourceByURL is not checked
 			// since we're already in an error state.
 			fhirutil.DeleteResourceByURL(targetURL)
-			return nil, "", err
+			return nil, "", nil, err
 		}
 		createdOpOutcomes[i] = created
 	}
 
 	// Return the bundle of OperationOutcomes.
 	responseBundle := fhirutil.ResponseBundle("201", createdOpOutcomes)
-	return responseBundle, targetURL, nil
+	return responseBundle, targetURL, duplicates, nil
 }
 
 // ResolveConflict attempts to resolve a single merge conflict. If the conflict
 // resolution is successful and no more conflicts exist, the merged FHIR Bundle is
 // returned. If additional conflicts still exist or the conflict resolution was not
 // successful, a FHIR Bundle of OperationOutcomes is returned detailing the remaining
-// merge conflicts.
+// merge conflicts. updatedResource replaces the target resource, or may be a FHIRPath
+// Patch (a Parameters resource) of replace operations to apply to it.
 func (m *Merger) ResolveConflict(targetBundleURL, targetResourceID string, updatedResource interface{}) error {
-	// Get the merge target.
-	target, err := fhirutil.GetResourceByURL("Bundle", targetBundleURL)
+	// Get the merge target, leaving its resources as generic JSON objects so nothing is lost
+	// when it's updated.
+	targetBundle, err := fhirutil.GetJSONBundle(targetBundleURL)
 	if err != nil {
 		return err
 	}
-	targetBundle := target.(*models.Bundle)
 
 	// Find the targetResource of this conflict in the bundle.
 	targetResourceIdx := -1
@@ -131,21 +215,14 @@ func (m *Merger) ResolveConflict(targetBundleURL, targetResourceID string, updat
 
 	if targetResourceIdx == -1 {
 		// The target resource was not found.
-		return fmt.Errorf("Target resource %s not found in target bundle %s", targetResourceID, targetBundleURL)
+		return &fhirutil.NotFoundError{Resource: targetResourceID, In: "target bundle " + targetBundleURL}
 	}
 
-	// Check that the resources are the same type. If not, we've got a problem!
-	updatedResourceType := fhirutil.GetResourceType(updatedResource)
-	targetResourceType := fhirutil.GetResourceType(targetBundle.Entry[targetResourceIdx].Resource)
-	if updatedResourceType != targetResourceType {
-		if updatedResourceType == "" {
-			// We couldn't figure out what type it was (probably because the request body was garbage), so we'll need a placeholder.
-			updatedResourceType = "Unknown"
-		}
-		return fmt.Errorf("Updated resource of type %s does not match target resource of type %s", updatedResourceType, targetResourceType)
+	// Update the target resource with the one provided, or patch it.
+	updatedResource, err = updatedTargetResource(targetBundle.Entry[targetResourceIdx].Resource, updatedResource)
+	if err != nil {
+		return err
 	}
-
-	// Update the target resource with the one provided.
 	targetBundle.Entry[targetResourceIdx].Resource = updatedResource
 
 	// PUT the updated bundle.
@@ -158,15 +235,16 @@ func (m *Merger) ResolveConflict(targetBundleURL, targetResourceID string, updat
 	return nil
 }
 
-// UpdateTargetResource updates a single resource in the target bundle, by ID.
-func (m *Merger) UpdateTargetResource(targetBundleURL, targetResourceID string, updatedResource interface{}) error {
+// UpdateTargetResource updates a single resource in the target bundle, by ID, returning
+// the updated resource. As with ResolveConflict, the update may be a FHIRPath Patch.
+func (m *Merger) UpdateTargetResource(targetBundleURL, targetResourceID string, updatedResource interface{}) (interface{}, error) {
 
-	// Get the merge target.
-	target, err := fhirutil.GetResourceByURL("Bundle", targetBundleURL)
+	// Get the merge target, leaving its resources as generic JSON objects so nothing is lost
+	// when it's updated.
+	targetBundle, err := fhirutil.GetJSONBundle(targetBundleURL)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	targetBundle := target.(*models.Bundle)
 
 	// Find the resource to update.
 	targetResourceIdx := -1
@@ -179,42 +257,131 @@ func (m *Merger) UpdateTargetResource(targetBundleURL, targetResourceID string,
 
 	if targetResourceIdx == -1 {
 		// The target resource was not found.
-		return fmt.Errorf("Target resource %s not found in target bundle %s", targetResourceID, targetBundleURL)
+		return nil, &fhirutil.NotFoundError{Resource: targetResourceID, In: "target bundle " + targetBundleURL}
 	}
 
-	// Check that the resources are the same type. If not, we've got a problem!
+	// Update the target resource with the one provided, or patch it.
+	updatedResource, err = updatedTargetResource(targetBundle.Entry[targetResourceIdx].Resource, updatedResource)
+	if err != nil {
+		return nil, err
+	}
+	targetBundle.Entry[targetResourceIdx].Resource = updatedResource
+
+	// PUT the updated bundle.
+	_, err = fhirutil.UpdateResource(m.fhirHost, "Bundle", targetBundle)
+	if err != nil {
+		return nil, err
+	}
+
+	// No error means the resource was updated successfully.
+	return updatedResource, nil
+}
+
+// updatedTargetResource returns a target resource as updated by a request: either the
+// resource provided, which must be of the same type, or the target resource with a FHIRPath
+// Patch (a Parameters resource) applied to it.
+func updatedTargetResource(targetResource, updatedResource interface{}) (interface{}, error) {
 	updatedResourceType := fhirutil.GetResourceType(updatedResource)
-	targetResourceType := fhirutil.GetResourceType(targetBundle.Entry[targetResourceIdx].Resource)
+	targetResourceType := fhirutil.GetResourceType(targetResource)
+	if updatedResourceType == "Parameters" && targetResourceType != "Parameters" {
+		target, ok := targetResource.(map[string]interface{})
+		patch, patchOK := updatedResource.(map[string]interface{})
+		if !ok || !patchOK {
+			return nil, &fhirutil.PatchError{Message: "FHIRPath Patches can only be applied to resources decoded from JSON"}
+		}
+		err := fhirutil.ApplyFHIRPathPatch(target, patch)
+		if err != nil {
+			return nil, err
+		}
+		return target, nil
+	}
+
+	// Check that the resources are the same type. If not, we've got a problem!
 	if updatedResourceType != targetResourceType {
 		if updatedResourceType == "" {
 			// We couldn't figure out what type it was (probably because the request body was garbage), so we'll need a placeholder.
 			updatedResourceType = "Unknown"
 		}
-		return fmt.Errorf("Updated resource of type %s does not match target resource of type %s", updatedResourceType, targetResourceType)
+		return nil, &TypeMismatchError{Expected: targetResourceType, Actual: updatedResourceType}
 	}
+	return updatedResource, nil
+}
 
-	// Update the target resource with the one provided.
-	targetBundle.Entry[targetResourceIdx].Resource = updatedResource
+// PairTargetResources merges a resource in the target bundle into another, as if they had
+// been matched, e.g. to pair an unmatchable resource with the resource it should have matched.
+// The merged resource keeps targetResourceID, and the paired resource is removed from the
+// target. If the merged resource has conflicts, they're returned as an OperationOutcome.
+func (m *Merger) PairTargetResources(targetBundleURL, targetResourceID, pairedResourceID string) (conflict *models.OperationOutcome, err error) {
+	// Get the merge target, leaving its resources as generic JSON objects so nothing is lost
+	// when it's updated.
+	targetBundle, err := fhirutil.GetJSONBundle(targetBundleURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find both resources.
+	targetIdx, pairedIdx := -1, -1
+	for i, entry := range targetBundle.Entry {
+		switch fhirutil.GetResourceID(entry.Resource) {
+		case targetResourceID:
+			targetIdx = i
+		case pairedResourceID:
+			pairedIdx = i
+		}
+	}
+	if targetIdx == -1 {
+		return nil, &fhirutil.NotFoundError{Resource: targetResourceID, In: "target bundle " + targetBundleURL}
+	}
+	if pairedIdx == -1 {
+		return nil, &fhirutil.NotFoundError{Resource: pairedResourceID, In: "target bundle " + targetBundleURL}
+	}
+
+	// Only resources of the same type can be paired.
+	targetResource := targetBundle.Entry[targetIdx].Resource
+	pairedResource := targetBundle.Entry[pairedIdx].Resource
+	targetResourceType := fhirutil.GetResourceType(targetResource)
+	if pairedResourceType := fhirutil.GetResourceType(pairedResource); pairedResourceType != targetResourceType {
+		return nil, &TypeMismatchError{Expected: targetResourceType, Actual: pairedResourceType}
+	}
+
+	// Merge the paired resource into the target resource, then remove it.
+	detector := new(Detector)
+	merged, conflict := detector.conflicts(&Match{
+		ResourceType: targetResourceType,
+		Left:         targetResource,
+		Right:        pairedResource,
+	}, targetResourceID)
+	targetBundle.Entry[targetIdx].Resource = merged
+	targetBundle.Entry = append(targetBundle.Entry[:pairedIdx], targetBundle.Entry[pairedIdx+1:]...)
+
+	// Other resources that referenced the paired resource now reference the target resource.
+	pairedKey, targetKey := targetResourceType+"/"+pairedResourceID, targetResourceType+"/"+targetResourceID
+	for _, entry := range targetBundle.Entry {
+		rewriteReferences(entry.Resource, func(reference string) string {
+			if referenceKey(reference) == pairedKey {
+				return targetKey
+			}
+			return reference
+		})
+	}
 
 	// PUT the updated bundle.
 	_, err = fhirutil.UpdateResource(m.fhirHost, "Bundle", targetBundle)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	// No error means the resource was updated successfully.
-	return nil
+	return conflict, nil
 }
 
 // DeleteTargetResource deletes a single resource in the target bundle, by ID.
 func (m *Merger) DeleteTargetResource(targetBundleURL, targetResourceID string) error {
 
-	// Get the merge target.
-	target, err := fhirutil.GetResourceByURL("Bundle", targetBundleURL)
+	// Get the merge target, leaving its resources as generic JSON objects so nothing is lost
+	// when it's updated.
+	targetBundle, err := fhirutil.GetJSONBundle(targetBundleURL)
 	if err != nil {
 		return err
 	}
-	targetBundle := target.(*models.Bundle)
 
 	// Find the resource to update.
 	found := false
@@ -232,7 +399,7 @@ func (m *Merger) DeleteTargetResource(targetBundleURL, targetResourceID string)
 
 	if !found {
 		// The target resource was not found.
-		return fmt.Errorf("Target resource %s not found in target bundle %s", targetResourceID, targetBundleURL)
+		return &fhirutil.NotFoundError{Resource: targetResourceID, In: "target bundle " + targetBundleURL}
 	}
 
 	// Update the target resource with one less entry.
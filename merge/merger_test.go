@@ -1,7 +1,6 @@
 package merge
 
 import (
-	"errors"
 	"net/http/httptest"
 	"strings"
 	"testing"
@@ -73,7 +72,7 @@ func (m *MergerTestSuite) TestMergePerfectMatch() {
 	merger := NewMerger(m.FHIRServer.URL)
 	source1 := m.FHIRServer.URL + "/Bundle/" + leftBundle.Id
 	source2 := m.FHIRServer.URL + "/Bundle/" + rightBundle.Id
-	outcome, targetURL, err := merger.Merge(source1, source2)
+	outcome, targetURL, _, err := merger.Merge(source1, source2)
 	m.NoError(err)
 	m.NotNil(outcome)
 	m.Empty(targetURL) // No target was created
@@ -98,7 +97,7 @@ func (m *MergerTestSuite) TestMergePartialMatch() {
 	source1 := m.FHIRServer.URL + "/Bundle/" + leftBundle.Id
 	source2 := m.FHIRServer.URL + "/Bundle/" + rightBundle.Id
 
-	outcome, targetURL, err := merger.Merge(source1, source2)
+	outcome, targetURL, _, err := merger.Merge(source1, source2)
 	m.NoError(err)
 	m.NotNil(outcome)
 	m.NotEmpty(targetURL)
@@ -157,7 +156,8 @@ func (m *MergerTestSuite) TestMergePartialMatch() {
 		issue := oo.Issue[0]
 		m.Equal("information", issue.Severity)
 		m.Equal("conflict", issue.Code)
-		m.Len(issue.Location, 2)
+		m.Len(issue.Expression, 2)
+		m.Equal(issue.Expression, issue.Location)
 		m.NotEmpty(issue.Diagnostics)
 
 		// Validate the Patient conflicts.
@@ -165,8 +165,8 @@ func (m *MergerTestSuite) TestMergePartialMatch() {
 			// Reference to the new Patient resource in the target bundle.
 			m.Len(issue.Diagnostics, len("Patient:"+bson.NewObjectId().Hex()))
 
-			for _, loc := range issue.Location {
-				m.True(contains([]string{"maritalStatus.coding[0].display", "maritalStatus.coding[0].code"}, loc))
+			for _, loc := range issue.Expression {
+				m.True(contains([]string{"Patient.maritalStatus.coding[0].display", "Patient.maritalStatus.coding[0].code"}, loc))
 			}
 			continue
 		}
@@ -176,14 +176,31 @@ func (m *MergerTestSuite) TestMergePartialMatch() {
 			// Reference to the new Encounter resource in the target bundle.
 			m.Len(issue.Diagnostics, len("Encounter:"+bson.NewObjectId().Hex()))
 
-			for _, loc := range issue.Location {
-				m.True(contains([]string{"period.start", "period.end"}, loc))
+			for _, loc := range issue.Expression {
+				m.True(contains([]string{"Encounter.period.start", "Encounter.period.end"}, loc))
 			}
 			continue
 		}
 	}
 }
 
+func (m *MergerTestSuite) TestMergeSourceVersionMismatch() {
+	created, err := fhirutil.LoadAndPostResource(m.FHIRServer.URL, "Bundle", "../fixtures/bundles/lowell_abbott_bundle.json")
+	m.NoError(err)
+	leftBundle, ok := created.(*models.Bundle)
+	m.True(ok)
+
+	// The host FHIR server is STU3, but the second source is on an R4 server.
+	fhirutil.SetHostVersion("http://r4.example.com/fhir", fhirutil.R4)
+	source1 := m.FHIRServer.URL + "/Bundle/" + leftBundle.Id
+	source2 := "http://r4.example.com/fhir/Bundle/123"
+
+	merger := NewMerger(m.FHIRServer.URL)
+	_, _, _, err = merger.Merge(source1, source2)
+	m.IsType(&BadSourceError{}, err)
+	m.Equal("Source 2 (http://r4.example.com/fhir/Bundle/123) is FHIR R4, but the host FHIR server is FHIR STU3", err.Error())
+}
+
 func (m *MergerTestSuite) TestMergePoorMatch() {
 	// Minimally the Patient resource matches, but everything else doesn't.
 	created, err := fhirutil.LoadAndPostResource(m.FHIRServer.URL, "Bundle", "../fixtures/bundles/lowell_abbott_bundle.json")
@@ -200,7 +217,7 @@ func (m *MergerTestSuite) TestMergePoorMatch() {
 	source1 := m.FHIRServer.URL + "/Bundle/" + leftBundle.Id
 	source2 := m.FHIRServer.URL + "/Bundle/" + rightBundle.Id
 
-	outcome, targetURL, err := merger.Merge(source1, source2)
+	outcome, targetURL, _, err := merger.Merge(source1, source2)
 	m.NoError(err)
 	m.NotNil(outcome)
 	m.NotEmpty(targetURL)
@@ -212,17 +229,18 @@ func (m *MergerTestSuite) TestMergePoorMatch() {
 	m.Len(oo.Issue, 1)
 
 	issue := oo.Issue[0]
-	m.Len(issue.Location, 7)
-	for _, loc := range issue.Location {
+	m.Len(issue.Expression, 7)
+	m.Equal(issue.Expression, issue.Location)
+	for _, loc := range issue.Expression {
 		m.True(contains(
 			[]string{
-				"id",
-				"birthDate",
-				"address[0].line[0]",
-				"telecom[0].use",
-				"telecom[0].system",
-				"telecom[0].value",
-				"name[0].suffix[0]",
+				"Patient.id",
+				"Patient.birthDate",
+				"Patient.address[0].line[0]",
+				"Patient.telecom[0].use",
+				"Patient.telecom[0].system",
+				"Patient.telecom[0].value",
+				"Patient.name[0].suffix[0]",
 			},
 			loc,
 		))
@@ -290,7 +308,7 @@ func (m *MergerTestSuite) TestGodawfulMatch() {
 	source1 := m.FHIRServer.URL + "/Bundle/" + leftBundle.Id
 	source2 := m.FHIRServer.URL + "/Bundle/" + rightBundle.Id
 
-	outcome, targetURL, err := merger.Merge(source1, source2)
+	outcome, targetURL, _, err := merger.Merge(source1, source2)
 	m.NoError(err)
 	m.NotNil(outcome)
 	m.NotEmpty(targetURL)
@@ -305,7 +323,8 @@ func (m *MergerTestSuite) TestGodawfulMatch() {
 	// Should be referencing a Patient resource.
 	m.True(strings.Contains(issue.Diagnostics, "Patient"))
 	// Many paths with conflicts.
-	m.Len(issue.Location, 9)
+	m.Len(issue.Expression, 9)
+	m.Equal(issue.Expression, issue.Location)
 }
 
 // ========================================================================= //
@@ -329,7 +348,7 @@ func (m *MergerTestSuite) TestResolveConflict() {
 	source1 := m.FHIRServer.URL + "/Bundle/" + leftBundle.Id
 	source2 := m.FHIRServer.URL + "/Bundle/" + rightBundle.Id
 
-	outcome, targetURL, err := merger.Merge(source1, source2)
+	outcome, targetURL, _, err := merger.Merge(source1, source2)
 	m.NoError(err)
 	m.NotNil(outcome)
 	m.NotEmpty(targetURL)
@@ -391,7 +410,7 @@ func (m *MergerTestSuite) TestResolveConflictWrongResource() {
 	source1 := m.FHIRServer.URL + "/Bundle/" + leftBundle.Id
 	source2 := m.FHIRServer.URL + "/Bundle/" + rightBundle.Id
 
-	outcome, targetURL, err := merger.Merge(source1, source2)
+	outcome, targetURL, _, err := merger.Merge(source1, source2)
 	m.NoError(err)
 	m.NotNil(outcome)
 	m.NotEmpty(targetURL)
@@ -416,5 +435,68 @@ func (m *MergerTestSuite) TestResolveConflictWrongResource() {
 	m.NoError(err)
 	err = merger.ResolveConflict(targetURL, targetPatientID, encounterResource)
 	m.Error(err)
-	m.Equal(errors.New("Updated resource of type Encounter does not match target resource of type Patient"), err)
+	m.Equal(&TypeMismatchError{Expected: "Patient", Actual: "Encounter"}, err)
+	m.Equal("Updated resource of type Encounter does not match target resource of type Patient", err.Error())
+}
+
+func (m *MergerTestSuite) TestResolveConflictWithPatch() {
+	created, err := fhirutil.LoadAndPostResource(m.FHIRServer.URL, "Bundle", "../fixtures/bundles/lowell_abbott_bundle.json")
+	m.NoError(err)
+	leftBundle, ok := created.(*models.Bundle)
+	m.True(ok)
+
+	created2, err := fhirutil.LoadAndPostResource(m.FHIRServer.URL, "Bundle", "../fixtures/bundles/lowell_abbott_unmarried_bundle.json")
+	m.NoError(err)
+	rightBundle, ok := created2.(*models.Bundle)
+	m.True(ok)
+
+	merger := NewMerger(m.FHIRServer.URL)
+	source1 := m.FHIRServer.URL + "/Bundle/" + leftBundle.Id
+	source2 := m.FHIRServer.URL + "/Bundle/" + rightBundle.Id
+
+	outcome, targetURL, _, err := merger.Merge(source1, source2)
+	m.NoError(err)
+
+	var targetPatientID string
+	for _, entry := range outcome.Entry {
+		oo, ok := entry.Resource.(*models.OperationOutcome)
+		m.True(ok)
+		if strings.Contains(oo.Issue[0].Diagnostics, "Patient") {
+			targetPatientID = strings.SplitN(oo.Issue[0].Diagnostics, ":", 2)[1]
+		}
+	}
+	m.NotEmpty(targetPatientID)
+
+	// Resolve the conflict by patching only the marital status.
+	patch, err := fhirutil.UnmarshalJSONResource([]byte(`{
+		"resourceType": "Parameters",
+		"parameter": [{"name": "operation", "part": [
+			{"name": "type", "valueCode": "replace"},
+			{"name": "path", "valueString": "Patient.maritalStatus"},
+			{"name": "value", "valueCodeableConcept": {"text": "Unmarried"}}
+		]}]
+	}`))
+	m.NoError(err)
+	err = merger.ResolveConflict(targetURL, targetPatientID, patch)
+	m.NoError(err)
+
+	target, err := fhirutil.GetResourceByURL("Bundle", targetURL)
+	m.NoError(err)
+	targetBundle, ok := target.(*models.Bundle)
+	m.True(ok)
+	for _, entry := range targetBundle.Entry {
+		if fhirutil.GetResourceID(entry.Resource) == targetPatientID {
+			targetPatient, ok := entry.Resource.(*models.Patient)
+			m.True(ok)
+			m.Equal("Unmarried", targetPatient.MaritalStatus.Text)
+			m.NotEmpty(targetPatient.Name)
+		}
+	}
+
+	// Patches that don't select a single element are rejected.
+	patch["parameter"].([]interface{})[0].(map[string]interface{})["part"].([]interface{})[1] = map[string]interface{}{
+		"name": "path", "valueString": "Patient.name.given",
+	}
+	err = merger.ResolveConflict(targetURL, targetPatientID, patch)
+	m.IsType(&fhirutil.PatchError{}, err)
 }
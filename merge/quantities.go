@@ -0,0 +1,167 @@
+package merge
+
+import (
+	"math"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// QuantityTolerance is how far apart two Quantities may be to still be considered the same.
+// They match if they're within either tolerance.
+type QuantityTolerance struct {
+	// Relative is a fraction of the larger value, e.g. 0.01 for 1%.
+	Relative float64
+	// Absolute is an amount in Unit (a UCUM code), e.g. 0.1 kg.
+	Absolute float64
+	Unit     string
+}
+
+var (
+	// QuantityTolerances are the tolerances for the Quantities of Observations, by the
+	// Observation's code (e.g. LOINC 29463-7 for body weight).
+	QuantityTolerances = map[string]QuantityTolerance{
+		"29463-7": {Relative: 0.01, Absolute: 0.1, Unit: "kg"},     // Body weight
+		"8302-2":  {Absolute: 1, Unit: "cm"},                       // Body height
+		"39156-5": {Absolute: 0.1, Unit: "kg/m2"},                  // Body mass index
+		"8310-5":  {Absolute: 0.1, Unit: "Cel"},                    // Body temperature
+		"8867-4":  {Absolute: 2, Unit: "/min"},                     // Heart rate
+		"9279-1":  {Absolute: 1, Unit: "/min"},                     // Respiratory rate
+		"8480-6":  {Absolute: 2, Unit: "mm[Hg]"},                   // Systolic blood pressure
+		"8462-4":  {Absolute: 2, Unit: "mm[Hg]"},                   // Diastolic blood pressure
+		"2339-0":  {Relative: 0.02, Absolute: 1, Unit: "mg/dL"},    // Glucose
+		"2093-3":  {Relative: 0.02, Absolute: 1, Unit: "mg/dL"},    // Total cholesterol
+		"4548-4":  {Absolute: 0.1, Unit: "%"},                      // Hemoglobin A1c
+		"718-7":   {Relative: 0.01, Absolute: 0.1, Unit: "g/dL"},   // Hemoglobin
+		"2160-0":  {Relative: 0.02, Absolute: 0.05, Unit: "mg/dL"}, // Creatinine
+	}
+
+	// DefaultQuantityTolerance is the tolerance for Quantities without one in QuantityTolerances.
+	DefaultQuantityTolerance = QuantityTolerance{Relative: 0.001}
+)
+
+// quantity is a Quantity found in a resource.
+type quantity struct {
+	value float64
+	unit  string
+}
+
+// codingCodeRegex matches the paths to the codes of a CodeableConcept named code, e.g.
+// code.coding[0].code, capturing the path to the CodeableConcept's parent.
+var codingCodeRegex = regexp.MustCompile(`^(?:(.*)\.)?code\.coding\[\d+\]\.code$`)
+
+// compareQuantities compares the Quantities two resources have at the same paths, converting
+// their units if they differ, returning a score (1 or 0) for each. The paths to those Quantities
+// in both resources are also returned, since they're compared as a whole rather than path by
+// path. Quantities without units, or with paths in exclude (e.g. those compared as intervals),
+// aren't compared.
+func compareQuantities(leftPathMap, rightPathMap PathMap, exclude []string) (scores []float64, paths []string) {
+	isObservation := false
+	if resourceType, ok := leftPathMap["resourceType"]; ok {
+		isObservation = resourceType.String() == "Observation"
+	}
+
+	for _, path := range leftPathMap.Keys() {
+		if !strings.HasSuffix(path, ".value") || contains(exclude, path) {
+			continue
+		}
+		prefix := strings.TrimSuffix(path, ".value")
+		left, leftOK := quantityAt(leftPathMap, prefix)
+		right, rightOK := quantityAt(rightPathMap, prefix)
+		if !leftOK || !rightOK || left.unit == "" || right.unit == "" {
+			continue
+		}
+
+		tolerance := DefaultQuantityTolerance
+		if isObservation {
+			tolerance = quantityTolerance(leftPathMap, prefix)
+		}
+		if matchQuantities(left, right, tolerance) {
+			scores = append(scores, 1)
+		} else {
+			scores = append(scores, 0)
+		}
+		paths = append(paths, subPaths(leftPathMap, prefix)...)
+		paths = append(paths, subPaths(rightPathMap, prefix)...)
+	}
+	return scores, paths
+}
+
+// quantityAt returns the Quantity at a path, if there is one. Its unit is its code, or if it
+// has no code, its human-readable unit.
+func quantityAt(paths PathMap, path string) (q quantity, ok bool) {
+	value, ok := paths[path+".value"]
+	if !ok || value.Kind() != reflect.Float64 {
+		return q, false
+	}
+	q.value = value.Float()
+	q.unit = quantityUnit(paths, path)
+	return q, true
+}
+
+// quantityPaths returns the paths to all of the elements of a Quantity.
+func subPaths(paths PathMap, path string) (elements []string) {
+	for _, p := range paths.Keys() {
+		if strings.HasPrefix(p, path+".") {
+			elements = append(elements, p)
+		}
+	}
+	return elements
+}
+
+// quantityTolerance returns the tolerance for a Quantity in an Observation, by the code of the
+// nearest element containing it that has one (e.g. a component's code, then the Observation's).
+func quantityTolerance(paths PathMap, path string) QuantityTolerance {
+	best, found := "", false
+	var tolerance QuantityTolerance
+	for _, p := range paths.Keys() {
+		match := codingCodeRegex.FindStringSubmatch(p)
+		if match == nil || paths[p].Kind() != reflect.String {
+			continue
+		}
+		parent := match[1]
+		if parent != "" && !strings.HasPrefix(path, parent+".") {
+			continue
+		}
+		t, ok := QuantityTolerances[paths[p].String()]
+		if ok && (!found || len(parent) > len(best)) {
+			best, found, tolerance = parent, true, t
+		}
+	}
+	if !found {
+		return DefaultQuantityTolerance
+	}
+	return tolerance
+}
+
+// matchQuantities tests if two Quantities are the same within a tolerance. Quantities with
+// different units are converted if both units are known and measure the same thing, e.g. kg
+// and [lb_av], but otherwise don't match.
+func matchQuantities(left, right quantity, tolerance QuantityTolerance) bool {
+	leftValue, rightValue := left.value, right.value
+	absolute := tolerance.Absolute
+
+	leftUnit, leftKnown := lookupUnit(left.unit)
+	rightUnit, rightKnown := lookupUnit(right.unit)
+	if leftKnown && rightKnown {
+		if leftUnit.dimension != rightUnit.dimension {
+			return false
+		}
+		leftValue, rightValue = leftUnit.toBase(leftValue), rightUnit.toBase(rightValue)
+		if toleranceUnit, ok := lookupUnit(tolerance.Unit); ok && toleranceUnit.dimension == leftUnit.dimension {
+			absolute *= toleranceUnit.factor
+		} else {
+			absolute = 0
+		}
+	} else if left.unit != right.unit {
+		return false
+	} else if tolerance.Unit != "" && tolerance.Unit != left.unit {
+		absolute = 0
+	}
+
+	difference := math.Abs(leftValue - rightValue)
+	if difference <= absolute || difference <= FloatTolerance {
+		return true
+	}
+	return difference <= tolerance.Relative*math.Max(math.Abs(leftValue), math.Abs(rightValue))
+}
@@ -0,0 +1,114 @@
+package merge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type QuantitiesTestSuite struct {
+	suite.Suite
+}
+
+func TestQuantitiesTestSuite(t *testing.T) {
+	suite.Run(t, new(QuantitiesTestSuite))
+}
+
+func (q *QuantitiesTestSuite) observation(code string, value float64, unit string) PathMap {
+	return pathMap(fixture(observationFixture, map[string]interface{}{
+		"code": codeableConcept("http://loinc.org", code, ""),
+		"valueQuantity": map[string]interface{}{
+			"value":  value,
+			"unit":   unit,
+			"system": "http://unitsofmeasure.org",
+			"code":   unit,
+		},
+	}))
+}
+
+func (q *QuantitiesTestSuite) TestLookupUnit() {
+	kg, ok := lookupUnit("kg")
+	q.True(ok)
+	q.Equal(70000.0, kg.toBase(70))
+
+	lb, ok := lookupUnit("lbs")
+	q.True(ok)
+	q.InDelta(70000.0, lb.toBase(154.3236), 0.1)
+
+	degF, ok := lookupUnit("[degF]")
+	q.True(ok)
+	cel, _ := lookupUnit("Cel")
+	q.InDelta(cel.toBase(37), degF.toBase(98.6), 0.00001)
+
+	perMin, ok := lookupUnit("{beats}/min")
+	q.True(ok)
+	bpm, _ := lookupUnit("bpm")
+	q.Equal(perMin, bpm)
+
+	_, ok = lookupUnit("furlong")
+	q.False(ok)
+}
+
+func (q *QuantitiesTestSuite) TestMatchQuantities() {
+	tolerance := QuantityTolerance{Relative: 0.01, Absolute: 0.1, Unit: "kg"}
+
+	// Units are converted.
+	q.True(matchQuantities(quantity{70, "kg"}, quantity{154.3, "[lb_av]"}, tolerance))
+	q.True(matchQuantities(quantity{70, "kg"}, quantity{70000, "g"}, tolerance))
+	q.False(matchQuantities(quantity{70, "kg"}, quantity{170, "[lb_av]"}, tolerance))
+
+	// Within either tolerance.
+	q.True(matchQuantities(quantity{70, "kg"}, quantity{70.09, "kg"}, QuantityTolerance{Absolute: 0.1, Unit: "kg"}))
+	q.True(matchQuantities(quantity{70, "kg"}, quantity{70.09, "kg"}, QuantityTolerance{Absolute: 100, Unit: "g"}))
+	q.True(matchQuantities(quantity{70, "kg"}, quantity{70.5, "kg"}, QuantityTolerance{Relative: 0.01}))
+	q.False(matchQuantities(quantity{70, "kg"}, quantity{70.5, "kg"}, QuantityTolerance{Absolute: 0.1, Unit: "kg"}))
+
+	// Units that measure different things never match.
+	q.False(matchQuantities(quantity{98.6, "[degF]"}, quantity{98.6, "Cel"}, tolerance))
+	q.True(matchQuantities(quantity{98.6, "[degF]"}, quantity{37, "Cel"}, QuantityTolerance{Absolute: 0.1, Unit: "Cel"}))
+	q.False(matchQuantities(quantity{70, "kg"}, quantity{70, "cm"}, tolerance))
+
+	// Unknown units are only compared to the same unit.
+	q.True(matchQuantities(quantity{3, "{tbl}"}, quantity{3, "{tbl}"}, DefaultQuantityTolerance))
+	q.True(matchQuantities(quantity{3, "tablets"}, quantity{3, "tablets"}, DefaultQuantityTolerance))
+	q.False(matchQuantities(quantity{3, "tablets"}, quantity{3, "capsules"}, DefaultQuantityTolerance))
+}
+
+func (q *QuantitiesTestSuite) TestQuantityTolerance() {
+	weight := q.observation("29463-7", 70, "kg")
+	q.Equal(QuantityTolerances["29463-7"], quantityTolerance(weight, "valueQuantity"))
+	q.Equal(DefaultQuantityTolerance, quantityTolerance(q.observation("00000-0", 70, "kg"), "valueQuantity"))
+
+	// Components use their own code.
+	paths := pathMap(fixture(observationFixture, map[string]interface{}{
+		"code":          codeableConcept("http://loinc.org", "85354-9", ""),
+		"valueQuantity": nil,
+		"component": []interface{}{
+			map[string]interface{}{
+				"code":          codeableConcept("http://loinc.org", "8480-6", ""),
+				"valueQuantity": map[string]interface{}{"value": 120.0, "code": "mm[Hg]"},
+			},
+		},
+	}))
+	q.Equal(QuantityTolerances["8480-6"], quantityTolerance(paths, "component[0].valueQuantity"))
+}
+
+func (q *QuantitiesTestSuite) TestCompareQuantities() {
+	scores, paths := compareQuantities(q.observation("29463-7", 70, "kg"), q.observation("29463-7", 154.3, "[lb_av]"), nil)
+	q.Equal([]float64{1}, scores)
+	q.Len(paths, 8)
+
+	scores, _ = compareQuantities(q.observation("8310-5", 98.6, "[degF]"), q.observation("8310-5", 98.6, "Cel"), nil)
+	q.Equal([]float64{0}, scores)
+
+	// Excluded Quantities aren't compared.
+	scores, paths = compareQuantities(q.observation("29463-7", 70, "kg"), q.observation("29463-7", 70, "kg"), []string{"valueQuantity.value"})
+	q.Empty(scores)
+	q.Empty(paths)
+}
+
+func (q *QuantitiesTestSuite) TestComparePathsConvertsUnits() {
+	matcher := new(Matcher)
+	q.True(matcher.comparePaths(q.observation("29463-7", 70, "kg"), q.observation("29463-7", 154.3, "[lb_av]")))
+	q.False(matcher.comparePaths(q.observation("8310-5", 98.6, "[degF]"), q.observation("8310-5", 98.6, "Cel")))
+}
@@ -0,0 +1,310 @@
+package merge
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/mitre/ptmerge/fhirutil"
+)
+
+// ReferenceWeight is how many paths a reference to a matched pair of resources counts as when
+// matching the resources that make it, e.g. two Observations of the same matched Encounter.
+// References to different resources count as that many paths that don't match.
+var ReferenceWeight = 3
+
+// bundleReferences indexes the resources in a source bundle by the keys they can be referenced
+// by, and tracks which of them have been matched.
+type bundleReferences struct {
+	// types maps each key (e.g. Encounter/123, or a urn:uuid: fullUrl) to the type of the
+	// resource it references.
+	types map[string]string
+	// keys maps each key to all of the keys its resource can be referenced by, starting with
+	// its type and ID.
+	keys map[string][]string
+	// counts is how many times each resource, by type and ID, is referenced in the bundle.
+	counts map[string]int
+	// dependencies maps each resource type to the types its resources reference.
+	dependencies map[string]map[string]bool
+	// pairs maps the keys of matched resources to the index of their Match.
+	pairs map[string]int
+	// primary are the keys of the primary Patient.
+	primary map[string]bool
+}
+
+// newBundleReferences indexes the resources in a source bundle, and the references between
+// them.
+func newBundleReferences(bundle *models.Bundle) *bundleReferences {
+	b := &bundleReferences{
+		types:        map[string]string{},
+		keys:         map[string][]string{},
+		counts:       map[string]int{},
+		dependencies: map[string]map[string]bool{},
+		pairs:        map[string]int{},
+		primary:      map[string]bool{},
+	}
+	for _, entry := range bundle.Entry {
+		resourceType := fhirutil.GetResourceType(entry.Resource)
+		id := resourceKey(entry.Resource)
+		keys := []string{id}
+		if fullURL := referenceKey(entry.FullUrl); fullURL != "" && fullURL != id {
+			keys = append(keys, fullURL)
+		}
+		for _, key := range keys {
+			b.types[key] = resourceType
+			b.keys[key] = keys
+		}
+	}
+
+	// Now that every resource is indexed, the references between them can be resolved.
+	for _, entry := range bundle.Entry {
+		resourceType := fhirutil.GetResourceType(entry.Resource)
+		paths := make(PathMap)
+		traverse(jsonTree(entry.Resource), paths, "")
+		for _, reference := range referencePaths(paths) {
+			key := referenceKey(reference)
+			referenced := b.types[key]
+			if referenced == "" {
+				continue
+			}
+			b.counts[b.keys[key][0]]++
+			if referenced == resourceType {
+				continue
+			}
+			if b.dependencies[resourceType] == nil {
+				b.dependencies[resourceType] = map[string]bool{}
+			}
+			b.dependencies[resourceType][referenced] = true
+		}
+	}
+	return b
+}
+
+// addMatch records that a resource is part of a Match, by the Match's index.
+func (b *bundleReferences) addMatch(resource interface{}, index int) {
+	for _, key := range b.keys[resourceKey(resource)] {
+		b.pairs[key] = index
+	}
+}
+
+// setPrimary records that a Patient is the primary Patient of the bundle.
+func (b *bundleReferences) setPrimary(patient interface{}) {
+	for _, key := range b.keys[resourceKey(patient)] {
+		b.primary[key] = true
+	}
+}
+
+// count returns how many times a resource is referenced in the bundle.
+func (b *bundleReferences) count(resource interface{}) int {
+	return b.counts[resourceKey(resource)]
+}
+
+// resourceKey returns the Type/id key of a resource.
+func resourceKey(resource interface{}) string {
+	return fhirutil.GetResourceType(resource) + "/" + fhirutil.GetResourceID(resource)
+}
+
+// referenceKey normalizes a reference to the key the resource it references is indexed by:
+// Type/id for relative and absolute URLs, or the reference itself for URNs (e.g. urn:uuid:).
+func referenceKey(reference string) string {
+	if reference == "" || strings.HasPrefix(reference, "urn:") {
+		return reference
+	}
+	if i := strings.Index(reference, "/_history/"); i >= 0 {
+		reference = reference[:i]
+	}
+	segments := strings.Split(strings.TrimSuffix(reference, "/"), "/")
+	if len(segments) < 2 {
+		return reference
+	}
+	return strings.Join(segments[len(segments)-2:], "/")
+}
+
+// referencePaths returns the references in a resource, by path.
+func referencePaths(paths PathMap) map[string]string {
+	references := map[string]string{}
+	for path, value := range paths {
+		if (path == "reference" || strings.HasSuffix(path, ".reference")) && value.Kind() == reflect.String {
+			references[path] = value.String()
+		}
+	}
+	return references
+}
+
+// compareReferences compares the references two resources make at the same paths to resources
+// in their source bundles, returning ReferenceWeight scores for each: 1s if they reference the
+// same matched pair of resources, or 0s if they reference different resources and at least one
+// of them has been matched. Other references (e.g. to resources outside the bundles, or that
+// are still unmatched on both sides) aren't compared.
+func (m *Matcher) compareReferences(leftPathMap, rightPathMap PathMap) (scores []float64) {
+	if m.leftReferences == nil || m.rightReferences == nil {
+		return nil
+	}
+
+	leftRefs, rightRefs := referencePaths(leftPathMap), referencePaths(rightPathMap)
+	paths := []string{}
+	for path := range leftRefs {
+		if _, ok := rightRefs[path]; ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		leftKey, rightKey := referenceKey(leftRefs[path]), referenceKey(rightRefs[path])
+		if m.leftReferences.types[leftKey] == "" || m.rightReferences.types[rightKey] == "" {
+			continue
+		}
+		if m.leftReferences.primary[leftKey] || m.rightReferences.primary[rightKey] {
+			// Most resources reference the primary Patient, so those references don't help
+			// tell resources apart.
+			continue
+		}
+		leftPair, leftMatched := m.leftReferences.pairs[leftKey]
+		rightPair, rightMatched := m.rightReferences.pairs[rightKey]
+		if !leftMatched && !rightMatched {
+			continue
+		}
+
+		score := 0.0
+		if leftMatched && rightMatched && leftPair == rightPair {
+			score = 1
+		}
+		for i := 0; i < ReferenceWeight; i++ {
+			scores = append(scores, score)
+		}
+	}
+	return scores
+}
+
+// dependencyOrder orders resource types so those that are referenced (e.g. Encounters) come
+// before the types that reference them (e.g. Observations), based on the references between
+// resources in the source bundles. Types are otherwise in alphabetical order, and cycles are
+// broken in alphabetical order.
+func dependencyOrder(resourceTypes []string, references ...*bundleReferences) []string {
+	// dependencies maps each resource type to the types it references in any bundle.
+	dependencies := map[string]map[string]bool{}
+	for _, refs := range references {
+		for resourceType, referenced := range refs.dependencies {
+			if dependencies[resourceType] == nil {
+				dependencies[resourceType] = map[string]bool{}
+			}
+			for r := range referenced {
+				dependencies[resourceType][r] = true
+			}
+		}
+	}
+
+	remaining := make([]string, len(resourceTypes))
+	copy(remaining, resourceTypes)
+	sort.Strings(remaining)
+	ordered := make([]string, 0, len(remaining))
+	for len(remaining) > 0 {
+		// Take the first type that doesn't reference any remaining type, or the first type
+		// if they all do.
+		next := 0
+		for i, resourceType := range remaining {
+			ready := true
+			for dependency := range dependencies[resourceType] {
+				if contains(remaining, dependency) {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				next = i
+				break
+			}
+		}
+		ordered = append(ordered, remaining[next])
+		remaining = append(remaining[:next], remaining[next+1:]...)
+	}
+	return ordered
+}
+
+// targetReferences maps the resources in a source bundle to the resources they became in the
+// target bundle, so references between them can be rewritten to the target's IDs.
+type targetReferences struct {
+	source *bundleReferences
+	// targets maps the Type/id key of each source resource to its Type/id in the target.
+	targets map[string]string
+	// duplicates maps the Type/id key of each duplicate removed from the source bundle to the
+	// key of the resource it duplicated, which was kept.
+	duplicates map[string]string
+}
+
+// newTargetReferences indexes a source bundle's resources. It must be called before any of
+// their IDs change.
+func newTargetReferences(bundle *models.Bundle) *targetReferences {
+	return &targetReferences{
+		source:     newBundleReferences(bundle),
+		targets:    map[string]string{},
+		duplicates: map[string]string{},
+	}
+}
+
+// add records that a source resource, by its key before its ID changed, became a target
+// resource.
+func (t *targetReferences) add(sourceKey string, target interface{}) {
+	t.targets[sourceKey] = resourceKey(target)
+}
+
+// addDuplicate records that a duplicate was removed in favor of a resource that was kept.
+func (t *targetReferences) addDuplicate(duplicate *Duplicate) {
+	t.duplicates[duplicate.ResourceType+"/"+duplicate.RemovedID] = duplicate.ResourceType + "/" + duplicate.KeptID
+}
+
+// targetReference returns the reference to the target resource that a reference to a source
+// resource became. References to resources outside the source bundle are left as they are.
+func (t *targetReferences) targetReference(reference string) string {
+	keys, ok := t.source.keys[referenceKey(reference)]
+	if !ok {
+		return reference
+	}
+	key := keys[0]
+	if kept, ok := t.duplicates[key]; ok {
+		key = kept
+	}
+	if target, ok := t.targets[key]; ok {
+		return target
+	}
+	if key != keys[0] {
+		return key
+	}
+	return reference
+}
+
+// rewrite rewrites the references a target resource makes to resources in the source bundle,
+// returning the rewritten resource. Resources that aren't generic JSON objects are only
+// converted to them if one of their references changes.
+func (t *targetReferences) rewrite(resource interface{}) interface{} {
+	tree := jsonTree(resource)
+	if tree == nil || !rewriteReferences(tree, t.targetReference) {
+		return resource
+	}
+	return tree
+}
+
+// rewriteReferences replaces every reference in a JSON tree with the reference returned by
+// rewrite, returning true if any of them changed.
+func rewriteReferences(tree interface{}, rewrite func(string) string) (changed bool) {
+	switch node := tree.(type) {
+	case map[string]interface{}:
+		for key, value := range node {
+			if reference, ok := value.(string); ok && key == "reference" {
+				if rewritten := rewrite(reference); rewritten != reference {
+					node[key] = rewritten
+					changed = true
+				}
+				continue
+			}
+			changed = rewriteReferences(value, rewrite) || changed
+		}
+	case []interface{}:
+		for _, value := range node {
+			changed = rewriteReferences(value, rewrite) || changed
+		}
+	}
+	return changed
+}
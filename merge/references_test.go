@@ -0,0 +1,227 @@
+package merge
+
+import (
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/mitre/ptmerge/fhirutil"
+	"github.com/stretchr/testify/suite"
+)
+
+type ReferencesTestSuite struct {
+	suite.Suite
+}
+
+func TestReferencesTestSuite(t *testing.T) {
+	suite.Run(t, new(ReferencesTestSuite))
+}
+
+func (r *ReferencesTestSuite) encounter(id, start string) map[string]interface{} {
+	return fixture(encounterFixture, map[string]interface{}{
+		"id":     id,
+		"period": map[string]interface{}{"start": start, "end": start},
+	})
+}
+
+func (r *ReferencesTestSuite) observation(id, encounter string) map[string]interface{} {
+	return fixture(observationFixture, map[string]interface{}{
+		"id":      id,
+		"context": map[string]interface{}{"reference": encounter},
+	})
+}
+
+func (r *ReferencesTestSuite) TestReferenceKey() {
+	r.Equal("Encounter/123", referenceKey("Encounter/123"))
+	r.Equal("Encounter/123", referenceKey("http://example.com/fhir/Encounter/123"))
+	r.Equal("Encounter/123", referenceKey("http://example.com/fhir/Encounter/123/_history/2"))
+	r.Equal("urn:uuid:7f1b3b0e-9ae1-4e3b-a5a4-36c1c6f1d1ab", referenceKey("urn:uuid:7f1b3b0e-9ae1-4e3b-a5a4-36c1c6f1d1ab"))
+	r.Equal("", referenceKey(""))
+}
+
+func (r *ReferencesTestSuite) TestDependencyOrder() {
+	patient := map[string]interface{}{"resourceType": "Patient", "id": "p"}
+	encounter := r.encounter("e1", "2017-01-02")
+	observation := r.observation("o1", "Encounter/e1")
+	condition := map[string]interface{}{"resourceType": "Condition", "id": "c1", "context": map[string]interface{}{"reference": "urn:uuid:e1"}}
+	procedure := map[string]interface{}{"resourceType": "Procedure", "id": "pr1", "reasonReference": []interface{}{map[string]interface{}{"reference": "Condition/c1"}}}
+
+	bundle := fixtureBundle(patient, encounter, observation, condition, procedure)
+	matcher := new(Matcher)
+	resources, err := matcher.collectResources(bundle)
+	r.NoError(err)
+
+	// Referenced types come first, whether they're referenced by fullUrl or type and ID.
+	ordered := dependencyOrder(resources.Keys(), newBundleReferences(bundle))
+	r.Equal([]string{"Patient", "Encounter", "Condition", "Observation", "Procedure"}, ordered)
+
+	// Cycles are broken in alphabetical order.
+	patient["managingOrganization"] = map[string]interface{}{"reference": "Procedure/pr1"}
+	ordered = dependencyOrder(resources.Keys(), newBundleReferences(bundle))
+	r.Equal([]string{"Condition", "Procedure", "Patient", "Encounter", "Observation"}, ordered)
+}
+
+func (r *ReferencesTestSuite) TestMatchThroughMatchedParents() {
+	patient := func() map[string]interface{} {
+		return map[string]interface{}{"resourceType": "Patient", "id": "p", "gender": "female"}
+	}
+
+	// The Observations are identical except for the Encounters they're in, which are in a
+	// different order on each side.
+	left := fixtureBundle(
+		patient(),
+		r.encounter("e1", "2017-01-02"),
+		r.encounter("e2", "2017-03-05"),
+		r.observation("o1", "urn:uuid:e1"),
+		r.observation("o2", "urn:uuid:e2"),
+	)
+	right := fixtureBundle(
+		patient(),
+		r.encounter("e3", "2017-03-05"),
+		r.encounter("e4", "2017-01-02"),
+		r.observation("o3", "Encounter/e3"),
+		r.observation("o4", "Encounter/e4"),
+	)
+
+	matcher := new(Matcher)
+	matches, unmatchables, err := matcher.Match(left, right)
+	r.NoError(err)
+	r.Empty(unmatchables)
+	r.Len(matches, 5)
+
+	pairs := map[string]string{}
+	for _, match := range matches {
+		pairs[match.Left.(map[string]interface{})["id"].(string)] = match.Right.(map[string]interface{})["id"].(string)
+	}
+	r.Equal(map[string]string{"p": "p", "e1": "e4", "e2": "e3", "o1": "o4", "o2": "o3"}, pairs)
+}
+
+func (r *ReferencesTestSuite) TestCompareReferences() {
+	left := fixtureBundle(r.encounter("e1", "2017-01-02"), r.observation("o1", "urn:uuid:e1"))
+	right := fixtureBundle(r.encounter("e2", "2017-01-02"), r.observation("o2", "urn:uuid:e2"), r.observation("o3", "http://example.com/Encounter/x"))
+	matcher := &Matcher{leftReferences: newBundleReferences(left), rightReferences: newBundleReferences(right)}
+	pathMaps := matcher.traverseResources([]interface{}{left.Entry[1].Resource, right.Entry[1].Resource, right.Entry[2].Resource})
+
+	// Neither Encounter is matched yet, and references to resources outside the bundle
+	// aren't compared.
+	r.Empty(matcher.compareReferences(pathMaps[0], pathMaps[1]))
+	r.Empty(matcher.compareReferences(pathMaps[0], pathMaps[2]))
+
+	// References to a matched pair count ReferenceWeight times.
+	matcher.addMatches([]Match{{ResourceType: "Encounter", Left: left.Entry[0].Resource, Right: right.Entry[0].Resource}}, 0)
+	r.Equal([]float64{1, 1, 1}, matcher.compareReferences(pathMaps[0], pathMaps[1]))
+
+	// A reference to a matched resource and one to an unmatched resource count against them.
+	unmatched := r.encounter("e5", "2017-01-02")
+	right.Entry = append(right.Entry, models.BundleEntryComponent{FullUrl: "urn:uuid:e5", Resource: unmatched})
+	matcher.rightReferences = newBundleReferences(right)
+	matcher.addMatches([]Match{{ResourceType: "Encounter", Left: left.Entry[0].Resource, Right: right.Entry[0].Resource}}, 0)
+	other := matcher.traverseResources([]interface{}{r.observation("o4", "urn:uuid:e5")})[0]
+	r.Equal([]float64{0, 0, 0}, matcher.compareReferences(pathMaps[0], other))
+}
+
+func (r *ReferencesTestSuite) TestPrimaryPatient() {
+	mother := map[string]interface{}{"resourceType": "Patient", "id": "m", "gender": "female", "birthDate": "1985-04-12"}
+	newborn := map[string]interface{}{"resourceType": "Patient", "id": "p", "gender": "male", "birthDate": "2017-01-02"}
+	left := fixtureBundle(mother, newborn, r.encounter("e1", "2017-01-02"))
+	right := fixtureBundle(newborn, mother, r.encounter("e2", "2017-01-02"), r.encounter("e3", "2017-01-05"))
+
+	// The primary Patient is the one most resources reference, and the other Patients are
+	// matched like other resources.
+	matcher := new(Matcher)
+	matches, unmatchables, err := matcher.Match(left, right)
+	r.NoError(err)
+	r.Len(matches, 3)
+	r.Equal(newborn, matches[0].Left)
+	r.Equal(newborn, matches[0].Right)
+	r.Equal(mother, matches[1].Left)
+	r.Equal(mother, matches[1].Right)
+	r.Len(unmatchables, 1)
+
+	// It can also be chosen by ID.
+	matcher = &Matcher{LeftPatient: "m", RightPatient: "m"}
+	matches, _, err = matcher.Match(left, right)
+	r.NoError(err)
+	r.Equal(mother, matches[0].Left)
+	r.Equal(mother, matches[0].Right)
+
+	matcher = &Matcher{LeftPatient: "x"}
+	_, _, err = matcher.Match(left, right)
+	r.Equal("Primary Patient x not found in source bundle", err.Error())
+
+	// Patients referenced equally often can't be told apart.
+	left = fixtureBundle(mother, newborn)
+	matcher = new(Matcher)
+	_, _, err = matcher.Match(left, right)
+	r.Equal(ErrDuplicatePatientResource, err)
+}
+
+func (r *ReferencesTestSuite) TestMergeRewritesReferences() {
+	patient := func() map[string]interface{} {
+		return map[string]interface{}{"resourceType": "Patient", "id": "p", "gender": "female"}
+	}
+	heartRate := func(id, encounter string) map[string]interface{} {
+		observation := r.observation(id, encounter)
+		observation["code"] = codeableConcept("http://loinc.org", "8867-4", "")
+		observation["valueQuantity"] = map[string]interface{}{"value": 72.0, "unit": "/min", "system": "http://unitsofmeasure.org", "code": "/min"}
+		return observation
+	}
+
+	// The Encounters match, and the second source has a duplicate of its Encounter. Its
+	// Observations are only in the second source, one of them in the duplicate.
+	left := fixtureBundle(patient(), r.encounter("e1", "2017-01-02"))
+	right := fixtureBundle(
+		patient(),
+		r.encounter("e1", "2017-01-02"),
+		r.encounter("e2", "2017-01-02"),
+		r.observation("o1", "Encounter/e1"),
+		heartRate("o2", "urn:uuid:e2"),
+	)
+
+	host := "http://references.example.com/fhir"
+	fhirutil.SetHostVersion(host, fhirutil.STU3)
+	outcome, _, duplicates, err := NewMerger(host).MergeBundles(left, right)
+	r.NoError(err)
+	r.Len(duplicates, 1)
+	r.Len(outcome.Entry, 4)
+
+	targets := map[string]map[string]interface{}{}
+	for _, entry := range outcome.Entry {
+		resource := entry.Resource.(map[string]interface{})
+		targets[fhirutil.GetResourceType(resource)+"/"+resource["id"].(string)] = resource
+	}
+	var patientKey, encounterKey string
+	for key, resource := range targets {
+		switch fhirutil.GetResourceType(resource) {
+		case "Patient":
+			patientKey = key
+		case "Encounter":
+			encounterKey = key
+		}
+	}
+	r.NotEmpty(patientKey)
+	r.NotEmpty(encounterKey)
+	r.NotEqual("Encounter/e1", encounterKey)
+
+	// Every reference is to the target's resources, including the reference to the duplicate.
+	for key, resource := range targets {
+		if fhirutil.GetResourceType(resource) != "Observation" {
+			continue
+		}
+		r.Equal(encounterKey, resource["context"].(map[string]interface{})["reference"], key)
+		r.Equal(patientKey, resource["subject"].(map[string]interface{})["reference"], key)
+	}
+	r.Equal(patientKey, targets[encounterKey]["subject"].(map[string]interface{})["reference"])
+}
+
+func (r *ReferencesTestSuite) TestTargetReference() {
+	bundle := fixtureBundle(r.encounter("e1", "2017-01-02"), r.encounter("e2", "2017-01-02"))
+	refs := newTargetReferences(bundle)
+	refs.add("Encounter/e1", map[string]interface{}{"resourceType": "Encounter", "id": "t1"})
+	refs.addDuplicate(&Duplicate{ResourceType: "Encounter", KeptID: "e1", RemovedID: "e2"})
+
+	r.Equal("Encounter/t1", refs.targetReference("Encounter/e1"))
+	r.Equal("Encounter/t1", refs.targetReference("urn:uuid:e1"))
+	r.Equal("Encounter/t1", refs.targetReference("http://example.com/fhir/Encounter/e2"))
+	r.Equal("Encounter/x", refs.targetReference("Encounter/x"))
+	r.Equal("#contained", refs.targetReference("#contained"))
+}
@@ -1,73 +1,218 @@
 package merge
 
 import (
+	"encoding/json"
 	"fmt"
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 
-	"github.com/intervention-engine/fhir/models"
+	"github.com/mitre/ptmerge/fhirutil"
 )
 
-// traverse recursively iterates through all non-nil fields in a resource, identifying the JSON paths
-// to non-nil fields. Each path and the value at that path (a primitive go type, or a time.Time object)
-// is collected in the PathMap for later reference or comparison. To build a path, each exported field in
-// a resource must have a "json" struct tag. In practice this is true of all intervention-engine/fhir models.
-func traverse(value reflect.Value, paths PathMap, path string) {
-	switch value.Kind() {
-	case reflect.Ptr, reflect.Interface:
-		// To get the actual value of the object or interface being pointed to we use Elem().
-		val := value.Elem()
-		// Check if the pointer or interface is nil.
-		if !val.IsValid() {
-			return
+// traverse recursively iterates through all values in a resource decoded from JSON (see jsonTree),
+// identifying the JSON paths to those values. Each path and the value at that path (a string, float64,
+// bool, or a models.FHIRDateTime for dates) is collected in the PathMap for later reference or comparison.
+// Since resources are traversed as JSON, rather than as models, every element is traversed, including
+// extensions and elements the models don't have, for any resource type or version of FHIR. Extensions
+// are identified by their URL, rather than their position (see traverseExtensions).
+func traverse(node interface{}, paths PathMap, path string) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		prefix := ""
+		// The path is empty if we're currently traversing the top-level object (e.g. Patient).
+		if path != "" {
+			prefix = path + "."
+		}
+		for key, value := range n {
+			if extensions, ok := value.([]interface{}); ok && (key == "extension" || key == "modifierExtension") {
+				traverseExtensions(extensions, paths, prefix+key)
+				continue
+			}
+			traverse(value, paths, prefix+key)
 		}
 
-		// Traverse the object that's being pointed to.
-		traverse(val, paths, path)
+	case []interface{}:
+		// Traverse all elements in the array.
+		for i, value := range n {
+			traverse(value, paths, path+fmt.Sprintf("[%d]", i))
+		}
 
-	case reflect.Struct:
-		// We don't traverse into FHIRDateTime objects.
-		_, ok := value.Interface().(models.FHIRDateTime)
-		if ok {
-			paths[path] = value
+	case string:
+		if n == "" {
+			return
+		}
+		// Dates are strings in JSON, so those in date elements are parsed to be compared as times.
+		if dt, ok := parseDateTime(n); ok && isDateTimeElement(path) {
+			paths[path] = reflect.ValueOf(dt)
 			return
 		}
+		paths[path] = reflect.ValueOf(n)
+
+	case nil:
+		return
+
+	default:
+		// These are the other JSON primitives (float64 and bool).
+		paths[path] = reflect.ValueOf(n)
+	}
+}
+
+// traverseExtensions traverses a list of extensions, identifying each by its URL rather than its
+// position, e.g. extension(http://hl7.org/fhir/us/core/StructureDefinition/us-core-race).valueCoding.code.
+// That way the same extension has the same path in every resource, wherever it is in the list, and
+// extensions from different IGs with the same name have different paths. Since the URL is part of the
+// path, it isn't collected itself. Later extensions with the same URL are numbered, e.g.
+// extension(http://example.com/note)[1], and extensions without a URL are identified by their
+// position. IgnoredExtensions aren't traversed.
+func traverseExtensions(extensions []interface{}, paths PathMap, path string) {
+	seen := make(map[string]int)
+	for i, extension := range extensions {
+		object, _ := extension.(map[string]interface{})
+		url, _ := object["url"].(string)
+		if url == "" {
+			traverse(extension, paths, path+fmt.Sprintf("[%d]", i))
+			continue
+		}
+		if containsExtension(IgnoredExtensions, url) {
+			continue
+		}
+
+		extensionPath := path + "(" + url + ")"
+		if n := seen[url]; n > 0 {
+			extensionPath += fmt.Sprintf("[%d]", n)
+		}
+		seen[url]++
+
+		fields := make(map[string]interface{}, len(object))
+		for key, value := range object {
+			if key != "url" {
+				fields[key] = value
+			}
+		}
+		traverse(fields, paths, extensionPath)
+	}
+}
+
+// extensionName returns the short name of an extension: the last part of its URL, e.g.
+// us-core-race for http://hl7.org/fhir/us/core/StructureDefinition/us-core-race. Extensions may be
+// configured by their short name, but are only ever identified by their URL.
+func extensionName(url string) string {
+	url = strings.TrimRight(url, "/")
+	return url[strings.LastIndex(url, "/")+1:]
+}
 
-		// Traverse all non-nil fields in the struct, building up their json paths.
-		for i := 0; i < value.NumField(); i++ {
-			jsonPath := value.Type().Field(i).Tag.Get("json")
-			// jsonPath will be empty for inline resources (e.g. DomainResource).
-			if jsonPath != "" {
-				prefix := ""
-				// The path is empty if we're currently traversing the top-level object (e.g. Patient).
-				if path != "" {
-					prefix = path + "."
+// containsExtension tests if an extension's URL is in a set of extensions, given by URL or name.
+func containsExtension(set []string, url string) bool {
+	name := extensionName(url)
+	for _, item := range set {
+		if item == url || item == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fhirPathExpressions converts paths found by traverse into FHIRPath expressions for a resource
+// type, e.g. Patient.address[0].line[0]. Extensions are selected by their URL, e.g.
+// extension(http://example.com/note) is extension.where(url='http://example.com/note')[0], and
+// elements holding the extensions of primitives (e.g. _birthDate) are named by the primitive.
+func fhirPathExpressions(resourceType string, paths []string) []string {
+	expressions := make([]string, len(paths))
+	for i, path := range paths {
+		expression := resourceType
+		for _, match := range pathSegmentRegex.FindAllStringSubmatch(path, -1) {
+			name, extension, indexes := strings.TrimPrefix(match[1], "_"), match[2], match[3]
+			expression += "." + name
+			if extension != "" {
+				expression += ".where(url=" + fhirutil.FHIRPathString(extension[1:len(extension)-1]) + ")"
+				// A resource may have the same extension more than once.
+				if indexes == "" {
+					indexes = "[0]"
 				}
-				// Splits into the name of the field (e.g. "gender") and the "omitempty" flag.
-				parts := strings.SplitN(jsonPath, ",", 2)
-				traverse(value.Field(i), paths, prefix+parts[0])
-			} else {
-				// This was an inline resource, so we shouldn't add it to the path. Just traverse
-				// it's fields instead.
-				traverse(value.Field(i), paths, path)
 			}
+			expression += indexes
 		}
+		expressions[i] = expression
+	}
+	return expressions
+}
 
-	case reflect.Slice, reflect.Array:
-		// Traverse all elements in the slice.
-		for i := 0; i < value.Len(); i++ {
-			traverse(value.Index(i), paths, path+fmt.Sprintf("[%d]", i))
+// pathSegmentRegex matches each segment of a path found by traverse: the element name, the name
+// of the extension, if any, and any indexes.
+var pathSegmentRegex = regexp.MustCompile(`([^.(\[]+)(\([^)]*\))?((?:\[\d+\])*)`)
+
+// findPath finds the value at a path found by traverse in a JSON tree, and a function that
+// replaces it. If the path isn't in the tree, found is false.
+func findPath(tree interface{}, path string) (value interface{}, set func(interface{}), found bool) {
+	value = tree
+	for _, match := range pathSegmentRegex.FindAllStringSubmatch(path, -1) {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, nil, false
 		}
+		key := match[1]
+		value, set = object[key], func(v interface{}) { object[key] = v }
 
-	case reflect.String:
-		// Check that the string isn't nil.
-		val := value.String()
-		if val != "" {
-			paths[path] = value
+		var indexes []int
+		for _, index := range indexRegex.FindAllStringSubmatch(match[3], -1) {
+			i, _ := strconv.Atoi(index[1])
+			indexes = append(indexes, i)
 		}
 
-	default:
-		// These are all of the other primitive types (e.g. int, float, bool).
-		paths[path] = value
+		// Extensions are found by URL, and their number among extensions with that URL.
+		if match[2] != "" {
+			extensionURL, n := match[2][1:len(match[2])-1], 0
+			if len(indexes) > 0 {
+				n, indexes = indexes[0], indexes[1:]
+			}
+			extensions, _ := value.([]interface{})
+			matched := false
+			for i, extension := range extensions {
+				object, _ := extension.(map[string]interface{})
+				if url, _ := object["url"].(string); url != "" && url == extensionURL {
+					if n == 0 {
+						indexes, matched = append([]int{i}, indexes...), true
+						break
+					}
+					n--
+				}
+			}
+			if !matched {
+				return nil, nil, false
+			}
+		}
+
+		for _, i := range indexes {
+			list, ok := value.([]interface{})
+			if !ok || i >= len(list) {
+				return nil, nil, false
+			}
+			index := i
+			value, set = list[index], func(v interface{}) { list[index] = v }
+		}
+	}
+	return value, set, set != nil
+}
+
+// indexRegex matches the indexes in a path segment, e.g. [0][1].
+var indexRegex = regexp.MustCompile(`\[(\d+)\]`)
+
+// jsonTree returns a resource decoded from JSON. Resources that are already generic JSON objects
+// are returned as they are. Models are marshaled to JSON and decoded. If that fails (which it
+// shouldn't for valid models) nil is returned, which has no paths.
+func jsonTree(resource interface{}) interface{} {
+	if object, ok := resource.(map[string]interface{}); ok {
+		return object
+	}
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return nil
+	}
+	var tree interface{}
+	if json.Unmarshal(data, &tree) != nil {
+		return nil
 	}
+	return tree
 }
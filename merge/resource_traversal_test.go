@@ -1,7 +1,6 @@
 package merge
 
 import (
-	"reflect"
 	"testing"
 	"time"
 
@@ -27,9 +26,9 @@ func (rt *ResourceTraversalTestSuite) TestStructTraversal() {
 	rt.NoError(err)
 	patient, ok := fix.(*models.Patient)
 	rt.True(ok)
-	patientValue := reflect.ValueOf(patient)
+	// Models are traversed as JSON.
 	pathmap := make(PathMap)
-	traverse(patientValue, pathmap, "")
+	traverse(jsonTree(patient), pathmap, "")
 
 	// Name
 	family, ok := pathmap["name[0].family"]
@@ -78,3 +77,184 @@ func (rt *ResourceTraversalTestSuite) TestStructTraversal() {
 	rt.True(ok)
 	rt.Equal("Married", display.String())
 }
+
+func (rt *ResourceTraversalTestSuite) TestJSONObjectTraversal() {
+	patient := map[string]interface{}{
+		"resourceType": "Patient",
+		"name": []interface{}{
+			map[string]interface{}{
+				"family": "Abbott",
+				"given":  []interface{}{"Lowell"},
+			},
+		},
+		"active":               true,
+		"birthDate":            "1950-09-02",
+		"deceasedDateTime":     "2017-01-02T16:09:32Z",
+		"multipleBirthInteger": float64(2),
+		"address":              nil,
+	}
+	pathmap := make(PathMap)
+	traverse(patient, pathmap, "")
+	rt.Len(pathmap, 7)
+
+	rt.Equal("Patient", pathmap["resourceType"].Interface())
+	rt.Equal("Abbott", pathmap["name[0].family"].Interface())
+	rt.Equal("Lowell", pathmap["name[0].given[0]"].Interface())
+	rt.Equal(true, pathmap["active"].Interface())
+	rt.Equal(float64(2), pathmap["multipleBirthInteger"].Interface())
+
+	// Dates are parsed.
+	rt.Equal(models.FHIRDateTime{
+		Time:      time.Date(1950, 9, 2, 0, 0, 0, 0, time.Local),
+		Precision: models.Date,
+	}, pathmap["birthDate"].Interface())
+	deceased, ok := pathmap["deceasedDateTime"].Interface().(models.FHIRDateTime)
+	rt.True(ok)
+	rt.True(deceased.Time.Equal(time.Date(2017, 1, 2, 16, 9, 32, 0, time.UTC)))
+	rt.Equal(models.Precision(models.Timestamp), deceased.Precision)
+}
+
+func (rt *ResourceTraversalTestSuite) TestExtensionTraversal() {
+	patient := map[string]interface{}{
+		"resourceType": "Patient",
+		"extension": []interface{}{
+			map[string]interface{}{
+				"url": "http://hl7.org/fhir/us/core/StructureDefinition/us-core-race",
+				"extension": []interface{}{
+					map[string]interface{}{
+						"url":         "ombCategory",
+						"valueCoding": map[string]interface{}{"code": "2106-3"},
+					},
+				},
+			},
+			map[string]interface{}{
+				"url":       "http://hl7.org/fhir/us/core/StructureDefinition/us-core-birthsex",
+				"valueCode": "M",
+			},
+			map[string]interface{}{
+				"url":         "http://example.com/note",
+				"valueString": "first",
+			},
+			map[string]interface{}{
+				"url":         "http://example.com/note",
+				"valueString": "second",
+			},
+			map[string]interface{}{
+				"valueString": "no url",
+			},
+		},
+	}
+	pathmap := make(PathMap)
+	traverse(patient, pathmap, "")
+	rt.Len(pathmap, 6)
+
+	rt.Equal("2106-3", pathmap["extension(http://hl7.org/fhir/us/core/StructureDefinition/us-core-race).extension(ombCategory).valueCoding.code"].Interface())
+	rt.Equal("M", pathmap["extension(http://hl7.org/fhir/us/core/StructureDefinition/us-core-birthsex).valueCode"].Interface())
+	rt.Equal("first", pathmap["extension(http://example.com/note).valueString"].Interface())
+	rt.Equal("second", pathmap["extension(http://example.com/note)[1].valueString"].Interface())
+	rt.Equal("no url", pathmap["extension[4].valueString"].Interface())
+
+	// Ignored extensions aren't traversed.
+	originalIgnored := IgnoredExtensions
+	IgnoredExtensions = []string{"us-core-birthsex", "http://example.com/note"}
+	pathmap = make(PathMap)
+	traverse(patient, pathmap, "")
+	IgnoredExtensions = originalIgnored
+
+	rt.Len(pathmap, 3)
+	rt.Contains(pathmap, "extension(http://hl7.org/fhir/us/core/StructureDefinition/us-core-race).extension(ombCategory).valueCoding.code")
+	rt.Contains(pathmap, "extension[4].valueString")
+}
+
+func (rt *ResourceTraversalTestSuite) TestFHIRPathExpressions() {
+	patient := map[string]interface{}{
+		"resourceType": "Patient",
+		"address": []interface{}{
+			map[string]interface{}{"line": []interface{}{"123 Main St"}},
+		},
+		"birthDate": "1950-09-02",
+		"_birthDate": map[string]interface{}{
+			"extension": []interface{}{
+				map[string]interface{}{"url": "http://example.com/birthTime", "valueDateTime": "1950-09-02T16:09:32Z"},
+			},
+		},
+		"extension": []interface{}{
+			map[string]interface{}{
+				"url": "http://hl7.org/fhir/us/core/StructureDefinition/us-core-race",
+				"extension": []interface{}{
+					map[string]interface{}{"url": "text", "valueString": "White"},
+				},
+			},
+			map[string]interface{}{"url": "http://example.com/note", "valueString": "first"},
+			map[string]interface{}{"url": "http://example.com/note", "valueString": "second"},
+		},
+	}
+	pathmap := make(PathMap)
+	traverse(patient, pathmap, "")
+	paths := pathmap.Keys()
+	expressions := fhirPathExpressions("Patient", paths)
+
+	expected := map[string]string{
+		"resourceType":       "Patient.resourceType",
+		"address[0].line[0]": "Patient.address[0].line[0]",
+		"birthDate":          "Patient.birthDate",
+		"_birthDate.extension(http://example.com/birthTime).valueDateTime":                                    "Patient.birthDate.extension.where(url='http://example.com/birthTime')[0].valueDateTime",
+		"extension(http://hl7.org/fhir/us/core/StructureDefinition/us-core-race).extension(text).valueString": "Patient.extension.where(url='http://hl7.org/fhir/us/core/StructureDefinition/us-core-race')[0].extension.where(url='text')[0].valueString",
+		"extension(http://example.com/note).valueString":                                                      "Patient.extension.where(url='http://example.com/note')[0].valueString",
+		"extension(http://example.com/note)[1].valueString":                                                   "Patient.extension.where(url='http://example.com/note')[1].valueString",
+	}
+	rt.Len(expressions, len(expected))
+	for i, path := range paths {
+		rt.Equal(expected[path], expressions[i])
+
+		// Each expression selects the value at its path.
+		values, err := fhirutil.EvaluateFHIRPath(patient, expressions[i])
+		rt.NoError(err)
+		rt.Len(values, 1)
+	}
+}
+
+func (rt *ResourceTraversalTestSuite) TestFHIRPathExpressionsEscapeURLs() {
+	expressions := fhirPathExpressions("Patient", []string{"extension(http://example.com/o'brien).valueString"})
+	rt.Equal([]string{`Patient.extension.where(url='http://example.com/o\'brien')[0].valueString`}, expressions)
+}
+
+func (rt *ResourceTraversalTestSuite) TestFindPath() {
+	patient := map[string]interface{}{
+		"resourceType": "Patient",
+		"name": []interface{}{
+			map[string]interface{}{"given": []interface{}{"Lowell", "Quincy"}},
+		},
+		"extension": []interface{}{
+			map[string]interface{}{"url": "http://example.com/note", "valueString": "first"},
+			map[string]interface{}{"valueString": "no url"},
+			map[string]interface{}{"url": "http://example.com/note", "valueString": "second"},
+		},
+	}
+
+	// Every path found by traverse can be found again.
+	pathmap := make(PathMap)
+	traverse(patient, pathmap, "")
+	for path, expected := range pathmap {
+		value, _, found := findPath(patient, path)
+		rt.True(found, path)
+		rt.Equal(expected.Interface(), value, path)
+	}
+
+	value, set, found := findPath(patient, "extension(http://example.com/note)[1].valueString")
+	rt.True(found)
+	rt.Equal("second", value)
+	set("changed")
+	rt.Equal("changed", patient["extension"].([]interface{})[2].(map[string]interface{})["valueString"])
+
+	value, set, found = findPath(patient, "name[0].given[1]")
+	rt.True(found)
+	rt.Equal("Quincy", value)
+	set("Q")
+	rt.Equal([]interface{}{"Lowell", "Q"}, patient["name"].([]interface{})[0].(map[string]interface{})["given"])
+
+	for _, path := range []string{"name[1].given[0]", "extension(http://example.com/note)[2].valueString", "gender.text", "name.given"} {
+		_, _, found = findPath(patient, path)
+		rt.False(found, path)
+	}
+}
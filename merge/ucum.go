@@ -0,0 +1,130 @@
+package merge
+
+import (
+	"regexp"
+	"strings"
+)
+
+// ucumUnit is a UCUM unit, as a multiple of the base unit of its dimension. Temperatures also
+// have an offset from their base unit (kelvin).
+type ucumUnit struct {
+	dimension string
+	factor    float64
+	offset    float64
+}
+
+// ucumUnits are common clinical UCUM units, by code.
+var ucumUnits = map[string]ucumUnit{
+	// Mass, in grams.
+	"kg":      {"mass", 1000, 0},
+	"g":       {"mass", 1, 0},
+	"mg":      {"mass", 0.001, 0},
+	"ug":      {"mass", 0.000001, 0},
+	"[lb_av]": {"mass", 453.59237, 0},
+	"[oz_av]": {"mass", 28.349523125, 0},
+
+	// Length, in meters.
+	"m":      {"length", 1, 0},
+	"cm":     {"length", 0.01, 0},
+	"mm":     {"length", 0.001, 0},
+	"km":     {"length", 1000, 0},
+	"[in_i]": {"length", 0.0254, 0},
+	"[ft_i]": {"length", 0.3048, 0},
+	"[mi_i]": {"length", 1609.344, 0},
+
+	// Temperature, in kelvin.
+	"K":      {"temperature", 1, 0},
+	"Cel":    {"temperature", 1, 273.15},
+	"[degF]": {"temperature", 5.0 / 9, 459.67 * 5 / 9},
+
+	// Volume, in liters.
+	"L":  {"volume", 1, 0},
+	"dL": {"volume", 0.1, 0},
+	"mL": {"volume", 0.001, 0},
+	"uL": {"volume", 0.000001, 0},
+
+	// Pressure, in pascals.
+	"Pa":     {"pressure", 1, 0},
+	"kPa":    {"pressure", 1000, 0},
+	"mm[Hg]": {"pressure", 133.322387415, 0},
+
+	// Time, in seconds.
+	"s":   {"time", 1, 0},
+	"min": {"time", 60, 0},
+	"h":   {"time", 3600, 0},
+	"d":   {"time", 86400, 0},
+	"wk":  {"time", 604800, 0},
+	"mo":  {"time", 2629800, 0},
+	"a":   {"time", 31557600, 0},
+
+	// Rates, per second.
+	"/s":   {"rate", 1, 0},
+	"/min": {"rate", 1.0 / 60, 0},
+	"/h":   {"rate", 1.0 / 3600, 0},
+
+	// Mass concentrations, in grams per liter.
+	"g/L":   {"mass concentration", 1, 0},
+	"g/dL":  {"mass concentration", 10, 0},
+	"mg/dL": {"mass concentration", 0.01, 0},
+	"mg/L":  {"mass concentration", 0.001, 0},
+	"ug/L":  {"mass concentration", 0.000001, 0},
+	"ug/dL": {"mass concentration", 0.00001, 0},
+
+	// Substance concentrations, in moles per liter.
+	"mol/L":  {"substance concentration", 1, 0},
+	"mmol/L": {"substance concentration", 0.001, 0},
+	"umol/L": {"substance concentration", 0.000001, 0},
+
+	// Body mass index, in kilograms per square meter.
+	"kg/m2": {"mass per area", 1, 0},
+
+	// Ratios.
+	"%": {"ratio", 0.01, 0},
+	"1": {"ratio", 1, 0},
+}
+
+// ucumAliases are units that are often used in Quantity.unit, or in place of a UCUM code,
+// and the UCUM codes they stand for.
+var ucumAliases = map[string]string{
+	"lb":    "[lb_av]",
+	"lbs":   "[lb_av]",
+	"oz":    "[oz_av]",
+	"in":    "[in_i]",
+	"ft":    "[ft_i]",
+	"mi":    "[mi_i]",
+	"°C":    "Cel",
+	"degC":  "Cel",
+	"C":     "Cel",
+	"°F":    "[degF]",
+	"degF":  "[degF]",
+	"F":     "[degF]",
+	"mmHg":  "mm[Hg]",
+	"bpm":   "/min",
+	"l":     "L",
+	"dl":    "dL",
+	"ml":    "mL",
+	"kg/m²": "kg/m2",
+}
+
+// ucumAnnotationRegex matches UCUM annotations, e.g. {beats} in {beats}/min, which don't
+// change what a unit means.
+var ucumAnnotationRegex = regexp.MustCompile(`\{[^}]*\}`)
+
+// lookupUnit returns the UCUM unit for a code or common alias, if it's in the table.
+func lookupUnit(unit string) (ucumUnit, bool) {
+	unit = strings.TrimSpace(ucumAnnotationRegex.ReplaceAllString(unit, ""))
+	if unit == "" {
+		// Units that are only an annotation, e.g. {score}, are unitless.
+		unit = "1"
+	}
+	if alias, ok := ucumAliases[unit]; ok {
+		unit = alias
+	}
+	u, ok := ucumUnits[unit]
+	return u, ok
+}
+
+// toBase converts a value in a unit to the base unit of its dimension.
+func (u ucumUnit) toBase(value float64) float64 {
+	return value*u.factor + u.offset
+}
@@ -2,18 +2,143 @@ package main
 
 import (
 	"flag"
+	"log"
+	"os"
+	"strings"
 
+	"github.com/mitre/ptmerge/audit"
+	"github.com/mitre/ptmerge/auth"
+	"github.com/mitre/ptmerge/fhirutil"
+	"github.com/mitre/ptmerge/merge"
 	"github.com/mitre/ptmerge/server"
 )
 
 func main() {
 	// command line flags
 	fhirhost := flag.String("fhirhost", "http://localhost:3001", "The FHIR server used to host the ptmerge service")
+	fhirVersions := flag.String("fhirversions", "", "A comma-separated list of FHIR servers and their versions (STU3 or R4), e.g. http://localhost:3001=R4. Other servers' versions are detected")
 	dbhost := flag.String("dbhost", "localhost:27017", "The Mongo database used to host the ptmerge service")
 	dbname := flag.String("dbname", "ptmerge", "The name of the Mongo database")
 	debug := flag.Bool("debug", false, "Run the ptmerge service in debug mode (more verbose output)")
+	authMode := flag.String("auth", "none", "How requests are authenticated: none, jwt, or apikey")
+	jwksFile := flag.String("jwks", "", "A local JWKS file used to verify JWTs (required with -auth jwt)")
+	jwtIssuer := flag.String("jwtissuer", "", "If set, the issuer JWTs must be issued by")
+	jwtAudience := flag.String("jwtaudience", "", "If set, the audience JWTs must be issued for")
+	apiKeysFile := flag.String("apikeys", "", "A JSON file mapping API keys to users (required with -auth apikey)")
+	auditMode := flag.String("audit", "mongo", "Where audit records are stored: mongo, fhir, file, or none")
+	auditFile := flag.String("auditfile", "audit.jsonl", "The JSON lines file audit records are appended to (with -audit file)")
+	mergeTTL := flag.Duration("mergettl", server.DefaultConfig.MergeTTL, "How long an incomplete merge may be inactive before it expires and is aborted (0 to never expire)")
+	claimTTL := flag.Duration("claimttl", server.DefaultConfig.ClaimTTL, "How long a merge stays assigned to a reviewer who isn't working on it (0 to never lapse)")
+	approval := flag.Bool("approval", server.DefaultConfig.RequireApproval, "Require a second reviewer to approve each merge before it is completed (requires -auth jwt or apikey)")
+	ignoreExtensions := flag.String("ignoreextensions", "", "A comma-separated list of extensions (by URL or name, e.g. us-core-birthsex) ignored when matching resources and detecting conflicts")
+	keyExtensions := flag.String("keyextensions", "", "A comma-separated list of extensions (by URL or name) that decide whether two resources with them match")
+	periodTolerance := flag.Duration("periodtolerance", merge.PeriodTolerance, "How far apart the start or end of two periods may be for them to match, e.g. for Encounters")
+	rangeTolerance := flag.Float64("rangetolerance", merge.RangeTolerance, "How far apart the low or high values of two ranges may be, in their units, for them to match")
+	inclusions := flag.String("inclusions", "", "A comma-separated list of resource types (or * for all) whose unmatched resources are each a conflict, so a reviewer decides whether they're included")
+	conceptMaps := flag.String("conceptmaps", "", "A directory of FHIR ConceptMap JSON files used to match codes from different code systems")
+	origins := flag.String("origins", "*", "A comma-separated list of origins allowed to make CORS requests")
 	flag.Parse()
 
-	server := server.NewServer(*fhirhost, *dbhost, *dbname, *debug)
+	if *fhirVersions != "" {
+		for _, hostVersion := range strings.Split(*fhirVersions, ",") {
+			parts := strings.SplitN(hostVersion, "=", 2)
+			if len(parts) != 2 {
+				log.Printf("Invalid FHIR server version %s, must be <url>=<version>\n", hostVersion)
+				os.Exit(1)
+			}
+			version, err := fhirutil.ParseVersion(strings.TrimSpace(parts[1]))
+			if err != nil {
+				log.Printf("Invalid FHIR server version %s: %s\n", hostVersion, err.Error())
+				os.Exit(1)
+			}
+			fhirutil.SetHostVersion(strings.TrimSpace(parts[0]), version)
+		}
+	}
+
+	if *ignoreExtensions != "" {
+		merge.IgnoredExtensions = splitList(*ignoreExtensions)
+	}
+	if *keyExtensions != "" {
+		merge.KeyExtensions = splitList(*keyExtensions)
+	}
+	if *inclusions != "" {
+		merge.InclusionResourceTypes = splitList(*inclusions)
+	}
+	if *conceptMaps != "" {
+		err := merge.LoadConceptMaps(*conceptMaps)
+		if err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+	}
+	merge.PeriodTolerance = *periodTolerance
+	merge.RangeTolerance = *rangeTolerance
+
+	config := server.DefaultConfig
+	config.AllowedOrigins = *origins
+	config.MergeTTL = *mergeTTL
+	config.ClaimTTL = *claimTTL
+	config.RequireApproval = *approval
+
+	switch *authMode {
+	case "none":
+		config.Authenticator = nil
+	case "jwt":
+		authenticator, err := auth.LoadJWKS(*jwksFile)
+		if err != nil {
+			log.Printf("Failed to load JWKS file %s: %s\n", *jwksFile, err.Error())
+			os.Exit(1)
+		}
+		authenticator.Issuer = *jwtIssuer
+		authenticator.Audience = *jwtAudience
+		config.Authenticator = authenticator
+	case "apikey":
+		authenticator, err := auth.LoadAPIKeys(*apiKeysFile)
+		if err != nil {
+			log.Printf("Failed to load API keys file %s: %s\n", *apiKeysFile, err.Error())
+			os.Exit(1)
+		}
+		config.Authenticator = authenticator
+	default:
+		log.Printf("Unknown authentication mode %s\n", *authMode)
+		os.Exit(1)
+	}
+	if config.RequireApproval && config.Authenticator == nil {
+		log.Println("Merges can't require approval by a second reviewer while authentication is disabled")
+		os.Exit(1)
+	}
+
+	switch *auditMode {
+	case "mongo":
+		config.Auditor = nil
+	case "fhir":
+		config.Auditor = audit.NewFHIRSink(*fhirhost)
+	case "file":
+		sink, err := audit.NewFileSink(*auditFile)
+		if err != nil {
+			log.Printf("Failed to open audit file %s: %s\n", *auditFile, err.Error())
+			os.Exit(1)
+		}
+		defer sink.Close()
+		config.Auditor = sink
+	case "none":
+		config.Auditor = audit.Discard{}
+	default:
+		log.Printf("Unknown audit mode %s\n", *auditMode)
+		os.Exit(1)
+	}
+
+	server := server.NewServer(*fhirhost, *dbhost, *dbname, *debug, config)
 	server.Run()
 }
+
+// splitList splits a comma-separated flag value, trimming spaces around each item.
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
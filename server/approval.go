@@ -0,0 +1,182 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mitre/ptmerge/audit"
+	"github.com/mitre/ptmerge/auth"
+	"github.com/mitre/ptmerge/events"
+	"github.com/mitre/ptmerge/state"
+)
+
+// approvalRequest is the body of an approve or reject request.
+type approvalRequest struct {
+	Comment string `json:"comment"`
+	// Conflicts are the IDs of the conflicts to reopen when rejecting a merge.
+	Conflicts []string `json:"conflicts"`
+}
+
+// Approve completes a merge that is awaiting approval. The approver must not be one of
+// the merge's reviewers. An optional comment may be given in the POST body.
+func (m *MergeController) Approve(c *gin.Context) {
+	mergeState, req, ok := m.loadForApproval(c)
+	if !ok {
+		return
+	}
+
+	mergeState.Approvals = append(mergeState.Approvals, state.Approval{
+		Decision:  state.DecisionApproved,
+		Reviewer:  auth.CurrentUserID(c),
+		Timestamp: time.Now(),
+		Comment:   req.Comment,
+	})
+	err := mergeState.Transition(state.StatusCompleted, auth.CurrentUserID(c))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	if !m.saveApproval(c, mergeState) {
+		return
+	}
+	m.publish(c, events.MergeCompleted, mergeState.MergeID, "", "")
+	auditComments(c, mergeState)
+
+	c.JSON(http.StatusOK, &state.Merge{
+		Timestamp: time.Now(),
+		Merge:     *mergeState,
+	})
+}
+
+// Reject sends a merge that is awaiting approval back for review, reopening the conflicts
+// listed in the POST body. The rejecter must not be one of the merge's reviewers, and
+// must explain the rejection with a comment.
+func (m *MergeController) Reject(c *gin.Context) {
+	mergeState, req, ok := m.loadForApproval(c)
+	if !ok {
+		return
+	}
+
+	if req.Comment == "" {
+		abortWithStatus(c, http.StatusBadRequest, "A comment explaining the rejection is required")
+		return
+	}
+	if len(req.Conflicts) == 0 {
+		abortWithStatus(c, http.StatusBadRequest, "At least one conflict to reopen is required")
+		return
+	}
+	for _, conflictID := range req.Conflicts {
+		conflict, found := mergeState.Conflicts[conflictID]
+		if !found {
+			abortWithStatus(c, http.StatusNotFound, "Merge conflict %s not found for merge %s", conflictID, mergeState.MergeID)
+			return
+		}
+		conflict.Resolved = false
+		conflict.ResolvedBy = ""
+	}
+
+	mergeState.Approvals = append(mergeState.Approvals, state.Approval{
+		Decision:          state.DecisionRejected,
+		Reviewer:          auth.CurrentUserID(c),
+		Timestamp:         time.Now(),
+		Comment:           req.Comment,
+		ReopenedConflicts: req.Conflicts,
+	})
+	err := mergeState.Transition(state.StatusInReview, auth.CurrentUserID(c))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	if !m.saveApproval(c, mergeState, req.Conflicts...) {
+		return
+	}
+	m.publish(c, events.MergeRejected, mergeState.MergeID, "", "")
+	for _, conflictID := range req.Conflicts {
+		m.publish(c, events.ConflictReopened, mergeState.MergeID, conflictID, mergeState.Conflicts[conflictID].TargetResource.ResourceID)
+	}
+
+	c.JSON(http.StatusOK, &state.Merge{
+		Timestamp: time.Now(),
+		Merge:     *mergeState,
+	})
+}
+
+// loadForApproval gets a merge that the current user may approve or reject, and parses
+// the request body. If the merge can't be approved by this user, an error response is
+// written and ok is false.
+func (m *MergeController) loadForApproval(c *gin.Context) (mergeState *state.MergeState, req *approvalRequest, ok bool) {
+	var err error
+	worker := m.session.Copy()
+	defer worker.Close()
+
+	mergeID := c.Param("merge_id")
+
+	// Get the merge state from mongo.
+	mergeState = &state.MergeState{}
+	err = worker.DB(m.dbname).C("merges").Find(bson.M{"_id": mergeID}).One(mergeState)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			abortWithStatus(c, http.StatusNotFound, "Merge %s not found", mergeID)
+			return nil, nil, false
+		}
+		abortWithError(c, err)
+		return nil, nil, false
+	}
+	audit.AddResources(c, mergeState.TargetURL)
+
+	if mergeState.CurrentStatus() != state.StatusAwaitingApproval {
+		abortWithStatus(c, http.StatusBadRequest, "Merge %s is %s, not awaiting approval", mergeID, mergeState.CurrentStatus())
+		return nil, nil, false
+	}
+
+	// The approver must be a second person.
+	user := auth.CurrentUserID(c)
+	for _, reviewer := range mergeState.Reviewers() {
+		if reviewer == user {
+			abortWithStatus(c, http.StatusForbidden, "Merge %s must be approved or rejected by someone other than its reviewers", mergeID)
+			return nil, nil, false
+		}
+	}
+	if !m.checkAssignee(c, mergeState) {
+		return nil, nil, false
+	}
+
+	// The body is optional for approvals.
+	req = &approvalRequest{}
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		abortWithError(c, err)
+		return nil, nil, false
+	}
+	if len(body) > 0 {
+		err = json.Unmarshal(body, req)
+		if err != nil {
+			abortWithStatus(c, http.StatusBadRequest, "Invalid approval: %s", err.Error())
+			return nil, nil, false
+		}
+	}
+	return mergeState, req, true
+}
+
+// saveApproval saves a merge after it is approved or rejected, along with any conflicts
+// that were reopened. If it can't be saved, an error response is written and false is
+// returned.
+func (m *MergeController) saveApproval(c *gin.Context, mergeState *state.MergeState, reopenedConflicts ...string) bool {
+	worker := m.session.Copy()
+	defer worker.Close()
+
+	err := m.saveMerge(worker, mergeState, reopenedConflicts...)
+	if err != nil {
+		abortWithError(c, err)
+		return false
+	}
+	return true
+}
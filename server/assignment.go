@@ -0,0 +1,360 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mitre/ptmerge/audit"
+	"github.com/mitre/ptmerge/auth"
+	"github.com/mitre/ptmerge/events"
+	"github.com/mitre/ptmerge/state"
+)
+
+// The ways a reviewer's queue may be prioritized.
+const (
+	// PriorityConflicts puts merges with the most remaining conflicts first.
+	PriorityConflicts = "conflicts"
+	// PriorityAge puts the oldest merges first.
+	PriorityAge = "age"
+	// PriorityMatch puts merges whose patients match each other least closely first.
+	PriorityMatch = "match"
+)
+
+// assignRequest is the body of an assign request.
+type assignRequest struct {
+	Assignee string `json:"assignee"`
+}
+
+// Claim assigns a merge to the current user. Merges assigned to someone else can't be
+// claimed until they are released or their assignment lapses.
+func (m *MergeController) Claim(c *gin.Context) {
+	mergeState, ok := m.loadForAssignment(c)
+	if !ok {
+		return
+	}
+
+	user := auth.CurrentUserID(c)
+	if assignee := mergeState.Assignee(m.config.ClaimTTL, time.Now()); assignee != "" && assignee != user {
+		abortWithStatus(c, http.StatusConflict, "Merge %s is assigned to %s", mergeState.MergeID, assignee)
+		return
+	}
+
+	previous := mergeState.Assignment
+	mergeState.Assign(user, user)
+	if !m.saveAssignment(c, mergeState, previous) {
+		return
+	}
+	m.publishAssignment(c, events.MergeAssigned, mergeState.MergeID, user)
+
+	c.JSON(http.StatusOK, &state.Merge{
+		Timestamp: time.Now(),
+		Merge:     *mergeState,
+	})
+}
+
+// Assign assigns a merge to the reviewer given in the POST body, replacing any earlier
+// assignment.
+func (m *MergeController) Assign(c *gin.Context) {
+	mergeState, ok := m.loadForAssignment(c)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	req := &assignRequest{}
+	err = json.Unmarshal(body, req)
+	if err != nil {
+		abortWithStatus(c, http.StatusBadRequest, "Invalid assignment: %s", err.Error())
+		return
+	}
+	if req.Assignee == "" {
+		abortWithStatus(c, http.StatusBadRequest, "An assignee is required")
+		return
+	}
+
+	previous := mergeState.Assignment
+	mergeState.Assign(req.Assignee, auth.CurrentUserID(c))
+	if !m.saveAssignment(c, mergeState, previous) {
+		return
+	}
+	m.publishAssignment(c, events.MergeAssigned, mergeState.MergeID, req.Assignee)
+
+	c.JSON(http.StatusOK, &state.Merge{
+		Timestamp: time.Now(),
+		Merge:     *mergeState,
+	})
+}
+
+// Release removes a merge's assignment so any reviewer may claim it. Only the assignee
+// or an admin may release a merge.
+func (m *MergeController) Release(c *gin.Context) {
+	mergeState, ok := m.loadForAssignment(c)
+	if !ok {
+		return
+	}
+
+	if mergeState.Assignment == nil {
+		abortWithStatus(c, http.StatusBadRequest, "Merge %s isn't assigned", mergeState.MergeID)
+		return
+	}
+	assignee := mergeState.Assignment.Assignee
+	user := auth.CurrentUser(c)
+	if user.ID != assignee && !user.HasRole(auth.Admin) {
+		abortWithStatus(c, http.StatusForbidden, "Merge %s may only be released by %s or an admin", mergeState.MergeID, assignee)
+		return
+	}
+
+	previous := mergeState.Assignment
+	mergeState.Release()
+	if !m.saveAssignment(c, mergeState, previous) {
+		return
+	}
+	m.publishAssignment(c, events.MergeReleased, mergeState.MergeID, assignee)
+
+	c.JSON(http.StatusOK, &state.Merge{
+		Timestamp: time.Now(),
+		Merge:     *mergeState,
+	})
+}
+
+// Queue returns the merges the current user may work on: those that are unassigned, or
+// assigned to them, and still need a reviewer. Merges awaiting approval are left out if
+// the user reviewed them, since they can't approve their own work. The supported query
+// parameters are:
+//
+//	priority  how merges are ordered: "conflicts" (most remaining conflicts first, the
+//	          default), "age" (oldest first), or "match" (least closely matching
+//	          patients first)
+//	_count    the maximum number of merges (default 50)
+func (m *MergeController) Queue(c *gin.Context) {
+	var err error
+	worker := m.session.Copy()
+	defer worker.Close()
+
+	priority, count, err := parseQueueParams(c.Request.URL.Query())
+	if err != nil {
+		abortWithStatus(c, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	user := auth.CurrentUserID(c)
+	now := time.Now()
+	assignable := []bson.M{
+		bson.M{"assignment": nil},
+		bson.M{"assignment.assignee": user},
+	}
+	if m.config.ClaimTTL > 0 {
+		cutoff := now.Add(-m.config.ClaimTTL)
+		assignable = append(assignable, bson.M{
+			"assignment.assigned": bson.M{"$lte": cutoff},
+			"lastActivity":        bson.M{"$lte": cutoff},
+		})
+	}
+	query := bson.M{
+		"completed": false,
+		"status":    bson.M{"$nin": []string{state.StatusAborted, state.StatusFailed}},
+		"$or":       assignable,
+		"$nor":      []bson.M{bson.M{"status": state.StatusAwaitingApproval, "editors": user}},
+	}
+
+	// Merges are filtered again as they're read, since not every reviewer of a merge is
+	// stored as an editor, so only as many as are needed are read.
+	iter := worker.DB(m.dbname).C("merges").Find(query).Sort(queueSort(priority)...).Batch(count).Iter()
+	queued := []state.QueuedMerge{}
+	var mergeState state.MergeState
+	for len(queued) < count && iter.Next(&mergeState) {
+		if assignee := mergeState.Assignee(m.config.ClaimTTL, now); assignee != "" && assignee != user {
+			mergeState = state.MergeState{}
+			continue
+		}
+		if mergeState.CurrentStatus() == state.StatusAwaitingApproval && containsUser(mergeState.Reviewers(), user) {
+			mergeState = state.MergeState{}
+			continue
+		}
+		queued = append(queued, state.QueuedMerge{
+			MatchScore: mergeState.PatientMatch,
+			Merge:      mergeState.Summary(),
+		})
+		mergeState = state.MergeState{}
+	}
+	if err = iter.Close(); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, &state.MergeQueue{
+		Timestamp: now,
+		Priority:  priority,
+		Merges:    queued,
+	})
+}
+
+// queueSort returns the sort order of a reviewer's queue with the given priority. Ties
+// are broken by age, oldest first.
+func queueSort(priority string) []string {
+	switch priority {
+	case PriorityConflicts:
+		return []string{"-remaining", "start", "_id"}
+	case PriorityMatch:
+		return []string{"matchScore", "start", "_id"}
+	default:
+		return []string{"start", "_id"}
+	}
+}
+
+// parseQueueParams parses the query parameters of a GET /queue request.
+func parseQueueParams(params url.Values) (priority string, count int, err error) {
+	priority = PriorityConflicts
+	if p := params.Get("priority"); p != "" {
+		switch p {
+		case PriorityConflicts, PriorityAge, PriorityMatch:
+			priority = p
+		default:
+			return "", 0, fmt.Errorf("Unknown priority %s, must be conflicts, age, or match", p)
+		}
+	}
+
+	count = DefaultMergeCount
+	if c := params.Get("_count"); c != "" {
+		count, err = strconv.Atoi(c)
+		if err != nil || count < 1 {
+			return "", 0, fmt.Errorf("Invalid _count %s, must be a positive integer", c)
+		}
+		if count > MaxMergeCount {
+			count = MaxMergeCount
+		}
+	}
+	return priority, count, nil
+}
+
+// loadForAssignment gets a merge that may be assigned. If the merge can't be assigned,
+// an error response is written and ok is false.
+func (m *MergeController) loadForAssignment(c *gin.Context) (mergeState *state.MergeState, ok bool) {
+	var err error
+	worker := m.session.Copy()
+	defer worker.Close()
+
+	mergeID := c.Param("merge_id")
+
+	// Get the merge state from mongo.
+	mergeState = &state.MergeState{}
+	err = worker.DB(m.dbname).C("merges").Find(bson.M{"_id": mergeID}).One(mergeState)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			abortWithStatus(c, http.StatusNotFound, "Merge %s not found", mergeID)
+			return nil, false
+		}
+		abortWithError(c, err)
+		return nil, false
+	}
+	audit.AddResources(c, mergeState.TargetURL)
+
+	// Only merges that still need a reviewer may be assigned.
+	switch mergeState.CurrentStatus() {
+	case state.StatusCreated, state.StatusInReview, state.StatusAwaitingApproval:
+		return mergeState, true
+	default:
+		abortWithStatus(c, http.StatusBadRequest, "Merge %s is %s and can't be assigned", mergeID, mergeState.CurrentStatus())
+		return nil, false
+	}
+}
+
+// saveAssignment saves a merge's new assignment, as long as nobody else changed its
+// assignment since it was loaded. If it can't be saved, an error response is written
+// and false is returned.
+func (m *MergeController) saveAssignment(c *gin.Context, mergeState *state.MergeState, previous *state.Assignment) bool {
+	worker := m.session.Copy()
+	defer worker.Close()
+
+	selector := bson.M{"_id": mergeState.MergeID}
+	if previous == nil {
+		selector["assignment"] = nil
+	} else {
+		selector["assignment.assignee"] = previous.Assignee
+		selector["assignment.assigned"] = previous.Assigned
+	}
+	update := bson.M{"$set": bson.M{"assignment": mergeState.Assignment}}
+	if mergeState.Assignment == nil {
+		update = bson.M{"$unset": bson.M{"assignment": ""}}
+	}
+
+	err := worker.DB(m.dbname).C("merges").Update(selector, update)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			abortWithStatus(c, http.StatusConflict, "Merge %s was just assigned by someone else", mergeState.MergeID)
+			return false
+		}
+		abortWithError(c, err)
+		return false
+	}
+	return true
+}
+
+// checkAssignee checks that the current user may change a merge: only its assignee may,
+// if it is assigned, although admins may change any merge. If the user may not, an error
+// response is written and false is returned.
+func (m *MergeController) checkAssignee(c *gin.Context, mergeState *state.MergeState) bool {
+	assignee := mergeState.Assignee(m.config.ClaimTTL, time.Now())
+	if assignee == "" || assignee == auth.CurrentUserID(c) || auth.CurrentUser(c).HasRole(auth.Admin) {
+		return true
+	}
+	abortWithStatus(c, http.StatusConflict, "Merge %s is assigned to %s", mergeState.MergeID, assignee)
+	return false
+}
+
+// releaseSubmitted releases a merge that was just submitted for approval, if it was
+// assigned to the user who submitted it, so an approver may claim it. Failing to release
+// it only means an admin has to, so errors are logged.
+func (m *MergeController) releaseSubmitted(worker *mgo.Session, mergeState *state.MergeState, user string) {
+	if mergeState.Assignment == nil || mergeState.Assignment.Assignee != user {
+		return
+	}
+	err := worker.DB(m.dbname).C("merges").Update(
+		bson.M{"_id": mergeState.MergeID, "assignment.assignee": user},
+		bson.M{"$unset": bson.M{"assignment": ""}},
+	)
+	if err != nil && err != mgo.ErrNotFound {
+		log.Printf("Failed to release merge %s: %s\n", mergeState.MergeID, err.Error())
+		return
+	}
+	mergeState.Release()
+	m.events.Publish(&events.Event{
+		Type:     events.MergeReleased,
+		MergeID:  mergeState.MergeID,
+		Assignee: user,
+		Actor:    user,
+	})
+}
+
+// publishAssignment publishes a change to a merge's assignment to the event bus.
+func (m *MergeController) publishAssignment(c *gin.Context, eventType, mergeID, assignee string) {
+	m.events.Publish(&events.Event{
+		Type:     eventType,
+		MergeID:  mergeID,
+		Assignee: assignee,
+		Actor:    auth.CurrentUserID(c),
+	})
+}
+
+func containsUser(users []string, user string) bool {
+	for _, u := range users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mitre/ptmerge/audit"
+	"github.com/mitre/ptmerge/auth"
+	"github.com/mitre/ptmerge/events"
+	"github.com/mitre/ptmerge/state"
+)
+
+// commentRequest is the body of a request to add a comment.
+type commentRequest struct {
+	Text string `json:"text"`
+	// ReplyTo is the ID of the comment being replied to, if any.
+	ReplyTo string `json:"replyTo"`
+}
+
+// AddComment adds a comment to a merge, or to one of its conflicts if the route includes
+// a conflict_id. The comment may reply to an earlier comment in the same thread.
+func (m *MergeController) AddComment(c *gin.Context) {
+	var err error
+	worker := m.session.Copy()
+	defer worker.Close()
+
+	mergeState, field, comments, ok := m.loadComments(c)
+	if !ok {
+		return
+	}
+
+	if !mergeState.IsActive() {
+		abortWithStatus(c, http.StatusBadRequest, "Merge %s is %s and can't be commented on", mergeState.MergeID, mergeState.CurrentStatus())
+		return
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	req := &commentRequest{}
+	err = json.Unmarshal(body, req)
+	if err != nil {
+		abortWithStatus(c, http.StatusBadRequest, "Invalid comment: %s", err.Error())
+		return
+	}
+	if strings.TrimSpace(req.Text) == "" {
+		abortWithStatus(c, http.StatusBadRequest, "A comment must have text")
+		return
+	}
+	if req.ReplyTo != "" && state.FindComment(comments, req.ReplyTo) == nil {
+		abortWithStatus(c, http.StatusBadRequest, "Comment %s to reply to not found", req.ReplyTo)
+		return
+	}
+
+	now := time.Now()
+	comment := state.Comment{
+		ID:        bson.NewObjectId().Hex(),
+		ReplyTo:   req.ReplyTo,
+		Author:    auth.CurrentUserID(c),
+		Timestamp: now,
+		Text:      req.Text,
+	}
+
+	// Comments are pushed, rather than saving the whole merge, so reviewers commenting at
+	// the same time don't lose each other's comments. Other changes to the merge only save
+	// the fields they change (see saveMerge), so they don't overwrite comments either.
+	err = worker.DB(m.dbname).C("merges").UpdateId(mergeState.MergeID, bson.M{
+		"$push": bson.M{field: comment},
+		"$set":  bson.M{"lastActivity": now},
+	})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	m.publishComment(c, events.CommentAdded, mergeState.MergeID, comment.ID)
+
+	c.JSON(http.StatusCreated, &comment)
+}
+
+// GetComments returns the comments on a merge, or on one of its conflicts if the route
+// includes a conflict_id, oldest first.
+func (m *MergeController) GetComments(c *gin.Context) {
+	_, _, comments, ok := m.loadComments(c)
+	if !ok {
+		return
+	}
+	if comments == nil {
+		comments = []state.Comment{}
+	}
+
+	c.JSON(http.StatusOK, &state.Comments{
+		Timestamp: time.Now(),
+		Comments:  comments,
+	})
+}
+
+// DeleteComment deletes a comment, along with all of the replies to it. Only the comment's
+// author or an admin may delete it.
+func (m *MergeController) DeleteComment(c *gin.Context) {
+	var err error
+	worker := m.session.Copy()
+	defer worker.Close()
+
+	mergeState, field, comments, ok := m.loadComments(c)
+	if !ok {
+		return
+	}
+
+	commentID := c.Param("comment_id")
+	comment := state.FindComment(comments, commentID)
+	if comment == nil {
+		abortWithStatus(c, http.StatusNotFound, "Comment %s not found for merge %s", commentID, mergeState.MergeID)
+		return
+	}
+
+	user := auth.CurrentUser(c)
+	if user.ID != comment.Author && !user.HasRole(auth.Admin) {
+		abortWithStatus(c, http.StatusForbidden, "Comment %s may only be deleted by %s or an admin", commentID, comment.Author)
+		return
+	}
+
+	if !mergeState.IsActive() {
+		abortWithStatus(c, http.StatusBadRequest, "Merge %s is %s and its comments can't be deleted", mergeState.MergeID, mergeState.CurrentStatus())
+		return
+	}
+
+	err = worker.DB(m.dbname).C("merges").UpdateId(mergeState.MergeID, bson.M{
+		"$pull": bson.M{field: bson.M{"id": bson.M{"$in": state.CommentThread(comments, commentID)}}},
+	})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	m.publishComment(c, events.CommentDeleted, mergeState.MergeID, commentID)
+
+	// Respond with 204 no content.
+	c.Data(http.StatusNoContent, "", nil)
+}
+
+// loadComments gets a merge and the comments on it, or on one of its conflicts if the
+// route includes a conflict_id. The field the comments are stored in is also returned.
+// If the merge or conflict doesn't exist, an error response is written and ok is false.
+func (m *MergeController) loadComments(c *gin.Context) (mergeState *state.MergeState, field string, comments []state.Comment, ok bool) {
+	var err error
+	worker := m.session.Copy()
+	defer worker.Close()
+
+	mergeID := c.Param("merge_id")
+
+	// Get the merge state from mongo.
+	mergeState = &state.MergeState{}
+	err = worker.DB(m.dbname).C("merges").Find(bson.M{"_id": mergeID}).One(mergeState)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			abortWithStatus(c, http.StatusNotFound, "Merge %s not found", mergeID)
+			return nil, "", nil, false
+		}
+		abortWithError(c, err)
+		return nil, "", nil, false
+	}
+
+	conflictID := c.Param("conflict_id")
+	if conflictID == "" {
+		return mergeState, "comments", mergeState.Comments, true
+	}
+
+	conflict, found := mergeState.Conflicts[conflictID]
+	if !found {
+		abortWithStatus(c, http.StatusNotFound, "Merge conflict %s not found for merge %s", conflictID, mergeID)
+		return nil, "", nil, false
+	}
+	audit.AddResources(c, conflict.TargetResource.ResourceID)
+	return mergeState, "conflicts." + conflictID + ".comments", conflict.Comments, true
+}
+
+// publishComment publishes a change to the comments on a merge or conflict to the event bus.
+func (m *MergeController) publishComment(c *gin.Context, eventType, mergeID, commentID string) {
+	m.events.Publish(&events.Event{
+		Type:       eventType,
+		MergeID:    mergeID,
+		ConflictID: c.Param("conflict_id"),
+		CommentID:  commentID,
+		Actor:      auth.CurrentUserID(c),
+	})
+}
+
+// auditComments adds all of the comments on a merge and its conflicts to the audit
+// record, so the reasons behind the merge are kept once it is completed.
+func auditComments(c *gin.Context, mergeState *state.MergeState) {
+	for _, comment := range mergeState.Comments {
+		audit.AddComments(c, audit.Comment{
+			Author:    comment.Author,
+			Timestamp: comment.Timestamp,
+			Text:      comment.Text,
+		})
+	}
+
+	conflictIDs := mergeState.Conflicts.Keys()
+	sort.Strings(conflictIDs)
+	for _, conflictID := range conflictIDs {
+		for _, comment := range mergeState.Conflicts[conflictID].Comments {
+			audit.AddComments(c, audit.Comment{
+				ConflictID: conflictID,
+				Author:     comment.Author,
+				Timestamp:  comment.Timestamp,
+				Text:       comment.Text,
+			})
+		}
+	}
+}
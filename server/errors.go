@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mitre/ptmerge/fhirutil"
+	"github.com/mitre/ptmerge/merge"
+	"github.com/mitre/ptmerge/state"
+)
+
+// requestError is an error the server reports with a specific status, e.g. a merge that
+// doesn't exist.
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// abortWithError ends a request with an error, which the OperationOutcomes middleware
+// renders with a status and issue code that match the error's type.
+func abortWithError(c *gin.Context, err error) {
+	c.Status(errorStatus(err))
+	c.Error(err)
+	c.Abort()
+}
+
+// abortWithStatus ends a request with an error message and status, which the
+// OperationOutcomes middleware renders.
+func abortWithStatus(c *gin.Context, status int, format string, args ...interface{}) {
+	abortWithError(c, &requestError{status: status, message: fmt.Sprintf(format, args...)})
+}
+
+// OperationOutcomes returns middleware that renders the errors handlers end requests
+// with as FHIR OperationOutcomes. Errors that aren't from the merge, fhirutil, or state
+// packages, such as database errors, are logged rather than revealed to the client.
+func OperationOutcomes() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+		err := c.Errors.Last().Err
+
+		// Other middleware (e.g. authentication) may set the status themselves.
+		status := c.Writer.Status()
+		if status < http.StatusBadRequest {
+			status = errorStatus(err)
+		}
+
+		diagnostics := err.Error()
+		code, known := issueCode(err, status)
+		if !known && status >= http.StatusInternalServerError {
+			log.Printf("Error handling %s %s: %s\n", c.Request.Method, c.Request.URL.Path, err.Error())
+			diagnostics = "An unexpected error occurred"
+		}
+		if upstream, ok := err.(*fhirutil.UpstreamError); ok && upstream.Err != nil {
+			log.Printf("Error handling %s %s: %s: %s\n", c.Request.Method, c.Request.URL.Path, err.Error(), upstream.Err.Error())
+		}
+
+		c.JSON(status, fhirutil.ErrorOutcome(code, diagnostics))
+	}
+}
+
+// errorStatus returns the HTTP status for an error.
+func errorStatus(err error) int {
+	switch e := err.(type) {
+	case *requestError:
+		return e.status
+	case *fhirutil.NotFoundError:
+		return http.StatusNotFound
+	case *fhirutil.ConflictError, *state.IllegalTransitionError, *state.StaleMergeError:
+		return http.StatusConflict
+	case *fhirutil.UpstreamError:
+		return http.StatusBadGateway
+	case *merge.BadSourceError, *merge.TypeMismatchError, *fhirutil.PatchError:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// issueCode returns the FHIR issue type code for an error with the given status. Errors
+// of unknown types are coded by their status, and known is false.
+func issueCode(err error, status int) (code string, known bool) {
+	switch e := err.(type) {
+	case *fhirutil.NotFoundError:
+		return "not-found", true
+	case *fhirutil.ConflictError, *state.StaleMergeError:
+		return "conflict", true
+	case *fhirutil.UpstreamError:
+		if e.StatusCode == 0 {
+			// The FHIR server couldn't be reached, which may not last.
+			return "transient", true
+		}
+		return "exception", true
+	case *merge.BadSourceError, *merge.TypeMismatchError, *fhirutil.PatchError:
+		return "invalid", true
+	case *state.IllegalTransitionError:
+		return "business-rule", true
+	case *requestError:
+		known = true
+	}
+
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid", known
+	case http.StatusUnauthorized:
+		return "login", known
+	case http.StatusForbidden:
+		return "forbidden", known
+	case http.StatusNotFound, http.StatusGone:
+		return "not-found", known
+	case http.StatusConflict:
+		return "conflict", known
+	default:
+		return "exception", known
+	}
+}
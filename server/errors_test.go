@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/mitre/ptmerge/fhirutil"
+	"github.com/mitre/ptmerge/merge"
+	"github.com/mitre/ptmerge/state"
+	"github.com/stretchr/testify/suite"
+)
+
+type ErrorsTestSuite struct {
+	suite.Suite
+}
+
+func TestErrorsTestSuite(t *testing.T) {
+	suite.Run(t, new(ErrorsTestSuite))
+}
+
+func (e *ErrorsTestSuite) TestTypedErrors() {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{&fhirutil.NotFoundError{Resource: "Patient:123"}, http.StatusNotFound, "not-found"},
+		{&fhirutil.ConflictError{Resource: "Bundle:123"}, http.StatusConflict, "conflict"},
+		{&fhirutil.UpstreamError{Message: "Failed", StatusCode: 500}, http.StatusBadGateway, "exception"},
+		{&fhirutil.UpstreamError{Message: "Failed"}, http.StatusBadGateway, "transient"},
+		{merge.ErrNoPatientResource, http.StatusBadRequest, "invalid"},
+		{&merge.TypeMismatchError{Expected: "Patient", Actual: "Encounter"}, http.StatusBadRequest, "invalid"},
+		{&fhirutil.PatchError{Message: "FHIRPath Patch has no operations"}, http.StatusBadRequest, "invalid"},
+		{&state.IllegalTransitionError{MergeID: "123", From: "in-review", To: "committed"}, http.StatusConflict, "business-rule"},
+		{&state.StaleMergeError{MergeID: "123"}, http.StatusConflict, "conflict"},
+	}
+
+	for _, test := range tests {
+		res, oo := e.do(func(c *gin.Context) {
+			abortWithError(c, test.err)
+		})
+		e.Equal(test.status, res.Code)
+		e.Equal(test.code, oo.Issue[0].Code)
+		e.Equal(test.err.Error(), oo.Issue[0].Diagnostics)
+	}
+}
+
+func (e *ErrorsTestSuite) TestStatusErrors() {
+	res, oo := e.do(func(c *gin.Context) {
+		abortWithStatus(c, http.StatusNotFound, "Merge %s not found", "123")
+	})
+	e.Equal(http.StatusNotFound, res.Code)
+	e.Equal("OperationOutcome", oo.ResourceType)
+	e.Equal("error", oo.Issue[0].Severity)
+	e.Equal("not-found", oo.Issue[0].Code)
+	e.Equal("Merge 123 not found", oo.Issue[0].Diagnostics)
+
+	res, oo = e.do(func(c *gin.Context) {
+		abortWithStatus(c, http.StatusForbidden, "Nope")
+	})
+	e.Equal(http.StatusForbidden, res.Code)
+	e.Equal("forbidden", oo.Issue[0].Code)
+
+	// Other middleware may set the status itself.
+	res, oo = e.do(func(c *gin.Context) {
+		c.Status(http.StatusUnauthorized)
+		c.Error(errors.New("No credentials were provided"))
+	})
+	e.Equal(http.StatusUnauthorized, res.Code)
+	e.Equal("login", oo.Issue[0].Code)
+	e.Equal("No credentials were provided", oo.Issue[0].Diagnostics)
+}
+
+func (e *ErrorsTestSuite) TestUnknownErrorsAreHidden() {
+	res, oo := e.do(func(c *gin.Context) {
+		abortWithError(c, errors.New("no reachable servers"))
+	})
+	e.Equal(http.StatusInternalServerError, res.Code)
+	e.Equal("exception", oo.Issue[0].Code)
+	e.Equal("An unexpected error occurred", oo.Issue[0].Diagnostics)
+}
+
+func (e *ErrorsTestSuite) TestResponsesAreUnchanged() {
+	engine := gin.New()
+	engine.Use(OperationOutcomes())
+	engine.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	req, err := http.NewRequest("GET", "/", nil)
+	e.Require().NoError(err)
+	res := httptest.NewRecorder()
+	engine.ServeHTTP(res, req)
+	e.Equal(http.StatusOK, res.Code)
+	e.Equal("ok", res.Body.String())
+}
+
+// do runs a handler behind the OperationOutcomes middleware, returning the response and
+// the OperationOutcome in its body.
+func (e *ErrorsTestSuite) do(handler gin.HandlerFunc) (*httptest.ResponseRecorder, *models.OperationOutcome) {
+	gin.SetMode(gin.ReleaseMode)
+	engine := gin.New()
+	engine.Use(OperationOutcomes())
+	engine.GET("/", handler)
+
+	req, err := http.NewRequest("GET", "/", nil)
+	e.Require().NoError(err)
+	res := httptest.NewRecorder()
+	engine.ServeHTTP(res, req)
+
+	oo := &models.OperationOutcome{}
+	e.Require().NoError(json.Unmarshal(res.Body.Bytes(), oo))
+	e.Require().Len(oo.Issue, 1)
+	return res, oo
+}
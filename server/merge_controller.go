@@ -1,8 +1,10 @@
 package server
 
 import (
-	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -12,6 +14,9 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/intervention-engine/fhir/models"
+	"github.com/mitre/ptmerge/audit"
+	"github.com/mitre/ptmerge/auth"
+	"github.com/mitre/ptmerge/events"
 	"github.com/mitre/ptmerge/fhirutil"
 	"github.com/mitre/ptmerge/merge"
 	"github.com/mitre/ptmerge/state"
@@ -22,17 +27,27 @@ type MergeController struct {
 	session  *mgo.Session
 	dbname   string
 	fhirHost string
+	events   *events.Bus
+	config   Config
 }
 
-// NewMergeController returns a pointer to a newly initialized MergeController.
-func NewMergeController(session *mgo.Session, dbname string, fhirHost string) *MergeController {
+// NewMergeController returns a pointer to a newly initialized MergeController. Changes
+// to merges are published to the event bus. The config's merge settings (such as
+// MergeTTL and RequireApproval) are applied to every merge.
+func NewMergeController(session *mgo.Session, dbname string, fhirHost string, bus *events.Bus, config Config) *MergeController {
 	return &MergeController{
 		session:  session,
 		dbname:   dbname,
 		fhirHost: fhirHost,
+		events:   bus,
+		config:   config,
 	}
 }
 
+// HeartbeatInterval is how often a comment is sent on idle event streams, so proxies
+// don't close them.
+var HeartbeatInterval = 15 * time.Second
+
 // ========================================================================= //
 // MERGE                                                                     //
 // ========================================================================= //
@@ -47,24 +62,48 @@ func (m *MergeController) Merge(c *gin.Context) {
 	source2 := c.Query("source2")
 
 	if source1 == "" || source2 == "" {
-		c.String(http.StatusBadRequest, "URL(s) referencing source bundles were not provided")
+		abortWithStatus(c, http.StatusBadRequest, "URL(s) referencing source bundles were not provided")
 		return
 	}
+	audit.AddResources(c, source1, source2)
 
 	merger := merge.NewMerger(m.fhirHost)
-	outcome, targetURL, err := merger.Merge(source1, source2)
+	merger.Patient1 = c.Query("patient1")
+	merger.Patient2 = c.Query("patient2")
+	bundle1, bundle2, err := merger.FetchSourceBundles(source1, source2)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	outcome, targetURL, duplicates, err := merger.MergeBundles(bundle1, bundle2)
 
 	if err != nil {
-		if err == merge.ErrNoPatientResource || err == merge.ErrDuplicatePatientResource {
-			c.String(http.StatusBadRequest, err.Error())
-			return
-		}
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
 		return
 	}
 
+	// Duplicates removed from the source bundles are recorded, by their URL in their source,
+	// whether or not the merge had conflicts.
+	sources := []string{source1, source2}
+	for _, duplicate := range duplicates {
+		audit.AddResources(c, sourceResourceURL(sources[duplicate.Source-1], duplicate.ResourceType, duplicate.RemovedID))
+	}
+
+	audit.AddResources(c, targetURL)
+
 	if targetURL == "" {
-		// The merge had no conflicts, just return the merged bundle.
+		// The merge had no conflicts, just return the merged bundle, along with an
+		// OperationOutcome listing any duplicates that were removed from it.
+		if len(duplicates) > 0 {
+			oo := duplicatesOutcome(duplicates, sources)
+			outcome.Entry = append(outcome.Entry, models.BundleEntryComponent{
+				Resource: oo,
+				Response: &models.BundleEntryResponseComponent{Status: "200"},
+			})
+			total := uint32(len(outcome.Entry))
+			outcome.Total = &total
+		}
 		c.JSON(http.StatusOK, outcome)
 		return
 	}
@@ -74,15 +113,15 @@ func (m *MergeController) Merge(c *gin.Context) {
 	for _, entry := range outcome.Entry {
 		oo, ok := entry.Resource.(*models.OperationOutcome)
 		if !ok {
-			c.String(http.StatusInternalServerError, "Malformed merge conflict")
+			abortWithStatus(c, http.StatusInternalServerError, "Malformed merge conflict")
 			return
 		}
 		if len(oo.Issue) != 1 {
-			c.String(http.StatusInternalServerError, "Malformed merge conflict: bad Issue")
+			abortWithStatus(c, http.StatusInternalServerError, "Malformed merge conflict: bad Issue")
 			return
 		}
 		if oo.Issue[0].Diagnostics == "" {
-			c.String(http.StatusInternalServerError, "Malformed merge conflict: bad Diagnostic information")
+			abortWithStatus(c, http.StatusInternalServerError, "Malformed merge conflict: bad Diagnostic information")
 			return
 		}
 
@@ -101,21 +140,37 @@ func (m *MergeController) Merge(c *gin.Context) {
 	// Some conflicts exist, create a new record in mongo to manage this merge's state.
 	mergeID := bson.NewObjectId().Hex()
 	now := time.Now()
-	err = worker.DB(m.dbname).C("merges").Insert(&state.MergeState{
-		MergeID:    mergeID,
-		Completed:  false,
-		Source1URL: source1,
-		Source2URL: source2,
-		TargetURL:  targetURL,
-		Conflicts:  conflictMap,
-		Start:      &now,
-	})
+	mergeState := &state.MergeState{
+		MergeID:      mergeID,
+		Completed:    false,
+		Status:       state.StatusCreated,
+		Source1URL:   source1,
+		Source2URL:   source2,
+		TargetURL:    targetURL,
+		Conflicts:    conflictMap,
+		Start:        &now,
+		CreatedBy:    auth.CurrentUserID(c),
+		LastActivity: &now,
+		Patients:     sourcePatientIDs(bundle1, bundle2),
+		History: []state.StatusChange{
+			state.StatusChange{Status: state.StatusCreated, Timestamp: now, Actor: auth.CurrentUserID(c)},
+		},
+		Demographics: append(
+			sourceDemographics(source1, bundle1),
+			sourceDemographics(source2, bundle2)...,
+		),
+		Duplicates: sourceDuplicates(duplicates),
+	}
+	mergeState.Index()
+	err = worker.DB(m.dbname).C("merges").Insert(mergeState)
 
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
 		return
 	}
 
+	m.publish(c, events.MergeCreated, mergeID, "", targetURL)
+
 	// Return the bundle of conflicts to resolve. The mergeID is passed in the Location header.
 	c.Header("Location", mergeID)
 	c.JSON(http.StatusCreated, outcome)
@@ -140,44 +195,40 @@ func (m *MergeController) Resolve(c *gin.Context) {
 	err = worker.DB(m.dbname).C("merges").Find(bson.M{"_id": mergeID}).One(&mergeState)
 	if err != nil {
 		if err == mgo.ErrNotFound {
-			c.String(http.StatusNotFound, "Merge %s not found", mergeID)
+			abortWithStatus(c, http.StatusNotFound, "Merge %s not found", mergeID)
 			return
 		}
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
 		return
 	}
 
-	// Check that the merge is incomplete.
-	if mergeState.Completed {
-		c.String(http.StatusBadRequest, "Merge %s is complete, no remaining conflicts to resolve", mergeID)
+	// Check that the merge can still be changed.
+	if !mergeState.IsEditable() {
+		abortWithStatus(c, http.StatusBadRequest, "Merge %s is %s, no remaining conflicts to resolve", mergeID, mergeState.CurrentStatus())
+		return
+	}
+	if !m.checkAssignee(c, &mergeState) {
 		return
 	}
 
 	// Check that the conflictID exists and is part of this merge.
 	conflict, found := mergeState.Conflicts[conflictID]
 	if !found {
-		c.String(http.StatusNotFound, "Merge conflict %s not found for merge %s", conflictID, mergeID)
+		abortWithStatus(c, http.StatusNotFound, "Merge conflict %s not found for merge %s", conflictID, mergeID)
 		return
 	}
 
+	audit.AddResources(c, conflict.TargetResource.ResourceID)
+
 	// Check that the conflict wasn't already resolved.
 	if conflict.Resolved {
-		c.String(http.StatusBadRequest, "Merge conflict %s was already resolved for merge %s", conflictID, mergeID)
+		abortWithStatus(c, http.StatusBadRequest, "Merge conflict %s was already resolved for merge %s", conflictID, mergeID)
 		return
 	}
 
 	// Extract the resource from the request body.
-	body, err := ioutil.ReadAll(c.Request.Body)
-	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	// Now we can unmarshal the body into the proper resource struct.
-	updatedResource := models.NewStructForResourceName(conflict.TargetResource.ResourceType)
-	err = json.Unmarshal(body, &updatedResource)
-	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+	updatedResource, ok := requestResource(c)
+	if !ok {
 		return
 	}
 
@@ -185,34 +236,60 @@ func (m *MergeController) Resolve(c *gin.Context) {
 	merger := merge.NewMerger(m.fhirHost)
 	err = merger.ResolveConflict(mergeState.TargetURL, conflict.TargetResource.ResourceID, updatedResource)
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
 		return
 	}
 
 	// No error means the conflict was resolved, so update the merge state.
 	mergeState.Conflicts[conflictID].Resolved = true
-	err = worker.DB(m.dbname).C("merges").UpdateId(mergeID, bson.M{"$set": mergeState})
+	mergeState.Conflicts[conflictID].ResolvedBy = auth.CurrentUserID(c)
+	mergeState.Edited(auth.CurrentUserID(c))
+	err = m.saveMerge(worker, &mergeState, conflictID)
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
 		return
 	}
+	m.publish(c, events.ConflictResolved, mergeID, conflictID, conflict.TargetResource.ResourceID)
+	m.respondWithRemainingConflicts(c, worker, &mergeState)
+}
+
+// respondWithRemainingConflicts responds with a bundle of a merge's remaining conflicts
+// after one is resolved. If none remain, the merge is completed (or submitted for approval)
+// and the target bundle is returned instead. mergeState must be the merge as just saved
+// (see saveMerge), so conflicts other requests resolved meanwhile are counted.
+func (m *MergeController) respondWithRemainingConflicts(c *gin.Context, worker *mgo.Session, mergeState *state.MergeState) {
+	var err error
+	mergeID := mergeState.MergeID
 
 	// Check if there were still other unresolved conflicts.
 	numRemaining := len(mergeState.Conflicts.RemainingConflicts())
 	if numRemaining == 0 {
-		// No conflicts remaining, mark the merge as "completed" and return the target Bundle.
-		mergeState.Completed = true
-		now := time.Now()
-		mergeState.End = &now
-		err = worker.DB(m.dbname).C("merges").UpdateId(mergeID, bson.M{"$set": mergeState})
+		// No conflicts remaining, mark the merge as "completed" (or submit it for approval)
+		// and return the target Bundle.
+		next, eventType := state.StatusCompleted, events.MergeCompleted
+		if m.config.RequireApproval {
+			next, eventType = state.StatusAwaitingApproval, events.ApprovalRequested
+		}
+		err = mergeState.Transition(next, auth.CurrentUserID(c))
 		if err != nil {
-			c.String(http.StatusInternalServerError, err.Error())
+			abortWithError(c, err)
 			return
 		}
+		err = m.saveMerge(worker, mergeState)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		m.publish(c, eventType, mergeID, "", "")
+		if next == state.StatusCompleted {
+			auditComments(c, mergeState)
+		} else {
+			m.releaseSubmitted(worker, mergeState, auth.CurrentUserID(c))
+		}
 
 		targetBundle, err := fhirutil.GetResourceByURL("Bundle", mergeState.TargetURL)
 		if err != nil {
-			c.String(http.StatusInternalServerError, err.Error())
+			abortWithError(c, err)
 			return
 		}
 		c.JSON(http.StatusOK, targetBundle)
@@ -224,7 +301,7 @@ func (m *MergeController) Resolve(c *gin.Context) {
 	for i, id := range mergeState.Conflicts.RemainingConflicts() {
 		oo, err := fhirutil.GetResourceByURL("OperationOutcome", mergeState.Conflicts[id].OperationOutcomeURL)
 		if err != nil {
-			c.String(http.StatusInternalServerError, err.Error())
+			abortWithError(c, err)
 			return
 		}
 		remainingConflicts[i] = oo
@@ -232,6 +309,22 @@ func (m *MergeController) Resolve(c *gin.Context) {
 	c.JSON(http.StatusOK, fhirutil.ResponseBundle("200", remainingConflicts))
 }
 
+// requestResource reads the resource in a request's body as a generic JSON object, so none
+// of its elements are lost. Bodies that aren't a JSON object are a 400.
+func requestResource(c *gin.Context) (resource map[string]interface{}, ok bool) {
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		abortWithError(c, err)
+		return nil, false
+	}
+	resource, err = fhirutil.UnmarshalJSONResource(body)
+	if err != nil {
+		abortWithStatus(c, http.StatusBadRequest, "Request body is not a valid resource: %s", err.Error())
+		return nil, false
+	}
+	return resource, true
+}
+
 // ========================================================================= //
 // DELETE MERGE                                                              //
 // ========================================================================= //
@@ -249,39 +342,88 @@ func (m *MergeController) DeleteMerge(c *gin.Context) {
 	err = worker.DB(m.dbname).C("merges").Find(bson.M{"_id": mergeID}).One(&mergeState)
 	if err != nil {
 		if err == mgo.ErrNotFound {
-			c.String(http.StatusNotFound, "Merge %s not found", mergeID)
+			abortWithStatus(c, http.StatusNotFound, "Merge %s not found", mergeID)
 			return
 		}
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
 		return
 	}
-	// Delete all conflicts.
-	for _, key := range mergeState.Conflicts.Keys() {
-		err = fhirutil.DeleteResourceByURL(mergeState.Conflicts[key].OperationOutcomeURL)
-		if err != nil {
-			c.String(http.StatusInternalServerError, err.Error())
-			return
-		}
+	audit.AddResources(c, mergeState.TargetURL)
+
+	if !mergeState.CanTransition(state.StatusAborted) {
+		abortWithStatus(c, http.StatusBadRequest, "Merge %s is %s and can no longer be aborted", mergeID, mergeState.CurrentStatus())
+		return
 	}
 
-	// Delete the target.
-	err = fhirutil.DeleteResourceByURL(mergeState.TargetURL)
+	err = deleteMergeResources(&mergeState)
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		// Some of the merge's resources may be gone, so it can't continue. Record the
+		// failure so the abort can be retried.
+		if mergeState.CanTransition(state.StatusFailed) {
+			if updateErr := m.abortMerge(worker, &mergeState, state.StatusFailed, auth.CurrentUserID(c)); updateErr != nil {
+				log.Printf("Failed to record the failed abort of merge %s: %s\n", mergeID, updateErr.Error())
+			}
+		}
+		abortWithError(c, err)
 		return
 	}
 
-	// Now wipe the saved merge state.
-	err = worker.DB(m.dbname).C("merges").RemoveId(mergeID)
+	// Keep the merge state as a record of the abort.
+	err = m.abortMerge(worker, &mergeState, state.StatusAborted, auth.CurrentUserID(c))
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
 		return
 	}
+	m.publish(c, events.MergeAborted, mergeID, "", "")
 
 	// 204 response explicitly has no body.
 	c.Data(http.StatusNoContent, "", nil)
 }
 
+// ========================================================================= //
+// COMMIT MERGE                                                              //
+// ========================================================================= //
+
+// CommitMerge makes a completed merge final. A committed merge can no longer be aborted.
+func (m *MergeController) CommitMerge(c *gin.Context) {
+	var err error
+	worker := m.session.Copy()
+	defer worker.Close()
+
+	mergeID := c.Param("merge_id")
+
+	// Get the merge state from mongo.
+	var mergeState state.MergeState
+	err = worker.DB(m.dbname).C("merges").Find(bson.M{"_id": mergeID}).One(&mergeState)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			abortWithStatus(c, http.StatusNotFound, "Merge %s not found", mergeID)
+			return
+		}
+		abortWithError(c, err)
+		return
+	}
+	audit.AddResources(c, mergeState.TargetURL)
+
+	err = mergeState.Transition(state.StatusCommitted, auth.CurrentUserID(c))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	err = m.saveMerge(worker, &mergeState)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	m.publish(c, events.MergeCommitted, mergeID, "", "")
+	auditComments(c, &mergeState)
+
+	c.JSON(http.StatusOK, &state.Merge{
+		Timestamp: time.Now(),
+		Merge:     mergeState,
+	})
+}
+
 // ========================================================================= //
 // MERGE TARGET MANAGEMENT                                                   //
 // ========================================================================= //
@@ -299,24 +441,32 @@ func (m *MergeController) GetTarget(c *gin.Context) {
 	err = worker.DB(m.dbname).C("merges").Find(bson.M{"_id": mergeID}).One(&mergeState)
 	if err != nil {
 		if err == mgo.ErrNotFound {
-			c.String(http.StatusNotFound, "Merge %s not found", mergeID)
+			abortWithStatus(c, http.StatusNotFound, "Merge %s not found", mergeID)
 			return
 		}
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
+		return
+	}
+
+	audit.AddResources(c, mergeState.TargetURL)
+
+	// Aborted merges have no target.
+	if mergeState.CurrentStatus() == state.StatusAborted {
+		abortWithStatus(c, http.StatusGone, "Merge %s was aborted", mergeID)
 		return
 	}
 
 	// Get the target from the host FHIR server.
 	targetBundle, err := fhirutil.GetResourceByURL("Bundle", mergeState.TargetURL)
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, targetBundle)
 }
 
 // UpdateTargetResource allows manual update of a resource in the target bundle.
-// The updated resource should be in the POST body.
+// The updated resource, or a FHIRPath Patch to apply to it, should be in the POST body.
 func (m *MergeController) UpdateTargetResource(c *gin.Context) {
 	var err error
 	worker := m.session.Copy()
@@ -330,50 +480,49 @@ func (m *MergeController) UpdateTargetResource(c *gin.Context) {
 	err = worker.DB(m.dbname).C("merges").Find(bson.M{"_id": mergeID}).One(&mergeState)
 	if err != nil {
 		if err == mgo.ErrNotFound {
-			c.String(http.StatusNotFound, "Merge %s not found", mergeID)
+			abortWithStatus(c, http.StatusNotFound, "Merge %s not found", mergeID)
 			return
 		}
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
 		return
 	}
 
-	// Get the resource from the request body.
-	body, err := ioutil.ReadAll(c.Request.Body)
-	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+	// Check that the target can still be changed.
+	if !mergeState.IsEditable() {
+		abortWithStatus(c, http.StatusBadRequest, "Merge %s is %s, its target can no longer be changed", mergeID, mergeState.CurrentStatus())
 		return
 	}
-
-	// Unmarshal into a map[string]interface{} to get the resourceType.
-
-	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+	if !m.checkAssignee(c, &mergeState) {
 		return
 	}
-	resourceType := fhirutil.JSONGetResourceType(body)
-	if resourceType == "" {
-		c.String(http.StatusInternalServerError, "Could not identify resourceType of updated resource")
+
+	// Get the resource from the request body.
+	updatedResource, ok := requestResource(c)
+	if !ok {
 		return
 	}
-
-	// Now we can unmarshal the body into the proper resource struct.
-	updatedResource := models.NewStructForResourceName(resourceType)
-	err = json.Unmarshal(body, &updatedResource)
-	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+	if fhirutil.GetResourceType(updatedResource) == "" {
+		abortWithStatus(c, http.StatusBadRequest, "Could not identify resourceType of updated resource")
 		return
 	}
 
 	// Update the target resource.
 	merger := merge.NewMerger(m.fhirHost)
-	err = merger.UpdateTargetResource(mergeState.TargetURL, targetResourceID, updatedResource)
+	resource, err := merger.UpdateTargetResource(mergeState.TargetURL, targetResourceID, updatedResource)
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
 		return
 	}
+	mergeState.Edited(auth.CurrentUserID(c))
+	err = m.saveMerge(worker, &mergeState)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	m.publish(c, events.TargetResourceUpdated, mergeID, "", targetResourceID)
 
 	// Respond with the updated resource.
-	c.JSON(http.StatusOK, updatedResource)
+	c.JSON(http.StatusOK, resource)
 }
 
 // DeleteTargetResource allows manual update of a resource in the target bundle.
@@ -391,19 +540,35 @@ func (m *MergeController) DeleteTargetResource(c *gin.Context) {
 	err = worker.DB(m.dbname).C("merges").Find(bson.M{"_id": mergeID}).One(&mergeState)
 	if err != nil {
 		if err == mgo.ErrNotFound {
-			c.String(http.StatusNotFound, "Merge %s not found", mergeID)
+			abortWithStatus(c, http.StatusNotFound, "Merge %s not found", mergeID)
 			return
 		}
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
+		return
+	}
+
+	// Check that the target can still be changed.
+	if !mergeState.IsEditable() {
+		abortWithStatus(c, http.StatusBadRequest, "Merge %s is %s, its target can no longer be changed", mergeID, mergeState.CurrentStatus())
+		return
+	}
+	if !m.checkAssignee(c, &mergeState) {
 		return
 	}
 
 	merger := merge.NewMerger(m.fhirHost)
 	err = merger.DeleteTargetResource(mergeState.TargetURL, targetResourceID)
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
+		return
+	}
+	mergeState.Edited(auth.CurrentUserID(c))
+	err = m.saveMerge(worker, &mergeState)
+	if err != nil {
+		abortWithError(c, err)
 		return
 	}
+	m.publish(c, events.TargetResourceDeleted, mergeID, "", targetResourceID)
 
 	// Respond with 204 no content.
 	c.Data(http.StatusNoContent, "", nil)
@@ -426,10 +591,16 @@ func (m *MergeController) GetRemainingConflicts(c *gin.Context) {
 	err = worker.DB(m.dbname).C("merges").Find(bson.M{"_id": mergeID}).One(&mergeState)
 	if err != nil {
 		if err == mgo.ErrNotFound {
-			c.String(http.StatusNotFound, "Merge %s not found", mergeID)
+			abortWithStatus(c, http.StatusNotFound, "Merge %s not found", mergeID)
 			return
 		}
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
+		return
+	}
+
+	// Aborted merges have no conflicts.
+	if mergeState.CurrentStatus() == state.StatusAborted {
+		abortWithStatus(c, http.StatusGone, "Merge %s was aborted", mergeID)
 		return
 	}
 
@@ -439,7 +610,7 @@ func (m *MergeController) GetRemainingConflicts(c *gin.Context) {
 	for i, id := range mergeState.Conflicts.RemainingConflicts() {
 		conflict, err := fhirutil.GetResource(m.fhirHost, "OperationOutcome", id)
 		if err != nil {
-			c.String(http.StatusInternalServerError, err.Error())
+			abortWithError(c, err)
 			return
 		}
 		conflicts[i] = conflict
@@ -461,10 +632,16 @@ func (m *MergeController) GetResolvedConflicts(c *gin.Context) {
 	err = worker.DB(m.dbname).C("merges").Find(bson.M{"_id": mergeID}).One(&mergeState)
 	if err != nil {
 		if err == mgo.ErrNotFound {
-			c.String(http.StatusNotFound, "Merge %s not found", mergeID)
+			abortWithStatus(c, http.StatusNotFound, "Merge %s not found", mergeID)
 			return
 		}
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
+		return
+	}
+
+	// Aborted merges have no conflicts.
+	if mergeState.CurrentStatus() == state.StatusAborted {
+		abortWithStatus(c, http.StatusGone, "Merge %s was aborted", mergeID)
 		return
 	}
 
@@ -474,7 +651,7 @@ func (m *MergeController) GetResolvedConflicts(c *gin.Context) {
 	for i, id := range mergeState.Conflicts.ResolvedConflicts() {
 		r, err := fhirutil.GetResource(m.fhirHost, "OperationOutcome", id)
 		if err != nil {
-			c.String(http.StatusInternalServerError, err.Error())
+			abortWithError(c, err)
 			return
 		}
 		resolved[i] = r
@@ -497,29 +674,34 @@ func (m *MergeController) DeleteConflict(c *gin.Context) {
 	err = worker.DB(m.dbname).C("merges").Find(bson.M{"_id": mergeID}).One(&mergeState)
 	if err != nil {
 		if err == mgo.ErrNotFound {
-			c.String(http.StatusNotFound, "Merge %s not found", mergeID)
+			abortWithStatus(c, http.StatusNotFound, "Merge %s not found", mergeID)
 			return
 		}
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
 		return
 	}
 
-	// Check that the merge is incomplete.
-	if mergeState.Completed {
-		c.String(http.StatusBadRequest, "Merge %s is complete, no remaining conflicts to resolve", mergeID)
+	// Check that the merge can still be changed.
+	if !mergeState.IsEditable() {
+		abortWithStatus(c, http.StatusBadRequest, "Merge %s is %s, no remaining conflicts to resolve", mergeID, mergeState.CurrentStatus())
+		return
+	}
+	if !m.checkAssignee(c, &mergeState) {
 		return
 	}
 
 	// Check that the conflictID exists and is part of this merge.
 	conflict, found := mergeState.Conflicts[conflictID]
 	if !found {
-		c.String(http.StatusNotFound, "Merge conflict %s not found for merge %s", conflictID, mergeID)
+		abortWithStatus(c, http.StatusNotFound, "Merge conflict %s not found for merge %s", conflictID, mergeID)
 		return
 	}
 
+	audit.AddResources(c, conflict.TargetResource.ResourceID)
+
 	// Check that the conflict wasn't already resolved.
 	if conflict.Resolved {
-		c.String(http.StatusBadRequest, "Merge conflict %s was already resolved for merge %s", conflictID, mergeID)
+		abortWithStatus(c, http.StatusBadRequest, "Merge conflict %s was already resolved for merge %s", conflictID, mergeID)
 		return
 	}
 
@@ -527,53 +709,279 @@ func (m *MergeController) DeleteConflict(c *gin.Context) {
 	merger := merge.NewMerger(m.fhirHost)
 	err = merger.DeleteTargetResource(mergeState.TargetURL, conflict.TargetResource.ResourceID)
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
 		return
 	}
 
 	// No error mean success, delete the conflict OperationOutcome.
 	err = fhirutil.DeleteResourceByURL(conflict.OperationOutcomeURL)
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
 		return
 	}
 
 	// Remove the conflict from the merge state.
 	delete(mergeState.Conflicts, conflictID)
+	mergeState.Edited(auth.CurrentUserID(c))
 
 	// Save the updated state.
-	err = worker.DB(m.dbname).C("merges").UpdateId(mergeID, bson.M{"$set": mergeState})
+	err = m.saveMerge(worker, &mergeState, conflictID)
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
 		return
 	}
+	m.publish(c, events.ConflictDeleted, mergeID, conflictID, conflict.TargetResource.ResourceID)
 
 	// Respond with 204 no content.
 	c.Data(http.StatusNoContent, "", nil)
 }
 
+// PairConflict resolves a conflict by merging its target resource into another resource in
+// the target, as if they had been matched. This is mostly for unmatchable resources that are
+// conflicts of their own (see merge.InclusionResourceTypes), and ambiguous duplicates. If the
+// merged resource has conflicts, they're added to the merge as a new conflict.
+func (m *MergeController) PairConflict(c *gin.Context) {
+	var err error
+	worker := m.session.Copy()
+	defer worker.Close()
+
+	mergeID := c.Param("merge_id")
+	conflictID := c.Param("conflict_id")
+	targetResourceID := c.Param("resource_id")
+
+	// Get the merge state from mongo.
+	var mergeState state.MergeState
+	err = worker.DB(m.dbname).C("merges").Find(bson.M{"_id": mergeID}).One(&mergeState)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			abortWithStatus(c, http.StatusNotFound, "Merge %s not found", mergeID)
+			return
+		}
+		abortWithError(c, err)
+		return
+	}
+
+	// Check that the merge can still be changed.
+	if !mergeState.IsEditable() {
+		abortWithStatus(c, http.StatusBadRequest, "Merge %s is %s, no remaining conflicts to resolve", mergeID, mergeState.CurrentStatus())
+		return
+	}
+	if !m.checkAssignee(c, &mergeState) {
+		return
+	}
+
+	// Check that the conflictID exists and is part of this merge.
+	conflict, found := mergeState.Conflicts[conflictID]
+	if !found {
+		abortWithStatus(c, http.StatusNotFound, "Merge conflict %s not found for merge %s", conflictID, mergeID)
+		return
+	}
+
+	pairedResourceID := conflict.TargetResource.ResourceID
+	audit.AddResources(c, pairedResourceID, targetResourceID)
+
+	// Check that the conflict wasn't already resolved.
+	if conflict.Resolved {
+		abortWithStatus(c, http.StatusBadRequest, "Merge conflict %s was already resolved for merge %s", conflictID, mergeID)
+		return
+	}
+	if targetResourceID == pairedResourceID {
+		abortWithStatus(c, http.StatusBadRequest, "Merge conflict %s can't be paired with its own target resource", conflictID)
+		return
+	}
+
+	// Only resources the merge couldn't match on its own, or thought might be duplicates,
+	// can be paired. Other conflicts are between resources that already matched.
+	code, err := m.conflictIssueCode(conflict)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if code != merge.InclusionIssueCode && code != merge.DuplicateIssueCode {
+		abortWithStatus(c, http.StatusBadRequest, "Merge conflict %s isn't an inclusion or duplicate conflict, so it can't be paired", conflictID)
+		return
+	}
+
+	// Merge the conflict's target resource into the other resource.
+	merger := merge.NewMerger(m.fhirHost)
+	pairConflict, err := merger.PairTargetResources(mergeState.TargetURL, targetResourceID, pairedResourceID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	// The paired resource is gone, so every conflict on it is resolved.
+	var resolvedConflicts []string
+	for _, id := range mergeState.Conflicts.RemainingConflicts() {
+		if mergeState.Conflicts[id].TargetResource.ResourceID == pairedResourceID {
+			mergeState.Conflicts[id].Resolved = true
+			mergeState.Conflicts[id].ResolvedBy = auth.CurrentUserID(c)
+			resolvedConflicts = append(resolvedConflicts, id)
+		}
+	}
+	changedConflicts := append([]string{}, resolvedConflicts...)
+
+	// Any conflicts in the merged resource are added to its open conflict, if it has one,
+	// otherwise they're a new conflict.
+	if pairConflict != nil {
+		if openID, found := openConflictOn(&mergeState, targetResourceID); found {
+			err = m.addConflictExpressions(mergeState.Conflicts[openID], pairConflict)
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+		} else {
+			created, err := fhirutil.PostResource(m.fhirHost, "OperationOutcome", pairConflict)
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			createdID := fhirutil.GetResourceID(created)
+			mergeState.Conflicts[createdID] = &state.ConflictState{
+				OperationOutcomeURL: m.fhirHost + "/OperationOutcome/" + createdID,
+				TargetResource: state.TargetResource{
+					ResourceType: conflict.TargetResource.ResourceType,
+					ResourceID:   targetResourceID,
+				},
+			}
+			changedConflicts = append(changedConflicts, createdID)
+		}
+	}
+
+	mergeState.Edited(auth.CurrentUserID(c))
+	err = m.saveMerge(worker, &mergeState, changedConflicts...)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	m.publish(c, events.TargetResourceDeleted, mergeID, "", pairedResourceID)
+	m.publish(c, events.TargetResourceUpdated, mergeID, "", targetResourceID)
+	for _, id := range resolvedConflicts {
+		m.publish(c, events.ConflictResolved, mergeID, id, pairedResourceID)
+	}
+	m.respondWithRemainingConflicts(c, worker, &mergeState)
+}
+
+// conflictIssueCode returns the issue code of a conflict's OperationOutcome, identifying
+// what kind of conflict it is.
+func (m *MergeController) conflictIssueCode(conflict *state.ConflictState) (string, error) {
+	oo, err := getOperationOutcome(conflict.OperationOutcomeURL)
+	if err != nil {
+		return "", err
+	}
+	if len(oo.Issue) == 0 {
+		return "", fmt.Errorf("Conflict %s has no issue", conflict.OperationOutcomeURL)
+	}
+	return oo.Issue[0].Code, nil
+}
+
+// addConflictExpressions adds the expressions of another conflict to an existing conflict,
+// skipping any it already has.
+func (m *MergeController) addConflictExpressions(conflict *state.ConflictState, other *models.OperationOutcome) error {
+	oo, err := getOperationOutcome(conflict.OperationOutcomeURL)
+	if err != nil {
+		return err
+	}
+	if len(oo.Issue) == 0 || len(other.Issue) == 0 {
+		return fmt.Errorf("Conflict %s has no issue", conflict.OperationOutcomeURL)
+	}
+	issue := &oo.Issue[0]
+	existing := make(map[string]bool)
+	for _, expression := range issue.Expression {
+		existing[expression] = true
+	}
+	for _, expression := range other.Issue[0].Expression {
+		if !existing[expression] {
+			issue.Expression = append(issue.Expression, expression)
+			existing[expression] = true
+		}
+	}
+	// Locations mirror expressions, see fhirutil.OperationOutcome.
+	issue.Location = issue.Expression
+	_, err = fhirutil.UpdateResource(m.fhirHost, "OperationOutcome", oo)
+	return err
+}
+
+// getOperationOutcome GETs a conflict's OperationOutcome.
+func getOperationOutcome(ooURL string) (*models.OperationOutcome, error) {
+	resource, err := fhirutil.GetResourceByURL("OperationOutcome", ooURL)
+	if err != nil {
+		return nil, err
+	}
+	oo, ok := resource.(*models.OperationOutcome)
+	if !ok {
+		return nil, fmt.Errorf("Conflict %s is not an OperationOutcome", ooURL)
+	}
+	return oo, nil
+}
+
+// openConflictOn returns the ID of an unresolved conflict on a target resource, if there is one.
+func openConflictOn(mergeState *state.MergeState, targetResourceID string) (string, bool) {
+	for _, id := range mergeState.Conflicts.RemainingConflicts() {
+		if mergeState.Conflicts[id].TargetResource.ResourceID == targetResourceID {
+			return id, true
+		}
+	}
+	return "", false
+}
+
 // ========================================================================= //
 // MERGE METADATA                                                            //
 // ========================================================================= //
 
-// AllMerges returns the metadata for all merges we have a record of.
+// AllMerges returns the metadata for a page of merges we have a record of. The merges
+// may be filtered and sorted, see parseMergeSearch for the supported query parameters.
 func (m *MergeController) AllMerges(c *gin.Context) {
 	var err error
 	worker := m.session.Copy()
 	defer worker.Close()
 
-	// Get all merges from mongo.
+	search, err := parseMergeSearch(c.Request.URL.Query())
+	if err != nil {
+		abortWithStatus(c, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	// Count all matching merges, then get just the requested page from mongo.
+	query := worker.DB(m.dbname).C("merges").Find(search.Query)
+	total, err := query.Count()
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
 	var merges []state.MergeState
-	err = worker.DB(m.dbname).C("merges").Find(nil).All(&merges)
+	err = query.Sort(search.Sort...).Skip((search.Page - 1) * search.Count).Limit(search.Count).All(&merges)
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
+		return
+	}
+
+	pagination := state.Pagination{
+		Total: total,
+		Page:  search.Page,
+		Count: search.Count,
+	}
+
+	if search.Summary {
+		// Package up the merge summaries.
+		summaries := make([]state.MergeSummary, len(merges))
+		for i := range merges {
+			summaries[i] = merges[i].Summary()
+		}
+		c.JSON(http.StatusOK, &state.MergeSummaries{
+			Timestamp:  time.Now(),
+			Pagination: pagination,
+			Merges:     summaries,
+		})
 		return
 	}
 
 	// Package up the merges metadata.
 	meta := &state.Merges{
-		Timestamp: time.Now(),
-		Merges:    merges,
+		Timestamp:  time.Now(),
+		Pagination: pagination,
+		Merges:     merges,
 	}
 
 	c.JSON(http.StatusOK, meta)
@@ -592,10 +1000,10 @@ func (m *MergeController) GetMerge(c *gin.Context) {
 	err = worker.DB(m.dbname).C("merges").Find(bson.M{"_id": mergeID}).One(&mergeState)
 	if err != nil {
 		if err == mgo.ErrNotFound {
-			c.String(http.StatusNotFound, "Merge %s not found", mergeID)
+			abortWithStatus(c, http.StatusNotFound, "Merge %s not found", mergeID)
 			return
 		}
-		c.String(http.StatusInternalServerError, err.Error())
+		abortWithError(c, err)
 		return
 	}
 
@@ -607,3 +1015,268 @@ func (m *MergeController) GetMerge(c *gin.Context) {
 
 	c.JSON(http.StatusOK, meta)
 }
+
+// ========================================================================= //
+// MERGE EVENTS                                                              //
+// ========================================================================= //
+
+// GetEvents streams changes to a merge as Server-Sent Events, so collaborating reviewers
+// can see each other's changes without polling. Each SSE event is named by the event
+// type, with the event as its JSON data. The stream ends when the merge is committed,
+// aborted or expired, or when the client disconnects. Merges that are already committed or
+// aborted are a 410. If the client falls behind and events are dropped, the stream ends
+// with an events-dropped event, so the client fetches the merge again before reconnecting.
+func (m *MergeController) GetEvents(c *gin.Context) {
+	var err error
+	worker := m.session.Copy()
+	defer worker.Close()
+
+	mergeID := c.Param("merge_id")
+
+	// Check that the merge exists.
+	var mergeState state.MergeState
+	err = worker.DB(m.dbname).C("merges").Find(bson.M{"_id": mergeID}).One(&mergeState)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			abortWithStatus(c, http.StatusNotFound, "Merge %s not found", mergeID)
+			return
+		}
+		abortWithError(c, err)
+		return
+	}
+	// Don't hold onto a database connection for the life of the stream.
+	worker.Close()
+
+	if !mergeState.IsActive() {
+		abortWithStatus(c, http.StatusGone, "Merge %s is %s, no more changes will be made", mergeID, mergeState.CurrentStatus())
+		return
+	}
+
+	sub := m.events.Subscribe(mergeID)
+	defer sub.Cancel()
+
+	heartbeat := time.NewTicker(HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	// Send the stream's headers straight away, so the client knows it's connected.
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // don't let nginx buffer the stream
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-sub.Events:
+			if !ok {
+				return false
+			}
+			c.SSEvent(event.Type, event)
+			return !event.IsFinal() && event.Type != events.EventsDropped
+		case <-heartbeat.C:
+			// SSE comments keep the connection alive without triggering client events.
+			_, err := io.WriteString(w, ": heartbeat\n\n")
+			return err == nil
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// ========================================================================= //
+// HELPERS                                                                   //
+// ========================================================================= //
+
+// deleteMergeResources deletes a merge's conflicts and target from the host FHIR server.
+// This is used both to abort merges and to expire them. Resources that are already gone
+// (e.g. deleted by an earlier attempt that failed part way) count as deleted, and a failure
+// to delete one resource doesn't stop the others from being deleted. The first failure is
+// returned.
+func deleteMergeResources(mergeState *state.MergeState) error {
+	urls := []string{}
+	for _, key := range mergeState.Conflicts.Keys() {
+		urls = append(urls, mergeState.Conflicts[key].OperationOutcomeURL)
+	}
+	urls = append(urls, mergeState.TargetURL)
+
+	var firstErr error
+	for _, resourceURL := range urls {
+		err := fhirutil.DeleteResourceByURL(resourceURL)
+		if _, notFound := err.(*fhirutil.NotFoundError); notFound {
+			continue
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// saveMerge saves the changes a request made to a merge: its status, history, editors and
+// approvals, and the given conflicts. Only those fields are written, so changes other
+// requests made since the merge was loaded (e.g. comments, or the merge's assignment)
+// aren't overwritten. Given conflicts that are no longer in the merge are removed.
+//
+// The save fails with a StaleMergeError if another change was saved since the merge was
+// loaded, so a request can't act on conflicts or a status that are out of date. Otherwise
+// mergeState is replaced by the merge as saved.
+func (m *MergeController) saveMerge(worker *mgo.Session, mergeState *state.MergeState, conflictIDs ...string) error {
+	mergeState.Index()
+	set := bson.M{
+		"status":     mergeState.Status,
+		"history":    mergeState.History,
+		"completed":  mergeState.Completed,
+		"remaining":  mergeState.Remaining,
+		"matchScore": mergeState.PatientMatch,
+	}
+	if mergeState.End != nil {
+		set["end"] = mergeState.End
+	}
+	if mergeState.LastActivity != nil {
+		set["lastActivity"] = mergeState.LastActivity
+	}
+	if len(mergeState.Approvals) > 0 {
+		set["approvals"] = mergeState.Approvals
+	}
+
+	unset := bson.M{}
+	for _, id := range conflictIDs {
+		conflict, found := mergeState.Conflicts[id]
+		if !found {
+			unset["conflicts."+id] = ""
+			continue
+		}
+		// Every field but the conflict's comments, so new conflicts are saved whole.
+		set["conflicts."+id+".operationOutcome"] = conflict.OperationOutcomeURL
+		set["conflicts."+id+".targetResource"] = conflict.TargetResource
+		set["conflicts."+id+".resolved"] = conflict.Resolved
+		set["conflicts."+id+".resolvedBy"] = conflict.ResolvedBy
+	}
+
+	update := bson.M{"$set": set, "$inc": bson.M{"version": 1}}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if len(mergeState.Editors) > 0 {
+		// Editors are only ever added, so editors saved by other requests are kept.
+		update["$addToSet"] = bson.M{"editors": bson.M{"$each": mergeState.Editors}}
+	}
+
+	var saved state.MergeState
+	_, err := worker.DB(m.dbname).C("merges").Find(versionSelector(mergeState)).Apply(mgo.Change{
+		Update:    update,
+		ReturnNew: true,
+	}, &saved)
+	if err == mgo.ErrNotFound {
+		return &state.StaleMergeError{MergeID: mergeState.MergeID}
+	}
+	if err != nil {
+		return err
+	}
+	*mergeState = saved
+	return nil
+}
+
+// versionSelector returns the mongo query for a merge as it was loaded. Merges from before
+// versions were tracked have no version until their first change is saved.
+func versionSelector(mergeState *state.MergeState) bson.M {
+	if mergeState.Version == 0 {
+		return bson.M{"_id": mergeState.MergeID, "version": bson.M{"$in": []interface{}{0, nil}}}
+	}
+	return bson.M{"_id": mergeState.MergeID, "version": mergeState.Version}
+}
+
+// abortMerge moves a merge whose resources were deleted to a status, either aborted or
+// failed. Since the resources are already gone, a merge another request changed meanwhile
+// is reloaded and moved to the status anyway, unless it can no longer make the transition.
+func (m *MergeController) abortMerge(worker *mgo.Session, mergeState *state.MergeState, status, actor string) error {
+	for {
+		err := mergeState.Transition(status, actor)
+		if err != nil {
+			return err
+		}
+		err = m.saveMerge(worker, mergeState)
+		if _, stale := err.(*state.StaleMergeError); !stale {
+			return err
+		}
+		var current state.MergeState
+		err = worker.DB(m.dbname).C("merges").FindId(mergeState.MergeID).One(&current)
+		if err != nil {
+			return err
+		}
+		*mergeState = current
+	}
+}
+
+// publish publishes an event for a change made by the current user to the event bus.
+func (m *MergeController) publish(c *gin.Context, eventType, mergeID, conflictID, resourceID string) {
+	m.events.Publish(&events.Event{
+		Type:       eventType,
+		MergeID:    mergeID,
+		ConflictID: conflictID,
+		ResourceID: resourceID,
+		Actor:      auth.CurrentUserID(c),
+	})
+}
+
+// sourcePatientIDs returns the IDs of all Patient resources in the source bundles.
+func sourcePatientIDs(bundles ...*models.Bundle) []string {
+	ids := []string{}
+	for _, bundle := range bundles {
+		for _, patient := range fhirutil.ResourcesOfType(bundle, "Patient") {
+			ids = append(ids, fhirutil.GetResourceID(patient))
+		}
+	}
+	return ids
+}
+
+// sourceDuplicates returns the duplicates removed from the source bundles, to be stored
+// with the merge.
+func sourceDuplicates(duplicates []merge.Duplicate) []state.Duplicate {
+	stored := make([]state.Duplicate, len(duplicates))
+	for i, d := range duplicates {
+		stored[i] = state.Duplicate{
+			Source:       d.Source,
+			ResourceType: d.ResourceType,
+			KeptID:       d.KeptID,
+			RemovedID:    d.RemovedID,
+			Ambiguous:    d.Ambiguous,
+		}
+	}
+	return stored
+}
+
+// duplicatesOutcome returns an OperationOutcome with an issue for each duplicate removed from
+// the source bundles, naming the removed and kept resources by their URLs in their source.
+func duplicatesOutcome(duplicates []merge.Duplicate, sources []string) *models.OperationOutcome {
+	oo := &models.OperationOutcome{
+		DomainResource: models.DomainResource{
+			Resource: models.Resource{
+				Id:           bson.NewObjectId().Hex(),
+				ResourceType: "OperationOutcome",
+			},
+		},
+	}
+	for _, d := range duplicates {
+		source := sources[d.Source-1]
+		oo.Issue = append(oo.Issue, models.OperationOutcomeIssueComponent{
+			Severity: "information",
+			Code:     merge.DuplicateIssueCode,
+			Diagnostics: fmt.Sprintf("%s was removed as a duplicate of %s",
+				sourceResourceURL(source, d.ResourceType, d.RemovedID),
+				sourceResourceURL(source, d.ResourceType, d.KeptID)),
+		})
+	}
+	return oo
+}
+
+// sourceResourceURL returns the URL of a resource in a source bundle, on the same server as
+// the bundle, e.g. http://example.com/fhir/Condition/123 for a Condition in
+// http://example.com/fhir/Bundle/456. If the source isn't a Bundle URL, the resource's
+// relative URL is returned.
+func sourceResourceURL(source, resourceType, id string) string {
+	if i := strings.LastIndex(source, "/Bundle/"); i >= 0 {
+		return source[:i] + "/" + resourceType + "/" + id
+	}
+	return resourceType + "/" + id
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mitre/ptmerge/state"
+)
+
+var (
+	// DefaultMergeCount is the number of merges returned per page if _count is not specified.
+	DefaultMergeCount = 50
+
+	// MaxMergeCount is the largest number of merges that may be returned in a single page.
+	MaxMergeCount = 500
+
+	// mergeSortFields maps the fields merges may be sorted by to their names in mongo.
+	mergeSortFields = map[string]string{
+		"id":        "_id",
+		"start":     "start",
+		"end":       "end",
+		"completed": "completed",
+		"status":    "status",
+		"source1":   "source1",
+		"source2":   "source2",
+	}
+)
+
+// mergeSearch is a parsed search for merges, including the filters, sort order,
+// and page requested.
+type mergeSearch struct {
+	Query   bson.M
+	Sort    []string
+	Page    int
+	Count   int
+	Summary bool
+}
+
+// parseMergeSearch parses the query parameters of a GET /merge request. The supported
+// parameters are:
+//
+//	_count    the number of merges per page (default 50)
+//	page      the page to return, starting from 1 (default 1)
+//	_sort     a comma-separated list of fields to sort by, prefixed with "-" for
+//	          descending order (default "-start")
+//	_summary  if "true", conflict counts are returned instead of conflicts
+//	completed "true" or "false"
+//	status    the merge's lifecycle status, e.g. "in-review"
+//	start     a date or dateTime the merge started, with an optional eq, ge, gt, le,
+//	          or lt prefix. May be repeated to give a range.
+//	end       a date or dateTime the merge ended, as for start
+//	source    the URL of either source bundle
+//	patient   the ID of a Patient in either source bundle
+func parseMergeSearch(params url.Values) (*mergeSearch, error) {
+	var err error
+	search := &mergeSearch{
+		Query: bson.M{},
+		Sort:  []string{"-start", "_id"},
+		Page:  1,
+		Count: DefaultMergeCount,
+	}
+
+	if count := params.Get("_count"); count != "" {
+		search.Count, err = strconv.Atoi(count)
+		if err != nil || search.Count < 1 {
+			return nil, fmt.Errorf("Invalid _count %s, must be a positive integer", count)
+		}
+		if search.Count > MaxMergeCount {
+			search.Count = MaxMergeCount
+		}
+	}
+
+	if page := params.Get("page"); page != "" {
+		search.Page, err = strconv.Atoi(page)
+		if err != nil || search.Page < 1 {
+			return nil, fmt.Errorf("Invalid page %s, must be a positive integer", page)
+		}
+	}
+
+	if sort := params.Get("_sort"); sort != "" {
+		search.Sort = []string{}
+		for _, field := range strings.Split(sort, ",") {
+			prefix := ""
+			if strings.HasPrefix(field, "-") {
+				prefix = "-"
+				field = field[1:]
+			}
+			mongoField, ok := mergeSortFields[field]
+			if !ok {
+				return nil, fmt.Errorf("Unknown _sort field %s", field)
+			}
+			search.Sort = append(search.Sort, prefix+mongoField)
+		}
+		// Always break ties by ID so pages are stable.
+		search.Sort = append(search.Sort, "_id")
+	}
+
+	if summary := params.Get("_summary"); summary != "" {
+		search.Summary, err = strconv.ParseBool(summary)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid _summary %s, must be true or false", summary)
+		}
+	}
+
+	if completed := params.Get("completed"); completed != "" {
+		isCompleted, err := strconv.ParseBool(completed)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid completed %s, must be true or false", completed)
+		}
+		search.Query["completed"] = isCompleted
+	}
+
+	if status := params.Get("status"); status != "" {
+		if !state.IsStatus(status) {
+			return nil, fmt.Errorf("Unknown status %s", status)
+		}
+		search.Query["status"] = status
+	}
+
+	for _, field := range []string{"start", "end"} {
+		if len(params[field]) == 0 {
+			continue
+		}
+		dateQuery := bson.M{}
+		for _, value := range params[field] {
+			err = addDateCriteria(dateQuery, value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s %s: %s", field, value, err.Error())
+			}
+		}
+		search.Query[field] = dateQuery
+	}
+
+	if source := params.Get("source"); source != "" {
+		search.Query["$or"] = []bson.M{
+			bson.M{"source1": source},
+			bson.M{"source2": source},
+		}
+	}
+
+	if patient := params.Get("patient"); patient != "" {
+		search.Query["patients"] = patient
+	}
+
+	return search, nil
+}
+
+// addDateCriteria adds the mongo criteria for a date search value (e.g. "ge2017-03-01")
+// to a query. Date-only values cover the whole day, as with FHIR date searches.
+func addDateCriteria(query bson.M, value string) error {
+	prefix := "eq"
+	if len(value) > 2 {
+		switch value[:2] {
+		case "eq", "ge", "gt", "le", "lt":
+			prefix = value[:2]
+			value = value[2:]
+		}
+	}
+
+	// The search value is an implicit range, from the start of the value to the start
+	// of the next day (or instant, for dateTimes).
+	var lower, upper time.Time
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		lower, upper = t, t.AddDate(0, 0, 1)
+	} else if t, err := time.Parse(time.RFC3339, value); err == nil {
+		lower, upper = t, t.Add(time.Nanosecond)
+	} else {
+		return fmt.Errorf("must be a date (YYYY-MM-DD) or dateTime (RFC 3339)")
+	}
+
+	switch prefix {
+	case "eq":
+		query["$gte"] = lower
+		query["$lt"] = upper
+	case "ge":
+		query["$gte"] = lower
+	case "gt":
+		query["$gte"] = upper
+	case "le":
+		query["$lt"] = upper
+	case "lt":
+		query["$lt"] = lower
+	}
+	return nil
+}
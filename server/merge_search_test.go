@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type MergeSearchTestSuite struct {
+	suite.Suite
+}
+
+func TestMergeSearchTestSuite(t *testing.T) {
+	suite.Run(t, new(MergeSearchTestSuite))
+}
+
+func (m *MergeSearchTestSuite) TestDefaults() {
+	search, err := parseMergeSearch(url.Values{})
+	m.NoError(err)
+	m.Equal(bson.M{}, search.Query)
+	m.Equal([]string{"-start", "_id"}, search.Sort)
+	m.Equal(1, search.Page)
+	m.Equal(DefaultMergeCount, search.Count)
+	m.False(search.Summary)
+}
+
+func (m *MergeSearchTestSuite) TestPagination() {
+	search, err := parseMergeSearch(url.Values{"_count": {"10"}, "page": {"3"}})
+	m.NoError(err)
+	m.Equal(10, search.Count)
+	m.Equal(3, search.Page)
+
+	// Counts are capped.
+	search, err = parseMergeSearch(url.Values{"_count": {"1000000"}})
+	m.NoError(err)
+	m.Equal(MaxMergeCount, search.Count)
+
+	_, err = parseMergeSearch(url.Values{"_count": {"0"}})
+	m.Error(err)
+	_, err = parseMergeSearch(url.Values{"page": {"first"}})
+	m.Error(err)
+}
+
+func (m *MergeSearchTestSuite) TestSort() {
+	search, err := parseMergeSearch(url.Values{"_sort": {"completed,-end"}})
+	m.NoError(err)
+	m.Equal([]string{"completed", "-end", "_id"}, search.Sort)
+
+	_, err = parseMergeSearch(url.Values{"_sort": {"conflicts"}})
+	m.Error(err)
+}
+
+func (m *MergeSearchTestSuite) TestFilters() {
+	search, err := parseMergeSearch(url.Values{
+		"completed": {"false"},
+		"source":    {"http://fhir/Bundle/1"},
+		"patient":   {"123"},
+		"_summary":  {"true"},
+	})
+	m.NoError(err)
+	m.True(search.Summary)
+	m.Equal(false, search.Query["completed"])
+	m.Equal("123", search.Query["patients"])
+	m.Equal([]bson.M{
+		bson.M{"source1": "http://fhir/Bundle/1"},
+		bson.M{"source2": "http://fhir/Bundle/1"},
+	}, search.Query["$or"])
+
+	_, err = parseMergeSearch(url.Values{"completed": {"maybe"}})
+	m.Error(err)
+
+	search, err = parseMergeSearch(url.Values{"status": {"awaiting-approval"}})
+	m.NoError(err)
+	m.Equal("awaiting-approval", search.Query["status"])
+
+	_, err = parseMergeSearch(url.Values{"status": {"done"}})
+	m.Error(err)
+}
+
+func (m *MergeSearchTestSuite) TestDateFilters() {
+	day := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	nextDay := day.AddDate(0, 0, 1)
+
+	search, err := parseMergeSearch(url.Values{"start": {"2017-03-01"}})
+	m.NoError(err)
+	m.Equal(bson.M{"$gte": day, "$lt": nextDay}, search.Query["start"])
+
+	search, err = parseMergeSearch(url.Values{"start": {"ge2017-03-01", "lt2017-03-02"}})
+	m.NoError(err)
+	m.Equal(bson.M{"$gte": day, "$lt": nextDay}, search.Query["start"])
+
+	search, err = parseMergeSearch(url.Values{"end": {"gt2017-03-01"}})
+	m.NoError(err)
+	m.Equal(bson.M{"$gte": nextDay}, search.Query["end"])
+
+	search, err = parseMergeSearch(url.Values{"end": {"le2017-03-01T12:00:00Z"}})
+	m.NoError(err)
+	noon := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	m.Equal(bson.M{"$lt": noon.Add(time.Nanosecond)}, search.Query["end"])
+
+	_, err = parseMergeSearch(url.Values{"start": {"ge03/01/2017"}})
+	m.Error(err)
+}
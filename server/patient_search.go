@@ -0,0 +1,281 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/mitre/ptmerge/fhirutil"
+	"github.com/mitre/ptmerge/state"
+)
+
+var (
+	// DefaultPatientSearchCount is the number of results returned by a patient search if
+	// _count is not specified.
+	DefaultPatientSearchCount = 20
+
+	// MaxPatientSearchCandidates is the most merges a patient search ranks by name. If more
+	// merges match, the most recently started are ranked.
+	MaxPatientSearchCandidates = 1000
+
+	// birthDatePattern matches partial or complete FHIR dates.
+	birthDatePattern = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?$`)
+)
+
+// patientSearch is a parsed search for merges by patient demographics.
+type patientSearch struct {
+	Name       string
+	NameMode   string // "", "exact", or "fuzzy"
+	BirthDate  string
+	Identifier string
+	Count      int
+}
+
+// parsePatientSearch parses the query parameters of a GET /search/merge request. The
+// supported parameters are:
+//
+//	name        words in the patient's name. Each word must start one of the patient's
+//	            names. Use name:exact to match whole words only, or name:fuzzy to also
+//	            match words that sound alike (e.g. "Lowel Abot").
+//	birthdate   the patient's birth date, as YYYY, YYYY-MM, or YYYY-MM-DD
+//	identifier  one of the patient's identifiers, as system|value or just value
+//	_count      the maximum number of results (default 20)
+func parsePatientSearch(params url.Values) (*patientSearch, error) {
+	search := &patientSearch{
+		Count: DefaultPatientSearchCount,
+	}
+
+	for _, mode := range []string{"", "exact", "fuzzy"} {
+		param := "name"
+		if mode != "" {
+			param += ":" + mode
+		}
+		if name := params.Get(param); name != "" {
+			if search.Name != "" {
+				return nil, fmt.Errorf("Only one name parameter may be used")
+			}
+			search.Name = name
+			search.NameMode = mode
+		}
+	}
+	if search.Name != "" && len(state.NameTokens(search.Name)) == 0 {
+		return nil, fmt.Errorf("Invalid name %s, must contain at least one letter", search.Name)
+	}
+
+	if birthDate := params.Get("birthdate"); birthDate != "" {
+		if !birthDatePattern.MatchString(birthDate) {
+			return nil, fmt.Errorf("Invalid birthdate %s, must be YYYY, YYYY-MM, or YYYY-MM-DD", birthDate)
+		}
+		search.BirthDate = birthDate
+	}
+
+	search.Identifier = params.Get("identifier")
+
+	if search.Name == "" && search.BirthDate == "" && search.Identifier == "" {
+		return nil, fmt.Errorf("At least one of name, birthdate, or identifier is required")
+	}
+
+	if count := params.Get("_count"); count != "" {
+		var err error
+		search.Count, err = strconv.Atoi(count)
+		if err != nil || search.Count < 1 {
+			return nil, fmt.Errorf("Invalid _count %s, must be a positive integer", count)
+		}
+		if search.Count > MaxMergeCount {
+			search.Count = MaxMergeCount
+		}
+	}
+	return search, nil
+}
+
+// Query returns the mongo query for merges with a patient matching the search. All
+// criteria must match the same patient. The most selective criterion (the identifier, or
+// else the birth date, or else the last word of the name) is also matched against any
+// patient, so the query can use that criterion's index.
+func (p *patientSearch) Query() bson.M {
+	criteria := []bson.M{}
+
+	for _, token := range state.NameTokens(p.Name) {
+		switch p.NameMode {
+		case "exact":
+			criteria = append(criteria, bson.M{"nameTokens": token})
+		case "fuzzy":
+			criteria = append(criteria, bson.M{"$or": []bson.M{
+				bson.M{"nameTokens": bson.RegEx{Pattern: "^" + regexp.QuoteMeta(token)}},
+				bson.M{"namePhonetics": state.Soundex(token)},
+			}})
+		default:
+			criteria = append(criteria, bson.M{"nameTokens": bson.RegEx{Pattern: "^" + regexp.QuoteMeta(token)}})
+		}
+	}
+
+	if p.BirthDate != "" {
+		criteria = append(criteria, bson.M{"birthDate": bson.RegEx{Pattern: "^" + regexp.QuoteMeta(p.BirthDate)}})
+	}
+
+	if p.Identifier != "" {
+		if strings.Contains(p.Identifier, "|") {
+			criteria = append(criteria, bson.M{"identifiers": p.Identifier})
+		} else {
+			criteria = append(criteria, bson.M{"identifiers": bson.RegEx{Pattern: `\|` + regexp.QuoteMeta(p.Identifier) + "$"}})
+		}
+	}
+
+	query := bson.M{"demographics": bson.M{"$elemMatch": bson.M{"$and": criteria}}}
+	prefilter := criteria[len(criteria)-1]
+	if or, ok := prefilter["$or"].([]bson.M); ok {
+		query["$or"] = demographicsFields(or...)
+	} else {
+		for field, value := range demographicsFields(prefilter)[0] {
+			query[field] = value
+		}
+	}
+	return query
+}
+
+// demographicsFields prefixes the fields of patient criteria with "demographics.", so
+// they match any patient in a merge.
+func demographicsFields(criteria ...bson.M) []bson.M {
+	prefixed := make([]bson.M, len(criteria))
+	for i, criterion := range criteria {
+		prefixed[i] = bson.M{}
+		for field, value := range criterion {
+			prefixed[i]["demographics."+field] = value
+		}
+	}
+	return prefixed
+}
+
+// Limit returns the most merges that need to be fetched to rank the results of the search.
+// Only searches by name are ranked, so other searches need no more than their Count.
+func (p *patientSearch) Limit() int {
+	if p.Name == "" {
+		return p.Count
+	}
+	return MaxPatientSearchCandidates
+}
+
+// Score returns how well the best matching patient in a merge matches the search,
+// from 0 to 1. Only names are scored, since the other criteria must match exactly.
+func (p *patientSearch) Score(mergeState *state.MergeState) float64 {
+	if p.Name == "" {
+		return 1
+	}
+	best := 0.0
+	for i := range mergeState.Demographics {
+		if score := mergeState.Demographics[i].NameScore(p.Name); score > best {
+			best = score
+		}
+	}
+	return best
+}
+
+// SearchMerges finds merges by the demographics of the patients being merged. See
+// parsePatientSearch for the supported query parameters.
+func (m *MergeController) SearchMerges(c *gin.Context) {
+	var err error
+	worker := m.session.Copy()
+	defer worker.Close()
+
+	search, err := parsePatientSearch(c.Request.URL.Query())
+	if err != nil {
+		abortWithStatus(c, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	var merges []state.MergeState
+	err = worker.DB(m.dbname).C("merges").Find(search.Query()).Sort("-start").Limit(search.Limit()).All(&merges)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	// Rank the merges, best match first.
+	results := make([]state.MergeSearchResult, len(merges))
+	for i := range merges {
+		results[i] = state.MergeSearchResult{
+			Score: search.Score(&merges[i]),
+			Merge: merges[i].Summary(),
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	if len(results) > search.Count {
+		results = results[:search.Count]
+	}
+
+	c.JSON(http.StatusOK, &state.MergeSearchResults{
+		Timestamp: time.Now(),
+		Results:   results,
+	})
+}
+
+// sourceDemographics copies the demographics of all Patient resources in a source bundle.
+func sourceDemographics(sourceURL string, bundle *models.Bundle) []state.PatientDemographics {
+	demographics := []state.PatientDemographics{}
+	for _, r := range fhirutil.ResourcesOfType(bundle, "Patient") {
+		resource, ok := r.(*models.Patient)
+		if !ok {
+			// Patients fetched for a merge are generic JSON objects. Their demographics
+			// are the same in STU3 and R4, so they can be read with the STU3 model.
+			if resource, ok = stu3Patient(r); !ok {
+				continue
+			}
+		}
+		d := state.PatientDemographics{
+			PatientID: resource.Id,
+			SourceURL: sourceURL,
+		}
+
+		for _, name := range resource.Name {
+			if name.Text != "" {
+				d.AddName(name.Text)
+				continue
+			}
+			d.AddName(strings.TrimSpace(strings.Join(append(name.Given, name.Family), " ")))
+		}
+
+		if resource.BirthDate != nil {
+			switch resource.BirthDate.Precision {
+			case models.Year:
+				d.BirthDate = resource.BirthDate.Time.Format("2006")
+			case models.YearMonth:
+				d.BirthDate = resource.BirthDate.Time.Format("2006-01")
+			default:
+				d.BirthDate = resource.BirthDate.Time.Format("2006-01-02")
+			}
+		}
+
+		for _, identifier := range resource.Identifier {
+			if identifier.Value != "" {
+				d.Identifiers = append(d.Identifiers, identifier.System+"|"+identifier.Value)
+			}
+		}
+		demographics = append(demographics, d)
+	}
+	return demographics
+}
+
+// stu3Patient reads a Patient that is a generic JSON object into the STU3 model.
+func stu3Patient(resource interface{}) (*models.Patient, bool) {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return nil, false
+	}
+	patient := &models.Patient{}
+	if json.Unmarshal(data, patient) != nil {
+		return nil, false
+	}
+	return patient, true
+}
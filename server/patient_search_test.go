@@ -0,0 +1,127 @@
+package server
+
+import (
+	"net/url"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mitre/ptmerge/state"
+	"github.com/stretchr/testify/suite"
+)
+
+type PatientSearchTestSuite struct {
+	suite.Suite
+}
+
+func TestPatientSearchTestSuite(t *testing.T) {
+	suite.Run(t, new(PatientSearchTestSuite))
+}
+
+func (p *PatientSearchTestSuite) TestParse() {
+	search, err := parsePatientSearch(url.Values{"name:fuzzy": {"Lowel Abot"}, "_count": {"5"}})
+	p.NoError(err)
+	p.Equal("Lowel Abot", search.Name)
+	p.Equal("fuzzy", search.NameMode)
+	p.Equal(5, search.Count)
+
+	search, err = parsePatientSearch(url.Values{"birthdate": {"1950-09"}, "identifier": {"1234"}})
+	p.NoError(err)
+	p.Equal("1950-09", search.BirthDate)
+	p.Equal("1234", search.Identifier)
+	p.Equal(DefaultPatientSearchCount, search.Count)
+}
+
+func (p *PatientSearchTestSuite) TestParseInvalid() {
+	// At least one criterion is required.
+	_, err := parsePatientSearch(url.Values{"_count": {"5"}})
+	p.Error(err)
+
+	_, err = parsePatientSearch(url.Values{"name": {"Abbott"}, "name:exact": {"Abbott"}})
+	p.Error(err)
+	_, err = parsePatientSearch(url.Values{"name": {"42"}})
+	p.Error(err)
+	_, err = parsePatientSearch(url.Values{"birthdate": {"09/15/1950"}})
+	p.Error(err)
+	_, err = parsePatientSearch(url.Values{"name": {"Abbott"}, "_count": {"-1"}})
+	p.Error(err)
+}
+
+func (p *PatientSearchTestSuite) TestQuery() {
+	search, err := parsePatientSearch(url.Values{"name:exact": {"Abbott"}, "identifier": {"urn:mrn|1234"}})
+	p.NoError(err)
+	p.Equal(bson.M{
+		"demographics": bson.M{"$elemMatch": bson.M{"$and": []bson.M{
+			bson.M{"nameTokens": "abbott"},
+			bson.M{"identifiers": "urn:mrn|1234"},
+		}}},
+		"demographics.identifiers": "urn:mrn|1234",
+	}, search.Query())
+
+	search, err = parsePatientSearch(url.Values{"name:fuzzy": {"Abot"}, "birthdate": {"1950"}})
+	p.NoError(err)
+	p.Equal(bson.M{
+		"demographics": bson.M{"$elemMatch": bson.M{"$and": []bson.M{
+			bson.M{"$or": []bson.M{
+				bson.M{"nameTokens": bson.RegEx{Pattern: "^abot"}},
+				bson.M{"namePhonetics": "A130"},
+			}},
+			bson.M{"birthDate": bson.RegEx{Pattern: "^1950"}},
+		}}},
+		"demographics.birthDate": bson.RegEx{Pattern: "^1950"},
+	}, search.Query())
+
+	// Fuzzy names are prefiltered by either their prefix or their sound.
+	search, err = parsePatientSearch(url.Values{"name:fuzzy": {"Abot"}})
+	p.NoError(err)
+	p.Equal(bson.M{
+		"demographics": bson.M{"$elemMatch": bson.M{"$and": []bson.M{
+			bson.M{"$or": []bson.M{
+				bson.M{"nameTokens": bson.RegEx{Pattern: "^abot"}},
+				bson.M{"namePhonetics": "A130"},
+			}},
+		}}},
+		"$or": []bson.M{
+			bson.M{"demographics.nameTokens": bson.RegEx{Pattern: "^abot"}},
+			bson.M{"demographics.namePhonetics": "A130"},
+		},
+	}, search.Query())
+
+	// Identifiers without a system match any system.
+	search, err = parsePatientSearch(url.Values{"identifier": {"12.34"}})
+	p.NoError(err)
+	p.Equal(bson.M{
+		"demographics": bson.M{"$elemMatch": bson.M{"$and": []bson.M{
+			bson.M{"identifiers": bson.RegEx{Pattern: `\|12\.34$`}},
+		}}},
+		"demographics.identifiers": bson.RegEx{Pattern: `\|12\.34$`},
+	}, search.Query())
+}
+
+func (p *PatientSearchTestSuite) TestLimit() {
+	// Searches by name are ranked, so more merges are fetched than are returned.
+	search, err := parsePatientSearch(url.Values{"name": {"Abbott"}, "_count": {"5"}})
+	p.NoError(err)
+	p.Equal(MaxPatientSearchCandidates, search.Limit())
+
+	search, err = parsePatientSearch(url.Values{"birthdate": {"1950"}, "_count": {"5"}})
+	p.NoError(err)
+	p.Equal(5, search.Limit())
+}
+
+func (p *PatientSearchTestSuite) TestScore() {
+	abbott := state.PatientDemographics{}
+	abbott.AddName("Lowell Abbott")
+	smith := state.PatientDemographics{}
+	smith.AddName("Jane Smith")
+
+	search, err := parsePatientSearch(url.Values{"name:fuzzy": {"Lowel Abot"}})
+	p.NoError(err)
+	both := &state.MergeState{Demographics: []state.PatientDemographics{smith, abbott}}
+	p.Equal(abbott.NameScore("Lowel Abot"), search.Score(both))
+
+	// Searches without a name match perfectly.
+	search, err = parsePatientSearch(url.Values{"birthdate": {"1950"}})
+	p.NoError(err)
+	p.Equal(1.0, search.Score(both))
+}
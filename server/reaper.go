@@ -0,0 +1,230 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mitre/ptmerge/audit"
+	"github.com/mitre/ptmerge/events"
+	"github.com/mitre/ptmerge/state"
+)
+
+// ReaperActor is the actor recorded for merges expired by the reaper.
+const ReaperActor = "ptmerge"
+
+// DefaultExpiringWithin is how far ahead GET /admin/merges/expiring looks if the within
+// parameter is not specified.
+var DefaultExpiringWithin = 24 * time.Hour
+
+// Reaper expires incomplete merges that have been inactive for longer than their TTL,
+// cleaning them up and keeping them exactly as if they had been aborted.
+type Reaper struct {
+	// TTL is how long an incomplete merge may be inactive before it expires.
+	TTL time.Duration
+	// Interval is how often the reaper checks for expired merges.
+	Interval time.Duration
+
+	session *mgo.Session
+	dbname  string
+	bus     *events.Bus
+	auditor audit.Sink
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewReaper returns a pointer to a newly initialized Reaper. Expired merges are
+// published to the event bus and recorded by the auditor.
+func NewReaper(session *mgo.Session, dbname string, ttl, interval time.Duration, bus *events.Bus, auditor audit.Sink) *Reaper {
+	return &Reaper{
+		TTL:      ttl,
+		Interval: interval,
+		session:  session,
+		dbname:   dbname,
+		bus:      bus,
+		auditor:  auditor,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start starts expiring merges in the background.
+func (r *Reaper) Start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+		for {
+			if n, err := r.ReapExpired(); err != nil {
+				log.Printf("Failed to expire inactive merges: %s\n", err.Error())
+			} else if n > 0 {
+				log.Printf("Expired %d inactive merge(s)\n", n)
+			}
+			select {
+			case <-ticker.C:
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the reaper, waiting for any merges being expired to finish.
+func (r *Reaper) Stop() {
+	close(r.stop)
+	r.wg.Wait()
+}
+
+// ReapExpired expires all merges that have been inactive for longer than the TTL and
+// returns how many were expired. Expired merges are kept as aborted, like merges aborted
+// by a reviewer. Merges that fail to expire are logged, and merges that changed since they
+// were found to be inactive are left alone.
+func (r *Reaper) ReapExpired() (int, error) {
+	worker := r.session.Copy()
+	defer worker.Close()
+
+	var expired []state.MergeState
+	err := worker.DB(r.dbname).C("merges").Find(inactiveSince(time.Now().Add(-r.TTL))).All(&expired)
+	if err != nil {
+		return 0, err
+	}
+
+	reaped := 0
+	for i := range expired {
+		mergeState := &expired[i]
+		claimed, err := r.claim(worker, mergeState)
+		if err == nil && !claimed {
+			continue
+		}
+
+		record := &audit.Record{
+			Action:      audit.ActionExpire,
+			Actor:       ReaperActor,
+			Timestamp:   time.Now(),
+			MergeID:     mergeState.MergeID,
+			ResourceIDs: []string{mergeState.TargetURL},
+			Outcome:     audit.OutcomeSuccess,
+		}
+		if err == nil {
+			err = deleteMergeResources(mergeState)
+		}
+		if err != nil {
+			log.Printf("Failed to expire merge %s: %s\n", mergeState.MergeID, err.Error())
+			record.Outcome = audit.OutcomeFailure
+		} else {
+			reaped++
+			r.bus.Publish(&events.Event{
+				Type:    events.MergeExpired,
+				MergeID: mergeState.MergeID,
+				Actor:   ReaperActor,
+			})
+		}
+
+		if err = r.auditor.Write(record); err != nil {
+			log.Printf("Failed to write audit record for %s of merge %s: %s\n", record.Action, record.MergeID, err.Error())
+		}
+	}
+	return reaped, nil
+}
+
+// claim aborts an expired merge before its resources are deleted, so no reviewer can
+// change it meanwhile. It returns false if the merge was changed, commented on, or
+// claimed since it was found to be inactive, in which case it's left alone.
+func (r *Reaper) claim(worker *mgo.Session, mergeState *state.MergeState) (bool, error) {
+	selector := versionSelector(mergeState)
+	selector["lastActivity"] = mergeState.LastActivity
+	selector["status"] = mergeState.Status
+	if mergeState.Status == "" {
+		selector["status"] = nil
+	}
+	if mergeState.Assignment == nil {
+		selector["assignment"] = nil
+	} else {
+		selector["assignment.assignee"] = mergeState.Assignment.Assignee
+		selector["assignment.assigned"] = mergeState.Assignment.Assigned
+	}
+
+	err := mergeState.Transition(state.StatusAborted, ReaperActor)
+	if err != nil {
+		return false, err
+	}
+	_, err = worker.DB(r.dbname).C("merges").Find(selector).Apply(mgo.Change{
+		Update: bson.M{
+			"$set": bson.M{
+				"status":       mergeState.Status,
+				"history":      mergeState.History,
+				"end":          mergeState.End,
+				"lastActivity": mergeState.LastActivity,
+			},
+			"$inc": bson.M{"version": 1},
+		},
+	}, nil)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// inactiveSince returns the mongo query for incomplete merges that have not changed
+// since the cutoff. Failed merges expire too, since they can't continue. Merges from
+// before activity was tracked never match, so they're never expired without warning
+// (see backfillLastActivity).
+func inactiveSince(cutoff time.Time) bson.M {
+	return bson.M{
+		"completed":    false,
+		"status":       bson.M{"$ne": state.StatusAborted},
+		"lastActivity": bson.M{"$lt": cutoff},
+	}
+}
+
+// ExpiringMerges returns the incomplete merges that will expire within a duration given
+// by the within parameter (e.g. "36h"), soonest first. If merges never expire, no merges
+// are returned.
+func (m *MergeController) ExpiringMerges(c *gin.Context) {
+	var err error
+	worker := m.session.Copy()
+	defer worker.Close()
+
+	within := DefaultExpiringWithin
+	if w := c.Query("within"); w != "" {
+		within, err = time.ParseDuration(w)
+		if err != nil || within < 0 {
+			abortWithStatus(c, http.StatusBadRequest, "Invalid within %s, must be a positive duration such as 24h", w)
+			return
+		}
+	}
+
+	expiring := &state.ExpiringMerges{
+		Timestamp: time.Now(),
+		Merges:    []state.ExpiringMerge{},
+	}
+	if m.config.MergeTTL == 0 {
+		c.JSON(http.StatusOK, expiring)
+		return
+	}
+
+	var merges []state.MergeState
+	cutoff := expiring.Timestamp.Add(within - m.config.MergeTTL)
+	err = worker.DB(m.dbname).C("merges").Find(inactiveSince(cutoff)).All(&merges)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	for i := range merges {
+		expiring.Merges = append(expiring.Merges, state.ExpiringMerge{
+			Expires: merges[i].LastActive().Add(m.config.MergeTTL),
+			Merge:   merges[i].Summary(),
+		})
+	}
+	sort.SliceStable(expiring.Merges, func(i, j int) bool {
+		return expiring.Merges[i].Expires.Before(expiring.Merges[j].Expires)
+	})
+	c.JSON(http.StatusOK, expiring)
+}
@@ -2,30 +2,98 @@ package server
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/mitre/ptmerge/audit"
+	"github.com/mitre/ptmerge/auth"
+	"github.com/mitre/ptmerge/events"
 	"gopkg.in/mgo.v2"
 )
 
 // RegisterRoutes registers all routes needed to serve the patient merging service.
-func RegisterRoutes(router *gin.Engine, session *mgo.Session, dbname string, fhirHost string) {
+func RegisterRoutes(router *gin.Engine, session *mgo.Session, dbname string, fhirHost string, config Config) {
 
-	mc := NewMergeController(session, dbname, fhirHost)
+	// Changes to merges are published to the event bus for any listeners.
+	bus := config.Events
+	if bus == nil {
+		bus = events.NewBus()
+	}
+	mc := NewMergeController(session, dbname, fhirHost, bus, config)
+	wc := NewWebhookController(session, dbname)
+
+	// Errors are returned as OperationOutcomes, including authentication errors.
+	router.Use(OperationOutcomes())
+
+	// Every merge-related action is audited, including those the user isn't authorized for
+	// or couldn't be authenticated for, so each route audits its action before authenticating.
+	auditor := config.Auditor
+	if auditor == nil {
+		auditor = audit.NewMongoSink(session, dbname)
+	}
+	audited := func(action string) gin.HandlerFunc {
+		return audit.Middleware(auditor, action)
+	}
+
+	// All routes require an authenticated user.
+	authenticator := config.Authenticator
+	if authenticator == nil {
+		authenticator = auth.Anonymous{}
+	}
+	authenticated := auth.Authenticate(authenticator)
+
+	viewer := auth.RequireRole(auth.Viewer)
+	reviewer := auth.RequireRole(auth.Reviewer)
+	admin := auth.RequireRole(auth.Admin)
 
 	// Merge operations.
-	router.POST("/merge", mc.Merge)
-	router.POST("/merge/:merge_id/resolve/:conflict_id", mc.Resolve)
-	router.POST("/merge/:merge_id/abort", mc.DeleteMerge)
+	router.POST("/merge", audited(audit.ActionCreate), authenticated, reviewer, mc.Merge)
+	router.POST("/merge/:merge_id/resolve/:conflict_id", audited(audit.ActionResolve), authenticated, reviewer, mc.Resolve)
+	router.POST("/merge/:merge_id/abort", audited(audit.ActionAbort), authenticated, admin, mc.DeleteMerge)
+	router.POST("/merge/:merge_id/commit", audited(audit.ActionCommit), authenticated, reviewer, mc.CommitMerge)
+
+	// Merge approval by a second reviewer.
+	router.POST("/merge/:merge_id/approve", audited(audit.ActionApprove), authenticated, reviewer, mc.Approve)
+	router.POST("/merge/:merge_id/reject", audited(audit.ActionReject), authenticated, reviewer, mc.Reject)
+
+	// Merge assignment to reviewers.
+	router.POST("/merge/:merge_id/claim", audited(audit.ActionClaim), authenticated, reviewer, mc.Claim)
+	router.POST("/merge/:merge_id/assign", audited(audit.ActionAssign), authenticated, admin, mc.Assign)
+	router.POST("/merge/:merge_id/release", audited(audit.ActionRelease), authenticated, reviewer, mc.Release)
+	router.GET("/queue", audited(audit.ActionViewQueue), authenticated, reviewer, mc.Queue)
+
+	// Comments on merges and their conflicts.
+	router.POST("/merge/:merge_id/comments", audited(audit.ActionAddComment), authenticated, reviewer, mc.AddComment)
+	router.GET("/merge/:merge_id/comments", audited(audit.ActionListComments), authenticated, viewer, mc.GetComments)
+	router.DELETE("/merge/:merge_id/comments/:comment_id", audited(audit.ActionDeleteComment), authenticated, reviewer, mc.DeleteComment)
+	router.POST("/merge/:merge_id/conflicts/:conflict_id/comments", audited(audit.ActionAddComment), authenticated, reviewer, mc.AddComment)
+	router.GET("/merge/:merge_id/conflicts/:conflict_id/comments", audited(audit.ActionListComments), authenticated, viewer, mc.GetComments)
+	router.DELETE("/merge/:merge_id/conflicts/:conflict_id/comments/:comment_id", audited(audit.ActionDeleteComment), authenticated, reviewer, mc.DeleteComment)
 
 	// Merge target management.
-	router.GET("/merge/:merge_id/target", mc.GetTarget)
-	router.POST("/merge/:merge_id/target/resources/:resource_id", mc.UpdateTargetResource)
-	router.DELETE("/merge/:merge_id/target/resources/:resource_id", mc.DeleteTargetResource)
+	router.GET("/merge/:merge_id/target", audited(audit.ActionViewTarget), authenticated, viewer, mc.GetTarget)
+	router.POST("/merge/:merge_id/target/resources/:resource_id", audited(audit.ActionUpdateTargetResource), authenticated, reviewer, mc.UpdateTargetResource)
+	router.DELETE("/merge/:merge_id/target/resources/:resource_id", audited(audit.ActionDeleteTargetResource), authenticated, reviewer, mc.DeleteTargetResource)
 
 	// Merge conflict management.
-	router.GET("/merge/:merge_id/conflicts", mc.GetRemainingConflicts)
-	router.GET("/merge/:merge_id/resolved", mc.GetResolvedConflicts)
-	router.DELETE("/merge/:merge_id/conflicts/:conflict_id", mc.DeleteConflict)
+	router.GET("/merge/:merge_id/conflicts", audited(audit.ActionViewConflicts), authenticated, viewer, mc.GetRemainingConflicts)
+	router.GET("/merge/:merge_id/resolved", audited(audit.ActionViewResolved), authenticated, viewer, mc.GetResolvedConflicts)
+	router.DELETE("/merge/:merge_id/conflicts/:conflict_id", audited(audit.ActionDeleteConflict), authenticated, reviewer, mc.DeleteConflict)
+	router.POST("/merge/:merge_id/conflicts/:conflict_id/pair/:resource_id", audited(audit.ActionPairConflict), authenticated, reviewer, mc.PairConflict)
 
 	// Merge metadata.
-	router.GET("/merge", mc.AllMerges)
-	router.GET("/merge/:merge_id", mc.GetMerge)
+	router.GET("/merge", audited(audit.ActionListMerges), authenticated, viewer, mc.AllMerges)
+	router.GET("/merge/:merge_id", audited(audit.ActionViewMerge), authenticated, viewer, mc.GetMerge)
+	router.GET("/merge/:merge_id/events", audited(audit.ActionWatchMerge), authenticated, viewer, mc.GetEvents)
+
+	// Merge search by patient demographics. This can't live under /merge since it
+	// would conflict with the /merge/:merge_id route.
+	router.GET("/search/merge", audited(audit.ActionSearchMerges), authenticated, viewer, mc.SearchMerges)
+
+	// Merge administration.
+	router.GET("/admin/merges/expiring", audited(audit.ActionListExpiring), authenticated, admin, mc.ExpiringMerges)
+
+	// Webhook subscriptions to merge events.
+	router.POST("/webhooks", audited(audit.ActionCreateWebhook), authenticated, admin, wc.CreateWebhook)
+	router.GET("/webhooks", audited(audit.ActionListWebhooks), authenticated, admin, wc.AllWebhooks)
+	router.GET("/webhooks/:webhook_id", audited(audit.ActionViewWebhook), authenticated, admin, wc.GetWebhook)
+	router.DELETE("/webhooks/:webhook_id", audited(audit.ActionDeleteWebhook), authenticated, admin, wc.DeleteWebhook)
+	router.GET("/webhooks/:webhook_id/deliveries", audited(audit.ActionViewDeliveries), authenticated, admin, wc.GetDeliveries)
 }
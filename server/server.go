@@ -8,7 +8,13 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/itsjamie/gin-cors"
+	"github.com/mitre/ptmerge/audit"
+	"github.com/mitre/ptmerge/auth"
+	"github.com/mitre/ptmerge/events"
+	"github.com/mitre/ptmerge/state"
+	"github.com/mitre/ptmerge/webhook"
 	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 // PTMergeServer contains the router and database connection needed to serve the
@@ -19,10 +25,50 @@ type PTMergeServer struct {
 	DatabaseHost string
 	DatabaseName string
 	Session      *mgo.Session
+	Config       Config
+}
+
+// Config holds the optional settings and services used to serve the ptmerge routes.
+type Config struct {
+	// Authenticator identifies the user making each request. If nil, authentication
+	// is disabled and every request is treated as coming from an anonymous admin.
+	Authenticator auth.Authenticator
+	// Auditor stores an audit record of every merge-related action. If nil, records
+	// are stored in the "audit" collection of the ptmerge database.
+	Auditor audit.Sink
+	// Events is the bus changes to merges are published to. If nil, a new bus is created.
+	Events *events.Bus
+	// MergeTTL is how long an incomplete merge may be inactive before it expires and is
+	// deleted, as if it were aborted. If 0, merges never expire.
+	MergeTTL time.Duration
+	// ReapInterval is how often expired merges are deleted.
+	ReapInterval time.Duration
+	// ClaimTTL is how long a merge stays assigned to a reviewer who isn't working on it,
+	// after which any reviewer may claim it. If 0, assignments never lapse.
+	ClaimTTL time.Duration
+	// RequireApproval requires a second reviewer to approve each merge once all of its
+	// conflicts are resolved, before it is completed. It requires an Authenticator, since
+	// every request is made by the same user without one.
+	RequireApproval bool
+	// AllowedOrigins is a comma-separated list of origins allowed to make CORS requests.
+	// Credentialed CORS requests are only allowed if specific origins are listed.
+	AllowedOrigins string
+}
+
+// DefaultConfig is the configuration used if no other is provided.
+var DefaultConfig = Config{
+	Authenticator:   nil,
+	Auditor:         nil,
+	Events:          nil,
+	MergeTTL:        0,
+	ReapInterval:    10 * time.Minute,
+	ClaimTTL:        4 * time.Hour,
+	RequireApproval: false,
+	AllowedOrigins:  "*",
 }
 
 // NewServer returns a newly initialized PTMergeServer.
-func NewServer(fhirhost, dbhost, dbname string, debug bool) *PTMergeServer {
+func NewServer(fhirhost, dbhost, dbname string, debug bool, config Config) *PTMergeServer {
 	if debug {
 		gin.SetMode(gin.DebugMode)
 	} else {
@@ -30,13 +76,16 @@ func NewServer(fhirhost, dbhost, dbname string, debug bool) *PTMergeServer {
 	}
 
 	engine := gin.Default() // includes the default logging and recovery middleware
+
+	// Browsers refuse credentialed CORS requests to a wildcard origin, so credentials
+	// are only allowed when specific origins are configured.
 	engine.Use(cors.Middleware(cors.Config{
-		Origins:         "*",
+		Origins:         config.AllowedOrigins,
 		Methods:         "GET, PUT, POST, DELETE",
-		RequestHeaders:  "Origin, Authorization, Content-Type, If-Match, If-None-Exist",
+		RequestHeaders:  "Origin, Authorization, X-API-Key, Content-Type, If-Match, If-None-Exist",
 		ExposedHeaders:  "Location, ETag, Last-Modified",
 		MaxAge:          86400 * time.Second, // Preflight expires after 1 day
-		Credentials:     true,
+		Credentials:     config.AllowedOrigins != "*",
 		ValidateHeaders: false,
 	}))
 
@@ -46,6 +95,7 @@ func NewServer(fhirhost, dbhost, dbname string, debug bool) *PTMergeServer {
 		DatabaseHost: dbhost,
 		DatabaseName: dbname,
 		Session:      nil,
+		Config:       config,
 	}
 }
 
@@ -69,6 +119,19 @@ func (p *PTMergeServer) Run() {
 	p.Session = session
 	defer p.Session.Close()
 
+	// index the patient demographics merges are searched by
+	ensureIndexes(p.Session, p.DatabaseName)
+
+	// merges from before activity was tracked start their TTL now, rather than expiring
+	// as soon as expiry is turned on
+	backfillLastActivity(p.Session, p.DatabaseName)
+
+	// merges from before statuses were tracked are given one, so they can be found by it
+	backfillStatus(p.Session, p.DatabaseName)
+
+	// merges from before the queue was sorted in mongo are given its sort keys
+	backfillIndex(p.Session, p.DatabaseName)
+
 	// ping the host FHIR server to make sure it's running
 	log.Println("Connecting to host FHIR server...")
 	_, err = http.Get(p.FHIRHost + "/metadata")
@@ -78,9 +141,141 @@ func (p *PTMergeServer) Run() {
 	}
 	log.Printf("Connected to host FHIR server at %s\n", p.FHIRHost)
 
+	// the background services share the routes' event bus and auditor
+	if p.Config.Events == nil {
+		p.Config.Events = events.NewBus()
+	}
+	if p.Config.Auditor == nil {
+		p.Config.Auditor = audit.NewMongoSink(p.Session, p.DatabaseName)
+	}
+
+	// deliver merge events to webhooks in the background
+	dispatcher := webhook.NewDispatcher(p.Session, p.DatabaseName, p.Config.Events)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	// expire inactive merges in the background
+	if p.Config.MergeTTL > 0 {
+		interval := p.Config.ReapInterval
+		if interval <= 0 {
+			interval = DefaultConfig.ReapInterval
+		}
+		reaper := NewReaper(p.Session, p.DatabaseName, p.Config.MergeTTL, interval, p.Config.Events, p.Config.Auditor)
+		reaper.Start()
+		defer reaper.Stop()
+		log.Printf("Incomplete merges expire after %s of inactivity\n", p.Config.MergeTTL)
+	}
+
 	// register ptmerge service routes
-	RegisterRoutes(p.Engine, p.Session, p.DatabaseName, p.FHIRHost)
+	if p.Config.Authenticator == nil {
+		log.Println("WARNING: Authentication is disabled, all requests are treated as an anonymous admin")
+		if p.Config.RequireApproval {
+			log.Println("WARNING: Approval by a second user isn't possible while authentication is disabled, so merges won't require it")
+			p.Config.RequireApproval = false
+		}
+	}
+	RegisterRoutes(p.Engine, p.Session, p.DatabaseName, p.FHIRHost, p.Config)
 	log.Println("Started ptmerge service!")
 
 	p.Engine.Run(":5000")
 }
+
+// ensureIndexes creates the indexes used to search for and expire merges, and to find
+// webhook deliveries. Failing to create an index only makes searches slower, so errors
+// are logged rather than fatal.
+func ensureIndexes(session *mgo.Session, dbname string) {
+	merges := session.DB(dbname).C("merges")
+	for _, key := range []string{
+		"patients",
+		"demographics.nameTokens",
+		"demographics.namePhonetics",
+		"demographics.birthDate",
+		"demographics.identifiers",
+		"lastActivity",
+		"status",
+	} {
+		if err := merges.EnsureIndexKey(key); err != nil {
+			log.Printf("Failed to index merges by %s: %s\n", key, err.Error())
+		}
+	}
+
+	// Index the webhook delivery log and retry queue.
+	deliveries := session.DB(dbname).C("webhookDeliveries")
+	for _, key := range [][]string{
+		{"webhookId", "-created"},
+		{"status", "nextAttempt"},
+	} {
+		if err := deliveries.EnsureIndexKey(key...); err != nil {
+			log.Printf("Failed to index webhook deliveries by %v: %s\n", key, err.Error())
+		}
+	}
+}
+
+// backfillLastActivity sets the last activity of merges from before activity was tracked
+// to now. Failing to backfill only means those merges never expire, so errors are logged
+// rather than fatal.
+func backfillLastActivity(session *mgo.Session, dbname string) {
+	info, err := session.DB(dbname).C("merges").UpdateAll(
+		bson.M{"lastActivity": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"lastActivity": time.Now()}},
+	)
+	if err != nil {
+		log.Printf("Failed to set the last activity of older merges: %s\n", err.Error())
+		return
+	}
+	if info.Updated > 0 {
+		log.Printf("Set the last activity of %d older merge(s) to now\n", info.Updated)
+	}
+}
+
+// backfillStatus stores the status of merges from before statuses were tracked, as
+// derived by their CurrentStatus, so searches by status find them. Failing to backfill only
+// means those merges are missing from searches by status, so errors are logged rather than
+// fatal.
+func backfillStatus(session *mgo.Session, dbname string) {
+	merges := session.DB(dbname).C("merges")
+	iter := merges.Find(bson.M{"status": bson.M{"$exists": false}}).Iter()
+	var mergeState state.MergeState
+	updated := 0
+	for iter.Next(&mergeState) {
+		mergeID, status := mergeState.MergeID, mergeState.CurrentStatus()
+		mergeState = state.MergeState{}
+		if err := merges.UpdateId(mergeID, bson.M{"$set": bson.M{"status": status}}); err != nil {
+			log.Printf("Failed to set the status of merge %s: %s\n", mergeID, err.Error())
+			continue
+		}
+		updated++
+	}
+	if err := iter.Close(); err != nil {
+		log.Printf("Failed to set the status of older merges: %s\n", err.Error())
+	}
+	if updated > 0 {
+		log.Printf("Set the status of %d older merge(s)\n", updated)
+	}
+}
+
+// backfillIndex stores the sort keys of merges from before the review queue was sorted in
+// mongo. Failing to backfill only means those merges are queued out of order, so errors
+// are logged rather than fatal.
+func backfillIndex(session *mgo.Session, dbname string) {
+	merges := session.DB(dbname).C("merges")
+	iter := merges.Find(bson.M{"remaining": bson.M{"$exists": false}}).Iter()
+	var mergeState state.MergeState
+	updated := 0
+	for iter.Next(&mergeState) {
+		mergeState.Index()
+		mergeID, set := mergeState.MergeID, bson.M{"remaining": mergeState.Remaining, "matchScore": mergeState.PatientMatch}
+		mergeState = state.MergeState{}
+		if err := merges.UpdateId(mergeID, bson.M{"$set": set}); err != nil {
+			log.Printf("Failed to index merge %s: %s\n", mergeID, err.Error())
+			continue
+		}
+		updated++
+	}
+	if err := iter.Close(); err != nil {
+		log.Printf("Failed to index older merges: %s\n", err.Error())
+	}
+	if updated > 0 {
+		log.Printf("Indexed %d older merge(s)\n", updated)
+	}
+}
@@ -1,28 +1,38 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"gopkg.in/mgo.v2/bson"
 
 	"github.com/gin-gonic/gin"
 	"github.com/intervention-engine/fhir/models"
 	"github.com/intervention-engine/fhir/server"
+	"github.com/mitre/ptmerge/audit"
+	"github.com/mitre/ptmerge/auth"
+	"github.com/mitre/ptmerge/events"
 	"github.com/mitre/ptmerge/fhirutil"
 	"github.com/mitre/ptmerge/merge"
 	"github.com/mitre/ptmerge/state"
 	"github.com/mitre/ptmerge/testutil"
+	"github.com/mitre/ptmerge/webhook"
 	"github.com/stretchr/testify/suite"
 )
 
+// testMergeTTL is how long merges may be inactive on the test PTMergeServer.
+const testMergeTTL = 7 * 24 * time.Hour
+
 type ServerTestSuite struct {
 	// The MongoSuite borrowed from IE provides useful features for starting/stopping
 	// a test mongo database. The same database is used by the mock FHIR server and
@@ -30,6 +40,7 @@ type ServerTestSuite struct {
 	testutil.MongoSuite
 	PTMergeServer *httptest.Server
 	FHIRServer    *httptest.Server
+	Events        *events.Bus
 }
 
 func TestServerTestSuite(t *testing.T) {
@@ -51,7 +62,11 @@ func (s *ServerTestSuite) SetupSuite() {
 
 	// Create a mock PTMergeServer.
 	ptmergeEngine := gin.New()
-	RegisterRoutes(ptmergeEngine, s.DB().Session, "ptmerge-test", s.FHIRServer.URL)
+	s.Events = events.NewBus()
+	ptmergeConfig := DefaultConfig
+	ptmergeConfig.Events = s.Events
+	ptmergeConfig.MergeTTL = testMergeTTL
+	RegisterRoutes(ptmergeEngine, s.DB().Session, "ptmerge-test", s.FHIRServer.URL, ptmergeConfig)
 	s.PTMergeServer = httptest.NewServer(ptmergeEngine)
 }
 
@@ -64,8 +79,11 @@ func (s *ServerTestSuite) TearDownSuite() {
 }
 
 func (s *ServerTestSuite) TearDownTest() {
-	// Cleanup any saved merge states.
+	// Cleanup any saved merge states, audit records, and webhooks.
 	s.DB().C("merges").DropCollection()
+	s.DB().C("audit").DropCollection()
+	s.DB().C("webhooks").DropCollection()
+	s.DB().C("webhookDeliveries").DropCollection()
 }
 
 // ========================================================================= //
@@ -116,6 +134,51 @@ func (s *ServerTestSuite) TestMergeNoConflicts() {
 	s.Equal(mergeCount, newCount)
 }
 
+func (s *ServerTestSuite) TestMergeNoConflictsWithDuplicates() {
+	// The left bundle has a copy of its Condition.
+	fixture, err := fhirutil.LoadResource("Bundle", "../fixtures/bundles/lowell_abbott_bundle.json")
+	s.NoError(err)
+	leftFixture := fixture.(*models.Bundle)
+	condition := fhirutil.ResourcesOfType(leftFixture, "Condition")[0].(*models.Condition)
+	duplicate := *condition
+	duplicate.Id = bson.NewObjectId().Hex()
+	leftFixture.Entry = append(leftFixture.Entry, models.BundleEntryComponent{Resource: &duplicate})
+	created, err := fhirutil.PostResource(s.FHIRServer.URL, "Bundle", leftFixture)
+	s.NoError(err)
+	leftBundle := created.(*models.Bundle)
+
+	created, err = fhirutil.LoadAndPostResource(s.FHIRServer.URL, "Bundle", "../fixtures/bundles/lowell_abbott_bundle.json")
+	s.NoError(err)
+	rightBundle := created.(*models.Bundle)
+
+	source1 := s.FHIRServer.URL + "/Bundle/" + leftBundle.Id
+	source2 := s.FHIRServer.URL + "/Bundle/" + rightBundle.Id
+	res, err := http.Post(s.PTMergeServer.URL+"/merge?source1="+url.QueryEscape(source1)+"&source2="+url.QueryEscape(source2), "", nil)
+	s.NoError(err)
+	defer res.Body.Close()
+	s.Equal(http.StatusOK, res.StatusCode)
+
+	// The removed duplicate is listed in an OperationOutcome after the merged resources.
+	bundle := models.Bundle{}
+	body, err := ioutil.ReadAll(res.Body)
+	s.NoError(err)
+	s.NoError(json.Unmarshal(body, &bundle))
+	s.Len(bundle.Entry, 8)
+	oo := &models.OperationOutcome{}
+	data, err := json.Marshal(bundle.Entry[7].Resource)
+	s.NoError(err)
+	s.NoError(json.Unmarshal(data, oo))
+	s.Len(oo.Issue, 1)
+	s.Equal("duplicate", oo.Issue[0].Code)
+	removedURL := s.FHIRServer.URL + "/Condition/" + duplicate.Id
+	s.Equal(removedURL+" was removed as a duplicate of "+s.FHIRServer.URL+"/Condition/"+condition.Id, oo.Issue[0].Diagnostics)
+
+	// The duplicate is audited by its URL.
+	record := audit.Record{}
+	s.NoError(s.DB().C("audit").Find(bson.M{"action": audit.ActionCreate}).One(&record))
+	s.Contains(record.ResourceIDs, removedURL)
+}
+
 func (s *ServerTestSuite) TestMergeSomeConflicts() {
 	// The outcome should be a set of conflicts.
 	created, err := fhirutil.LoadAndPostResource(s.FHIRServer.URL, "Bundle", "../fixtures/bundles/lowell_abbott_bundle.json")
@@ -166,7 +229,8 @@ func (s *ServerTestSuite) TestMergeSomeConflicts() {
 		issue := oo.Issue[0]
 		s.Equal("information", issue.Severity)
 		s.Equal("conflict", issue.Code)
-		s.Len(issue.Location, 2)
+		s.Len(issue.Expression, 2)
+		s.Equal(issue.Expression, issue.Location)
 		s.NotEmpty(issue.Diagnostics)
 
 		// Validate the Patient conflicts.
@@ -178,8 +242,8 @@ func (s *ServerTestSuite) TestMergeSomeConflicts() {
 			s.NotEmpty(parts[1])
 			s.Len(parts[1], len(bson.NewObjectId().Hex()))
 
-			for _, loc := range issue.Location {
-				s.True(contains([]string{"maritalStatus.coding[0].display", "maritalStatus.coding[0].code"}, loc))
+			for _, loc := range issue.Expression {
+				s.True(contains([]string{"Patient.maritalStatus.coding[0].display", "Patient.maritalStatus.coding[0].code"}, loc))
 			}
 			patientConflictID = oo.Id
 			patientTargetID = parts[1]
@@ -195,8 +259,8 @@ func (s *ServerTestSuite) TestMergeSomeConflicts() {
 			s.NotEmpty(parts[1])
 			s.Len(parts[1], len(bson.NewObjectId().Hex()))
 
-			for _, loc := range issue.Location {
-				s.True(contains([]string{"period.start", "period.end"}, loc))
+			for _, loc := range issue.Expression {
+				s.True(contains([]string{"Encounter.period.start", "Encounter.period.end"}, loc))
 			}
 			encounterConflictID = oo.Id
 			encounterTargetID = parts[1]
@@ -275,6 +339,15 @@ func (s *ServerTestSuite) TestMergeSomeConflicts() {
 	s.False(mergeState.Completed)
 	s.NotNil(mergeState.Start)
 	s.Nil(mergeState.End)
+	s.Equal("anonymous", mergeState.CreatedBy)
+	s.Equal(state.StatusCreated, mergeState.Status)
+	s.Len(mergeState.History, 1)
+	s.Equal("anonymous", mergeState.History[0].Actor)
+	s.NotNil(mergeState.LastActivity)
+	s.Len(mergeState.Demographics, 2)
+	s.Equal(source1, mergeState.Demographics[0].SourceURL)
+	s.Equal([]string{"Lowell Abbott"}, mergeState.Demographics[0].Names)
+	s.Equal("1950-09-02", mergeState.Demographics[0].BirthDate)
 	s.Len(mergeState.Conflicts, 2)
 
 	// Patient conflict metadata.
@@ -379,7 +452,7 @@ func (s *ServerTestSuite) TestMergeBadSources() {
 	// Unmarshal and check the body.
 	body, err := ioutil.ReadAll(res.Body)
 	s.NoError(err)
-	s.Equal(merge.ErrNoPatientResource.Error(), string(body))
+	s.Equal(merge.ErrNoPatientResource.Error(), s.diagnostics(body))
 }
 
 // ========================================================================= //
@@ -635,6 +708,11 @@ func (s *ServerTestSuite) TestResolveConflictNoMoreConflicts() {
 	s.True(mergeState.Completed)
 	s.NotNil(mergeState.Start)
 	s.NotNil(mergeState.End)
+	s.Equal(state.StatusCompleted, mergeState.Status)
+	s.Len(mergeState.History, 3)
+	s.Equal(state.StatusInReview, mergeState.History[1].Status)
+	s.Equal(state.StatusCompleted, mergeState.History[2].Status)
+	s.Equal("anonymous", mergeState.History[2].Actor)
 	s.Len(mergeState.Conflicts, 2)
 
 	// The patient conflict should now be resolved.
@@ -710,7 +788,7 @@ func (s *ServerTestSuite) TestResolveConflictMergeNotFound() {
 	s.NoError(err)
 
 	s.Equal(http.StatusNotFound, res.StatusCode)
-	s.Equal(fmt.Sprintf("Merge %s not found", mergeID), string(body))
+	s.Equal(fmt.Sprintf("Merge %s not found", mergeID), s.diagnostics(body))
 }
 
 func (s *ServerTestSuite) TestResolveConflictConflictNotFound() {
@@ -777,7 +855,7 @@ func (s *ServerTestSuite) TestResolveConflictConflictNotFound() {
 	s.NoError(err)
 
 	s.Equal(http.StatusNotFound, res.StatusCode)
-	s.Equal(fmt.Sprintf("Merge conflict %s not found for merge %s", conflictID, m1.MergeID), string(body))
+	s.Equal(fmt.Sprintf("Merge conflict %s not found for merge %s", conflictID, m1.MergeID), s.diagnostics(body))
 }
 
 func (s *ServerTestSuite) TestResolveConflictConflictAlreadyResolved() {
@@ -842,7 +920,7 @@ func (s *ServerTestSuite) TestResolveConflictConflictAlreadyResolved() {
 	s.NoError(err)
 
 	s.Equal(http.StatusBadRequest, res.StatusCode)
-	s.Equal(fmt.Sprintf("Merge conflict %s was already resolved for merge %s", cid2, mergeID2), string(body))
+	s.Equal(fmt.Sprintf("Merge conflict %s was already resolved for merge %s", cid2, mergeID2), s.diagnostics(body))
 }
 
 // ========================================================================= //
@@ -887,6 +965,60 @@ func (s *ServerTestSuite) TestAbortMerge() {
 
 	// Check the response. There should be no response body.
 	s.Equal(http.StatusNoContent, res.StatusCode)
+
+	// The merge is kept as a record of the abort, but its target is gone.
+	mergeState := &state.MergeState{}
+	err = s.DB().C("merges").FindId(mergeID).One(mergeState)
+	s.NoError(err)
+	s.Equal(state.StatusAborted, mergeState.Status)
+	s.NotNil(mergeState.End)
+
+	res, err = http.Get(s.PTMergeServer.URL + "/merge/" + mergeID + "/target")
+	s.NoError(err)
+	res.Body.Close()
+	s.Equal(http.StatusGone, res.StatusCode)
+
+	// Aborted merges can't be aborted again.
+	res, err = http.Post(s.PTMergeServer.URL+"/merge/"+mergeID+"/abort", "", nil)
+	s.NoError(err)
+	res.Body.Close()
+	s.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
+func (s *ServerTestSuite) TestAbortMergeRetry() {
+	resource, err := fhirutil.LoadAndPostResource(s.FHIRServer.URL, "Bundle", "../fixtures/bundles/joey_chestnut_bundle.json")
+	s.NoError(err)
+	target, ok := resource.(*models.Bundle)
+	s.True(ok)
+
+	// A failed abort already deleted the merge's conflict, but not its target.
+	c1 := make(state.ConflictMap)
+	c1["conflict1"] = &state.ConflictState{
+		OperationOutcomeURL: s.FHIRServer.URL + "/OperationOutcome/" + bson.NewObjectId().Hex(),
+		TargetResource: state.TargetResource{
+			ResourceID:   bson.NewObjectId().Hex(),
+			ResourceType: "Patient",
+		},
+	}
+	mergeID, err := s.insertMergeState(&state.MergeState{
+		MergeID:   bson.NewObjectId().Hex(),
+		Status:    state.StatusFailed,
+		TargetURL: s.FHIRServer.URL + "/Bundle/" + target.Id,
+		Conflicts: c1,
+	})
+	s.NoError(err)
+
+	// Retrying the abort deletes what's left.
+	res, err := http.Post(s.PTMergeServer.URL+"/merge/"+mergeID+"/abort", "", nil)
+	s.NoError(err)
+	res.Body.Close()
+	s.Equal(http.StatusNoContent, res.StatusCode)
+
+	_, err = fhirutil.GetResource(s.FHIRServer.URL, "Bundle", target.Id)
+	s.Error(err)
+	mergeState := &state.MergeState{}
+	s.NoError(s.DB().C("merges").FindId(mergeID).One(mergeState))
+	s.Equal(state.StatusAborted, mergeState.Status)
 }
 
 func (s *ServerTestSuite) TestAbortMergeMergeNotFound() {
@@ -942,7 +1074,7 @@ func (s *ServerTestSuite) TestAbortMergeMergeNotFound() {
 	s.NoError(err)
 
 	s.Equal(http.StatusNotFound, res.StatusCode)
-	s.Equal(fmt.Sprintf("Merge %s not found", mergeID), string(body))
+	s.Equal(fmt.Sprintf("Merge %s not found", mergeID), s.diagnostics(body))
 }
 
 // ========================================================================= //
@@ -1059,6 +1191,146 @@ func (s *ServerTestSuite) TestAllMergesNoMerges() {
 	s.Len(metadata.Merges, 0)
 }
 
+func (s *ServerTestSuite) TestAllMergesPaginatedAndFiltered() {
+	// Insert 5 merges, started a day apart. The first 2 are completed.
+	first := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	ids := make([]string, 5)
+	for i := 0; i < 5; i++ {
+		start := first.AddDate(0, 0, i)
+		conflicts := make(state.ConflictMap)
+		conflicts[bson.NewObjectId().Hex()] = &state.ConflictState{Resolved: true}
+		conflicts[bson.NewObjectId().Hex()] = &state.ConflictState{Resolved: i < 2}
+		m := &state.MergeState{
+			MergeID:    bson.NewObjectId().Hex(),
+			Completed:  i < 2,
+			Source1URL: s.FHIRServer.URL + "/Bundle/" + bson.NewObjectId().Hex(),
+			Source2URL: s.FHIRServer.URL + "/Bundle/" + bson.NewObjectId().Hex(),
+			TargetURL:  s.FHIRServer.URL + "/Bundle/" + bson.NewObjectId().Hex(),
+			Patients:   []string{fmt.Sprintf("patient-%d", i)},
+			Conflicts:  conflicts,
+			Start:      &start,
+		}
+		_, err := s.insertMergeState(m)
+		s.NoError(err)
+		ids[i] = m.MergeID
+	}
+
+	// By default, the newest merges come first.
+	metadata := state.Merges{}
+	s.getJSON("/merge?_count=2&page=2", &metadata)
+	s.Equal(5, metadata.Total)
+	s.Equal(2, metadata.Page)
+	s.Equal(2, metadata.Count)
+	s.Len(metadata.Merges, 2)
+	s.Equal(ids[2], metadata.Merges[0].MergeID)
+	s.Equal(ids[1], metadata.Merges[1].MergeID)
+
+	// Filter by completion and start date, oldest first.
+	metadata = state.Merges{}
+	s.getJSON("/merge?completed=false&start=ge2017-03-04&_sort=start", &metadata)
+	s.Equal(2, metadata.Total)
+	s.Len(metadata.Merges, 2)
+	s.Equal(ids[3], metadata.Merges[0].MergeID)
+	s.Equal(ids[4], metadata.Merges[1].MergeID)
+
+	// Filter by patient.
+	metadata = state.Merges{}
+	s.getJSON("/merge?patient=patient-1", &metadata)
+	s.Equal(1, metadata.Total)
+	s.Equal(ids[1], metadata.Merges[0].MergeID)
+
+	// Summaries count conflicts instead of listing them.
+	summaries := state.MergeSummaries{}
+	s.getJSON("/merge?_summary=true&_sort=start&_count=1", &summaries)
+	s.Equal(5, summaries.Total)
+	s.Len(summaries.Merges, 1)
+	s.Equal(ids[0], summaries.Merges[0].MergeID)
+	s.Equal(state.ConflictCounts{Total: 2, Resolved: 2, Remaining: 0}, summaries.Merges[0].Conflicts)
+
+	// Bad parameters are rejected.
+	res, err := http.Get(s.PTMergeServer.URL + "/merge?_sort=conflicts")
+	s.NoError(err)
+	res.Body.Close()
+	s.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
+// ========================================================================= //
+// TEST SEARCH MERGES                                                        //
+// ========================================================================= //
+
+func (s *ServerTestSuite) TestSearchMerges() {
+	abbott := state.PatientDemographics{
+		PatientID:   "abbott",
+		BirthDate:   "1950-09-15",
+		Identifiers: []string{"urn:mrn|1234"},
+	}
+	abbott.AddName("Lowell Abbott")
+	abbottJr := state.PatientDemographics{
+		PatientID: "abbott-jr",
+		BirthDate: "1975-02-01",
+	}
+	abbottJr.AddName("Lowell Abbot Jr")
+	smith := state.PatientDemographics{
+		PatientID:   "smith",
+		BirthDate:   "1950-09-15",
+		Identifiers: []string{"urn:mrn|5678"},
+	}
+	smith.AddName("Jane Smith")
+
+	ids := make([]string, 3)
+	for i, d := range []state.PatientDemographics{abbott, abbottJr, smith} {
+		m := &state.MergeState{
+			MergeID:      bson.NewObjectId().Hex(),
+			Conflicts:    make(state.ConflictMap),
+			Demographics: []state.PatientDemographics{d},
+		}
+		_, err := s.insertMergeState(m)
+		s.NoError(err)
+		ids[i] = m.MergeID
+	}
+
+	// Partial names match the start of each name.
+	results := state.MergeSearchResults{}
+	s.getJSON("/search/merge?name=lowell+abbott", &results)
+	s.Len(results.Results, 1)
+	s.Equal(ids[0], results.Results[0].Merge.MergeID)
+	s.Equal(1.0, results.Results[0].Score)
+
+	// Fuzzy names match names that sound alike, best match first.
+	results = state.MergeSearchResults{}
+	s.getJSON("/search/merge?name:fuzzy=Lowel+Abot", &results)
+	s.Len(results.Results, 2)
+	s.Equal(ids[1], results.Results[0].Merge.MergeID)
+	s.Equal(ids[0], results.Results[1].Merge.MergeID)
+	s.True(results.Results[0].Score > results.Results[1].Score)
+
+	// All criteria must match the same patient.
+	results = state.MergeSearchResults{}
+	s.getJSON("/search/merge?birthdate=1950-09", &results)
+	s.Len(results.Results, 2)
+	results = state.MergeSearchResults{}
+	s.getJSON("/search/merge?birthdate=1950&name=smith", &results)
+	s.Len(results.Results, 1)
+	s.Equal(ids[2], results.Results[0].Merge.MergeID)
+
+	// Identifiers may be searched with or without a system.
+	results = state.MergeSearchResults{}
+	s.getJSON("/search/merge?identifier=urn:mrn|1234", &results)
+	s.Len(results.Results, 1)
+	s.Equal(ids[0], results.Results[0].Merge.MergeID)
+	results = state.MergeSearchResults{}
+	s.getJSON("/search/merge?identifier=5678", &results)
+	s.Len(results.Results, 1)
+	s.Equal(ids[2], results.Results[0].Merge.MergeID)
+	s.Equal("smith", results.Results[0].Merge.Demographics[0].PatientID)
+
+	// A search needs at least one criterion.
+	res, err := http.Get(s.PTMergeServer.URL + "/search/merge")
+	s.NoError(err)
+	res.Body.Close()
+	s.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
 // ========================================================================= //
 // TEST GET MERGE                                                            //
 // ========================================================================= //
@@ -1121,6 +1393,59 @@ func (s *ServerTestSuite) TestGetMergeNotFound() {
 	s.Equal(http.StatusNotFound, res.StatusCode)
 }
 
+func (s *ServerTestSuite) TestGetMergeIsAudited() {
+	m1 := &state.MergeState{
+		MergeID:   bson.NewObjectId().Hex(),
+		TargetURL: s.FHIRServer.URL + "/Bundle/" + bson.NewObjectId().Hex(),
+	}
+	_, err := s.insertMergeState(m1)
+	s.NoError(err)
+
+	// View the merge, then try to view one that doesn't exist.
+	res, err := http.Get(s.PTMergeServer.URL + "/merge/" + m1.MergeID)
+	s.NoError(err)
+	res.Body.Close()
+	missingID := bson.NewObjectId().Hex()
+	res, err = http.Get(s.PTMergeServer.URL + "/merge/" + missingID)
+	s.NoError(err)
+	res.Body.Close()
+
+	// Both attempts should be audited.
+	var records []audit.Record
+	err = s.DB().C("audit").Find(nil).Sort("timestamp").All(&records)
+	s.NoError(err)
+	s.Len(records, 2)
+
+	s.Equal(audit.ActionViewMerge, records[0].Action)
+	s.Equal("anonymous", records[0].Actor)
+	s.Equal(m1.MergeID, records[0].MergeID)
+	s.Equal(audit.OutcomeSuccess, records[0].Outcome)
+
+	s.Equal(audit.ActionViewMerge, records[1].Action)
+	s.Equal(missingID, records[1].MergeID)
+	s.Equal(audit.OutcomeFailure, records[1].Outcome)
+	s.Equal(http.StatusNotFound, records[1].Status)
+}
+
+func (s *ServerTestSuite) TestUnauthenticatedRequestIsAudited() {
+	server := s.authenticatedServer()
+	defer server.Close()
+
+	mergeID := bson.NewObjectId().Hex()
+	res := s.postAs(server, "wrong-key", "/merge/"+mergeID+"/abort", "")
+	s.Equal(http.StatusUnauthorized, res.StatusCode)
+
+	// The attempt is audited, without an actor.
+	var records []audit.Record
+	s.NoError(s.DB().C("audit").Find(nil).All(&records))
+	s.Len(records, 1)
+	s.Equal(audit.ActionAbort, records[0].Action)
+	s.Equal("", records[0].Actor)
+	s.Equal(mergeID, records[0].MergeID)
+	s.Equal(audit.OutcomeFailure, records[0].Outcome)
+	s.Equal(http.StatusUnauthorized, records[0].Status)
+}
+
 // ========================================================================= //
 // TEST GET REMAINING CONFLICTS                                              //
 // ========================================================================= //
@@ -1200,8 +1525,9 @@ func (s *ServerTestSuite) TestGetRemainingConflicts() {
 
 	s.Equal(coo1.Id, oo.Id)
 	s.Len(oo.Issue, 1)
-	s.Len(oo.Issue[0].Location, 3)
-	s.Equal([]string{"foo", "bar.x", "bar.y"}, oo.Issue[0].Location)
+	s.Len(oo.Issue[0].Expression, 3)
+	s.Equal(oo.Issue[0].Expression, oo.Issue[0].Location)
+	s.Equal([]string{"foo", "bar.x", "bar.y"}, oo.Issue[0].Expression)
 	s.Equal("Patient:"+c1[coo1.Id].TargetResource.ResourceID, oo.Issue[0].Diagnostics)
 }
 
@@ -1315,8 +1641,8 @@ func (s *ServerTestSuite) TestGetRemainingConflictsConflictNotFound() {
 	body, err := ioutil.ReadAll(res.Body)
 	s.NoError(err)
 
-	s.Equal(http.StatusInternalServerError, res.StatusCode)
-	s.Equal(fmt.Sprintf("Resource %s not found", "OperationOutcome:"+cid1), string(body))
+	s.Equal(http.StatusNotFound, res.StatusCode)
+	s.Equal(fmt.Sprintf("Resource %s not found", "OperationOutcome:"+cid1), s.diagnostics(body))
 }
 
 func (s *ServerTestSuite) TestGetRemainingConflictsMergeNotFound() {
@@ -1332,7 +1658,7 @@ func (s *ServerTestSuite) TestGetRemainingConflictsMergeNotFound() {
 	s.NoError(err)
 
 	s.Equal(http.StatusNotFound, res.StatusCode)
-	s.Equal(fmt.Sprintf("Merge %s not found", mergeID), string(body))
+	s.Equal(fmt.Sprintf("Merge %s not found", mergeID), s.diagnostics(body))
 }
 
 // ========================================================================= //
@@ -1414,8 +1740,9 @@ func (s *ServerTestSuite) TestGetResolvedConflicts() {
 
 	s.Equal(coo2.Id, oo.Id)
 	s.Len(oo.Issue, 1)
-	s.Len(oo.Issue[0].Location, 3)
-	s.Equal([]string{"foo", "bar.u", "bar.v"}, oo.Issue[0].Location)
+	s.Len(oo.Issue[0].Expression, 3)
+	s.Equal(oo.Issue[0].Expression, oo.Issue[0].Location)
+	s.Equal([]string{"foo", "bar.u", "bar.v"}, oo.Issue[0].Expression)
 	s.Equal("Patient:"+c1[coo2.Id].TargetResource.ResourceID, oo.Issue[0].Diagnostics)
 }
 
@@ -1530,8 +1857,8 @@ func (s *ServerTestSuite) TestGetResolvedConflictsConflictNotFound() {
 	body, err := ioutil.ReadAll(res.Body)
 	s.NoError(err)
 
-	s.Equal(http.StatusInternalServerError, res.StatusCode)
-	s.Equal(fmt.Sprintf("Resource %s not found", "OperationOutcome:"+cid2), string(body))
+	s.Equal(http.StatusNotFound, res.StatusCode)
+	s.Equal(fmt.Sprintf("Resource %s not found", "OperationOutcome:"+cid2), s.diagnostics(body))
 }
 
 func (s *ServerTestSuite) TestGetResolvedConflictsMergeNotFound() {
@@ -1547,7 +1874,7 @@ func (s *ServerTestSuite) TestGetResolvedConflictsMergeNotFound() {
 	s.NoError(err)
 
 	s.Equal(http.StatusNotFound, res.StatusCode)
-	s.Equal(fmt.Sprintf("Merge %s not found", mergeID), string(body))
+	s.Equal(fmt.Sprintf("Merge %s not found", mergeID), s.diagnostics(body))
 }
 
 // ========================================================================= //
@@ -1648,7 +1975,7 @@ func (s *ServerTestSuite) TestDeleteUnresolvedConflictConflictNotFound() {
 
 	// Check the response.
 	s.Equal(http.StatusNotFound, res.StatusCode)
-	s.Equal(fmt.Sprintf("Merge conflict %s not found for merge %s", conflictID, m1.MergeID), string(body))
+	s.Equal(fmt.Sprintf("Merge conflict %s not found for merge %s", conflictID, m1.MergeID), s.diagnostics(body))
 }
 
 func (s *ServerTestSuite) TestDeleteUnresolvedConflictMergeNotFound() {
@@ -1665,7 +1992,7 @@ func (s *ServerTestSuite) TestDeleteUnresolvedConflictMergeNotFound() {
 
 	// Check the response.
 	s.Equal(http.StatusNotFound, res.StatusCode)
-	s.Equal(fmt.Sprintf("Merge %s not found", mergeID), string(body))
+	s.Equal(fmt.Sprintf("Merge %s not found", mergeID), s.diagnostics(body))
 }
 
 // ========================================================================= //
@@ -1728,8 +2055,8 @@ func (s *ServerTestSuite) TestGetMergeTargetTargetNotFound() {
 	s.NoError(err)
 
 	// Check the response.
-	s.Equal(http.StatusInternalServerError, res.StatusCode)
-	s.Equal(fmt.Sprintf("Resource %s not found", m1.TargetURL), string(body))
+	s.Equal(http.StatusNotFound, res.StatusCode)
+	s.Equal(fmt.Sprintf("Resource %s not found", m1.TargetURL), s.diagnostics(body))
 }
 
 func (s *ServerTestSuite) TestGetMergeTargetMergeNotFound() {
@@ -1746,7 +2073,7 @@ func (s *ServerTestSuite) TestGetMergeTargetMergeNotFound() {
 
 	// Check the response.
 	s.Equal(http.StatusNotFound, res.StatusCode)
-	s.Equal(fmt.Sprintf("Merge %s not found", mergeID), string(body))
+	s.Equal(fmt.Sprintf("Merge %s not found", mergeID), s.diagnostics(body))
 }
 
 // ========================================================================= //
@@ -1865,8 +2192,8 @@ func (s *ServerTestSuite) TestUpdateTargetResourceTargetNotFound() {
 	s.NoError(err)
 
 	// Check the response.
-	s.Equal(http.StatusInternalServerError, res.StatusCode)
-	s.Equal(fmt.Sprintf("Resource %s not found", m1.TargetURL), string(body))
+	s.Equal(http.StatusNotFound, res.StatusCode)
+	s.Equal(fmt.Sprintf("Resource %s not found", m1.TargetURL), s.diagnostics(body))
 }
 
 func (s *ServerTestSuite) TestUpdateTargetResourceMergeNotFound() {
@@ -1881,7 +2208,34 @@ func (s *ServerTestSuite) TestUpdateTargetResourceMergeNotFound() {
 
 	// Check the response.
 	s.Equal(http.StatusNotFound, res.StatusCode)
-	s.Equal(fmt.Sprintf("Merge %s not found", mergeID), string(body))
+	s.Equal(fmt.Sprintf("Merge %s not found", mergeID), s.diagnostics(body))
+}
+
+func (s *ServerTestSuite) TestMalformedResourcesAreRejected() {
+	conflicts := make(state.ConflictMap)
+	conflicts["conflict1"] = &state.ConflictState{
+		OperationOutcomeURL: s.FHIRServer.URL + "/OperationOutcome/" + bson.NewObjectId().Hex(),
+		TargetResource:      state.TargetResource{ResourceID: "p", ResourceType: "Patient"},
+	}
+	mergeID, err := s.insertMergeState(&state.MergeState{
+		MergeID:   bson.NewObjectId().Hex(),
+		TargetURL: s.FHIRServer.URL + "/Bundle/" + bson.NewObjectId().Hex(),
+		Conflicts: conflicts,
+	})
+	s.NoError(err)
+
+	// Bodies that aren't JSON objects are the client's mistake, not the server's.
+	for _, path := range []string{"/resolve/conflict1", "/target/resources/p"} {
+		for _, body := range []string{"{", "[]"} {
+			res, err := http.Post(s.PTMergeServer.URL+"/merge/"+mergeID+path, "application/json", strings.NewReader(body))
+			s.NoError(err)
+			oo := &models.OperationOutcome{}
+			s.NoError(json.NewDecoder(res.Body).Decode(oo))
+			res.Body.Close()
+			s.Equal(http.StatusBadRequest, res.StatusCode, path)
+			s.Equal("invalid", oo.Issue[0].Code, path)
+		}
+	}
 }
 
 // ========================================================================= //
@@ -1984,8 +2338,8 @@ func (s *ServerTestSuite) TestDeleteTargetResourceTargetNotFound() {
 	s.NoError(err)
 
 	// Check the response.
-	s.Equal(http.StatusInternalServerError, res.StatusCode)
-	s.Equal(fmt.Sprintf("Resource %s not found", m1.TargetURL), string(body))
+	s.Equal(http.StatusNotFound, res.StatusCode)
+	s.Equal(fmt.Sprintf("Resource %s not found", m1.TargetURL), s.diagnostics(body))
 }
 
 func (s *ServerTestSuite) TestDeleteTargetResourceMergeNotFound() {
@@ -2002,16 +2356,1217 @@ func (s *ServerTestSuite) TestDeleteTargetResourceMergeNotFound() {
 
 	// Check the response.
 	s.Equal(http.StatusNotFound, res.StatusCode)
-	s.Equal(fmt.Sprintf("Merge %s not found", mergeID), string(body))
+	s.Equal(fmt.Sprintf("Merge %s not found", mergeID), s.diagnostics(body))
 }
 
 // ========================================================================= //
-// TEST HELPERS                                                              //
+// TEST MERGE LIFECYCLE                                                      //
+// ========================================================================= //
+
+func (s *ServerTestSuite) TestPairConflict() {
+	var err error
+
+	// Setup a target with two Conditions that should have matched, but were verified differently.
+	condition := func(id, verificationStatus string) map[string]interface{} {
+		return map[string]interface{}{
+			"resourceType":       "Condition",
+			"id":                 id,
+			"subject":            map[string]interface{}{"reference": "Patient/p"},
+			"clinicalStatus":     "active",
+			"verificationStatus": verificationStatus,
+		}
+	}
+	targetBundle := &models.Bundle{
+		Type: "collection",
+		Entry: []models.BundleEntryComponent{
+			{Resource: condition("c1", "confirmed")},
+			{Resource: condition("c2", "provisional")},
+		},
+	}
+	created, err := fhirutil.PostResource(s.FHIRServer.URL, "Bundle", targetBundle)
+	s.NoError(err)
+	targetBundle, ok := created.(*models.Bundle)
+	s.True(ok)
+
+	// c2 is an unmatched resource with another conflict, and c1 already has an open conflict.
+	conflicts := make(state.ConflictMap)
+	inclusionID := s.postConflict(conflicts, merge.InclusionIssueCode, "c2", "Condition")
+	otherID := s.postConflict(conflicts, "conflict", "c2", "Condition.clinicalStatus")
+	openID := s.postConflict(conflicts, "conflict", "c1", "Condition.clinicalStatus")
+	mergeID, err := s.insertMergeState(&state.MergeState{
+		MergeID:   bson.NewObjectId().Hex(),
+		TargetURL: s.FHIRServer.URL + "/Bundle/" + targetBundle.Id,
+		Conflicts: conflicts,
+	})
+	s.NoError(err)
+
+	// Only inclusion or duplicate conflicts can be paired.
+	res, err := http.Post(s.PTMergeServer.URL+"/merge/"+mergeID+"/conflicts/"+otherID+"/pair/c1", "", nil)
+	s.NoError(err)
+	res.Body.Close()
+	s.Equal(http.StatusBadRequest, res.StatusCode)
+
+	res, err = http.Post(s.PTMergeServer.URL+"/merge/"+mergeID+"/conflicts/"+inclusionID+"/pair/c1", "", nil)
+	s.NoError(err)
+	res.Body.Close()
+	s.Equal(http.StatusOK, res.StatusCode)
+
+	// Every conflict on the paired resource is resolved, and the new conflict was added to
+	// c1's open conflict rather than being a new one.
+	var mergeState state.MergeState
+	err = s.DB().C("merges").FindId(mergeID).One(&mergeState)
+	s.NoError(err)
+	s.Len(mergeState.Conflicts, 3)
+	s.True(mergeState.Conflicts[inclusionID].Resolved)
+	s.True(mergeState.Conflicts[otherID].Resolved)
+	s.Equal([]string{openID}, mergeState.Conflicts.RemainingConflicts())
+
+	resource, err := fhirutil.GetResource(s.FHIRServer.URL, "OperationOutcome", openID)
+	s.NoError(err)
+	oo, ok := resource.(*models.OperationOutcome)
+	s.True(ok)
+	s.Equal([]string{"Condition.clinicalStatus", "Condition.verificationStatus"}, oo.Issue[0].Expression)
+	s.Equal(oo.Issue[0].Expression, oo.Issue[0].Location)
+}
+
+// postConflict posts a conflict with the given issue code on a target Condition, adding it
+// to conflicts. It returns the conflict's ID.
+func (s *ServerTestSuite) postConflict(conflicts state.ConflictMap, code, resourceID string, expressions ...string) string {
+	oo := fhirutil.OperationOutcome("Condition", resourceID, expressions)
+	oo.Issue[0].Code = code
+	created, err := fhirutil.PostResource(s.FHIRServer.URL, "OperationOutcome", oo)
+	s.NoError(err)
+	id := fhirutil.GetResourceID(created)
+	conflicts[id] = &state.ConflictState{
+		OperationOutcomeURL: s.FHIRServer.URL + "/OperationOutcome/" + id,
+		TargetResource: state.TargetResource{
+			ResourceID:   resourceID,
+			ResourceType: "Condition",
+		},
+	}
+	return id
+}
+
+func (s *ServerTestSuite) TestCommitMerge() {
+	end := time.Now()
+	mergeID, err := s.insertMergeState(&state.MergeState{
+		MergeID:   bson.NewObjectId().Hex(),
+		Completed: true,
+		Status:    state.StatusCompleted,
+		Conflicts: make(state.ConflictMap),
+		End:       &end,
+	})
+	s.NoError(err)
+
+	res, err := http.Post(s.PTMergeServer.URL+"/merge/"+mergeID+"/commit", "", nil)
+	s.NoError(err)
+	defer res.Body.Close()
+	s.Equal(http.StatusOK, res.StatusCode)
+
+	body, err := ioutil.ReadAll(res.Body)
+	s.NoError(err)
+	meta := state.Merge{}
+	s.NoError(json.Unmarshal(body, &meta))
+	s.Equal(state.StatusCommitted, meta.Merge.Status)
+	s.Len(meta.Merge.History, 1)
+	s.Equal("anonymous", meta.Merge.History[0].Actor)
+
+	// The status history is exposed by GET /merge.
+	merges := state.Merges{}
+	s.getJSON("/merge?status=committed", &merges)
+	s.Len(merges.Merges, 1)
+	s.Equal(state.StatusCommitted, merges.Merges[0].History[0].Status)
+
+	// Committed merges are final.
+	res, err = http.Post(s.PTMergeServer.URL+"/merge/"+mergeID+"/abort", "", nil)
+	s.NoError(err)
+	res.Body.Close()
+	s.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
+func (s *ServerTestSuite) TestCommitMergeNotCompleted() {
+	mergeID, err := s.insertMergeState(&state.MergeState{
+		MergeID:   bson.NewObjectId().Hex(),
+		Status:    state.StatusInReview,
+		Conflicts: make(state.ConflictMap),
+	})
+	s.NoError(err)
+
+	res, err := http.Post(s.PTMergeServer.URL+"/merge/"+mergeID+"/commit", "", nil)
+	s.NoError(err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	s.NoError(err)
+	s.Equal(http.StatusConflict, res.StatusCode)
+	s.Equal(fmt.Sprintf("Merge %s is in-review and cannot become committed", mergeID), s.diagnostics(body))
+}
+
+func (s *ServerTestSuite) TestTargetChangesRejectedOnCompletedMerge() {
+	mergeID, err := s.insertMergeState(&state.MergeState{
+		MergeID:   bson.NewObjectId().Hex(),
+		Completed: true,
+		Conflicts: make(state.ConflictMap),
+	})
+	s.NoError(err)
+	resourceURL := s.PTMergeServer.URL + "/merge/" + mergeID + "/target/resources/" + bson.NewObjectId().Hex()
+
+	res, err := http.Post(resourceURL, "application/json", strings.NewReader(`{"resourceType": "Patient"}`))
+	s.NoError(err)
+	res.Body.Close()
+	s.Equal(http.StatusBadRequest, res.StatusCode)
+
+	req, err := http.NewRequest("DELETE", resourceURL, nil)
+	s.NoError(err)
+	res, err = http.DefaultClient.Do(req)
+	s.NoError(err)
+	res.Body.Close()
+	s.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
+// ========================================================================= //
+// TEST MERGE APPROVAL                                                       //
+// ========================================================================= //
+
+func (s *ServerTestSuite) TestApproveMerge() {
+	server := s.authenticatedServer()
+	defer server.Close()
+	mergeID := s.insertMergeAwaitingApproval()
+
+	// Reviewers can't approve their own work.
+	res := s.postAs(server, "alice-key", "/merge/"+mergeID+"/approve", "")
+	s.Equal(http.StatusForbidden, res.StatusCode)
+
+	res = s.postAs(server, "bob-key", "/merge/"+mergeID+"/approve", `{"comment": "Looks right to me"}`)
+	s.Equal(http.StatusOK, res.StatusCode)
+
+	mergeState := &state.MergeState{}
+	s.NoError(s.DB().C("merges").FindId(mergeID).One(mergeState))
+	s.Equal(state.StatusCompleted, mergeState.Status)
+	s.True(mergeState.Completed)
+	s.Len(mergeState.Approvals, 1)
+	s.Equal(state.DecisionApproved, mergeState.Approvals[0].Decision)
+	s.Equal("bob", mergeState.Approvals[0].Reviewer)
+	s.Equal("Looks right to me", mergeState.Approvals[0].Comment)
+	s.Equal("bob", mergeState.History[len(mergeState.History)-1].Actor)
+
+	// Merges can only be approved once.
+	res = s.postAs(server, "bob-key", "/merge/"+mergeID+"/approve", "")
+	s.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
+func (s *ServerTestSuite) TestApproveMergeEditor() {
+	server := s.authenticatedServer()
+	defer server.Close()
+	mergeID := s.insertMergeAwaitingApproval()
+
+	// Bob deleted a target resource, so he can't approve the merge either.
+	s.NoError(s.DB().C("merges").UpdateId(mergeID, bson.M{"$set": bson.M{"editors": []string{"alice", "bob"}}}))
+	res := s.postAs(server, "bob-key", "/merge/"+mergeID+"/approve", "")
+	s.Equal(http.StatusForbidden, res.StatusCode)
+}
+
+func (s *ServerTestSuite) TestRejectMerge() {
+	server := s.authenticatedServer()
+	defer server.Close()
+	mergeID := s.insertMergeAwaitingApproval()
+
+	// Rejections need a comment and the conflicts to reopen.
+	res := s.postAs(server, "bob-key", "/merge/"+mergeID+"/reject", `{"conflicts": ["conflict1"]}`)
+	s.Equal(http.StatusBadRequest, res.StatusCode)
+	res = s.postAs(server, "bob-key", "/merge/"+mergeID+"/reject", `{"comment": "Wrong address"}`)
+	s.Equal(http.StatusBadRequest, res.StatusCode)
+	res = s.postAs(server, "bob-key", "/merge/"+mergeID+"/reject", `{"comment": "Wrong address", "conflicts": ["nope"]}`)
+	s.Equal(http.StatusNotFound, res.StatusCode)
+
+	sub := s.Events.Subscribe(mergeID)
+	defer sub.Cancel()
+
+	res = s.postAs(server, "bob-key", "/merge/"+mergeID+"/reject", `{"comment": "Wrong address", "conflicts": ["conflict1"]}`)
+	s.Equal(http.StatusOK, res.StatusCode)
+
+	// The selected conflict is reopened, and the merge is back in review.
+	mergeState := &state.MergeState{}
+	s.NoError(s.DB().C("merges").FindId(mergeID).One(mergeState))
+	s.Equal(state.StatusInReview, mergeState.Status)
+	s.False(mergeState.Conflicts["conflict1"].Resolved)
+	s.Empty(mergeState.Conflicts["conflict1"].ResolvedBy)
+	s.True(mergeState.Conflicts["conflict2"].Resolved)
+	s.Len(mergeState.Approvals, 1)
+	s.Equal(state.DecisionRejected, mergeState.Approvals[0].Decision)
+	s.Equal([]string{"conflict1"}, mergeState.Approvals[0].ReopenedConflicts)
+
+	s.Equal(events.MergeRejected, (<-sub.Events).Type)
+	event := <-sub.Events
+	s.Equal(events.ConflictReopened, event.Type)
+	s.Equal("conflict1", event.ConflictID)
+}
+
+// authenticatedServer returns a PTMergeServer that authenticates two reviewers, alice
+// and bob, and an admin, carol, by API key.
+func (s *ServerTestSuite) authenticatedServer() *httptest.Server {
+	config := DefaultConfig
+	config.Events = s.Events
+	config.RequireApproval = true
+	config.Authenticator = auth.NewAPIKeyAuthenticator(map[string]*auth.User{
+		"alice-key": &auth.User{ID: "alice", Roles: []auth.Role{auth.Reviewer}},
+		"bob-key":   &auth.User{ID: "bob", Roles: []auth.Role{auth.Reviewer}},
+		"carol-key": &auth.User{ID: "carol", Roles: []auth.Role{auth.Admin}},
+	})
+	engine := gin.New()
+	RegisterRoutes(engine, s.DB().Session, "ptmerge-test", s.FHIRServer.URL, config)
+	return httptest.NewServer(engine)
+}
+
+// postAs POSTs a body to a path on a server with an API key.
+func (s *ServerTestSuite) postAs(server *httptest.Server, key, path, body string) *http.Response {
+	req, err := http.NewRequest("POST", server.URL+path, strings.NewReader(body))
+	s.NoError(err)
+	req.Header.Set(auth.APIKeyHeader, key)
+	res, err := http.DefaultClient.Do(req)
+	s.NoError(err)
+	res.Body.Close()
+	return res
+}
+
+// deleteAs DELETEs a path on a server with an API key.
+func (s *ServerTestSuite) deleteAs(server *httptest.Server, key, path string) *http.Response {
+	req, err := http.NewRequest("DELETE", server.URL+path, nil)
+	s.NoError(err)
+	req.Header.Set(auth.APIKeyHeader, key)
+	res, err := http.DefaultClient.Do(req)
+	s.NoError(err)
+	res.Body.Close()
+	return res
+}
+
+// getAs GETs a path on a server with an API key, decoding the JSON response.
+func (s *ServerTestSuite) getAs(server *httptest.Server, key, path string, obj interface{}) {
+	req, err := http.NewRequest("GET", server.URL+path, nil)
+	s.NoError(err)
+	req.Header.Set(auth.APIKeyHeader, key)
+	res, err := http.DefaultClient.Do(req)
+	s.NoError(err)
+	defer res.Body.Close()
+	s.Equal(http.StatusOK, res.StatusCode)
+
+	body, err := ioutil.ReadAll(res.Body)
+	s.NoError(err)
+	s.NoError(json.Unmarshal(body, obj))
+}
+
+// insertMergeAwaitingApproval inserts a merge with 2 conflicts that alice resolved.
+func (s *ServerTestSuite) insertMergeAwaitingApproval() string {
+	conflicts := make(state.ConflictMap)
+	conflicts["conflict1"] = &state.ConflictState{Resolved: true, ResolvedBy: "alice"}
+	conflicts["conflict2"] = &state.ConflictState{Resolved: true, ResolvedBy: "alice"}
+	mergeID, err := s.insertMergeState(&state.MergeState{
+		MergeID:   bson.NewObjectId().Hex(),
+		Status:    state.StatusAwaitingApproval,
+		Conflicts: conflicts,
+		History: []state.StatusChange{
+			state.StatusChange{Status: state.StatusAwaitingApproval, Timestamp: time.Now(), Actor: "alice"},
+		},
+	})
+	s.NoError(err)
+	return mergeID
+}
+
 // ========================================================================= //
+// TEST MERGE ASSIGNMENT                                                     //
+// ========================================================================= //
+
+func (s *ServerTestSuite) TestClaimAndReleaseMerge() {
+	server := s.authenticatedServer()
+	defer server.Close()
+	mergeID := s.insertQueuedMerge(state.StatusCreated, 1, time.Now())
+
+	sub := s.Events.Subscribe(mergeID)
+	defer sub.Cancel()
+
+	res := s.postAs(server, "alice-key", "/merge/"+mergeID+"/claim", "")
+	s.Equal(http.StatusOK, res.StatusCode)
+	event := <-sub.Events
+	s.Equal(events.MergeAssigned, event.Type)
+	s.Equal("alice", event.Assignee)
+
+	mergeState := &state.MergeState{}
+	s.NoError(s.DB().C("merges").FindId(mergeID).One(mergeState))
+	s.Require().NotNil(mergeState.Assignment)
+	s.Equal("alice", mergeState.Assignment.Assignee)
+	s.Equal("alice", mergeState.Assignment.AssignedBy)
+
+	// Claiming it again is fine, but nobody else may claim or release it.
+	res = s.postAs(server, "alice-key", "/merge/"+mergeID+"/claim", "")
+	s.Equal(http.StatusOK, res.StatusCode)
+	<-sub.Events
+	res = s.postAs(server, "bob-key", "/merge/"+mergeID+"/claim", "")
+	s.Equal(http.StatusConflict, res.StatusCode)
+	res = s.postAs(server, "bob-key", "/merge/"+mergeID+"/release", "")
+	s.Equal(http.StatusForbidden, res.StatusCode)
+
+	res = s.postAs(server, "alice-key", "/merge/"+mergeID+"/release", "")
+	s.Equal(http.StatusOK, res.StatusCode)
+	event = <-sub.Events
+	s.Equal(events.MergeReleased, event.Type)
+	s.Equal("alice", event.Assignee)
+
+	mergeState = &state.MergeState{}
+	s.NoError(s.DB().C("merges").FindId(mergeID).One(mergeState))
+	s.Nil(mergeState.Assignment)
+
+	// Released merges can't be released again.
+	res = s.postAs(server, "alice-key", "/merge/"+mergeID+"/release", "")
+	s.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
+func (s *ServerTestSuite) TestClaimLapsedAssignment() {
+	server := s.authenticatedServer()
+	defer server.Close()
+	mergeID := s.insertQueuedMerge(state.StatusInReview, 1, time.Now())
+
+	// Alice claimed the merge long ago, and hasn't worked on it since.
+	lapsed := time.Now().Add(-2 * DefaultConfig.ClaimTTL)
+	s.NoError(s.DB().C("merges").UpdateId(mergeID, bson.M{"$set": bson.M{
+		"assignment":   &state.Assignment{Assignee: "alice", Assigned: lapsed},
+		"lastActivity": lapsed,
+	}}))
+
+	res := s.postAs(server, "bob-key", "/merge/"+mergeID+"/claim", "")
+	s.Equal(http.StatusOK, res.StatusCode)
+
+	mergeState := &state.MergeState{}
+	s.NoError(s.DB().C("merges").FindId(mergeID).One(mergeState))
+	s.Equal("bob", mergeState.Assignment.Assignee)
+}
+
+func (s *ServerTestSuite) TestClaimIsEnforced() {
+	server := s.authenticatedServer()
+	defer server.Close()
+	mergeID := s.insertQueuedMerge(state.StatusInReview, 1, time.Now())
+
+	res := s.postAs(server, "alice-key", "/merge/"+mergeID+"/claim", "")
+	s.Equal(http.StatusOK, res.StatusCode)
+
+	// Nobody else may change a claimed merge, but admins may.
+	res = s.deleteAs(server, "bob-key", "/merge/"+mergeID+"/conflicts/nope")
+	s.Equal(http.StatusConflict, res.StatusCode)
+	res = s.deleteAs(server, "bob-key", "/merge/"+mergeID+"/target/resources/nope")
+	s.Equal(http.StatusConflict, res.StatusCode)
+	res = s.postAs(server, "bob-key", "/merge/"+mergeID+"/resolve/nope", "{}")
+	s.Equal(http.StatusConflict, res.StatusCode)
+	res = s.deleteAs(server, "alice-key", "/merge/"+mergeID+"/conflicts/nope")
+	s.Equal(http.StatusNotFound, res.StatusCode)
+	res = s.deleteAs(server, "carol-key", "/merge/"+mergeID+"/conflicts/nope")
+	s.Equal(http.StatusNotFound, res.StatusCode)
+
+	// Nor approve a merge assigned to someone else.
+	approvalID := s.insertMergeAwaitingApproval()
+	res = s.postAs(server, "carol-key", "/merge/"+approvalID+"/assign", `{"assignee": "dave"}`)
+	s.Equal(http.StatusOK, res.StatusCode)
+	res = s.postAs(server, "bob-key", "/merge/"+approvalID+"/approve", "")
+	s.Equal(http.StatusConflict, res.StatusCode)
+}
+
+func (s *ServerTestSuite) TestAssignMerge() {
+	server := s.authenticatedServer()
+	defer server.Close()
+	mergeID := s.insertQueuedMerge(state.StatusCreated, 1, time.Now())
+
+	res := s.postAs(server, "alice-key", "/merge/"+mergeID+"/claim", "")
+	s.Equal(http.StatusOK, res.StatusCode)
+
+	// Only admins may assign merges, and they may reassign claimed merges.
+	res = s.postAs(server, "alice-key", "/merge/"+mergeID+"/assign", `{"assignee": "alice"}`)
+	s.Equal(http.StatusForbidden, res.StatusCode)
+	res = s.postAs(server, "carol-key", "/merge/"+mergeID+"/assign", `{}`)
+	s.Equal(http.StatusBadRequest, res.StatusCode)
+	res = s.postAs(server, "carol-key", "/merge/"+mergeID+"/assign", `{"assignee": "bob"}`)
+	s.Equal(http.StatusOK, res.StatusCode)
+
+	mergeState := &state.MergeState{}
+	s.NoError(s.DB().C("merges").FindId(mergeID).One(mergeState))
+	s.Equal("bob", mergeState.Assignment.Assignee)
+	s.Equal("carol", mergeState.Assignment.AssignedBy)
+
+	// Admins may release anyone's merges.
+	res = s.postAs(server, "carol-key", "/merge/"+mergeID+"/release", "")
+	s.Equal(http.StatusOK, res.StatusCode)
+
+	// Committed merges can't be assigned.
+	committedID := s.insertQueuedMerge(state.StatusCommitted, 0, time.Now())
+	res = s.postAs(server, "alice-key", "/merge/"+committedID+"/claim", "")
+	s.Equal(http.StatusBadRequest, res.StatusCode)
+	res = s.postAs(server, "alice-key", "/merge/"+bson.NewObjectId().Hex()+"/claim", "")
+	s.Equal(http.StatusNotFound, res.StatusCode)
+}
+
+func (s *ServerTestSuite) TestQueue() {
+	server := s.authenticatedServer()
+	defer server.Close()
+	now := time.Now()
+	oldest := s.insertQueuedMerge(state.StatusCreated, 1, now.Add(-3*time.Hour))
+	most := s.insertQueuedMerge(state.StatusInReview, 5, now.Add(-2*time.Hour))
+	newest := s.insertQueuedMerge(state.StatusCreated, 2, now.Add(-time.Hour))
+	bobs := s.insertQueuedMerge(state.StatusCreated, 3, now)
+	s.insertQueuedMerge(state.StatusCommitted, 0, now)
+
+	res := s.postAs(server, "bob-key", "/merge/"+bobs+"/claim", "")
+	s.Equal(http.StatusOK, res.StatusCode)
+
+	queueIDs := func(queue *state.MergeQueue) []string {
+		ids := []string{}
+		for _, m := range queue.Merges {
+			ids = append(ids, m.Merge.MergeID)
+		}
+		return ids
+	}
+
+	// Bob's merge isn't in alice's queue.
+	queue := &state.MergeQueue{}
+	s.getAs(server, "alice-key", "/queue", queue)
+	s.Equal(PriorityConflicts, queue.Priority)
+	s.Equal([]string{most, newest, oldest}, queueIDs(queue))
+
+	queue = &state.MergeQueue{}
+	s.getAs(server, "bob-key", "/queue?priority=age", queue)
+	s.Equal([]string{oldest, most, newest, bobs}, queueIDs(queue))
+
+	queue = &state.MergeQueue{}
+	s.getAs(server, "bob-key", "/queue?priority=age&_count=1", queue)
+	s.Equal([]string{oldest}, queueIDs(queue))
+
+	req, err := http.NewRequest("GET", server.URL+"/queue?priority=random", nil)
+	s.NoError(err)
+	req.Header.Set(auth.APIKeyHeader, "alice-key")
+	res, err = http.DefaultClient.Do(req)
+	s.NoError(err)
+	res.Body.Close()
+	s.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
+// insertQueuedMerge inserts a merge with a number of remaining conflicts.
+func (s *ServerTestSuite) insertQueuedMerge(status string, conflicts int, start time.Time) string {
+	conflictMap := make(state.ConflictMap)
+	for i := 0; i < conflicts; i++ {
+		conflictMap[bson.NewObjectId().Hex()] = &state.ConflictState{Resolved: false}
+	}
+	mergeID, err := s.insertMergeState(&state.MergeState{
+		MergeID:   bson.NewObjectId().Hex(),
+		Status:    status,
+		Completed: status == state.StatusCommitted,
+		Conflicts: conflictMap,
+		Start:     &start,
+	})
+	s.NoError(err)
+	return mergeID
+}
+
+// ========================================================================= //
+// TEST COMMENTS                                                             //
+// ========================================================================= //
+
+func (s *ServerTestSuite) TestMergeComments() {
+	server := s.authenticatedServer()
+	defer server.Close()
+	mergeID := s.insertQueuedMerge(state.StatusInReview, 1, time.Now())
+	path := "/merge/" + mergeID + "/comments"
+
+	sub := s.Events.Subscribe(mergeID)
+	defer sub.Cancel()
+
+	res := s.postAs(server, "alice-key", path, `{"text": "Can someone check the address?"}`)
+	s.Equal(http.StatusCreated, res.StatusCode)
+	event := <-sub.Events
+	s.Equal(events.CommentAdded, event.Type)
+	s.NotEmpty(event.CommentID)
+	s.Empty(event.ConflictID)
+
+	// Replies must be to comments in the same thread.
+	res = s.postAs(server, "bob-key", path, `{"text": "Confirmed with the clinic", "replyTo": "`+event.CommentID+`"}`)
+	s.Equal(http.StatusCreated, res.StatusCode)
+	<-sub.Events
+	res = s.postAs(server, "bob-key", path, `{"text": "Hello?", "replyTo": "nope"}`)
+	s.Equal(http.StatusBadRequest, res.StatusCode)
+	res = s.postAs(server, "bob-key", path, `{"text": " "}`)
+	s.Equal(http.StatusBadRequest, res.StatusCode)
+
+	comments := &state.Comments{}
+	s.getAs(server, "alice-key", path, comments)
+	s.Len(comments.Comments, 2)
+	s.Equal("alice", comments.Comments[0].Author)
+	s.Equal("Can someone check the address?", comments.Comments[0].Text)
+	s.Equal("bob", comments.Comments[1].Author)
+	s.Equal(comments.Comments[0].ID, comments.Comments[1].ReplyTo)
+
+	// Only the author may delete a comment, which deletes its replies too.
+	res = s.deleteAs(server, "bob-key", path+"/"+comments.Comments[0].ID)
+	s.Equal(http.StatusForbidden, res.StatusCode)
+	res = s.deleteAs(server, "alice-key", path+"/"+comments.Comments[0].ID)
+	s.Equal(http.StatusNoContent, res.StatusCode)
+	event = <-sub.Events
+	s.Equal(events.CommentDeleted, event.Type)
+	s.Equal(comments.Comments[0].ID, event.CommentID)
+
+	comments = &state.Comments{}
+	s.getAs(server, "alice-key", path, comments)
+	s.Empty(comments.Comments)
+
+	res = s.deleteAs(server, "alice-key", path+"/nope")
+	s.Equal(http.StatusNotFound, res.StatusCode)
+}
+
+func (s *ServerTestSuite) TestResolveKeepsConcurrentComments() {
+	resource, err := fhirutil.LoadAndPostResource(s.FHIRServer.URL, "Bundle", "../fixtures/bundles/joey_chestnut_bundle.json")
+	s.NoError(err)
+	target, ok := resource.(*models.Bundle)
+	s.True(ok)
+	patient, ok := target.Entry[0].Resource.(*models.Patient)
+	s.True(ok)
+
+	conflicts := make(state.ConflictMap)
+	conflicts["conflict1"] = &state.ConflictState{
+		TargetResource: state.TargetResource{ResourceID: patient.Id, ResourceType: "Patient"},
+	}
+	mergeID, err := s.insertMergeState(&state.MergeState{
+		MergeID:   bson.NewObjectId().Hex(),
+		Status:    state.StatusInReview,
+		TargetURL: s.FHIRServer.URL + "/Bundle/" + target.Id,
+		Conflicts: conflicts,
+	})
+	s.NoError(err)
+
+	// Comments are added while the resolved target is being saved, after the merge was
+	// loaded to resolve its conflict.
+	fhirURL, err := url.Parse(s.FHIRServer.URL)
+	s.NoError(err)
+	proxy := httputil.NewSingleHostReverseProxy(fhirURL)
+	fhirProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			s.NoError(s.DB().C("merges").UpdateId(mergeID, bson.M{"$push": bson.M{
+				"comments":                     state.Comment{ID: "comment1", Author: "bob", Text: "On the merge"},
+				"conflicts.conflict1.comments": state.Comment{ID: "comment2", Author: "bob", Text: "On the conflict"},
+			}}))
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer fhirProxy.Close()
+	engine := gin.New()
+	config := DefaultConfig
+	config.Events = s.Events
+	RegisterRoutes(engine, s.DB().Session, "ptmerge-test", fhirProxy.URL, config)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	data, err := json.Marshal(patient)
+	s.NoError(err)
+	res, err := http.Post(server.URL+"/merge/"+mergeID+"/resolve/conflict1", "application/json", bytes.NewReader(data))
+	s.NoError(err)
+	res.Body.Close()
+	s.Equal(http.StatusOK, res.StatusCode)
+
+	// The conflict was resolved without losing either comment.
+	mergeState := &state.MergeState{}
+	s.NoError(s.DB().C("merges").FindId(mergeID).One(mergeState))
+	s.Equal(state.StatusCompleted, mergeState.Status)
+	s.True(mergeState.Conflicts["conflict1"].Resolved)
+	s.Len(mergeState.Comments, 1)
+	s.Equal("comment1", mergeState.Comments[0].ID)
+	s.Len(mergeState.Conflicts["conflict1"].Comments, 1)
+	s.Equal("comment2", mergeState.Conflicts["conflict1"].Comments[0].ID)
+}
+
+func (s *ServerTestSuite) TestResolveRejectsConcurrentChanges() {
+	resource, err := fhirutil.LoadAndPostResource(s.FHIRServer.URL, "Bundle", "../fixtures/bundles/joey_chestnut_bundle.json")
+	s.NoError(err)
+	target, ok := resource.(*models.Bundle)
+	s.True(ok)
+	patient, ok := target.Entry[0].Resource.(*models.Patient)
+	s.True(ok)
+
+	conflicts := make(state.ConflictMap)
+	conflicts["conflict1"] = &state.ConflictState{
+		TargetResource: state.TargetResource{ResourceID: patient.Id, ResourceType: "Patient"},
+	}
+	mergeID, err := s.insertMergeState(&state.MergeState{
+		MergeID:   bson.NewObjectId().Hex(),
+		Status:    state.StatusInReview,
+		TargetURL: s.FHIRServer.URL + "/Bundle/" + target.Id,
+		Conflicts: conflicts,
+	})
+	s.NoError(err)
+
+	// The merge is aborted while the resolved target is being saved, after the merge was
+	// loaded to resolve its conflict.
+	fhirURL, err := url.Parse(s.FHIRServer.URL)
+	s.NoError(err)
+	proxy := httputil.NewSingleHostReverseProxy(fhirURL)
+	fhirProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			s.NoError(s.DB().C("merges").UpdateId(mergeID, bson.M{
+				"$set": bson.M{"status": state.StatusAborted},
+				"$inc": bson.M{"version": 1},
+			}))
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer fhirProxy.Close()
+	engine := gin.New()
+	config := DefaultConfig
+	config.Events = s.Events
+	RegisterRoutes(engine, s.DB().Session, "ptmerge-test", fhirProxy.URL, config)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	data, err := json.Marshal(patient)
+	s.NoError(err)
+	res, err := http.Post(server.URL+"/merge/"+mergeID+"/resolve/conflict1", "application/json", bytes.NewReader(data))
+	s.NoError(err)
+	res.Body.Close()
+	s.Equal(http.StatusConflict, res.StatusCode)
+
+	// The resolve didn't bring the aborted merge back.
+	mergeState := &state.MergeState{}
+	s.NoError(s.DB().C("merges").FindId(mergeID).One(mergeState))
+	s.Equal(state.StatusAborted, mergeState.Status)
+	s.False(mergeState.Conflicts["conflict1"].Resolved)
+	s.Equal(1, mergeState.Version)
+}
+
+func (s *ServerTestSuite) TestConflictComments() {
+	server := s.authenticatedServer()
+	defer server.Close()
+	mergeID := s.insertMergeAwaitingApproval()
+
+	res := s.postAs(server, "alice-key", "/merge/"+mergeID+"/conflicts/conflict1/comments", `{"text": "Called clinic, confirmed new address"}`)
+	s.Equal(http.StatusCreated, res.StatusCode)
+	res = s.postAs(server, "alice-key", "/merge/"+mergeID+"/comments", `{"text": "Ready for approval"}`)
+	s.Equal(http.StatusCreated, res.StatusCode)
+	res = s.postAs(server, "alice-key", "/merge/"+mergeID+"/conflicts/nope/comments", `{"text": "Hello?"}`)
+	s.Equal(http.StatusNotFound, res.StatusCode)
+
+	// Comments on a conflict are stored with the conflict.
+	comments := &state.Comments{}
+	s.getAs(server, "bob-key", "/merge/"+mergeID+"/conflicts/conflict1/comments", comments)
+	s.Len(comments.Comments, 1)
+	s.Equal("Called clinic, confirmed new address", comments.Comments[0].Text)
+
+	mergeState := &state.MergeState{}
+	s.NoError(s.DB().C("merges").FindId(mergeID).One(mergeState))
+	s.Len(mergeState.Comments, 1)
+	s.Len(mergeState.Conflicts["conflict1"].Comments, 1)
+	s.Empty(mergeState.Conflicts["conflict2"].Comments)
+
+	// The comments are audited when the merge is completed.
+	res = s.postAs(server, "bob-key", "/merge/"+mergeID+"/approve", "")
+	s.Equal(http.StatusOK, res.StatusCode)
+
+	var record audit.Record
+	s.NoError(s.DB().C("audit").Find(bson.M{"mergeId": mergeID, "action": audit.ActionApprove, "outcome": audit.OutcomeSuccess}).One(&record))
+	s.Len(record.Comments, 2)
+	s.Equal("Ready for approval", record.Comments[0].Text)
+	s.Empty(record.Comments[0].ConflictID)
+	s.Equal("conflict1", record.Comments[1].ConflictID)
+	s.Equal("alice", record.Comments[1].Author)
+}
+
+// ========================================================================= //
+// TEST MERGE EVENTS                                                         //
+// ========================================================================= //
+
+func (s *ServerTestSuite) TestMergeEvents() {
+	var err error
+
+	// Put a target bundle and a conflict on the host FHIR server.
+	resource, err := fhirutil.LoadAndPostResource(s.FHIRServer.URL, "OperationOutcome", "../fixtures/operation_outcomes/oo_0.json")
+	s.NoError(err)
+	conflict, ok := resource.(*models.OperationOutcome)
+	s.True(ok)
+
+	resource, err = fhirutil.LoadAndPostResource(s.FHIRServer.URL, "Bundle", "../fixtures/bundles/joey_chestnut_bundle.json")
+	s.NoError(err)
+	target, ok := resource.(*models.Bundle)
+	s.True(ok)
+
+	// Put the merge state in mongo.
+	c1 := make(state.ConflictMap)
+	c1[conflict.Id] = &state.ConflictState{
+		OperationOutcomeURL: s.FHIRServer.URL + "/OperationOutcome/" + conflict.Id,
+		Resolved:            false,
+		TargetResource: state.TargetResource{
+			ResourceID:   bson.NewObjectId().Hex(),
+			ResourceType: "Patient",
+		},
+	}
+	m1 := &state.MergeState{
+		MergeID:   bson.NewObjectId().Hex(),
+		Completed: false,
+		TargetURL: s.FHIRServer.URL + "/Bundle/" + target.Id,
+		Conflicts: c1,
+	}
+	mergeID, err := s.insertMergeState(m1)
+	s.NoError(err)
+
+	// Start listening for events. The response headers arrive before any events.
+	stream, err := http.Get(s.PTMergeServer.URL + "/merge/" + mergeID + "/events")
+	s.NoError(err)
+	defer stream.Body.Close()
+	s.Equal(http.StatusOK, stream.StatusCode)
+	s.Equal("text/event-stream", stream.Header.Get("Content-Type"))
+
+	// Abort the merge.
+	res, err := http.Post(s.PTMergeServer.URL+"/merge/"+mergeID+"/abort", "", nil)
+	s.NoError(err)
+	res.Body.Close()
+	s.Equal(http.StatusNoContent, res.StatusCode)
+
+	// The abort is streamed, then the stream ends.
+	var names, data []string
+	scanner := bufio.NewScanner(stream.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "event:") {
+			names = append(names, strings.TrimPrefix(line, "event:"))
+		}
+		if strings.HasPrefix(line, "data:") {
+			data = append(data, strings.TrimPrefix(line, "data:"))
+		}
+	}
+	s.NoError(scanner.Err())
+	s.Equal([]string{events.MergeAborted}, names)
+	s.Len(data, 1)
+
+	event := events.Event{}
+	s.NoError(json.Unmarshal([]byte(data[0]), &event))
+	s.Equal(events.MergeAborted, event.Type)
+	s.Equal(mergeID, event.MergeID)
+	s.Equal("anonymous", event.Actor)
+}
+
+func (s *ServerTestSuite) TestMergeEventsDropped() {
+	mergeID, err := s.insertMergeState(&state.MergeState{
+		MergeID:   bson.NewObjectId().Hex(),
+		Conflicts: make(state.ConflictMap),
+	})
+	s.NoError(err)
+
+	// Subscribe with no buffer, so every event is dropped.
+	size := events.SubscriberBufferSize
+	events.SubscriberBufferSize = 0
+	defer func() { events.SubscriberBufferSize = size }()
+
+	stream, err := http.Get(s.PTMergeServer.URL + "/merge/" + mergeID + "/events")
+	s.NoError(err)
+	defer stream.Body.Close()
+	s.Equal(http.StatusOK, stream.StatusCode)
+
+	s.Events.Publish(&events.Event{Type: events.CommentAdded, MergeID: mergeID})
+
+	// The client is told events were dropped, then the stream ends.
+	var names []string
+	scanner := bufio.NewScanner(stream.Body)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "event:") {
+			names = append(names, strings.TrimPrefix(line, "event:"))
+		}
+	}
+	s.NoError(scanner.Err())
+	s.Equal([]string{events.EventsDropped}, names)
+}
+
+func (s *ServerTestSuite) TestMergeEventsMergeEnded() {
+	mergeID, err := s.insertMergeState(&state.MergeState{
+		MergeID:   bson.NewObjectId().Hex(),
+		Status:    state.StatusAborted,
+		Conflicts: make(state.ConflictMap),
+	})
+	s.NoError(err)
+
+	res, err := http.Get(s.PTMergeServer.URL + "/merge/" + mergeID + "/events")
+	s.NoError(err)
+	defer res.Body.Close()
+	s.Equal(http.StatusGone, res.StatusCode)
+}
+
+func (s *ServerTestSuite) TestMergeEventsMergeNotFound() {
+	res, err := http.Get(s.PTMergeServer.URL + "/merge/" + bson.NewObjectId().Hex() + "/events")
+	s.NoError(err)
+	defer res.Body.Close()
+	s.Equal(http.StatusNotFound, res.StatusCode)
+}
+
+// ========================================================================= //
+// TEST MERGE EXPIRATION                                                     //
+// ========================================================================= //
+
+func (s *ServerTestSuite) TestReapExpired() {
+	var err error
+
+	// Put a target bundle and a conflict on the host FHIR server.
+	resource, err := fhirutil.LoadAndPostResource(s.FHIRServer.URL, "OperationOutcome", "../fixtures/operation_outcomes/oo_0.json")
+	s.NoError(err)
+	conflict, ok := resource.(*models.OperationOutcome)
+	s.True(ok)
+
+	resource, err = fhirutil.LoadAndPostResource(s.FHIRServer.URL, "Bundle", "../fixtures/bundles/joey_chestnut_bundle.json")
+	s.NoError(err)
+	target, ok := resource.(*models.Bundle)
+	s.True(ok)
+
+	// Put an inactive merge, a recently active merge, and an old completed merge in mongo.
+	longAgo := time.Now().Add(-48 * time.Hour)
+	recently := time.Now().Add(-time.Hour)
+	c1 := make(state.ConflictMap)
+	c1[conflict.Id] = &state.ConflictState{
+		OperationOutcomeURL: s.FHIRServer.URL + "/OperationOutcome/" + conflict.Id,
+		TargetResource: state.TargetResource{
+			ResourceID:   bson.NewObjectId().Hex(),
+			ResourceType: "Patient",
+		},
+	}
+	inactiveID, err := s.insertMergeState(&state.MergeState{
+		MergeID:      bson.NewObjectId().Hex(),
+		TargetURL:    s.FHIRServer.URL + "/Bundle/" + target.Id,
+		Conflicts:    c1,
+		Start:        &longAgo,
+		LastActivity: &longAgo,
+	})
+	s.NoError(err)
+	activeID, err := s.insertMergeState(&state.MergeState{
+		MergeID:      bson.NewObjectId().Hex(),
+		Conflicts:    make(state.ConflictMap),
+		Start:        &longAgo,
+		LastActivity: &recently,
+	})
+	s.NoError(err)
+	completedID, err := s.insertMergeState(&state.MergeState{
+		MergeID:      bson.NewObjectId().Hex(),
+		Completed:    true,
+		Conflicts:    make(state.ConflictMap),
+		Start:        &longAgo,
+		LastActivity: &longAgo,
+	})
+	s.NoError(err)
+	// Merges from before activity was tracked aren't expired.
+	untrackedID, err := s.insertMergeState(&state.MergeState{
+		MergeID:   bson.NewObjectId().Hex(),
+		Conflicts: make(state.ConflictMap),
+		Start:     &longAgo,
+	})
+	s.NoError(err)
+
+	sub := s.Events.Subscribe(inactiveID)
+	defer sub.Cancel()
+
+	reaper := NewReaper(s.DB().Session, "ptmerge-test", 24*time.Hour, time.Minute, s.Events, audit.NewMongoSink(s.DB().Session, "ptmerge-test"))
+	n, err := reaper.ReapExpired()
+	s.NoError(err)
+	s.Equal(1, n)
+
+	// Only the inactive merge was expired, and it was cleaned up and kept like an aborted merge.
+	expired := &state.MergeState{}
+	s.NoError(s.DB().C("merges").FindId(inactiveID).One(expired))
+	s.Equal(state.StatusAborted, expired.Status)
+	s.Equal(ReaperActor, expired.History[len(expired.History)-1].Actor)
+	s.NotNil(expired.End)
+	count, err := s.DB().C("merges").Find(bson.M{
+		"_id":    bson.M{"$in": []string{activeID, completedID, untrackedID}},
+		"status": bson.M{"$ne": state.StatusAborted},
+	}).Count()
+	s.NoError(err)
+	s.Equal(3, count)
+
+	_, err = fhirutil.GetResource(s.FHIRServer.URL, "Bundle", target.Id)
+	s.Error(err)
+	_, err = fhirutil.GetResource(s.FHIRServer.URL, "OperationOutcome", conflict.Id)
+	s.Error(err)
+
+	// The expiration was published and audited.
+	event := <-sub.Events
+	s.Equal(events.MergeExpired, event.Type)
+	s.Equal(ReaperActor, event.Actor)
+
+	record := audit.Record{}
+	err = s.DB().C("audit").Find(bson.M{"mergeId": inactiveID}).One(&record)
+	s.NoError(err)
+	s.Equal(audit.ActionExpire, record.Action)
+	s.Equal(ReaperActor, record.Actor)
+	s.Equal(audit.OutcomeSuccess, record.Outcome)
+}
+
+func (s *ServerTestSuite) TestReapSkipsMergesChangedMeanwhile() {
+	longAgo := time.Now().Add(-48 * time.Hour)
+	reaper := NewReaper(s.DB().Session, "ptmerge-test", 24*time.Hour, time.Minute, s.Events, audit.NewMongoSink(s.DB().Session, "ptmerge-test"))
+
+	// Each merge is found to be inactive, then claimed, commented on, or resolved before
+	// the reaper gets to it.
+	changes := []bson.M{
+		{"$set": bson.M{"assignment": state.Assignment{Assignee: "alice", Assigned: time.Now()}}},
+		{"$set": bson.M{"lastActivity": time.Now()}},
+		{"$set": bson.M{"status": state.StatusInReview}, "$inc": bson.M{"version": 1}},
+	}
+	for _, change := range changes {
+		mergeID, err := s.insertMergeState(&state.MergeState{
+			MergeID:      bson.NewObjectId().Hex(),
+			TargetURL:    s.FHIRServer.URL + "/Bundle/" + bson.NewObjectId().Hex(),
+			Conflicts:    make(state.ConflictMap),
+			Start:        &longAgo,
+			LastActivity: &longAgo,
+		})
+		s.NoError(err)
+		inactive := &state.MergeState{}
+		s.NoError(s.DB().C("merges").FindId(mergeID).One(inactive))
+		s.NoError(s.DB().C("merges").UpdateId(mergeID, change))
+
+		claimed, err := reaper.claim(s.DB().Session, inactive)
+		s.NoError(err)
+		s.False(claimed)
+		current := &state.MergeState{}
+		s.NoError(s.DB().C("merges").FindId(mergeID).One(current))
+		s.NotEqual(state.StatusAborted, current.Status)
+	}
+}
+
+func (s *ServerTestSuite) TestExpiringMerges() {
+	// Merges expire after a week of inactivity on the test server.
+	sixDaysAgo := time.Now().Add(-6 * 24 * time.Hour)
+	sixAndAHalfDaysAgo := time.Now().Add(-13 * 12 * time.Hour)
+	yesterday := time.Now().Add(-24 * time.Hour)
+
+	ids := []string{}
+	for _, lastActivity := range []time.Time{sixDaysAgo, sixAndAHalfDaysAgo, yesterday} {
+		last := lastActivity
+		id, err := s.insertMergeState(&state.MergeState{
+			MergeID:      bson.NewObjectId().Hex(),
+			Conflicts:    make(state.ConflictMap),
+			Start:        &last,
+			LastActivity: &last,
+		})
+		s.NoError(err)
+		ids = append(ids, id)
+	}
+
+	// By default, merges expiring in the next day are listed, soonest first.
+	expiring := state.ExpiringMerges{}
+	s.getJSON("/admin/merges/expiring", &expiring)
+	s.Len(expiring.Merges, 2)
+	s.Equal(ids[1], expiring.Merges[0].Merge.MergeID)
+	s.Equal(ids[0], expiring.Merges[1].Merge.MergeID)
+	s.WithinDuration(sixDaysAgo.Add(testMergeTTL), expiring.Merges[1].Expires, time.Second)
+
+	expiring = state.ExpiringMerges{}
+	s.getJSON("/admin/merges/expiring?within=13h", &expiring)
+	s.Len(expiring.Merges, 1)
+	s.Equal(ids[1], expiring.Merges[0].Merge.MergeID)
+
+	res, err := http.Get(s.PTMergeServer.URL + "/admin/merges/expiring?within=soon")
+	s.NoError(err)
+	res.Body.Close()
+	s.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
+func (s *ServerTestSuite) TestBackfillStatus() {
+	c1 := make(state.ConflictMap)
+	c1["conflict1"] = &state.ConflictState{Resolved: true}
+	reviewedID, err := s.insertMergeState(&state.MergeState{
+		MergeID:   bson.NewObjectId().Hex(),
+		Conflicts: c1,
+	})
+	s.NoError(err)
+	completedID, err := s.insertMergeState(&state.MergeState{
+		MergeID:   bson.NewObjectId().Hex(),
+		Completed: true,
+		Conflicts: make(state.ConflictMap),
+	})
+	s.NoError(err)
+
+	// Merges from before statuses were tracked can be found by their status once it's stored.
+	backfillStatus(s.DB().Session, "ptmerge-test")
+
+	n, err := s.DB().C("merges").Find(bson.M{"_id": reviewedID, "status": state.StatusInReview}).Count()
+	s.NoError(err)
+	s.Equal(1, n)
+	n, err = s.DB().C("merges").Find(bson.M{"_id": completedID, "status": state.StatusCompleted}).Count()
+	s.NoError(err)
+	s.Equal(1, n)
+}
+
+func (s *ServerTestSuite) TestBackfillIndex() {
+	mergeID := bson.NewObjectId().Hex()
+	s.NoError(s.DB().C("merges").Insert(bson.M{
+		"_id": mergeID,
+		"conflicts": bson.M{
+			"conflict1": bson.M{"resolved": false},
+			"conflict2": bson.M{"resolved": true},
+		},
+	}))
+
+	// Merges from before the queue was sorted in mongo are given its sort keys.
+	backfillIndex(s.DB().Session, "ptmerge-test")
+
+	n, err := s.DB().C("merges").Find(bson.M{"_id": mergeID, "remaining": 1, "matchScore": 0}).Count()
+	s.NoError(err)
+	s.Equal(1, n)
+}
+
+func (s *ServerTestSuite) TestBackfillLastActivity() {
+	longAgo := time.Now().Add(-30 * 24 * time.Hour)
+	untrackedID, err := s.insertMergeState(&state.MergeState{
+		MergeID:   bson.NewObjectId().Hex(),
+		Conflicts: make(state.ConflictMap),
+		Start:     &longAgo,
+	})
+	s.NoError(err)
+	trackedID, err := s.insertMergeState(&state.MergeState{
+		MergeID:      bson.NewObjectId().Hex(),
+		Conflicts:    make(state.ConflictMap),
+		Start:        &longAgo,
+		LastActivity: &longAgo,
+	})
+	s.NoError(err)
+
+	// Only merges from before activity was tracked are changed.
+	backfillLastActivity(s.DB().Session, "ptmerge-test")
+
+	var untracked, tracked state.MergeState
+	s.NoError(s.DB().C("merges").FindId(untrackedID).One(&untracked))
+	s.NotNil(untracked.LastActivity)
+	s.WithinDuration(time.Now(), *untracked.LastActivity, time.Minute)
+	s.NoError(s.DB().C("merges").FindId(trackedID).One(&tracked))
+	s.WithinDuration(longAgo, *tracked.LastActivity, time.Second)
+}
+
+// ========================================================================= //
+// TEST WEBHOOKS                                                             //
+// ========================================================================= //
+
+func (s *ServerTestSuite) TestWebhooks() {
+	var err error
+
+	// Stand up a receiver for the webhook deliveries.
+	received := make(chan *http.Request, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+	}))
+	defer receiver.Close()
+
+	// Subscribe the receiver to merge aborts.
+	res, err := http.Post(s.PTMergeServer.URL+"/webhooks", "application/json",
+		strings.NewReader(`{"url": "`+receiver.URL+`", "events": ["merge-aborted"]}`))
+	s.NoError(err)
+	s.Equal(http.StatusCreated, res.StatusCode)
+	body, err := ioutil.ReadAll(res.Body)
+	s.NoError(err)
+	res.Body.Close()
+	hook := webhook.Webhook{}
+	s.NoError(json.Unmarshal(body, &hook))
+	s.Equal(hook.ID, res.Header.Get("Location"))
+	s.Equal("anonymous", hook.CreatedBy)
+	s.Len(hook.Secret, 64)
+
+	// Secrets are never returned again.
+	hooks := []webhook.Webhook{}
+	s.getJSON("/webhooks", &hooks)
+	s.Len(hooks, 1)
+	s.Equal(receiver.URL, hooks[0].URL)
+	s.Empty(hooks[0].Secret)
+
+	// Abort a merge, delivering the event.
+	dispatcher := webhook.NewDispatcher(s.DB().Session, "ptmerge-test", s.Events)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	resource, err := fhirutil.LoadAndPostResource(s.FHIRServer.URL, "Bundle", "../fixtures/bundles/joey_chestnut_bundle.json")
+	s.NoError(err)
+	target, ok := resource.(*models.Bundle)
+	s.True(ok)
+	mergeID, err := s.insertMergeState(&state.MergeState{
+		MergeID:   bson.NewObjectId().Hex(),
+		TargetURL: s.FHIRServer.URL + "/Bundle/" + target.Id,
+		Conflicts: make(state.ConflictMap),
+	})
+	s.NoError(err)
+	res, err = http.Post(s.PTMergeServer.URL+"/merge/"+mergeID+"/abort", "", nil)
+	s.NoError(err)
+	res.Body.Close()
+	s.Equal(http.StatusNoContent, res.StatusCode)
+
+	select {
+	case req := <-received:
+		s.Equal(events.MergeAborted, req.Header.Get(webhook.EventHeader))
+	case <-time.After(5 * time.Second):
+		s.Fail("Webhook delivery timed out")
+	}
+
+	// The delivery is logged.
+	deliveries := webhook.Deliveries{}
+	for i := 0; i < 100; i++ {
+		s.getJSON("/webhooks/"+hook.ID+"/deliveries?status=delivered", &deliveries)
+		if deliveries.Total == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Equal(1, deliveries.Total)
+	s.Equal(mergeID, deliveries.Deliveries[0].Event.MergeID)
+	s.Equal(1, deliveries.Deliveries[0].Attempts)
+
+	// Unsubscribe.
+	req, err := http.NewRequest("DELETE", s.PTMergeServer.URL+"/webhooks/"+hook.ID, nil)
+	s.NoError(err)
+	res, err = http.DefaultClient.Do(req)
+	s.NoError(err)
+	res.Body.Close()
+	s.Equal(http.StatusNoContent, res.StatusCode)
+
+	res, err = http.Get(s.PTMergeServer.URL + "/webhooks/" + hook.ID)
+	s.NoError(err)
+	res.Body.Close()
+	s.Equal(http.StatusNotFound, res.StatusCode)
+}
+
+func (s *ServerTestSuite) TestCreateWebhookInvalid() {
+	for _, body := range []string{
+		`{"url": "ftp://example.com"}`,
+		`{"url": "http://example.com", "events": ["merge-exploded"]}`,
+		`not json`,
+	} {
+		res, err := http.Post(s.PTMergeServer.URL+"/webhooks", "application/json", strings.NewReader(body))
+		s.NoError(err)
+		res.Body.Close()
+		s.Equal(http.StatusBadRequest, res.StatusCode)
+	}
+}
+
+// ========================================================================= //
+// TEST HELPERS                                                              //
+// ========================================================================= //
+
+// getJSON GETs a path on the PTMergeServer, expecting a 200 response, and
+// unmarshals the JSON response body into obj.
+func (s *ServerTestSuite) getJSON(path string, obj interface{}) {
+	res, err := http.Get(s.PTMergeServer.URL + path)
+	s.NoError(err)
+	defer res.Body.Close()
+	s.Equal(http.StatusOK, res.StatusCode)
+
+	body, err := ioutil.ReadAll(res.Body)
+	s.NoError(err)
+	err = json.Unmarshal(body, obj)
+	s.NoError(err)
+}
+
+// diagnostics returns the diagnostics of the error in an OperationOutcome response body.
+func (s *ServerTestSuite) diagnostics(body []byte) string {
+	oo := &models.OperationOutcome{}
+	s.NoError(json.Unmarshal(body, oo))
+	s.Require().Len(oo.Issue, 1)
+	return oo.Issue[0].Diagnostics
+}
 
 // insertMergeState inserts a MergeState into the test mongo database. This
 // helper uses the "ptmerge-test" database only.
 func (s *ServerTestSuite) insertMergeState(mergeState *state.MergeState) (mergeID string, err error) {
+	mergeState.Index()
 	err = s.DB().C("merges").Insert(mergeState)
 	if err != nil {
 		return "", err
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mitre/ptmerge/audit"
+	"github.com/mitre/ptmerge/auth"
+	"github.com/mitre/ptmerge/events"
+	"github.com/mitre/ptmerge/state"
+	"github.com/mitre/ptmerge/webhook"
+)
+
+// webhookEvents are the event types a webhook may subscribe to.
+var webhookEvents = []string{
+	events.MergeCreated,
+	events.ApprovalRequested,
+	events.MergeRejected,
+	events.MergeCompleted,
+	events.MergeCommitted,
+	events.MergeAborted,
+	events.MergeExpired,
+	events.MergeAssigned,
+	events.MergeReleased,
+	events.ConflictResolved,
+	events.ConflictReopened,
+	events.ConflictDeleted,
+	events.TargetResourceUpdated,
+	events.TargetResourceDeleted,
+	events.CommentAdded,
+	events.CommentDeleted,
+}
+
+// WebhookController manages the resource handlers for webhook subscriptions.
+type WebhookController struct {
+	session *mgo.Session
+	dbname  string
+}
+
+// NewWebhookController returns a pointer to a newly initialized WebhookController.
+func NewWebhookController(session *mgo.Session, dbname string) *WebhookController {
+	return &WebhookController{
+		session: session,
+		dbname:  dbname,
+	}
+}
+
+// CreateWebhook subscribes a URL to merge events. The webhook is in the POST body, with
+// an optional list of event types and an optional secret. If no secret is given, one is
+// generated. The secret is only ever returned in this response.
+func (w *WebhookController) CreateWebhook(c *gin.Context) {
+	var err error
+	worker := w.session.Copy()
+	defer worker.Close()
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	hook := &webhook.Webhook{}
+	err = json.Unmarshal(body, hook)
+	if err != nil {
+		abortWithStatus(c, http.StatusBadRequest, "Invalid webhook: %s", err.Error())
+		return
+	}
+
+	// Validate the webhook.
+	hookURL, err := url.Parse(hook.URL)
+	if err != nil || (hookURL.Scheme != "http" && hookURL.Scheme != "https") || hookURL.Host == "" {
+		abortWithStatus(c, http.StatusBadRequest, "Invalid webhook url %s, must be an absolute http(s) URL", hook.URL)
+		return
+	}
+	for _, eventType := range hook.Events {
+		if !isWebhookEvent(eventType) {
+			abortWithStatus(c, http.StatusBadRequest, "Unknown webhook event %s", eventType)
+			return
+		}
+	}
+	if hook.Secret == "" {
+		hook.Secret, err = webhook.NewSecret()
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+	}
+
+	now := time.Now()
+	hook.ID = bson.NewObjectId().Hex()
+	hook.CreatedBy = auth.CurrentUserID(c)
+	hook.Created = &now
+	audit.AddResources(c, hook.ID)
+
+	err = worker.DB(w.dbname).C("webhooks").Insert(hook)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	c.Header("Location", hook.ID)
+	c.JSON(http.StatusCreated, hook)
+}
+
+// AllWebhooks returns all webhook subscriptions, without their secrets.
+func (w *WebhookController) AllWebhooks(c *gin.Context) {
+	var err error
+	worker := w.session.Copy()
+	defer worker.Close()
+
+	hooks := []webhook.Webhook{}
+	err = worker.DB(w.dbname).C("webhooks").Find(nil).Sort("created").All(&hooks)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	c.JSON(http.StatusOK, hooks)
+}
+
+// GetWebhook returns a single webhook subscription, without its secret.
+func (w *WebhookController) GetWebhook(c *gin.Context) {
+	var err error
+	worker := w.session.Copy()
+	defer worker.Close()
+
+	webhookID := c.Param("webhook_id")
+	audit.AddResources(c, webhookID)
+
+	var hook webhook.Webhook
+	err = worker.DB(w.dbname).C("webhooks").FindId(webhookID).One(&hook)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			abortWithStatus(c, http.StatusNotFound, "Webhook %s not found", webhookID)
+			return
+		}
+		abortWithError(c, err)
+		return
+	}
+
+	hook.Secret = ""
+	c.JSON(http.StatusOK, &hook)
+}
+
+// DeleteWebhook unsubscribes a webhook. Pending deliveries to it will fail, but its
+// delivery log is kept.
+func (w *WebhookController) DeleteWebhook(c *gin.Context) {
+	var err error
+	worker := w.session.Copy()
+	defer worker.Close()
+
+	webhookID := c.Param("webhook_id")
+	audit.AddResources(c, webhookID)
+
+	err = worker.DB(w.dbname).C("webhooks").RemoveId(webhookID)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			abortWithStatus(c, http.StatusNotFound, "Webhook %s not found", webhookID)
+			return
+		}
+		abortWithError(c, err)
+		return
+	}
+
+	// 204 response explicitly has no body.
+	c.Data(http.StatusNoContent, "", nil)
+}
+
+// GetDeliveries returns a page of a webhook's delivery log, newest first. It supports
+// the _count and page parameters, as for GET /merge, and a status parameter to only
+// return pending, delivered, or failed deliveries.
+func (w *WebhookController) GetDeliveries(c *gin.Context) {
+	var err error
+	worker := w.session.Copy()
+	defer worker.Close()
+
+	webhookID := c.Param("webhook_id")
+	audit.AddResources(c, webhookID)
+
+	// Check that the webhook exists.
+	n, err := worker.DB(w.dbname).C("webhooks").FindId(webhookID).Count()
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if n == 0 {
+		abortWithStatus(c, http.StatusNotFound, "Webhook %s not found", webhookID)
+		return
+	}
+
+	pagination := state.Pagination{
+		Page:  1,
+		Count: DefaultMergeCount,
+	}
+	if count := c.Query("_count"); count != "" {
+		pagination.Count, err = strconv.Atoi(count)
+		if err != nil || pagination.Count < 1 {
+			abortWithStatus(c, http.StatusBadRequest, "Invalid _count %s, must be a positive integer", count)
+			return
+		}
+		if pagination.Count > MaxMergeCount {
+			pagination.Count = MaxMergeCount
+		}
+	}
+	if page := c.Query("page"); page != "" {
+		pagination.Page, err = strconv.Atoi(page)
+		if err != nil || pagination.Page < 1 {
+			abortWithStatus(c, http.StatusBadRequest, "Invalid page %s, must be a positive integer", page)
+			return
+		}
+	}
+
+	query := bson.M{"webhookId": webhookID}
+	if status := c.Query("status"); status != "" {
+		if status != webhook.StatusPending && status != webhook.StatusDelivered && status != webhook.StatusFailed {
+			abortWithStatus(c, http.StatusBadRequest, "Invalid status %s, must be pending, delivered, or failed", status)
+			return
+		}
+		query["status"] = status
+	}
+
+	q := worker.DB(w.dbname).C("webhookDeliveries").Find(query)
+	pagination.Total, err = q.Count()
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	deliveries := []webhook.Delivery{}
+	err = q.Sort("-created", "_id").Skip((pagination.Page - 1) * pagination.Count).Limit(pagination.Count).All(&deliveries)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, &webhook.Deliveries{
+		Timestamp:  time.Now(),
+		Pagination: pagination,
+		Deliveries: deliveries,
+	})
+}
+
+// isWebhookEvent returns true if webhooks may subscribe to the event type.
+func isWebhookEvent(eventType string) bool {
+	for _, t := range webhookEvents {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
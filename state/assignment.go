@@ -0,0 +1,50 @@
+package state
+
+import "time"
+
+// Assignment records the reviewer a merge is assigned to. Reviewers may claim merges for
+// themselves, or be assigned them by an admin.
+type Assignment struct {
+	Assignee   string    `bson:"assignee" json:"assignee"`
+	AssignedBy string    `bson:"assignedBy,omitempty" json:"assignedBy,omitempty"`
+	Assigned   time.Time `bson:"assigned" json:"assigned"`
+}
+
+// Assign assigns the merge to a reviewer, replacing any earlier assignment.
+func (m *MergeState) Assign(assignee, assignedBy string) {
+	m.Assignment = &Assignment{
+		Assignee:   assignee,
+		AssignedBy: assignedBy,
+		Assigned:   time.Now(),
+	}
+}
+
+// Release removes the merge's assignment, so any reviewer may claim it.
+func (m *MergeState) Release() {
+	m.Assignment = nil
+}
+
+// ClaimExpires returns when the merge's assignment lapses, if nobody works on the merge
+// for ttl. The zero time is returned if the merge isn't assigned.
+func (m *MergeState) ClaimExpires(ttl time.Duration) time.Time {
+	if m.Assignment == nil {
+		return time.Time{}
+	}
+	last := m.Assignment.Assigned
+	if active := m.LastActive(); active.After(last) {
+		last = active
+	}
+	return last.Add(ttl)
+}
+
+// Assignee returns the reviewer the merge is currently assigned to, or "" if it isn't
+// assigned or its assignment lapsed at least ttl ago. If ttl is 0, assignments never lapse.
+func (m *MergeState) Assignee(ttl time.Duration, now time.Time) string {
+	if m.Assignment == nil {
+		return ""
+	}
+	if ttl > 0 && !now.Before(m.ClaimExpires(ttl)) {
+		return ""
+	}
+	return m.Assignment.Assignee
+}
@@ -0,0 +1,41 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type AssignmentTestSuite struct {
+	suite.Suite
+}
+
+func TestAssignmentTestSuite(t *testing.T) {
+	suite.Run(t, new(AssignmentTestSuite))
+}
+
+func (a *AssignmentTestSuite) TestAssignee() {
+	m := &MergeState{}
+	a.Equal("", m.Assignee(time.Hour, time.Now()))
+
+	m.Assign("alice", "bob")
+	a.Equal("alice", m.Assignment.Assignee)
+	a.Equal("bob", m.Assignment.AssignedBy)
+	a.Equal("alice", m.Assignee(time.Hour, time.Now()))
+
+	// The assignment lapses if nobody works on the merge.
+	later := time.Now().Add(2 * time.Hour)
+	a.Equal("", m.Assignee(time.Hour, later))
+	a.Equal("alice", m.Assignee(0, later))
+
+	// Working on the merge keeps the assignment.
+	active := later.Add(-time.Minute)
+	m.LastActivity = &active
+	a.Equal("alice", m.Assignee(time.Hour, later))
+	a.Equal(active.Add(time.Hour), m.ClaimExpires(time.Hour))
+
+	m.Release()
+	a.Nil(m.Assignment)
+	a.True(m.ClaimExpires(time.Hour).IsZero())
+}
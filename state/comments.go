@@ -0,0 +1,42 @@
+package state
+
+import "time"
+
+// Comments represents the comments on a merge or one of its conflicts, oldest first.
+type Comments struct {
+	Timestamp time.Time `json:"timestamp,omitempty"`
+	Comments  []Comment `json:"comments"`
+}
+
+// Comment is a reviewer's note on a merge or one of its conflicts, e.g. explaining how a
+// conflict was resolved. Comments are threaded: a reply holds the ID of the comment it
+// replies to.
+type Comment struct {
+	ID        string    `bson:"id" json:"id"`
+	ReplyTo   string    `bson:"replyTo,omitempty" json:"replyTo,omitempty"`
+	Author    string    `bson:"author" json:"author"`
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+	Text      string    `bson:"text" json:"text"`
+}
+
+// FindComment returns the comment with the given ID, or nil if there is none.
+func FindComment(comments []Comment, id string) *Comment {
+	for i := range comments {
+		if comments[i].ID == id {
+			return &comments[i]
+		}
+	}
+	return nil
+}
+
+// CommentThread returns the IDs of a comment and all of the replies beneath it.
+func CommentThread(comments []Comment, id string) []string {
+	thread := []string{id}
+	// Replies always follow the comment they reply to, so one pass finds them all.
+	for _, comment := range comments {
+		if comment.ReplyTo != "" && containsString(thread, comment.ReplyTo) {
+			thread = append(thread, comment.ID)
+		}
+	}
+	return thread
+}
@@ -0,0 +1,204 @@
+package state
+
+import (
+	"strings"
+	"unicode"
+)
+
+// PatientDemographics are the key demographics of a Patient in one of a merge's source
+// bundles. They are copied into the merge state when the merge is created so merges can
+// be found by patient, rather than by opaque URLs.
+type PatientDemographics struct {
+	PatientID   string   `bson:"patientId" json:"patientId"`
+	SourceURL   string   `bson:"source,omitempty" json:"source,omitempty"`
+	Names       []string `bson:"names,omitempty" json:"names,omitempty"`
+	BirthDate   string   `bson:"birthDate,omitempty" json:"birthDate,omitempty"`
+	Identifiers []string `bson:"identifiers,omitempty" json:"identifiers,omitempty"`
+	// NameTokens are the lowercase words in all of the patient's names, used for
+	// partial name searches.
+	NameTokens []string `bson:"nameTokens,omitempty" json:"-"`
+	// NamePhonetics are the Soundex codes of the NameTokens, used for fuzzy name searches.
+	NamePhonetics []string `bson:"namePhonetics,omitempty" json:"-"`
+}
+
+// AddName adds a name to the demographics, updating the search keys.
+func (p *PatientDemographics) AddName(name string) {
+	if name == "" {
+		return
+	}
+	p.Names = append(p.Names, name)
+	for _, token := range NameTokens(name) {
+		if !containsString(p.NameTokens, token) {
+			p.NameTokens = append(p.NameTokens, token)
+		}
+		code := Soundex(token)
+		if !containsString(p.NamePhonetics, code) {
+			p.NamePhonetics = append(p.NamePhonetics, code)
+		}
+	}
+}
+
+// NameScore scores how well a name query matches these demographics, from 0 (no match)
+// to 1 (every word in the query is, or starts, one of the patient's names). Words that
+// are only similar are scored by their edit distance.
+func (p *PatientDemographics) NameScore(query string) float64 {
+	queryTokens := NameTokens(query)
+	if len(queryTokens) == 0 {
+		return 0
+	}
+
+	total := 0.0
+	for _, qt := range queryTokens {
+		best := 0.0
+		for _, nt := range p.NameTokens {
+			var score float64
+			if strings.HasPrefix(nt, qt) {
+				score = 1
+			} else {
+				maxLen := len(nt)
+				if len(qt) > maxLen {
+					maxLen = len(qt)
+				}
+				score = 1 - float64(Levenshtein(qt, nt))/float64(maxLen)
+			}
+			if score > best {
+				best = score
+			}
+		}
+		total += best
+	}
+	return total / float64(len(queryTokens))
+}
+
+// MatchScore scores how closely these demographics match another patient's, from 0 to 1.
+// Patients that share an identifier always match. Otherwise names and birth dates are
+// weighted equally, with a missing birth date counting as half a match.
+func (p *PatientDemographics) MatchScore(other *PatientDemographics) float64 {
+	for _, identifier := range p.Identifiers {
+		if containsString(other.Identifiers, identifier) {
+			return 1
+		}
+	}
+
+	name := 0.0
+	for _, n := range other.Names {
+		if score := p.NameScore(n); score > name {
+			name = score
+		}
+	}
+
+	birthDate := 0.5
+	if p.BirthDate != "" && other.BirthDate != "" {
+		birthDate = 0
+		if p.BirthDate == other.BirthDate {
+			birthDate = 1
+		}
+	}
+	return (name + birthDate) / 2
+}
+
+// MatchScore returns how closely the patients in a merge's two source bundles match each
+// other, from 0 to 1, using the best matching pair. Merges without demographics score 0.
+func (m *MergeState) MatchScore() float64 {
+	best := 0.0
+	for i := range m.Demographics {
+		for j := range m.Demographics {
+			// Only compare patients from different sources.
+			if i == j || (m.Demographics[i].SourceURL != "" && m.Demographics[i].SourceURL == m.Demographics[j].SourceURL) {
+				continue
+			}
+			if score := m.Demographics[i].MatchScore(&m.Demographics[j]); score > best {
+				best = score
+			}
+		}
+	}
+	return best
+}
+
+// NameTokens splits a name into lowercase words, dropping punctuation.
+func NameTokens(name string) []string {
+	return strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+}
+
+// soundexCodes maps consonants to their Soundex digits. Vowels, h, w, and y have no code.
+var soundexCodes = map[rune]byte{
+	'b': '1', 'f': '1', 'p': '1', 'v': '1',
+	'c': '2', 'g': '2', 'j': '2', 'k': '2', 'q': '2', 's': '2', 'x': '2', 'z': '2',
+	'd': '3', 't': '3',
+	'l': '4',
+	'm': '5', 'n': '5',
+	'r': '6',
+}
+
+// Soundex returns the American Soundex code of a word (e.g. "abbott" is "A130"), so
+// words that sound alike can be matched.
+func Soundex(word string) string {
+	word = strings.ToLower(word)
+	code := make([]rune, 0, 4)
+	var last byte
+	for i, r := range word {
+		digit, coded := soundexCodes[r]
+		if i == 0 {
+			code = append(code, unicode.ToUpper(r))
+			last = digit
+			continue
+		}
+		if coded && digit != last {
+			code = append(code, rune(digit))
+			if len(code) == 4 {
+				break
+			}
+		}
+		// Letters separated by h or w are coded once, but vowels split them.
+		if r != 'h' && r != 'w' {
+			last = digit
+		}
+	}
+	for len(code) < 4 && len(code) > 0 {
+		code = append(code, '0')
+	}
+	return string(code)
+}
+
+// Levenshtein returns the edit distance between two strings.
+func Levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+func containsString(set []string, el string) bool {
+	for _, item := range set {
+		if item == el {
+			return true
+		}
+	}
+	return false
+}
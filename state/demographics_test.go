@@ -0,0 +1,95 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type DemographicsTestSuite struct {
+	suite.Suite
+}
+
+func TestDemographicsTestSuite(t *testing.T) {
+	suite.Run(t, new(DemographicsTestSuite))
+}
+
+func (d *DemographicsTestSuite) TestNameTokens() {
+	d.Equal([]string{"lowell", "o", "abbott"}, NameTokens("Lowell O. Abbott"))
+	d.Equal([]string{"mary", "ann", "o", "brien"}, NameTokens("Mary-Ann O'Brien"))
+	d.Empty(NameTokens("  123 "))
+}
+
+func (d *DemographicsTestSuite) TestSoundex() {
+	d.Equal("A130", Soundex("abbott"))
+	d.Equal("A130", Soundex("Abot"))
+	d.Equal("L400", Soundex("lowell"))
+	d.Equal("L400", Soundex("Lowel"))
+	d.Equal("R163", Soundex("Robert"))
+	d.Equal("R163", Soundex("Rupert"))
+	d.Equal("A261", Soundex("Ashcraft"))
+	d.Equal("T522", Soundex("Tymczak"))
+	d.Equal("P236", Soundex("Pfister"))
+	d.Equal("", Soundex(""))
+
+	// Non-ASCII first letters are kept whole.
+	d.Equal("É420", Soundex("Élise"))
+	d.Equal("Ø236", Soundex("Østergaard"))
+}
+
+func (d *DemographicsTestSuite) TestLevenshtein() {
+	d.Equal(0, Levenshtein("abbott", "abbott"))
+	d.Equal(2, Levenshtein("abot", "abbott"))
+	d.Equal(3, Levenshtein("kitten", "sitting"))
+	d.Equal(4, Levenshtein("", "john"))
+}
+
+func (d *DemographicsTestSuite) TestAddName() {
+	p := &PatientDemographics{}
+	p.AddName("Lowell Abbott")
+	p.AddName("Lowell O. Abbott")
+	p.AddName("")
+
+	d.Equal([]string{"Lowell Abbott", "Lowell O. Abbott"}, p.Names)
+	d.Equal([]string{"lowell", "abbott", "o"}, p.NameTokens)
+	d.Equal([]string{"L400", "A130", "O000"}, p.NamePhonetics)
+}
+
+func (d *DemographicsTestSuite) TestNameScore() {
+	p := &PatientDemographics{}
+	p.AddName("Lowell Abbott")
+
+	// Whole words and prefixes are perfect matches.
+	d.Equal(1.0, p.NameScore("lowell abbott"))
+	d.Equal(1.0, p.NameScore("Low Abb"))
+
+	// Misspellings score lower, but better than unrelated names.
+	misspelled := p.NameScore("Lowel Abot")
+	d.True(misspelled < 1.0)
+	d.True(misspelled > p.NameScore("Jane Smith"))
+
+	d.Equal(0.0, p.NameScore(""))
+}
+
+func (d *DemographicsTestSuite) TestMatchScore() {
+	left := &PatientDemographics{SourceURL: "left", BirthDate: "1950-09-02", Identifiers: []string{"urn:mrn|123"}}
+	left.AddName("Lowell Abbott")
+	right := &PatientDemographics{SourceURL: "right", BirthDate: "1950-09-02"}
+	right.AddName("Lowell Abbott")
+	d.Equal(1.0, left.MatchScore(right))
+
+	// A different birth date halves the score.
+	right.BirthDate = "1951-09-02"
+	d.Equal(0.5, left.MatchScore(right))
+
+	// Shared identifiers always match.
+	right.Identifiers = []string{"urn:mrn|123"}
+	d.Equal(1.0, left.MatchScore(right))
+
+	// Patients are only compared with those from the other source.
+	m := &MergeState{Demographics: []PatientDemographics{*left, *left}}
+	d.Equal(0.0, m.MatchScore())
+	m.Demographics[1].SourceURL = "right"
+	d.Equal(1.0, m.MatchScore())
+	d.Equal(0.0, (&MergeState{}).MatchScore())
+}
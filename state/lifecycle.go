@@ -0,0 +1,180 @@
+package state
+
+import (
+	"fmt"
+	"time"
+)
+
+// The lifecycle statuses of a merge.
+const (
+	// StatusCreated merges have conflicts that nobody has worked on yet.
+	StatusCreated = "created"
+	// StatusInReview merges have had at least one change made by a reviewer.
+	StatusInReview = "in-review"
+	// StatusAwaitingApproval merges have no remaining conflicts, but must be approved
+	// before they are completed.
+	StatusAwaitingApproval = "awaiting-approval"
+	// StatusCompleted merges have no remaining conflicts. The target may be committed.
+	StatusCompleted = "completed"
+	// StatusCommitted merges are final.
+	StatusCommitted = "committed"
+	// StatusAborted merges were abandoned, and their target and conflicts deleted.
+	StatusAborted = "aborted"
+	// StatusFailed merges could not be cleaned up or continued. They may only be aborted.
+	StatusFailed = "failed"
+)
+
+// transitions lists the statuses a merge may move to from each status.
+var transitions = map[string][]string{
+	StatusCreated:          {StatusInReview, StatusAwaitingApproval, StatusCompleted, StatusAborted, StatusFailed},
+	StatusInReview:         {StatusAwaitingApproval, StatusCompleted, StatusAborted, StatusFailed},
+	StatusAwaitingApproval: {StatusInReview, StatusCompleted, StatusAborted, StatusFailed},
+	StatusCompleted:        {StatusCommitted, StatusAborted, StatusFailed},
+	StatusCommitted:        {},
+	StatusAborted:          {},
+	StatusFailed:           {StatusAborted},
+}
+
+// IsStatus returns true if status is one of the lifecycle statuses.
+func IsStatus(status string) bool {
+	_, ok := transitions[status]
+	return ok
+}
+
+// StatusChange records a merge entering a status, when, and who caused it.
+type StatusChange struct {
+	Status    string    `bson:"status" json:"status"`
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+	Actor     string    `bson:"actor,omitempty" json:"actor,omitempty"`
+}
+
+// IllegalTransitionError is returned when a merge can't move to the requested status.
+type IllegalTransitionError struct {
+	MergeID string
+	From    string
+	To      string
+}
+
+func (e *IllegalTransitionError) Error() string {
+	return fmt.Sprintf("Merge %s is %s and cannot become %s", e.MergeID, e.From, e.To)
+}
+
+// CurrentStatus returns the merge's lifecycle status. Merges from before statuses were
+// tracked are assumed to be created, in review, or completed.
+func (m *MergeState) CurrentStatus() string {
+	if m.Status != "" {
+		return m.Status
+	}
+	if m.Completed {
+		return StatusCompleted
+	}
+	if len(m.Conflicts.ResolvedConflicts()) > 0 {
+		return StatusInReview
+	}
+	return StatusCreated
+}
+
+// CanTransition returns true if the merge may move to the status.
+func (m *MergeState) CanTransition(to string) bool {
+	for _, status := range transitions[m.CurrentStatus()] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition moves the merge to a new status on behalf of an actor, recording the change
+// in its history. Completed and End are kept up to date for older clients.
+func (m *MergeState) Transition(to, actor string) error {
+	if !m.CanTransition(to) {
+		return &IllegalTransitionError{MergeID: m.MergeID, From: m.CurrentStatus(), To: to}
+	}
+
+	now := time.Now()
+	m.Status = to
+	m.History = append(m.History, StatusChange{
+		Status:    to,
+		Timestamp: now,
+		Actor:     actor,
+	})
+	m.LastActivity = &now
+
+	switch to {
+	case StatusCompleted:
+		m.Completed = true
+		m.End = &now
+	case StatusAborted:
+		m.End = &now
+	}
+	return nil
+}
+
+// IsEditable returns true if the merge's conflicts and target may still be changed.
+func (m *MergeState) IsEditable() bool {
+	status := m.CurrentStatus()
+	return status == StatusCreated || status == StatusInReview
+}
+
+// Edited records that a reviewer changed the merge's conflicts or target, adding them to
+// its Editors. Newly created merges move into review.
+func (m *MergeState) Edited(actor string) {
+	if actor != "" && !containsString(m.Editors, actor) {
+		m.Editors = append(m.Editors, actor)
+	}
+	if m.CurrentStatus() == StatusCreated {
+		// Created merges may always move into review.
+		m.Transition(StatusInReview, actor)
+		return
+	}
+	m.Touch()
+}
+
+// IsActive returns true if the merge hasn't reached a final status.
+func (m *MergeState) IsActive() bool {
+	status := m.CurrentStatus()
+	return status != StatusCommitted && status != StatusAborted
+}
+
+// The decisions an approver may make.
+const (
+	DecisionApproved = "approved"
+	DecisionRejected = "rejected"
+)
+
+// Approval is a second reviewer's decision on a merge awaiting approval.
+type Approval struct {
+	Decision  string    `bson:"decision" json:"decision"`
+	Reviewer  string    `bson:"reviewer" json:"reviewer"`
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+	Comment   string    `bson:"comment,omitempty" json:"comment,omitempty"`
+	// ReopenedConflicts are the IDs of the conflicts a rejection reopened.
+	ReopenedConflicts []string `bson:"reopenedConflicts,omitempty" json:"reopenedConflicts,omitempty"`
+}
+
+// Reviewers returns the users who resolved the merge's conflicts, changed its conflicts
+// or target in any other way, or submitted it for approval. None of them may approve or
+// reject it.
+func (m *MergeState) Reviewers() []string {
+	reviewers := []string{}
+	for _, key := range m.Conflicts.Keys() {
+		conflict := m.Conflicts[key]
+		if conflict.Resolved && conflict.ResolvedBy != "" && !containsString(reviewers, conflict.ResolvedBy) {
+			reviewers = append(reviewers, conflict.ResolvedBy)
+		}
+	}
+	for _, editor := range m.Editors {
+		if !containsString(reviewers, editor) {
+			reviewers = append(reviewers, editor)
+		}
+	}
+	for i := len(m.History) - 1; i >= 0; i-- {
+		if m.History[i].Status == StatusAwaitingApproval {
+			if m.History[i].Actor != "" && !containsString(reviewers, m.History[i].Actor) {
+				reviewers = append(reviewers, m.History[i].Actor)
+			}
+			break
+		}
+	}
+	return reviewers
+}
@@ -0,0 +1,117 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type LifecycleTestSuite struct {
+	suite.Suite
+}
+
+func TestLifecycleTestSuite(t *testing.T) {
+	suite.Run(t, new(LifecycleTestSuite))
+}
+
+func (l *LifecycleTestSuite) TestCurrentStatusOfOlderMerges() {
+	conflicts := make(ConflictMap)
+	conflicts["foo"] = &ConflictState{Resolved: false}
+	m := &MergeState{Conflicts: conflicts}
+	l.Equal(StatusCreated, m.CurrentStatus())
+
+	conflicts["bar"] = &ConflictState{Resolved: true}
+	l.Equal(StatusInReview, m.CurrentStatus())
+
+	m.Completed = true
+	l.Equal(StatusCompleted, m.CurrentStatus())
+}
+
+func (l *LifecycleTestSuite) TestTransition() {
+	m := &MergeState{MergeID: "abc123", Status: StatusCreated}
+
+	l.NoError(m.Transition(StatusInReview, "alice"))
+	l.Equal(StatusInReview, m.Status)
+	l.False(m.Completed)
+	l.NotNil(m.LastActivity)
+
+	l.NoError(m.Transition(StatusCompleted, "bob"))
+	l.True(m.Completed)
+	l.NotNil(m.End)
+
+	l.NoError(m.Transition(StatusCommitted, "bob"))
+
+	l.Len(m.History, 3)
+	l.Equal(StatusInReview, m.History[0].Status)
+	l.Equal("alice", m.History[0].Actor)
+	l.False(m.History[0].Timestamp.IsZero())
+	l.Equal(StatusCommitted, m.History[2].Status)
+}
+
+func (l *LifecycleTestSuite) TestIllegalTransition() {
+	m := &MergeState{MergeID: "abc123", Status: StatusCommitted}
+	err := m.Transition(StatusAborted, "alice")
+	l.Error(err)
+	l.Equal("Merge abc123 is committed and cannot become aborted", err.Error())
+	l.Equal(StatusCommitted, m.Status)
+	l.Empty(m.History)
+
+	// Only completed merges can be committed.
+	m.Status = StatusInReview
+	l.False(m.CanTransition(StatusCommitted))
+
+	// Failed merges can only be aborted.
+	m.Status = StatusFailed
+	l.False(m.CanTransition(StatusInReview))
+	l.True(m.CanTransition(StatusAborted))
+}
+
+func (l *LifecycleTestSuite) TestEdited() {
+	m := &MergeState{Status: StatusCreated}
+	l.True(m.IsEditable())
+
+	m.Edited("alice")
+	l.Equal(StatusInReview, m.Status)
+	l.Len(m.History, 1)
+
+	// Further edits only update the activity time.
+	m.Edited("bob")
+	l.Len(m.History, 1)
+	l.True(m.IsEditable())
+
+	m.Status = StatusAwaitingApproval
+	l.False(m.IsEditable())
+}
+
+func (l *LifecycleTestSuite) TestIsActive() {
+	l.True((&MergeState{Status: StatusCompleted}).IsActive())
+	l.False((&MergeState{Status: StatusCommitted}).IsActive())
+	l.False((&MergeState{Status: StatusAborted}).IsActive())
+	l.True(IsStatus(StatusFailed))
+	l.False(IsStatus("exploded"))
+}
+
+func (l *LifecycleTestSuite) TestReviewers() {
+	conflicts := make(ConflictMap)
+	conflicts["foo"] = &ConflictState{Resolved: true, ResolvedBy: "alice"}
+	conflicts["bar"] = &ConflictState{Resolved: true, ResolvedBy: "alice"}
+	conflicts["hey"] = &ConflictState{Resolved: false}
+	m := &MergeState{
+		Conflicts: conflicts,
+		History: []StatusChange{
+			StatusChange{Status: StatusAwaitingApproval, Actor: "carol"},
+			StatusChange{Status: StatusInReview, Actor: "dave"},
+			StatusChange{Status: StatusAwaitingApproval, Actor: "bob"},
+		},
+	}
+
+	// Only the latest submitter for approval counts.
+	l.Equal([]string{"alice", "bob"}, m.Reviewers())
+
+	// So does anyone who changed the merge, even if their changes were since undone.
+	m.Edited("erin")
+	m.Edited("alice")
+	m.Edited("erin")
+	l.Equal([]string{"erin", "alice"}, m.Editors)
+	l.Equal([]string{"alice", "erin", "bob"}, m.Reviewers())
+}
@@ -1,11 +1,45 @@
 package state
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
-// Merges represents all metadata for all merges.
+// Merges represents the metadata for a page of merges.
 type Merges struct {
-	Timestamp time.Time    `json:"timestamp,omitempty"`
-	Merges    []MergeState `json:"merges"`
+	Timestamp time.Time `json:"timestamp,omitempty"`
+	Pagination
+	Merges []MergeState `json:"merges"`
+}
+
+// MergeSummaries represents the summarized metadata for a page of merges.
+type MergeSummaries struct {
+	Timestamp time.Time `json:"timestamp,omitempty"`
+	Pagination
+	Merges []MergeSummary `json:"merges"`
+}
+
+// Pagination describes which page of a larger set of results is being returned.
+type Pagination struct {
+	// Total is the number of results across all pages.
+	Total int `json:"total"`
+	// Page is the number of this page, starting from 1.
+	Page int `json:"page"`
+	// Count is the maximum number of results per page.
+	Count int `json:"count"`
+}
+
+// MergeSearchResults represents the merges found by a patient search, best match first.
+type MergeSearchResults struct {
+	Timestamp time.Time           `json:"timestamp,omitempty"`
+	Results   []MergeSearchResult `json:"results"`
+}
+
+// MergeSearchResult is a single merge found by a patient search, scored from 0 to 1
+// by how well its patients' demographics matched the search.
+type MergeSearchResult struct {
+	Score float64      `json:"score"`
+	Merge MergeSummary `json:"merge"`
 }
 
 // Merge represents the metadata for a single merge.
@@ -23,8 +57,150 @@ type MergeState struct {
 	TargetURL  string      `bson:"targetBundle,omitempty" json:"targetBundle,omitempty"`
 	Conflicts  ConflictMap `bson:"conflicts,omitempty" json:"conflicts,omitempty"`
 	Completed  bool        `bson:"completed" json:"completed"`
+	CreatedBy  string      `bson:"createdBy,omitempty" json:"createdBy,omitempty"`
+	Patients   []string    `bson:"patients,omitempty" json:"patients,omitempty"`
 	Start      *time.Time  `bson:"start,omitempty" json:"start,omitempty"`
 	End        *time.Time  `bson:"end,omitempty" json:"end,omitempty"`
+	// Status is where the merge is in its lifecycle (see lifecycle.go). Completed is
+	// also true once the merge is completed or committed, for older clients.
+	Status string `bson:"status,omitempty" json:"status,omitempty"`
+	// History lists every status the merge has entered, oldest first.
+	History []StatusChange `bson:"history,omitempty" json:"history,omitempty"`
+	// Editors lists every user who changed the merge's conflicts or target, in the order
+	// they first did.
+	Editors []string `bson:"editors,omitempty" json:"editors,omitempty"`
+	// Approvals lists every approval or rejection of the merge, oldest first.
+	Approvals []Approval `bson:"approvals,omitempty" json:"approvals,omitempty"`
+	// Assignment is the reviewer working on the merge, if any (see assignment.go).
+	Assignment *Assignment `bson:"assignment,omitempty" json:"assignment,omitempty"`
+	// Comments on the merge as a whole, oldest first. Comments on a single conflict are
+	// stored with the conflict.
+	Comments []Comment `bson:"comments,omitempty" json:"comments,omitempty"`
+	// LastActivity is when the merge was last changed. Incomplete merges expire if
+	// they are inactive for too long.
+	LastActivity *time.Time `bson:"lastActivity,omitempty" json:"lastActivity,omitempty"`
+	// Demographics of the Patients in both source bundles, used to search for merges.
+	Demographics []PatientDemographics `bson:"demographics,omitempty" json:"demographics,omitempty"`
+	// Duplicates are the resources removed from the source bundles because they matched
+	// another resource in the same bundle.
+	Duplicates []Duplicate `bson:"duplicates,omitempty" json:"duplicates,omitempty"`
+	// Remaining and PatientMatch store the merge's remaining conflict count and MatchScore
+	// so the review queue can be sorted by them in mongo. See Index.
+	Remaining    int     `bson:"remaining" json:"-"`
+	PatientMatch float64 `bson:"matchScore" json:"-"`
+	// Version counts the changes saved to the merge, so a change based on an outdated copy
+	// of it can be detected and rejected. See StaleMergeError.
+	Version int `bson:"version" json:"-"`
+}
+
+// StaleMergeError is returned when a change to a merge can't be saved because another
+// change was saved since the merge was loaded.
+type StaleMergeError struct {
+	MergeID string
+}
+
+func (e *StaleMergeError) Error() string {
+	return fmt.Sprintf("Merge %s was changed by another request, reload it and try again", e.MergeID)
+}
+
+// MergeSummary is a compact view of a MergeState that counts its conflicts
+// rather than listing them.
+type MergeSummary struct {
+	MergeID      string                `json:"id,omitempty"`
+	Source1URL   string                `json:"source1,omitempty"`
+	Source2URL   string                `json:"source2,omitempty"`
+	TargetURL    string                `json:"targetBundle,omitempty"`
+	Completed    bool                  `json:"completed"`
+	Status       string                `json:"status"`
+	CreatedBy    string                `json:"createdBy,omitempty"`
+	Patients     []string              `json:"patients,omitempty"`
+	Demographics []PatientDemographics `json:"demographics,omitempty"`
+	Start        *time.Time            `json:"start,omitempty"`
+	End          *time.Time            `json:"end,omitempty"`
+	LastActivity *time.Time            `json:"lastActivity,omitempty"`
+	Assignment   *Assignment           `json:"assignment,omitempty"`
+	Conflicts    ConflictCounts        `json:"conflicts"`
+}
+
+// ExpiringMerges represents the incomplete merges that will soon expire, soonest first.
+type ExpiringMerges struct {
+	Timestamp time.Time       `json:"timestamp,omitempty"`
+	Merges    []ExpiringMerge `json:"merges"`
+}
+
+// ExpiringMerge is a single incomplete merge and when it will expire.
+type ExpiringMerge struct {
+	Expires time.Time    `json:"expires"`
+	Merge   MergeSummary `json:"merge"`
+}
+
+// MergeQueue represents the merges a reviewer may work on, highest priority first.
+type MergeQueue struct {
+	Timestamp time.Time     `json:"timestamp,omitempty"`
+	Priority  string        `json:"priority"`
+	Merges    []QueuedMerge `json:"merges"`
+}
+
+// QueuedMerge is a single merge in a reviewer's queue. MatchScore is how closely the
+// merge's patients match each other, from 0 to 1.
+type QueuedMerge struct {
+	MatchScore float64      `json:"matchScore"`
+	Merge      MergeSummary `json:"merge"`
+}
+
+// ConflictCounts counts the conflicts in a merge.
+type ConflictCounts struct {
+	Total     int `json:"total"`
+	Resolved  int `json:"resolved"`
+	Remaining int `json:"remaining"`
+}
+
+// Summary returns a compact summary of the merge state.
+func (m *MergeState) Summary() MergeSummary {
+	return MergeSummary{
+		MergeID:      m.MergeID,
+		Source1URL:   m.Source1URL,
+		Source2URL:   m.Source2URL,
+		TargetURL:    m.TargetURL,
+		Completed:    m.Completed,
+		Status:       m.CurrentStatus(),
+		CreatedBy:    m.CreatedBy,
+		Patients:     m.Patients,
+		Demographics: m.Demographics,
+		Start:        m.Start,
+		End:          m.End,
+		LastActivity: m.LastActivity,
+		Assignment:   m.Assignment,
+		Conflicts: ConflictCounts{
+			Total:     len(m.Conflicts),
+			Resolved:  len(m.Conflicts.ResolvedConflicts()),
+			Remaining: len(m.Conflicts.RemainingConflicts()),
+		},
+	}
+}
+
+// Touch records that the merge was just changed.
+func (m *MergeState) Touch() {
+	now := time.Now()
+	m.LastActivity = &now
+}
+
+// LastActive returns when the merge was last changed. Merges from before activity
+// was tracked were last changed when they started.
+func (m *MergeState) LastActive() time.Time {
+	if m.LastActivity != nil {
+		return *m.LastActivity
+	}
+	if m.Start != nil {
+		return *m.Start
+	}
+	return time.Time{}
+}
+
+// Index updates the merge's stored sort keys from its conflicts and demographics.
+func (m *MergeState) Index() {
+	m.Remaining = len(m.Conflicts.RemainingConflicts())
+	m.PatientMatch = m.MatchScore()
 }
 
 // ConflictMap is a map containing one or more ConflictStates. The key to each
@@ -70,6 +246,19 @@ type ConflictState struct {
 	OperationOutcomeURL string         `bson:"operationOutcome,omitempty" json:"operationOutcome,omitempty"`
 	TargetResource      TargetResource `bson:"targetResource,omitempty" json:"targetResource,omitempty"`
 	Resolved            bool           `bson:"resolved" json:"resolved"`
+	ResolvedBy          string         `bson:"resolvedBy,omitempty" json:"resolvedBy,omitempty"`
+	Comments            []Comment      `bson:"comments,omitempty" json:"comments,omitempty"`
+}
+
+// Duplicate is a resource removed from a source bundle because it matched an earlier
+// resource of the same type in the same bundle. Ambiguous duplicates have conflicting
+// elements, so they are also in the target bundle, each with a conflict of its own.
+type Duplicate struct {
+	Source       int    `bson:"source" json:"source"`
+	ResourceType string `bson:"type" json:"type"`
+	KeptID       string `bson:"kept" json:"kept"`
+	RemovedID    string `bson:"removed" json:"removed"`
+	Ambiguous    bool   `bson:"ambiguous" json:"ambiguous"`
 }
 
 // TargetResource represents a single resource in a target bundle.
@@ -3,6 +3,7 @@ package state
 import (
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
 )
@@ -73,3 +74,41 @@ func contains(set []string, value string) bool {
 	}
 	return false
 }
+
+func (m *StateTestSuite) TestMergeSummary() {
+	conflicts := make(ConflictMap)
+	conflicts["foo"] = &ConflictState{Resolved: true}
+	conflicts["bar"] = &ConflictState{Resolved: false}
+	conflicts["hey"] = &ConflictState{Resolved: false}
+
+	mergeState := &MergeState{
+		MergeID:    "abc123",
+		Source1URL: "http://fhir/Bundle/1",
+		Source2URL: "http://fhir/Bundle/2",
+		TargetURL:  "http://fhir/Bundle/3",
+		Patients:   []string{"p1", "p2"},
+		Conflicts:  conflicts,
+	}
+
+	summary := mergeState.Summary()
+	m.Equal("abc123", summary.MergeID)
+	m.Equal("http://fhir/Bundle/1", summary.Source1URL)
+	m.Equal("http://fhir/Bundle/2", summary.Source2URL)
+	m.Equal("http://fhir/Bundle/3", summary.TargetURL)
+	m.Equal([]string{"p1", "p2"}, summary.Patients)
+	m.Equal(ConflictCounts{Total: 3, Resolved: 1, Remaining: 2}, summary.Conflicts)
+}
+
+func (m *StateTestSuite) TestLastActive() {
+	mergeState := &MergeState{}
+	m.True(mergeState.LastActive().IsZero())
+
+	// Merges from before activity was tracked fall back to their start time.
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	mergeState.Start = &start
+	m.Equal(start, mergeState.LastActive())
+
+	mergeState.Touch()
+	m.NotNil(mergeState.LastActivity)
+	m.WithinDuration(time.Now(), mergeState.LastActive(), time.Second)
+}
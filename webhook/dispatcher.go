@@ -0,0 +1,303 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mitre/ptmerge/events"
+)
+
+// Dispatcher delivers the events published to an event bus to the webhooks subscribed
+// to them. Published events are handed off to a background queue, which queues a delivery
+// in mongo for each webhook before it is attempted, so deliveries that fail are retried
+// with exponential backoff, even across restarts.
+type Dispatcher struct {
+	// MaxAttempts is the number of times a delivery is attempted before it fails.
+	MaxAttempts int
+	// RetryBackoff is the delay before the first retry. It doubles with each retry,
+	// up to MaxRetryBackoff.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// PollInterval is how often the queue is checked for deliveries due to be retried.
+	PollInterval time.Duration
+	// ClaimTimeout is how long a delivery being attempted is held before another
+	// dispatcher (e.g. in another instance of the service) may attempt it, in case the
+	// dispatcher attempting it stops.
+	ClaimTimeout time.Duration
+	// Client is the HTTP client deliveries are POSTed with.
+	Client *http.Client
+
+	session       *mgo.Session
+	dbname        string
+	bus           *events.Bus
+	removeHandler func()
+	wake          chan struct{}
+	stop          chan struct{}
+	wg            sync.WaitGroup
+
+	// published holds the events published since they were last queued, and
+	// publishedSignal wakes the goroutine that queues them.
+	published       []*events.Event
+	publishedMutex  sync.Mutex
+	publishedSignal chan struct{}
+}
+
+// NewDispatcher returns a pointer to a newly initialized Dispatcher for the webhooks
+// stored in a database.
+func NewDispatcher(session *mgo.Session, dbname string, bus *events.Bus) *Dispatcher {
+	return &Dispatcher{
+		MaxAttempts:     8,
+		RetryBackoff:    30 * time.Second,
+		MaxRetryBackoff: time.Hour,
+		PollInterval:    10 * time.Second,
+		ClaimTimeout:    time.Minute,
+		Client:          &http.Client{Timeout: 10 * time.Second},
+		session:         session,
+		dbname:          dbname,
+		bus:             bus,
+		wake:            make(chan struct{}, 1),
+		stop:            make(chan struct{}),
+		publishedSignal: make(chan struct{}, 1),
+	}
+}
+
+// Start starts queueing events as they're published, and delivering them in the background.
+func (d *Dispatcher) Start() {
+	// Take each event as it's published, rather than from a subscription, since a subscriber
+	// that falls behind misses events. Handlers must be quick, so the deliveries are queued
+	// in the background.
+	d.removeHandler = d.bus.Handle(func(event *events.Event) {
+		d.publishedMutex.Lock()
+		d.published = append(d.published, event)
+		d.publishedMutex.Unlock()
+		signal(d.publishedSignal)
+	})
+	d.wg.Add(2)
+
+	// Queue a delivery for each webhook subscribed to each published event. Events that
+	// are published before the dispatcher stops are still queued.
+	go func() {
+		defer d.wg.Done()
+		for {
+			select {
+			case <-d.publishedSignal:
+				d.enqueuePublished()
+			case <-d.stop:
+				d.enqueuePublished()
+				return
+			}
+		}
+	}()
+
+	// Attempt deliveries as they're queued or become due for retry.
+	go func() {
+		defer d.wg.Done()
+		ticker := time.NewTicker(d.PollInterval)
+		defer ticker.Stop()
+		for {
+			d.DeliverDue()
+			select {
+			case <-d.wake:
+			case <-ticker.C:
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the dispatcher, waiting for any delivery in progress to finish. Queued
+// deliveries are attempted when the dispatcher is next started.
+func (d *Dispatcher) Stop() {
+	d.removeHandler()
+	close(d.stop)
+	d.wg.Wait()
+}
+
+// enqueuePublished queues the deliveries of the events published since it was last called.
+func (d *Dispatcher) enqueuePublished() {
+	d.publishedMutex.Lock()
+	published := d.published
+	d.published = nil
+	d.publishedMutex.Unlock()
+
+	for _, event := range published {
+		if err := d.Enqueue(event); err != nil {
+			log.Printf("Failed to queue webhook deliveries for %s event on merge %s: %s\n", event.Type, event.MergeID, err.Error())
+		}
+	}
+}
+
+// signal wakes the goroutine waiting on a channel, unless it has already been woken.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// Enqueue queues a delivery of an event to each webhook subscribed to it.
+func (d *Dispatcher) Enqueue(event *events.Event) error {
+	worker := d.session.Copy()
+	defer worker.Close()
+
+	var webhooks []Webhook
+	err := worker.DB(d.dbname).C("webhooks").Find(nil).All(&webhooks)
+	if err != nil {
+		return err
+	}
+
+	queued := false
+	now := time.Now()
+	for i := range webhooks {
+		if !webhooks[i].Subscribed(event.Type) {
+			continue
+		}
+		err = worker.DB(d.dbname).C("webhookDeliveries").Insert(&Delivery{
+			ID:          bson.NewObjectId().Hex(),
+			WebhookID:   webhooks[i].ID,
+			Event:       *event,
+			Status:      StatusPending,
+			Created:     now,
+			NextAttempt: &now,
+		})
+		if err != nil {
+			return err
+		}
+		queued = true
+	}
+
+	if queued {
+		// Let the delivery loop know there's work, unless it already knows.
+		signal(d.wake)
+	}
+	return nil
+}
+
+// DeliverDue attempts all pending deliveries that are due, oldest first. Each delivery is
+// claimed before it's attempted, so other dispatchers don't attempt it too.
+func (d *Dispatcher) DeliverDue() {
+	worker := d.session.Copy()
+	defer worker.Close()
+
+	for {
+		delivery, err := d.claimDue(worker)
+		if err == mgo.ErrNotFound {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to get due webhook deliveries: %s\n", err.Error())
+			return
+		}
+		if err = d.attempt(worker, delivery); err != nil {
+			log.Printf("Failed to update webhook delivery %s: %s\n", delivery.ID, err.Error())
+		}
+	}
+}
+
+// claimDue claims the oldest pending delivery that is due, by putting off its next attempt
+// for the ClaimTimeout. If no delivery is due, the error is mgo.ErrNotFound.
+func (d *Dispatcher) claimDue(worker *mgo.Session) (*Delivery, error) {
+	now := time.Now()
+	var delivery Delivery
+	_, err := worker.DB(d.dbname).C("webhookDeliveries").Find(bson.M{
+		"status":      StatusPending,
+		"nextAttempt": bson.M{"$lte": now},
+	}).Sort("nextAttempt").Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"nextAttempt": now.Add(d.ClaimTimeout)}},
+		ReturnNew: true,
+	}, &delivery)
+	if err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// attempt makes a single attempt at a delivery, then saves the outcome. The returned
+// error is only for failing to save the outcome; failed attempts are recorded in the
+// delivery itself.
+func (d *Dispatcher) attempt(worker *mgo.Session, delivery *Delivery) error {
+	now := time.Now()
+	delivery.Attempts++
+	delivery.LastAttempt = &now
+	delivery.LastStatusCode = 0
+	delivery.LastError = ""
+
+	var webhook Webhook
+	err := worker.DB(d.dbname).C("webhooks").FindId(delivery.WebhookID).One(&webhook)
+	if err == mgo.ErrNotFound {
+		// The webhook was deleted, so there's nowhere to deliver to.
+		delivery.Status = StatusFailed
+		delivery.LastError = "Webhook deleted"
+		delivery.NextAttempt = nil
+		return worker.DB(d.dbname).C("webhookDeliveries").UpdateId(delivery.ID, delivery)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = d.post(&webhook, delivery)
+	switch {
+	case err == nil:
+		delivery.Status = StatusDelivered
+		delivery.NextAttempt = nil
+	case delivery.Attempts >= d.MaxAttempts:
+		delivery.Status = StatusFailed
+		delivery.LastError = err.Error()
+		delivery.NextAttempt = nil
+	default:
+		delivery.LastError = err.Error()
+		next := now.Add(d.backoff(delivery.Attempts))
+		delivery.NextAttempt = &next
+	}
+	return worker.DB(d.dbname).C("webhookDeliveries").UpdateId(delivery.ID, delivery)
+}
+
+// post POSTs the signed event to the webhook's URL. Any non-2xx response is an error.
+func (d *Dispatcher) post(webhook *Webhook, delivery *Delivery) error {
+	body, err := json.Marshal(&delivery.Event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, delivery.Event.Type)
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	req.Header.Set(SignatureHeader, Sign(webhook.Secret, body))
+
+	res, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	delivery.LastStatusCode = res.StatusCode
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("Webhook responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// backoff returns the delay before the next attempt, after the given number of attempts.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.RetryBackoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= d.MaxRetryBackoff {
+			return d.MaxRetryBackoff
+		}
+	}
+	return delay
+}
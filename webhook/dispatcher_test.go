@@ -0,0 +1,197 @@
+package webhook
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mitre/ptmerge/events"
+	"github.com/mitre/ptmerge/testutil"
+	"github.com/stretchr/testify/suite"
+)
+
+type DispatcherTestSuite struct {
+	testutil.MongoSuite
+	Dispatcher *Dispatcher
+	Receiver   *httptest.Server
+	// Status is the status the receiver responds with.
+	Status   int
+	Received []*http.Request
+	Bodies   [][]byte
+}
+
+func TestDispatcherTestSuite(t *testing.T) {
+	suite.Run(t, new(DispatcherTestSuite))
+}
+
+func (d *DispatcherTestSuite) SetupSuite() {
+	d.Receiver = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		d.Received = append(d.Received, r)
+		d.Bodies = append(d.Bodies, body)
+		w.WriteHeader(d.Status)
+	}))
+}
+
+func (d *DispatcherTestSuite) SetupTest() {
+	d.Dispatcher = NewDispatcher(d.DB().Session, "ptmerge-test", events.NewBus())
+	d.Dispatcher.MaxAttempts = 3
+	d.Dispatcher.RetryBackoff = time.Minute
+	d.Status = http.StatusOK
+	d.Received = nil
+	d.Bodies = nil
+}
+
+func (d *DispatcherTestSuite) TearDownTest() {
+	d.DB().C("webhooks").DropCollection()
+	d.DB().C("webhookDeliveries").DropCollection()
+}
+
+func (d *DispatcherTestSuite) TearDownSuite() {
+	d.Receiver.Close()
+	d.TearDownDBServer()
+}
+
+func (d *DispatcherTestSuite) TestDeliver() {
+	d.insertWebhook(&Webhook{ID: "hook1", URL: d.Receiver.URL, Secret: "s3cr3t"})
+	d.insertWebhook(&Webhook{ID: "hook2", URL: d.Receiver.URL, Events: []string{events.ConflictResolved}})
+
+	// Only the first webhook is subscribed to merge creation.
+	err := d.Dispatcher.Enqueue(&events.Event{Type: events.MergeCreated, MergeID: "merge1"})
+	d.NoError(err)
+	d.Dispatcher.DeliverDue()
+
+	d.Len(d.Received, 1)
+	req := d.Received[0]
+	d.Equal("application/json", req.Header.Get("Content-Type"))
+	d.Equal(events.MergeCreated, req.Header.Get(EventHeader))
+	d.Equal(Sign("s3cr3t", d.Bodies[0]), req.Header.Get(SignatureHeader))
+	d.Contains(string(d.Bodies[0]), `"mergeId":"merge1"`)
+
+	delivery := d.getDelivery(req.Header.Get(DeliveryHeader))
+	d.Equal("hook1", delivery.WebhookID)
+	d.Equal(StatusDelivered, delivery.Status)
+	d.Equal(1, delivery.Attempts)
+	d.Equal(http.StatusOK, delivery.LastStatusCode)
+	d.Nil(delivery.NextAttempt)
+}
+
+func (d *DispatcherTestSuite) TestRetry() {
+	d.insertWebhook(&Webhook{ID: "hook1", URL: d.Receiver.URL, Secret: "s3cr3t"})
+	d.Status = http.StatusServiceUnavailable
+
+	err := d.Dispatcher.Enqueue(&events.Event{Type: events.MergeAborted, MergeID: "merge1"})
+	d.NoError(err)
+	d.Dispatcher.DeliverDue()
+	d.Len(d.Received, 1)
+	id := d.Received[0].Header.Get(DeliveryHeader)
+
+	// The failed delivery is retried after a backoff.
+	delivery := d.getDelivery(id)
+	d.Equal(StatusPending, delivery.Status)
+	d.Equal(1, delivery.Attempts)
+	d.Equal(http.StatusServiceUnavailable, delivery.LastStatusCode)
+	d.NotEmpty(delivery.LastError)
+	d.WithinDuration(time.Now().Add(time.Minute), *delivery.NextAttempt, 5*time.Second)
+
+	// It isn't retried before it's due.
+	d.Dispatcher.DeliverDue()
+	d.Len(d.Received, 1)
+
+	// After the last attempt, the delivery fails.
+	for i := 0; i < 2; i++ {
+		d.makeDue(id)
+		d.Dispatcher.DeliverDue()
+	}
+	d.Len(d.Received, 3)
+	delivery = d.getDelivery(id)
+	d.Equal(StatusFailed, delivery.Status)
+	d.Equal(3, delivery.Attempts)
+	d.Nil(delivery.NextAttempt)
+}
+
+func (d *DispatcherTestSuite) TestWebhookDeleted() {
+	d.insertWebhook(&Webhook{ID: "hook1", URL: d.Receiver.URL, Secret: "s3cr3t"})
+	err := d.Dispatcher.Enqueue(&events.Event{Type: events.MergeCompleted, MergeID: "merge1"})
+	d.NoError(err)
+	d.NoError(d.DB().C("webhooks").RemoveId("hook1"))
+
+	d.Dispatcher.DeliverDue()
+	d.Len(d.Received, 0)
+
+	var delivery Delivery
+	d.NoError(d.DB().C("webhookDeliveries").Find(bson.M{"webhookId": "hook1"}).One(&delivery))
+	d.Equal(StatusFailed, delivery.Status)
+}
+
+func (d *DispatcherTestSuite) TestStartAndStop() {
+	d.insertWebhook(&Webhook{ID: "hook1", URL: d.Receiver.URL, Secret: "s3cr3t"})
+	d.Dispatcher.Start()
+
+	// Events published to the bus are delivered in the background.
+	d.Dispatcher.bus.Publish(&events.Event{Type: events.MergeCreated, MergeID: "merge1"})
+	for i := 0; i < 100; i++ {
+		n, err := d.DB().C("webhookDeliveries").Find(bson.M{"status": StatusDelivered}).Count()
+		d.NoError(err)
+		if n == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	d.Dispatcher.Stop()
+	d.Len(d.Received, 1)
+}
+
+func (d *DispatcherTestSuite) TestBurstIsQueued() {
+	d.insertWebhook(&Webhook{ID: "hook1", URL: d.Receiver.URL, Secret: "s3cr3t"})
+	d.Dispatcher.Start()
+
+	// Every event is queued by the time the dispatcher stops, even more than a subscriber
+	// could buffer.
+	burst := events.SubscriberBufferSize + 10
+	for i := 0; i < burst; i++ {
+		d.Dispatcher.bus.Publish(&events.Event{Type: events.MergeCreated, MergeID: "merge1"})
+	}
+	d.Dispatcher.Stop()
+	n, err := d.DB().C("webhookDeliveries").Find(bson.M{"webhookId": "hook1"}).Count()
+	d.NoError(err)
+	d.Equal(burst, n)
+}
+
+func (d *DispatcherTestSuite) TestClaimedDeliveriesAreNotAttemptedTwice() {
+	d.insertWebhook(&Webhook{ID: "hook1", URL: d.Receiver.URL, Secret: "s3cr3t"})
+	err := d.Dispatcher.Enqueue(&events.Event{Type: events.MergeCreated, MergeID: "merge1"})
+	d.NoError(err)
+
+	// Another dispatcher claims the delivery first.
+	other := NewDispatcher(d.DB().Session, "ptmerge-test", events.NewBus())
+	claimed, err := other.claimDue(d.DB().Session)
+	d.NoError(err)
+	d.Equal(StatusPending, claimed.Status)
+
+	d.Dispatcher.DeliverDue()
+	d.Empty(d.Received)
+
+	// Until its claim lapses.
+	d.makeDue(claimed.ID)
+	d.Dispatcher.DeliverDue()
+	d.Len(d.Received, 1)
+}
+
+func (d *DispatcherTestSuite) insertWebhook(hook *Webhook) {
+	d.NoError(d.DB().C("webhooks").Insert(hook))
+}
+
+func (d *DispatcherTestSuite) getDelivery(id string) *Delivery {
+	delivery := &Delivery{}
+	d.NoError(d.DB().C("webhookDeliveries").FindId(id).One(delivery))
+	return delivery
+}
+
+func (d *DispatcherTestSuite) makeDue(id string) {
+	d.NoError(d.DB().C("webhookDeliveries").UpdateId(id, bson.M{"$set": bson.M{"nextAttempt": time.Now()}}))
+}
@@ -0,0 +1,103 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/mitre/ptmerge/events"
+	"github.com/mitre/ptmerge/state"
+)
+
+// Headers sent with each webhook delivery.
+const (
+	SignatureHeader = "X-PTMerge-Signature"
+	EventHeader     = "X-PTMerge-Event"
+	DeliveryHeader  = "X-PTMerge-Delivery"
+)
+
+// The statuses of a delivery.
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+// LifecycleEvents are the events a webhook receives if it doesn't list any.
+var LifecycleEvents = []string{
+	events.MergeCreated,
+	events.MergeCompleted,
+	events.MergeCommitted,
+	events.MergeAborted,
+	events.MergeExpired,
+}
+
+// Webhook is a subscription to merge events, delivered by POSTing them to a URL.
+// This is stored in the "webhooks" collection.
+type Webhook struct {
+	ID  string `bson:"_id,omitempty" json:"id,omitempty"`
+	URL string `bson:"url" json:"url"`
+	// Events are the types of events delivered. If empty, the LifecycleEvents are delivered.
+	Events []string `bson:"events,omitempty" json:"events,omitempty"`
+	// Secret is the key each delivery is signed with. It is only returned when the
+	// webhook is created.
+	Secret    string     `bson:"secret" json:"secret,omitempty"`
+	CreatedBy string     `bson:"createdBy,omitempty" json:"createdBy,omitempty"`
+	Created   *time.Time `bson:"created,omitempty" json:"created,omitempty"`
+}
+
+// Subscribed returns true if the webhook receives events of the given type.
+func (w *Webhook) Subscribed(eventType string) bool {
+	subscribed := w.Events
+	if len(subscribed) == 0 {
+		subscribed = LifecycleEvents
+	}
+	for _, t := range subscribed {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery is a single event to be delivered to a webhook, and the outcome of the
+// attempts to deliver it so far. This is stored in the "webhookDeliveries" collection.
+type Delivery struct {
+	ID             string       `bson:"_id,omitempty" json:"id,omitempty"`
+	WebhookID      string       `bson:"webhookId" json:"webhookId"`
+	Event          events.Event `bson:"event" json:"event"`
+	Status         string       `bson:"status" json:"status"`
+	Attempts       int          `bson:"attempts" json:"attempts"`
+	Created        time.Time    `bson:"created" json:"created"`
+	NextAttempt    *time.Time   `bson:"nextAttempt,omitempty" json:"nextAttempt,omitempty"`
+	LastAttempt    *time.Time   `bson:"lastAttempt,omitempty" json:"lastAttempt,omitempty"`
+	LastStatusCode int          `bson:"lastStatusCode,omitempty" json:"lastStatusCode,omitempty"`
+	LastError      string       `bson:"lastError,omitempty" json:"lastError,omitempty"`
+}
+
+// Deliveries represents a page of a webhook's delivery log.
+type Deliveries struct {
+	Timestamp time.Time `json:"timestamp,omitempty"`
+	state.Pagination
+	Deliveries []Delivery `json:"deliveries"`
+}
+
+// Sign returns the signature of a delivery's body, sent in the SignatureHeader. It is
+// the hex-encoded HMAC-SHA256 of the body using the webhook's secret, prefixed with
+// "sha256=". Receivers should compute the same signature and compare them in constant time.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewSecret returns a random secret for signing deliveries.
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
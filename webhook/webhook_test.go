@@ -0,0 +1,51 @@
+package webhook
+
+import (
+	"testing"
+
+	"github.com/mitre/ptmerge/events"
+	"github.com/stretchr/testify/suite"
+)
+
+type WebhookTestSuite struct {
+	suite.Suite
+}
+
+func TestWebhookTestSuite(t *testing.T) {
+	suite.Run(t, new(WebhookTestSuite))
+}
+
+func (w *WebhookTestSuite) TestSign() {
+	// From RFC 4231, test case 2.
+	w.Equal("sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843",
+		Sign("Jefe", []byte("what do ya want for nothing?")))
+}
+
+func (w *WebhookTestSuite) TestNewSecret() {
+	s1, err := NewSecret()
+	w.NoError(err)
+	w.Len(s1, 64)
+	s2, err := NewSecret()
+	w.NoError(err)
+	w.NotEqual(s1, s2)
+}
+
+func (w *WebhookTestSuite) TestSubscribed() {
+	// Webhooks get lifecycle events by default.
+	hook := &Webhook{}
+	w.True(hook.Subscribed(events.MergeCreated))
+	w.True(hook.Subscribed(events.MergeAborted))
+	w.False(hook.Subscribed(events.ConflictResolved))
+
+	hook.Events = []string{events.ConflictResolved}
+	w.True(hook.Subscribed(events.ConflictResolved))
+	w.False(hook.Subscribed(events.MergeCreated))
+}
+
+func (w *WebhookTestSuite) TestBackoff() {
+	d := NewDispatcher(nil, "", events.NewBus())
+	w.Equal(d.RetryBackoff, d.backoff(1))
+	w.Equal(2*d.RetryBackoff, d.backoff(2))
+	w.Equal(8*d.RetryBackoff, d.backoff(4))
+	w.Equal(d.MaxRetryBackoff, d.backoff(100))
+}